@@ -18,11 +18,16 @@ import (
 	"bytes"
 	"compress/gzip"
 	"errors"
+	"fmt"
 	"io"
 	"os"
+	"strconv"
 	"testing"
 
 	"google.golang.org/protobuf/encoding/protodelim"
+	"google.golang.org/protobuf/proto"
+
+	"github.com/prometheus/common/model"
 
 	dto "github.com/prometheus/client_model/go"
 )
@@ -62,6 +67,46 @@ func BenchmarkParseText(b *testing.B) {
 	}
 }
 
+// BenchmarkParseTextStream compares TextToMetricFamilies with ParseStream on
+// the test data and on a larger scrape of 500 metric families with 200 series
+// each.
+func BenchmarkParseTextStream(b *testing.B) {
+	data, err := os.ReadFile("testdata/text")
+	if err != nil {
+		b.Fatal(err)
+	}
+	var large bytes.Buffer
+	for i := 0; i < 500; i++ {
+		fmt.Fprintf(&large, "# HELP metric_%d Some help.\n# TYPE metric_%d counter\n", i, i)
+		for j := 0; j < 200; j++ {
+			fmt.Fprintf(&large, "metric_%d{instance=\"host-%d\",job=\"job\"} %d\n", i, j, j)
+		}
+	}
+	for _, input := range []struct {
+		name string
+		data []byte
+	}{{"testdata", data}, {"large", large.Bytes()}} {
+		b.Run(input.name+"/map", func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				var p TextParser
+				if _, err := p.TextToMetricFamilies(bytes.NewReader(input.data)); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+		b.Run(input.name+"/stream", func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				var p TextParser
+				if err := p.ParseStream(bytes.NewReader(input.data), func(*dto.MetricFamily) error { return nil }); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
 // BenchmarkParseTextGzip benchmarks the parsing of a gzipped text-format scrape
 // into metric family DTOs.
 func BenchmarkParseTextGzip(b *testing.B) {
@@ -177,3 +222,148 @@ func BenchmarkParseProtoMap(b *testing.B) {
 		}
 	}
 }
+
+// escapingBenchmarkFamily returns a counter family with n series, each with a
+// metric name and label names that need escaping under legacy schemes.
+func escapingBenchmarkFamily(n int) *dto.MetricFamily {
+	mf := &dto.MetricFamily{
+		Name:   proto.String("http.requests_total"),
+		Help:   proto.String("Total number of HTTP requests."),
+		Type:   dto.MetricType_COUNTER.Enum(),
+		Metric: make([]*dto.Metric, 0, n),
+	}
+	for i := 0; i < n; i++ {
+		mf.Metric = append(mf.Metric, &dto.Metric{
+			Label: []*dto.LabelPair{
+				{Name: proto.String("http.method"), Value: proto.String("GET")},
+				{Name: proto.String("instance"), Value: proto.String(strconv.Itoa(i))},
+			},
+			Counter: &dto.Counter{Value: proto.Float64(float64(i))},
+		})
+	}
+	return mf
+}
+
+// BenchmarkEncodeEscaping compares escaping a copy of a 50k-series family
+// before encoding it with the encoders escaping names while writing them.
+func BenchmarkEncodeEscaping(b *testing.B) {
+	mf := escapingBenchmarkFamily(50000)
+	for _, bm := range []struct {
+		name   string
+		format Format
+		encode func(io.Writer, *dto.MetricFamily) (int, error)
+	}{
+		{"text", FmtText, func(w io.Writer, mf *dto.MetricFamily) (int, error) {
+			return MetricFamilyToText(w, mf)
+		}},
+		{"openmetrics", FmtOpenMetrics_1_0_0, func(w io.Writer, mf *dto.MetricFamily) (int, error) {
+			return MetricFamilyToOpenMetrics(w, mf)
+		}},
+	} {
+		b.Run(bm.name+"/copy", func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				escaped := model.EscapeMetricFamily(mf, model.UnderscoreEscaping)
+				if _, err := bm.encode(io.Discard, escaped); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+		b.Run(bm.name+"/lazy", func(b *testing.B) {
+			enc := NewEncoder(io.Discard, bm.format, WithEscapingScheme(model.UnderscoreEscaping))
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if err := enc.Encode(mf); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkEncodeWithEscaper encodes a scrape of 10k series in 500 families
+// with names that need escaping, with and without a shared model.Escaper.
+func BenchmarkEncodeWithEscaper(b *testing.B) {
+	var families []*dto.MetricFamily
+	for i := 0; i < 500; i++ {
+		mf := &dto.MetricFamily{
+			Name: proto.String("app.subsystem_" + strconv.Itoa(i) + ".requests.total"),
+			Type: dto.MetricType_COUNTER.Enum(),
+		}
+		for j := 0; j < 20; j++ {
+			mf.Metric = append(mf.Metric, &dto.Metric{
+				Label: []*dto.LabelPair{
+					{Name: proto.String("http.method"), Value: proto.String("GET")},
+					{Name: proto.String("http.status_code"), Value: proto.String(strconv.Itoa(200 + j))},
+				},
+				Counter: &dto.Counter{Value: proto.Float64(float64(j))},
+			})
+		}
+		families = append(families, mf)
+	}
+	for _, format := range []struct {
+		name   string
+		format Format
+	}{{"text", FmtText}, {"proto", FmtProtoDelim}} {
+		b.Run(format.name+"/scheme", func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				// A new Encoder per scrape, as in an HTTP handler.
+				enc := NewEncoder(io.Discard, format.format, WithEscapingScheme(model.ValueEncodingEscaping))
+				for _, mf := range families {
+					if err := enc.Encode(mf); err != nil {
+						b.Fatal(err)
+					}
+				}
+			}
+		})
+		b.Run(format.name+"/escaper", func(b *testing.B) {
+			escaper := model.NewEscaper(model.ValueEncodingEscaping, 1000)
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				enc := NewEncoder(io.Discard, format.format, WithEscaper(escaper))
+				for _, mf := range families {
+					if err := enc.Encode(mf); err != nil {
+						b.Fatal(err)
+					}
+				}
+			}
+		})
+	}
+}
+
+// benchmarkFormats are the formats used by BenchmarkContentType and
+// BenchmarkToEscapingScheme: a constant, a negotiated format with an escaping
+// term, and a format as found in a Content-Type header.
+var benchmarkFormats = []struct {
+	name   string
+	format Format
+}{
+	{"constant", FmtText},
+	{"negotiated", FmtOpenMetrics_1_0_0 + escapingTerm(model.UnderscoreEscaping)},
+	{"header", "application/vnd.google.protobuf;proto=io.prometheus.client.MetricFamily;encoding=delimited;escaping=dots"},
+}
+
+func BenchmarkContentType(b *testing.B) {
+	for _, bm := range benchmarkFormats {
+		b.Run(bm.name, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if bm.format.FormatType() == TypeUnknown {
+					b.Fatal("unknown format")
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkToEscapingScheme(b *testing.B) {
+	for _, bm := range benchmarkFormats {
+		b.Run(bm.name, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				bm.format.ToEscapingScheme()
+			}
+		})
+	}
+}
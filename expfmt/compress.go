@@ -0,0 +1,181 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package expfmt
+
+import (
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// The content codings (see the Content-Encoding header) supported by
+// NegotiateEncoding and NewCompressedEncoder.
+const (
+	EncodingGzip     = "gzip"
+	EncodingIdentity = "identity"
+)
+
+// ErrUnsupportedEncoding is returned (wrapped) by NewDecoderWithHeaders if the
+// Content-Encoding header names a content coding other than gzip and identity.
+var ErrUnsupportedEncoding = errors.New("unsupported content encoding")
+
+// NegotiateEncoding returns the content coding to use for the response based
+// on the Accept-Encoding header: EncodingGzip if the client accepts gzip with
+// at least the quality value of identity, and EncodingIdentity otherwise. A
+// "*" entry applies to all codings not listed explicitly. If neither identity
+// nor "*" is listed, any accepted gzip entry is preferred. Codings without
+// support in this package, like zstd or br, are never selected. If the client
+// accepts neither gzip nor identity, EncodingIdentity is returned anyway, as
+// there is nothing better to fall back to.
+func NegotiateEncoding(h http.Header) string {
+	// A negative quality value means that the coding is not listed.
+	gzipQ, identityQ, anyQ := -1.0, -1.0, -1.0
+	for _, v := range h.Values(hdrAcceptEncoding) {
+		for _, entry := range strings.Split(v, ",") {
+			coding, params, _ := strings.Cut(entry, ";")
+			q := 1.0
+			for _, p := range strings.Split(params, ";") {
+				key, value, ok := strings.Cut(p, "=")
+				if !ok || strings.TrimSpace(key) != "q" {
+					continue
+				}
+				var err error
+				if q, err = strconv.ParseFloat(strings.TrimSpace(value), 64); err != nil {
+					q = 0
+				}
+			}
+			switch strings.ToLower(strings.TrimSpace(coding)) {
+			case EncodingGzip, "x-gzip":
+				gzipQ = q
+			case EncodingIdentity:
+				identityQ = q
+			case "*":
+				anyQ = q
+			}
+		}
+	}
+	if gzipQ < 0 {
+		gzipQ = anyQ
+	}
+	if identityQ < 0 {
+		identityQ = anyQ
+	}
+	if gzipQ > 0 && gzipQ >= identityQ {
+		return EncodingGzip
+	}
+	return EncodingIdentity
+}
+
+// NewCompressedEncoder works like NewEncoder, but compresses the output
+// written to w with the given content coding, as returned by
+// NegotiateEncoding. Codings other than EncodingGzip result in uncompressed
+// output, i.e. they are treated like EncodingIdentity.
+//
+// The returned io.Closer has to be called once all metric families have been
+// encoded. It closes the Encoder (see Closer) and then flushes and closes the
+// compressor, but not w. Unlike NewEncoder, NewCompressedEncoder does not
+// panic for unknown formats but returns an error, as it does for formats that
+// fail Format.Validate.
+func NewCompressedEncoder(w io.Writer, format Format, encoding string, options ...EncoderOption) (Encoder, io.Closer, error) {
+	if err := format.Validate(); err != nil {
+		return nil, nil, err
+	}
+	if encoding != EncodingGzip {
+		enc := NewEncoder(w, format, options...)
+		return enc, enc.(Closer), nil
+	}
+	gz := gzip.NewWriter(w)
+	enc := NewEncoder(gz, format, options...)
+	return enc, compressedCloser{enc: enc.(Closer), compressor: gz}, nil
+}
+
+// compressedCloser closes an Encoder and the compressor it writes to.
+type compressedCloser struct {
+	enc        Closer
+	compressor io.Closer
+}
+
+// Close implements io.Closer. The compressor is closed even if closing the
+// Encoder fails.
+func (c compressedCloser) Close() error {
+	err := c.enc.Close()
+	if cErr := c.compressor.Close(); err == nil {
+		err = cErr
+	}
+	return err
+}
+
+// NewDecoderWithHeaders returns a Decoder for a response body r with the given
+// response headers. The format is determined from the Content-Type header with
+// ResponseFormatErr, so that a missing or unsupported Content-Type results in
+// an error wrapping ErrInvalidContentType (rather than the fallback to the text
+// format of NewDecoder). A body with Content-Encoding gzip (or x-gzip) is
+// decompressed transparently. The decompressor is closed once r is exhausted.
+// Other content codings except identity result in an error wrapping
+// ErrUnsupportedEncoding. Note that the HTTP client of the standard library
+// already decompresses gzip-encoded bodies (and removes the Content-Encoding
+// header) if it added the Accept-Encoding header itself.
+func NewDecoderWithHeaders(r io.Reader, h http.Header) (Decoder, error) {
+	format, err := ResponseFormatErr(h)
+	if err != nil {
+		return nil, err
+	}
+	var gzipped bool
+	for _, v := range h.Values(hdrContentEncoding) {
+		for _, coding := range strings.Split(v, ",") {
+			switch coding = strings.ToLower(strings.TrimSpace(coding)); coding {
+			case "", EncodingIdentity:
+			case EncodingGzip, "x-gzip":
+				if gzipped {
+					return nil, fmt.Errorf("%w %q: only a single gzip coding is supported", ErrUnsupportedEncoding, strings.Join(h.Values(hdrContentEncoding), ","))
+				}
+				gzipped = true
+			default:
+				return nil, fmt.Errorf("%w %q", ErrUnsupportedEncoding, coding)
+			}
+		}
+	}
+	if gzipped {
+		gz, err := gzip.NewReader(r)
+		if err != nil {
+			return nil, fmt.Errorf("reading gzip header: %w", err)
+		}
+		r = &closingReader{r: gz, c: gz}
+	}
+	return NewDecoder(r, format), nil
+}
+
+// closingReader reads from r and closes c as soon as r returns an error,
+// including io.EOF.
+type closingReader struct {
+	r      io.Reader
+	c      io.Closer
+	closed bool
+}
+
+// Read implements io.Reader. An error from closing c replaces io.EOF.
+func (cr *closingReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	if err != nil && !cr.closed {
+		cr.closed = true
+		if cErr := cr.c.Close(); cErr != nil && errors.Is(err, io.EOF) {
+			err = cErr
+		}
+	}
+	return n, err
+}
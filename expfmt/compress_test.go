@@ -0,0 +1,230 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package expfmt
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	dto "github.com/prometheus/client_model/go"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestNegotiateEncoding(t *testing.T) {
+	scenarios := []struct {
+		header   []string
+		expected string
+	}{
+		{header: nil, expected: EncodingIdentity},
+		{header: []string{""}, expected: EncodingIdentity},
+		{header: []string{"gzip"}, expected: EncodingGzip},
+		{header: []string{"GZIP"}, expected: EncodingGzip},
+		{header: []string{"x-gzip"}, expected: EncodingGzip},
+		{header: []string{"gzip, deflate, br"}, expected: EncodingGzip},
+		{header: []string{"zstd"}, expected: EncodingIdentity},
+		{header: []string{"zstd, gzip;q=0.5"}, expected: EncodingGzip},
+		{header: []string{"identity"}, expected: EncodingIdentity},
+		{header: []string{"gzip;q=0"}, expected: EncodingIdentity},
+		{header: []string{"gzip;q=0.5, identity"}, expected: EncodingIdentity},
+		{header: []string{"gzip;q=0.5, identity;q=0.5"}, expected: EncodingGzip},
+		{header: []string{"*"}, expected: EncodingGzip},
+		{header: []string{"*;q=0.5, identity"}, expected: EncodingIdentity},
+		{header: []string{"identity;q=0"}, expected: EncodingIdentity},
+		{header: []string{"*;q=0"}, expected: EncodingIdentity},
+		{header: []string{"br", "gzip ; q=0.8"}, expected: EncodingGzip},
+		{header: []string{"gzip;q=invalid"}, expected: EncodingIdentity},
+	}
+	for _, s := range scenarios {
+		h := http.Header{hdrAcceptEncoding: s.header}
+		if got := NegotiateEncoding(h); got != s.expected {
+			t.Errorf("Accept-Encoding %q: expected %q, got %q", s.header, s.expected, got)
+		}
+	}
+}
+
+func TestNewCompressedEncoder(t *testing.T) {
+	families := []*dto.MetricFamily{
+		{
+			Name:   proto.String("foo_total"),
+			Help:   proto.String("Some help."),
+			Type:   dto.MetricType_COUNTER.Enum(),
+			Metric: []*dto.Metric{{Counter: &dto.Counter{Value: proto.Float64(1)}}},
+		},
+		{
+			Name:   proto.String("bar"),
+			Type:   dto.MetricType_GAUGE.Enum(),
+			Metric: []*dto.Metric{{Gauge: &dto.Gauge{Value: proto.Float64(2)}}},
+		},
+	}
+
+	for _, format := range []Format{FmtText, FmtProtoDelim, FmtOpenMetrics_1_0_0} {
+		for _, encoding := range []string{EncodingGzip, EncodingIdentity, "zstd"} {
+			t.Run(string(format)+"/"+encoding, func(t *testing.T) {
+				var buf bytes.Buffer
+				enc, closer, err := NewCompressedEncoder(&buf, format, encoding)
+				if err != nil {
+					t.Fatalf("unexpected error: %s", err)
+				}
+				for _, mf := range families {
+					if err := enc.Encode(mf); err != nil {
+						t.Fatalf("unexpected error during encode: %s", err)
+					}
+				}
+				if err := closer.Close(); err != nil {
+					t.Fatalf("unexpected error during close: %s", err)
+				}
+
+				var r io.Reader = &buf
+				if encoding == EncodingGzip {
+					gz, err := gzip.NewReader(&buf)
+					if err != nil {
+						t.Fatalf("output is not gzip-compressed: %s", err)
+					}
+					r = gz
+				}
+				got := map[string]*dto.MetricFamily{}
+				if err := DecodeEach(NewDecoder(r, format), func(mf *dto.MetricFamily) error {
+					got[mf.GetName()] = mf
+					return nil
+				}); err != nil {
+					t.Fatalf("unexpected error during decode: %s", err)
+				}
+				if len(got) != len(families) {
+					t.Fatalf("expected %d metric families, got %d", len(families), len(got))
+				}
+				for _, mf := range families {
+					if !proto.Equal(got[mf.GetName()], mf) {
+						t.Errorf("expected %v, got %v", mf, got[mf.GetName()])
+					}
+				}
+			})
+		}
+	}
+}
+
+func TestNewCompressedEncoderInvalidFormat(t *testing.T) {
+	for _, format := range []Format{FmtUnknown, FmtText + FmtAllowUTF8} {
+		if _, _, err := NewCompressedEncoder(io.Discard, format, EncodingGzip); !errors.Is(err, ErrInvalidContentType) {
+			t.Errorf("%q: expected error wrapping ErrInvalidContentType, got %v", format, err)
+		}
+	}
+}
+
+func TestNewDecoderWithHeaders(t *testing.T) {
+	mf := &dto.MetricFamily{
+		Name:   proto.String("foo"),
+		Type:   dto.MetricType_GAUGE.Enum(),
+		Metric: []*dto.Metric{{Gauge: &dto.Gauge{Value: proto.Float64(1)}}},
+	}
+	encode := func(format Format, encoding string) []byte {
+		var buf bytes.Buffer
+		enc, closer, err := NewCompressedEncoder(&buf, format, encoding)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if err := enc.Encode(mf); err != nil {
+			t.Fatalf("unexpected error during encode: %s", err)
+		}
+		if err := closer.Close(); err != nil {
+			t.Fatalf("unexpected error during close: %s", err)
+		}
+		return buf.Bytes()
+	}
+
+	scenarios := []struct {
+		name            string
+		format          Format
+		encoding        string
+		contentEncoding string
+	}{
+		{name: "gzipped protobuf", format: FmtProtoDelim, encoding: EncodingGzip, contentEncoding: "gzip"},
+		{name: "gzipped text", format: FmtText, encoding: EncodingGzip, contentEncoding: "gzip"},
+		{name: "x-gzip", format: FmtText, encoding: EncodingGzip, contentEncoding: "x-gzip"},
+		{name: "identity", format: FmtProtoDelim, encoding: EncodingIdentity, contentEncoding: "identity"},
+		{name: "no encoding", format: FmtText, encoding: EncodingIdentity},
+	}
+	for _, s := range scenarios {
+		t.Run(s.name, func(t *testing.T) {
+			h := http.Header{}
+			h.Set(hdrContentType, string(s.format))
+			if s.contentEncoding != "" {
+				h.Set(hdrContentEncoding, s.contentEncoding)
+			}
+			dec, err := NewDecoderWithHeaders(bytes.NewReader(encode(s.format, s.encoding)), h)
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			var got dto.MetricFamily
+			if err := dec.Decode(&got); err != nil {
+				t.Fatalf("unexpected error during decode: %s", err)
+			}
+			if !proto.Equal(&got, mf) {
+				t.Errorf("expected %v, got %v", mf, &got)
+			}
+			if err := dec.Decode(&got); !errors.Is(err, io.EOF) {
+				t.Errorf("expected io.EOF, got %v", err)
+			}
+		})
+	}
+
+	for _, s := range []struct {
+		contentType, contentEncoding string
+		expErr                       error
+	}{
+		{contentType: string(FmtText), contentEncoding: "br", expErr: ErrUnsupportedEncoding},
+		{contentType: string(FmtText), contentEncoding: "gzip, gzip", expErr: ErrUnsupportedEncoding},
+		{contentType: "", contentEncoding: "gzip", expErr: ErrInvalidContentType},
+		{contentType: "application/json", expErr: ErrInvalidContentType},
+	} {
+		h := http.Header{}
+		h.Set(hdrContentType, s.contentType)
+		h.Set(hdrContentEncoding, s.contentEncoding)
+		if _, err := NewDecoderWithHeaders(bytes.NewReader(encode(FmtText, EncodingGzip)), h); !errors.Is(err, s.expErr) {
+			t.Errorf("Content-Type %q, Content-Encoding %q: expected error wrapping %v, got %v", s.contentType, s.contentEncoding, s.expErr, err)
+		}
+	}
+
+	h := http.Header{}
+	h.Set(hdrContentType, string(FmtText))
+	h.Set(hdrContentEncoding, "gzip")
+	if _, err := NewDecoderWithHeaders(strings.NewReader("not gzipped"), h); err == nil {
+		t.Errorf("expected an error for a body that is not gzip-compressed")
+	}
+}
+
+type countingCloser struct{ closed int }
+
+func (c *countingCloser) Close() error {
+	c.closed++
+	return nil
+}
+
+func TestClosingReader(t *testing.T) {
+	c := &countingCloser{}
+	r := &closingReader{r: strings.NewReader("abc"), c: c}
+	if _, err := io.ReadAll(r); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if _, err := r.Read(make([]byte, 1)); !errors.Is(err, io.EOF) {
+		t.Errorf("expected io.EOF, got %v", err)
+	}
+	if c.closed != 1 {
+		t.Errorf("expected the closer to be called once, got %d calls", c.closed)
+	}
+}
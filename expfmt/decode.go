@@ -15,10 +15,11 @@ package expfmt
 
 import (
 	"bufio"
+	"context"
+	"errors"
 	"fmt"
 	"io"
 	"math"
-	"mime"
 	"net/http"
 
 	dto "github.com/prometheus/client_model/go"
@@ -32,61 +33,189 @@ type Decoder interface {
 	Decode(*dto.MetricFamily) error
 }
 
+// EscapingSchemeGetter is implemented by all Decoders returned by NewDecoder.
+// EscapingScheme returns the escaping scheme that the Format passed to
+// NewDecoder announces (see Format.ToEscapingScheme), i.e. the scheme that
+// was applied to the names in the decoded input. It can be used with
+// model.UnescapeName to restore the original names.
+type EscapingSchemeGetter interface {
+	EscapingScheme() model.EscapingScheme
+}
+
+// ContextDecoder is implemented by all Decoders returned by NewDecoder.
+// DecodeContext works like Decode, but returns ctx.Err() instead of decoding
+// the next metric family once ctx is done. The context is checked between
+// metric families, so a read that blocks on the underlying reader is not
+// interrupted. Decode is equivalent to DecodeContext with
+// context.Background().
+type ContextDecoder interface {
+	DecodeContext(ctx context.Context, v *dto.MetricFamily) error
+}
+
+// EachDecoder is implemented by all Decoders returned by NewDecoder.
+// DecodeEach decodes the remaining metric families one at a time and calls fn
+// for each of them. Every call to fn receives a newly allocated MetricFamily,
+// which fn may retain. DecodeEach returns nil at the end of the input. If
+// decoding fails, or fn returns an error, DecodeEach stops and returns that
+// error.
+//
+// Unlike Decode, DecodeEach does not need to hold all metric families of the
+// text format in memory. See the implementations for details.
+type EachDecoder interface {
+	DecodeEach(fn func(*dto.MetricFamily) error) error
+}
+
 // DecodeOptions contains options used by the Decoder and in sample extraction.
 type DecodeOptions struct {
 	// Timestamp is added to each value from the stream that has no explicit timestamp set.
 	Timestamp model.Time
+	// EscapingScheme is applied to the metric and label names of the
+	// extracted samples, following the same rules as the encoder returned by
+	// NewEncoder. In particular, the _bucket, _sum, and _count suffixes of
+	// histogram and summary samples are appended to the escaped name of the
+	// metric family. The zero value, model.NoEscaping, leaves names
+	// unchanged.
+	EscapingScheme model.EscapingScheme
+	// RetainOriginalName, if true, adds an OriginalNameLabel with the
+	// unescaped metric name to every extracted sample whose name has been
+	// changed by EscapingScheme, so that the mapping can be reversed.
+	RetainOriginalName bool
 }
 
+// OriginalNameLabel is the label added by sample extraction to retain the
+// original metric name if DecodeOptions.RetainOriginalName is set.
+const OriginalNameLabel model.LabelName = "__name_original__"
+
 // ResponseFormat extracts the correct format from a HTTP response header.
-// If no matching format can be found FormatUnknown is returned.
+// If no matching format can be found FormatUnknown is returned. Use
+// ResponseFormatErr to learn why no format could be found.
 func ResponseFormat(h http.Header) Format {
-	ct := h.Get(hdrContentType)
+	f, _ := ResponseFormatErr(h)
+	return f
+}
 
-	mediatype, params, err := mime.ParseMediaType(ct)
+// ResponseFormatErr works like ResponseFormat, but additionally returns an
+// error wrapping ErrInvalidContentType if the Content-Type header cannot be
+// parsed or describes a format that cannot be decoded. The Content-Type is
+// parsed like with ParseContentType, so an escaping parameter is carried over
+// to the returned Format (see Format.ToEscapingScheme), and unknown parameters
+// are ignored. Of the protobuf formats, only the delimited encoding can be
+// decoded.
+//
+// In contrast to ParseContentType, escaping=allow-utf-8 (or one of its
+// alternative spellings) is not rejected for format versions that do not
+// support names outside of the legacy character set, as earlier versions of
+// Negotiate returned such Content-Types. Instead, the returned Format uses the
+// default escaping scheme, or model.ValueEncodingEscaping if the default is
+// model.NoEscaping, like Negotiate does for those versions.
+func ResponseFormatErr(h http.Header) (Format, error) {
+	ct := h.Get(hdrContentType)
+	f, params, err := parseBaseFormat(ct)
 	if err != nil {
-		return FmtUnknown
+		return FmtUnknown, err
 	}
-
-	const textType = "text/plain"
-
-	switch mediatype {
-	case ProtoType:
-		if p, ok := params["proto"]; ok && p != ProtoProtocol {
-			return FmtUnknown
-		}
-		if e, ok := params["encoding"]; ok && e != "delimited" {
-			return FmtUnknown
-		}
-		return FmtProtoDelim
-
-	case textType:
-		if v, ok := params["version"]; ok && v != TextVersion {
-			return FmtUnknown
-		}
-		return FmtText
+	switch f.FormatType() {
+	case TypeProtoText, TypeProtoCompact:
+		return FmtUnknown, fmt.Errorf("%w %q: only the delimited protobuf encoding can be decoded", ErrInvalidContentType, ct)
 	}
-
-	return FmtUnknown
+	e, err := escapingParam(params)
+	if err != nil {
+		return FmtUnknown, fmt.Errorf("%w %q: %w", ErrInvalidContentType, ct, err)
+	}
+	if e == "" {
+		return f, nil
+	}
+	if escaped := f + Format("; "+model.EscapingKey+"="+e); escaped.Validate() == nil {
+		return escaped, nil
+	}
+	return f + escapingTerm(legacyEscapingScheme(model.GetNameEscapingScheme())), nil
 }
 
 // NewDecoder returns a new decoder based on the given input format.
 // If the input format does not imply otherwise, a text format decoder is returned.
+//
+// For OpenMetrics, the version parameter of the format selects the version of
+// the OpenMetrics text format to parse. Versions 0.0.1 and 1.0.0 are treated
+// alike. Only version 2.0.0 allows quoted metric and label names. The input
+// has to end with a `# EOF` line. Counters are named with their `_total`
+// suffix. Exemplars and created timestamps are carried over to the
+// corresponding fields of the MetricFamily proto messages.
+//
+// If the format is recognized but fails Format.Validate, every call of Decode
+// returns the validation error.
 func NewDecoder(r io.Reader, format Format) Decoder {
+	escapingScheme := format.ToEscapingScheme()
+	var err error
+	if format.FormatType() != TypeUnknown {
+		err = format.Validate()
+	}
 	switch format.FormatType() {
-	case TypeProtoDelim:
-		return &protoDecoder{r: bufio.NewReader(r)}
+	case TypeProtoDelim, TypeOpenMetricsProto:
+		return &protoDecoder{r: bufio.NewReader(r), err: err, escapingScheme: escapingScheme}
+	case TypeOpenMetrics:
+		return &openMetricsDecoder{r: r, version: format.Version(), err: err, escapingScheme: escapingScheme}
+	}
+	return &textDecoder{r: r, err: err, escapingScheme: escapingScheme}
+}
+
+// DecodeEach calls the DecodeEach method of d if d implements EachDecoder, as
+// all Decoders returned by NewDecoder do. Otherwise, it calls Decode until d
+// reports io.EOF and passes each newly allocated MetricFamily to fn, with the
+// same semantics.
+func DecodeEach(d Decoder, fn func(*dto.MetricFamily) error) error {
+	if ed, ok := d.(EachDecoder); ok {
+		return ed.DecodeEach(fn)
+	}
+	return decodeEach(d, fn)
+}
+
+// decodeEach implements DecodeEach with the Decode method of d.
+func decodeEach(d Decoder, fn func(*dto.MetricFamily) error) error {
+	for {
+		mf := &dto.MetricFamily{}
+		if err := d.Decode(mf); err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return err
+		}
+		if err := fn(mf); err != nil {
+			return err
+		}
 	}
-	return &textDecoder{r: r}
 }
 
 // protoDecoder implements the Decoder interface for protocol buffers.
 type protoDecoder struct {
-	r protodelim.Reader
+	r              protodelim.Reader
+	err            error // Returned by every Decode if set.
+	escapingScheme model.EscapingScheme
+}
+
+// EscapingScheme implements the EscapingSchemeGetter interface.
+func (d *protoDecoder) EscapingScheme() model.EscapingScheme {
+	return d.escapingScheme
 }
 
 // Decode implements the Decoder interface.
 func (d *protoDecoder) Decode(v *dto.MetricFamily) error {
+	return d.DecodeContext(context.Background(), v)
+}
+
+// DecodeEach implements the EachDecoder interface. Only one metric family is
+// held in memory at a time.
+func (d *protoDecoder) DecodeEach(fn func(*dto.MetricFamily) error) error {
+	return decodeEach(d, fn)
+}
+
+// DecodeContext implements the ContextDecoder interface.
+func (d *protoDecoder) DecodeContext(ctx context.Context, v *dto.MetricFamily) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if d.err != nil {
+		return d.err
+	}
 	opts := protodelim.UnmarshalOptions{
 		MaxSize: -1,
 	}
@@ -117,13 +246,56 @@ func (d *protoDecoder) Decode(v *dto.MetricFamily) error {
 
 // textDecoder implements the Decoder interface for the text protocol.
 type textDecoder struct {
-	r    io.Reader
-	fams map[string]*dto.MetricFamily
-	err  error
+	r              io.Reader
+	fams           map[string]*dto.MetricFamily
+	err            error
+	escapingScheme model.EscapingScheme
+}
+
+// EscapingScheme implements the EscapingSchemeGetter interface.
+func (d *textDecoder) EscapingScheme() model.EscapingScheme {
+	return d.escapingScheme
 }
 
 // Decode implements the Decoder interface.
 func (d *textDecoder) Decode(v *dto.MetricFamily) error {
+	return d.DecodeContext(context.Background(), v)
+}
+
+// DecodeEach implements the EachDecoder interface. If Decode has not been
+// called before, the input is parsed with TextParser.ParseStream, so that only
+// one metric family is held in memory at a time. Families are then passed to
+// fn in the order of the input, and, as explained there, a metric family whose
+// lines are interleaved with another one results in a ParseError, while Decode
+// merges such families. Otherwise, the metric families left over by Decode
+// are passed to fn.
+func (d *textDecoder) DecodeEach(fn func(*dto.MetricFamily) error) error {
+	if d.err != nil {
+		return decodeEach(d, fn)
+	}
+	var p TextParser
+	d.err = p.ParseStream(d.r, func(mf *dto.MetricFamily) error {
+		// ParseStream reuses mf and its Metric slice, but not the metrics.
+		return fn(&dto.MetricFamily{
+			Name:   mf.Name,
+			Help:   mf.Help,
+			Type:   mf.Type,
+			Unit:   mf.Unit,
+			Metric: append([]*dto.Metric(nil), mf.Metric...),
+		})
+	})
+	if d.err == nil {
+		d.err = io.EOF
+		return nil
+	}
+	return d.err
+}
+
+// DecodeContext implements the ContextDecoder interface.
+func (d *textDecoder) DecodeContext(ctx context.Context, v *dto.MetricFamily) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
 	if d.err == nil {
 		// Read all metrics in one shot.
 		var p TextParser
@@ -145,6 +317,60 @@ func (d *textDecoder) Decode(v *dto.MetricFamily) error {
 	return d.err
 }
 
+// openMetricsDecoder implements the Decoder interface for the OpenMetrics text
+// format.
+type openMetricsDecoder struct {
+	r              io.Reader
+	version        string
+	fams           []*dto.MetricFamily
+	err            error
+	escapingScheme model.EscapingScheme
+}
+
+// EscapingScheme implements the EscapingSchemeGetter interface.
+func (d *openMetricsDecoder) EscapingScheme() model.EscapingScheme {
+	return d.escapingScheme
+}
+
+// Decode implements the Decoder interface.
+func (d *openMetricsDecoder) Decode(v *dto.MetricFamily) error {
+	return d.DecodeContext(context.Background(), v)
+}
+
+// DecodeEach implements the EachDecoder interface. As the input has to end
+// with a `# EOF` line, it is still parsed completely before the first metric
+// family is passed to fn.
+func (d *openMetricsDecoder) DecodeEach(fn func(*dto.MetricFamily) error) error {
+	return decodeEach(d, fn)
+}
+
+// DecodeContext implements the ContextDecoder interface.
+func (d *openMetricsDecoder) DecodeContext(ctx context.Context, v *dto.MetricFamily) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if d.err == nil {
+		// Read all metrics in one shot, so that a missing `# EOF` line is
+		// detected before any metric family is returned.
+		d.fams, d.err = parseOpenMetrics(d.r, d.version)
+		// If we don't get an error, store io.EOF for the end.
+		if d.err == nil {
+			d.err = io.EOF
+		}
+	}
+	if len(d.fams) == 0 {
+		return d.err
+	}
+	fam := d.fams[0]
+	d.fams = d.fams[1:]
+	v.Name = fam.Name
+	v.Help = fam.Help
+	v.Type = fam.Type
+	v.Unit = fam.Unit
+	v.Metric = fam.Metric
+	return nil
+}
+
 // SampleDecoder wraps a Decoder to extract samples from the metric families
 // decoded by the wrapped Decoder.
 type SampleDecoder struct {
@@ -201,6 +427,26 @@ func extractSamples(f *dto.MetricFamily, o *DecodeOptions) (model.Vector, error)
 	return nil, fmt.Errorf("expfmt.extractSamples: unknown metric family type %v", f.GetType())
 }
 
+// sampleLabels returns the labels of m together with the metric name label for
+// the sample of f with the given name suffix. Names are escaped with
+// model.LabelSet.Escape, the suffix being appended to the escaped name of f as
+// the text-based encoders do. If o.RetainOriginalName is true and escaping
+// changed the metric name, the original name is added as OriginalNameLabel.
+func sampleLabels(o *DecodeOptions, f *dto.MetricFamily, m *dto.Metric, suffix string) model.LabelSet {
+	lset := make(model.LabelSet, len(m.Label)+3)
+	for _, p := range m.Label {
+		lset[model.LabelName(p.GetName())] = model.LabelValue(p.GetValue())
+	}
+	lset[model.MetricNameLabel] = model.LabelValue(f.GetName())
+	lset = lset.Escape(o.EscapingScheme)
+	name := string(lset[model.MetricNameLabel])
+	if o.RetainOriginalName && name != f.GetName() {
+		lset[OriginalNameLabel] = model.LabelValue(f.GetName() + suffix)
+	}
+	lset[model.MetricNameLabel] = model.LabelValue(name + suffix)
+	return lset
+}
+
 func extractCounter(o *DecodeOptions, f *dto.MetricFamily) model.Vector {
 	samples := make(model.Vector, 0, len(f.Metric))
 
@@ -209,11 +455,7 @@ func extractCounter(o *DecodeOptions, f *dto.MetricFamily) model.Vector {
 			continue
 		}
 
-		lset := make(model.LabelSet, len(m.Label)+1)
-		for _, p := range m.Label {
-			lset[model.LabelName(p.GetName())] = model.LabelValue(p.GetValue())
-		}
-		lset[model.MetricNameLabel] = model.LabelValue(f.GetName())
+		lset := sampleLabels(o, f, m, "")
 
 		smpl := &model.Sample{
 			Metric: model.Metric(lset),
@@ -240,11 +482,7 @@ func extractGauge(o *DecodeOptions, f *dto.MetricFamily) model.Vector {
 			continue
 		}
 
-		lset := make(model.LabelSet, len(m.Label)+1)
-		for _, p := range m.Label {
-			lset[model.LabelName(p.GetName())] = model.LabelValue(p.GetValue())
-		}
-		lset[model.MetricNameLabel] = model.LabelValue(f.GetName())
+		lset := sampleLabels(o, f, m, "")
 
 		smpl := &model.Sample{
 			Metric: model.Metric(lset),
@@ -271,11 +509,7 @@ func extractUntyped(o *DecodeOptions, f *dto.MetricFamily) model.Vector {
 			continue
 		}
 
-		lset := make(model.LabelSet, len(m.Label)+1)
-		for _, p := range m.Label {
-			lset[model.LabelName(p.GetName())] = model.LabelValue(p.GetValue())
-		}
-		lset[model.MetricNameLabel] = model.LabelValue(f.GetName())
+		lset := sampleLabels(o, f, m, "")
 
 		smpl := &model.Sample{
 			Metric: model.Metric(lset),
@@ -308,13 +542,9 @@ func extractSummary(o *DecodeOptions, f *dto.MetricFamily) model.Vector {
 		}
 
 		for _, q := range m.Summary.Quantile {
-			lset := make(model.LabelSet, len(m.Label)+2)
-			for _, p := range m.Label {
-				lset[model.LabelName(p.GetName())] = model.LabelValue(p.GetValue())
-			}
+			lset := sampleLabels(o, f, m, "")
 			// BUG(matt): Update other names to "quantile".
 			lset[model.LabelName(model.QuantileLabel)] = model.LabelValue(fmt.Sprint(q.GetQuantile()))
-			lset[model.MetricNameLabel] = model.LabelValue(f.GetName())
 
 			samples = append(samples, &model.Sample{
 				Metric:    model.Metric(lset),
@@ -323,11 +553,7 @@ func extractSummary(o *DecodeOptions, f *dto.MetricFamily) model.Vector {
 			})
 		}
 
-		lset := make(model.LabelSet, len(m.Label)+1)
-		for _, p := range m.Label {
-			lset[model.LabelName(p.GetName())] = model.LabelValue(p.GetValue())
-		}
-		lset[model.MetricNameLabel] = model.LabelValue(f.GetName() + "_sum")
+		lset := sampleLabels(o, f, m, "_sum")
 
 		samples = append(samples, &model.Sample{
 			Metric:    model.Metric(lset),
@@ -335,11 +561,7 @@ func extractSummary(o *DecodeOptions, f *dto.MetricFamily) model.Vector {
 			Timestamp: timestamp,
 		})
 
-		lset = make(model.LabelSet, len(m.Label)+1)
-		for _, p := range m.Label {
-			lset[model.LabelName(p.GetName())] = model.LabelValue(p.GetValue())
-		}
-		lset[model.MetricNameLabel] = model.LabelValue(f.GetName() + "_count")
+		lset = sampleLabels(o, f, m, "_count")
 
 		samples = append(samples, &model.Sample{
 			Metric:    model.Metric(lset),
@@ -367,12 +589,8 @@ func extractHistogram(o *DecodeOptions, f *dto.MetricFamily) model.Vector {
 		infSeen := false
 
 		for _, q := range m.Histogram.Bucket {
-			lset := make(model.LabelSet, len(m.Label)+2)
-			for _, p := range m.Label {
-				lset[model.LabelName(p.GetName())] = model.LabelValue(p.GetValue())
-			}
+			lset := sampleLabels(o, f, m, "_bucket")
 			lset[model.LabelName(model.BucketLabel)] = model.LabelValue(fmt.Sprint(q.GetUpperBound()))
-			lset[model.MetricNameLabel] = model.LabelValue(f.GetName() + "_bucket")
 
 			if math.IsInf(q.GetUpperBound(), +1) {
 				infSeen = true
@@ -385,11 +603,7 @@ func extractHistogram(o *DecodeOptions, f *dto.MetricFamily) model.Vector {
 			})
 		}
 
-		lset := make(model.LabelSet, len(m.Label)+1)
-		for _, p := range m.Label {
-			lset[model.LabelName(p.GetName())] = model.LabelValue(p.GetValue())
-		}
-		lset[model.MetricNameLabel] = model.LabelValue(f.GetName() + "_sum")
+		lset := sampleLabels(o, f, m, "_sum")
 
 		samples = append(samples, &model.Sample{
 			Metric:    model.Metric(lset),
@@ -397,11 +611,7 @@ func extractHistogram(o *DecodeOptions, f *dto.MetricFamily) model.Vector {
 			Timestamp: timestamp,
 		})
 
-		lset = make(model.LabelSet, len(m.Label)+1)
-		for _, p := range m.Label {
-			lset[model.LabelName(p.GetName())] = model.LabelValue(p.GetValue())
-		}
-		lset[model.MetricNameLabel] = model.LabelValue(f.GetName() + "_count")
+		lset = sampleLabels(o, f, m, "_count")
 
 		count := &model.Sample{
 			Metric:    model.Metric(lset),
@@ -412,12 +622,8 @@ func extractHistogram(o *DecodeOptions, f *dto.MetricFamily) model.Vector {
 
 		if !infSeen {
 			// Append an infinity bucket sample.
-			lset := make(model.LabelSet, len(m.Label)+2)
-			for _, p := range m.Label {
-				lset[model.LabelName(p.GetName())] = model.LabelValue(p.GetValue())
-			}
+			lset := sampleLabels(o, f, m, "_bucket")
 			lset[model.LabelName(model.BucketLabel)] = model.LabelValue("+Inf")
-			lset[model.MetricNameLabel] = model.LabelValue(f.GetName() + "_bucket")
 
 			samples = append(samples, &model.Sample{
 				Metric:    model.Metric(lset),
@@ -16,6 +16,7 @@ package expfmt
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"errors"
 	"io"
 	"math"
@@ -470,6 +471,42 @@ func testDiscriminatorHTTPHeader(t testing.TB) {
 			input:  map[string]string{"Content-Type": `text/plain; version=0.0.3`},
 			output: FmtUnknown,
 		},
+		{
+			input:  map[string]string{"Content-Type": `text/plain; version=1.0.0`},
+			output: FmtText_1_0_0,
+		},
+		{
+			input:  map[string]string{"Content-Type": `text/plain; escaping=allow-utf-8; charset=utf-8; version=1.0.0`},
+			output: FmtText_1_0_0 + "; escaping=allow-utf-8",
+		},
+		{
+			input:  map[string]string{"Content-Type": `text/plain;foo=bar;version=0.0.4;escaping=underscores`},
+			output: FmtText + "; escaping=underscores",
+		},
+		{
+			input:  map[string]string{"Content-Type": `application/openmetrics-text; version=1.0.0; charset=utf-8; escaping=values`},
+			output: FmtOpenMetrics_1_0_0 + "; escaping=values",
+		},
+		{
+			input:  map[string]string{"Content-Type": `application/vnd.google.protobuf; escaping=dots; foo=bar; encoding=delimited; proto=io.prometheus.client.MetricFamily`},
+			output: FmtProtoDelim + "; escaping=dots",
+		},
+		{
+			input:  map[string]string{"Content-Type": `application/vnd.google.protobuf; proto=io.prometheus.client.MetricFamily; encoding=text`},
+			output: FmtUnknown,
+		},
+		{
+			input:  map[string]string{"Content-Type": `text/plain; escaping=bogus`},
+			output: FmtUnknown,
+		},
+		{
+			input:  map[string]string{"Content-Type": `text/plain; version=`},
+			output: FmtUnknown,
+		},
+		{
+			input:  nil,
+			output: FmtUnknown,
+		},
 	}
 
 	for i, scenario := range scenarios {
@@ -491,6 +528,166 @@ func testDiscriminatorHTTPHeader(t testing.TB) {
 	}
 }
 
+func TestResponseFormatErr(t *testing.T) {
+	for _, ct := range []string{"", "text/plain; version=", "application/json", "text/plain; escaping=bogus"} {
+		h := http.Header{}
+		h.Set(hdrContentType, ct)
+		f, err := ResponseFormatErr(h)
+		if f != FmtUnknown {
+			t.Errorf("%q: expected %s, got %s", ct, FmtUnknown, f)
+		}
+		if !errors.Is(err, ErrInvalidContentType) {
+			t.Errorf("%q: expected error wrapping ErrInvalidContentType, got %v", ct, err)
+		}
+	}
+
+	h := http.Header{}
+	h.Set(hdrContentType, "text/plain; version=0.0.4; escaping=dots")
+	f, err := ResponseFormatErr(h)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if got := f.ToEscapingScheme(); got != model.DotsEscaping {
+		t.Errorf("expected escaping scheme %s, got %s", model.DotsEscaping, got)
+	}
+}
+
+func TestResponseFormatLegacyAllowUTF8(t *testing.T) {
+	defer model.SetNameEscapingScheme(model.GetNameEscapingScheme())
+
+	scenarios := []struct {
+		contentType    string
+		defaultScheme  model.EscapingScheme
+		expectedFormat Format
+	}{
+		{
+			contentType:    "text/plain; version=0.0.4; charset=utf-8; escaping=allow-utf-8",
+			defaultScheme:  model.UnderscoreEscaping,
+			expectedFormat: FmtText + "; escaping=underscores",
+		},
+		{
+			contentType:    "application/openmetrics-text; version=1.0.0; charset=utf-8; escaping=allow-utf-8",
+			defaultScheme:  model.DotsEscaping,
+			expectedFormat: FmtOpenMetrics_1_0_0 + "; escaping=dots",
+		},
+		{
+			contentType:    "text/plain; version=0.0.4; validchars=utf8",
+			defaultScheme:  model.NoEscaping,
+			expectedFormat: FmtText + "; escaping=values",
+		},
+		{
+			contentType:    "text/plain; version=1.0.0; charset=utf-8; escaping=allow-utf-8",
+			defaultScheme:  model.UnderscoreEscaping,
+			expectedFormat: FmtText_1_0_0 + "; escaping=allow-utf-8",
+		},
+	}
+	for _, scenario := range scenarios {
+		model.SetNameEscapingScheme(scenario.defaultScheme)
+		h := http.Header{}
+		h.Set(hdrContentType, scenario.contentType)
+		f, err := ResponseFormatErr(h)
+		if err != nil {
+			t.Errorf("%q: unexpected error: %s", scenario.contentType, err)
+			continue
+		}
+		if f != scenario.expectedFormat {
+			t.Errorf("%q: expected %s, got %s", scenario.contentType, scenario.expectedFormat, f)
+		}
+		if err := f.Validate(); err != nil {
+			t.Errorf("%q: expected a valid format, got %s", scenario.contentType, err)
+		}
+	}
+
+	// The body of such a response can be decoded.
+	model.SetNameEscapingScheme(model.UnderscoreEscaping)
+	h := http.Header{}
+	h.Set(hdrContentType, "text/plain; version=0.0.4; charset=utf-8; escaping=allow-utf-8")
+	dec, err := NewDecoderWithHeaders(strings.NewReader("# TYPE foo counter\nfoo 1\n"), h)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	var mf dto.MetricFamily
+	if err := dec.Decode(&mf); err != nil {
+		t.Fatalf("unexpected error during decode: %s", err)
+	}
+	if mf.GetName() != "foo" {
+		t.Errorf("expected metric family foo, got %s", mf.GetName())
+	}
+}
+
+func TestDecoderEscapingScheme(t *testing.T) {
+	defer model.SetNameEscapingScheme(model.GetNameEscapingScheme())
+	model.SetNameEscapingScheme(model.UnderscoreEscaping)
+
+	tests := []struct {
+		contentType string
+		expected    model.EscapingScheme
+	}{
+		{contentType: "text/plain; version=0.0.4; escaping=dots", expected: model.DotsEscaping},
+		{contentType: "application/vnd.google.protobuf; proto=io.prometheus.client.MetricFamily; encoding=delimited; escaping=dots", expected: model.DotsEscaping},
+		{contentType: "text/plain; version=1.0.0; escaping=allow-utf-8", expected: model.NoEscaping},
+		{contentType: "text/plain; version=0.0.4", expected: model.UnderscoreEscaping},
+	}
+	for _, test := range tests {
+		h := http.Header{}
+		h.Set(hdrContentType, test.contentType)
+		dec := NewDecoder(strings.NewReader(""), ResponseFormat(h))
+		if got := dec.(EscapingSchemeGetter).EscapingScheme(); got != test.expected {
+			t.Errorf("%q: expected escaping scheme %s, got %s", test.contentType, test.expected, got)
+		}
+	}
+}
+
+func TestDecodeContext(t *testing.T) {
+	families := []*dto.MetricFamily{
+		{
+			Name:   proto.String("foo"),
+			Type:   dto.MetricType_GAUGE.Enum(),
+			Metric: []*dto.Metric{{Gauge: &dto.Gauge{Value: proto.Float64(1)}}},
+		},
+		{
+			Name:   proto.String("bar"),
+			Type:   dto.MetricType_GAUGE.Enum(),
+			Metric: []*dto.Metric{{Gauge: &dto.Gauge{Value: proto.Float64(2)}}},
+		},
+	}
+
+	for _, format := range []Format{FmtProtoDelim, FmtText, FmtOpenMetrics_1_0_0} {
+		t.Run(string(format), func(t *testing.T) {
+			var buf bytes.Buffer
+			enc := NewEncoder(&buf, format)
+			for _, mf := range families {
+				if err := enc.Encode(mf); err != nil {
+					t.Fatalf("unexpected error during encode: %s", err)
+				}
+			}
+			if err := enc.(Closer).Close(); err != nil {
+				t.Fatalf("unexpected error during close: %s", err)
+			}
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			dec := NewDecoder(&buf, format).(ContextDecoder)
+			if err := dec.DecodeContext(ctx, &dto.MetricFamily{}); err != nil {
+				t.Fatalf("unexpected error decoding the first family: %s", err)
+			}
+			cancel()
+			if err := dec.DecodeContext(ctx, &dto.MetricFamily{}); !errors.Is(err, context.Canceled) {
+				t.Fatalf("expected %v, got %v", context.Canceled, err)
+			}
+
+			// Decoding continues with a context that is not done.
+			var mf dto.MetricFamily
+			if err := dec.DecodeContext(context.Background(), &mf); err != nil {
+				t.Fatalf("unexpected error decoding the second family: %s", err)
+			}
+			if err := dec.DecodeContext(context.Background(), &dto.MetricFamily{}); !errors.Is(err, io.EOF) {
+				t.Errorf("expected %v, got %v", io.EOF, err)
+			}
+		})
+	}
+}
+
 func TestDiscriminatorHTTPHeader(t *testing.T) {
 	testDiscriminatorHTTPHeader(t)
 }
@@ -566,6 +763,155 @@ func TestExtractSamples(t *testing.T) {
 	}
 }
 
+func TestExtractSamplesEscaping(t *testing.T) {
+	fams := []*dto.MetricFamily{
+		{
+			Name: proto.String("my.summary"),
+			Type: dto.MetricType_SUMMARY.Enum(),
+			Metric: []*dto.Metric{
+				{
+					Label: []*dto.LabelPair{{Name: proto.String("some.label"), Value: proto.String("a")}},
+					Summary: &dto.Summary{
+						SampleCount: proto.Uint64(2),
+						SampleSum:   proto.Float64(3),
+						Quantile:    []*dto.Quantile{{Quantile: proto.Float64(0.5), Value: proto.Float64(1)}},
+					},
+				},
+			},
+		},
+		{
+			Name: proto.String("my.histogram"),
+			Type: dto.MetricType_HISTOGRAM.Enum(),
+			Metric: []*dto.Metric{
+				{
+					Histogram: &dto.Histogram{
+						SampleCount: proto.Uint64(2),
+						SampleSum:   proto.Float64(3),
+						Bucket:      []*dto.Bucket{{UpperBound: proto.Float64(1), CumulativeCount: proto.Uint64(1)}},
+					},
+				},
+			},
+		},
+		{
+			Name: proto.String("legacy_gauge"),
+			Type: dto.MetricType_GAUGE.Enum(),
+			Metric: []*dto.Metric{
+				{Gauge: &dto.Gauge{Value: proto.Float64(1)}},
+			},
+		},
+	}
+
+	scenarios := []struct {
+		name  string
+		opts  *DecodeOptions
+		names []model.Metric
+	}{
+		{
+			name: "no escaping",
+			opts: &DecodeOptions{Timestamp: 42},
+			names: []model.Metric{
+				{model.MetricNameLabel: "my.summary", "some.label": "a", model.QuantileLabel: "0.5"},
+				{model.MetricNameLabel: "my.summary_sum", "some.label": "a"},
+				{model.MetricNameLabel: "my.summary_count", "some.label": "a"},
+				{model.MetricNameLabel: "my.histogram_bucket", model.BucketLabel: "1"},
+				{model.MetricNameLabel: "my.histogram_sum"},
+				{model.MetricNameLabel: "my.histogram_count"},
+				{model.MetricNameLabel: "my.histogram_bucket", model.BucketLabel: "+Inf"},
+				{model.MetricNameLabel: "legacy_gauge"},
+			},
+		},
+		{
+			name: "no escaping does not add original names",
+			opts: &DecodeOptions{Timestamp: 42, RetainOriginalName: true},
+			names: []model.Metric{
+				{model.MetricNameLabel: "my.summary", "some.label": "a", model.QuantileLabel: "0.5"},
+				{model.MetricNameLabel: "my.summary_sum", "some.label": "a"},
+				{model.MetricNameLabel: "my.summary_count", "some.label": "a"},
+				{model.MetricNameLabel: "my.histogram_bucket", model.BucketLabel: "1"},
+				{model.MetricNameLabel: "my.histogram_sum"},
+				{model.MetricNameLabel: "my.histogram_count"},
+				{model.MetricNameLabel: "my.histogram_bucket", model.BucketLabel: "+Inf"},
+				{model.MetricNameLabel: "legacy_gauge"},
+			},
+		},
+		{
+			name: "underscore escaping",
+			opts: &DecodeOptions{Timestamp: 42, EscapingScheme: model.UnderscoreEscaping},
+			names: []model.Metric{
+				{model.MetricNameLabel: "my_summary", "some_label": "a", model.QuantileLabel: "0.5"},
+				{model.MetricNameLabel: "my_summary_sum", "some_label": "a"},
+				{model.MetricNameLabel: "my_summary_count", "some_label": "a"},
+				{model.MetricNameLabel: "my_histogram_bucket", model.BucketLabel: "1"},
+				{model.MetricNameLabel: "my_histogram_sum"},
+				{model.MetricNameLabel: "my_histogram_count"},
+				{model.MetricNameLabel: "my_histogram_bucket", model.BucketLabel: "+Inf"},
+				{model.MetricNameLabel: "legacy_gauge"},
+			},
+		},
+		{
+			name: "value escaping with original names",
+			opts: &DecodeOptions{Timestamp: 42, EscapingScheme: model.ValueEncodingEscaping, RetainOriginalName: true},
+			names: []model.Metric{
+				{model.MetricNameLabel: "U__my_2e_summary", OriginalNameLabel: "my.summary", "U__some_2e_label": "a", model.QuantileLabel: "0.5"},
+				{model.MetricNameLabel: "U__my_2e_summary_sum", OriginalNameLabel: "my.summary_sum", "U__some_2e_label": "a"},
+				{model.MetricNameLabel: "U__my_2e_summary_count", OriginalNameLabel: "my.summary_count", "U__some_2e_label": "a"},
+				{model.MetricNameLabel: "U__my_2e_histogram_bucket", OriginalNameLabel: "my.histogram_bucket", model.BucketLabel: "1"},
+				{model.MetricNameLabel: "U__my_2e_histogram_sum", OriginalNameLabel: "my.histogram_sum"},
+				{model.MetricNameLabel: "U__my_2e_histogram_count", OriginalNameLabel: "my.histogram_count"},
+				{model.MetricNameLabel: "U__my_2e_histogram_bucket", OriginalNameLabel: "my.histogram_bucket", model.BucketLabel: "+Inf"},
+				{model.MetricNameLabel: "legacy_gauge"},
+			},
+		},
+	}
+
+	for _, scenario := range scenarios {
+		t.Run(scenario.name, func(t *testing.T) {
+			got, err := ExtractSamples(scenario.opts, fams...)
+			if err != nil {
+				t.Fatal("Unexpected error from ExtractSamples:", err)
+			}
+			if len(got) != len(scenario.names) {
+				t.Fatalf("expected %d samples, got %d: %v", len(scenario.names), len(got), got)
+			}
+			for i, want := range scenario.names {
+				if !got[i].Metric.Equal(want) {
+					t.Errorf("%d: expected metric %v, got %v", i, want, got[i].Metric)
+				}
+			}
+		})
+	}
+}
+
+func TestExtractSamplesEscapingCollisions(t *testing.T) {
+	fam := &dto.MetricFamily{
+		Name: proto.String("my.gauge"),
+		Type: dto.MetricType_GAUGE.Enum(),
+		Metric: []*dto.Metric{
+			{
+				Label: []*dto.LabelPair{
+					{Name: proto.String("a.b"), Value: proto.String("escaped")},
+					{Name: proto.String("a_b"), Value: proto.String("unchanged")},
+				},
+				Gauge: &dto.Gauge{Value: proto.Float64(1)},
+			},
+		},
+	}
+	for _, scheme := range []model.EscapingScheme{model.UnderscoreEscaping, model.DotsEscaping, model.ValueEncodingEscaping} {
+		got, err := ExtractSamples(&DecodeOptions{Timestamp: 42, EscapingScheme: scheme}, fam)
+		if err != nil {
+			t.Fatal("Unexpected error from ExtractSamples:", err)
+		}
+		want := model.LabelSet{
+			model.MetricNameLabel: "my.gauge",
+			"a.b":                 "escaped",
+			"a_b":                 "unchanged",
+		}.Escape(scheme)
+		if len(got) != 1 || !got[0].Metric.Equal(model.Metric(want)) {
+			t.Errorf("%s: expected metric %v, got %v", scheme, want, got)
+		}
+	}
+}
+
 func TestTextDecoderWithBufioReader(t *testing.T) {
 	example := `
 	# TYPE foo gauge
@@ -595,3 +941,164 @@ func TestTextDecoderWithBufioReader(t *testing.T) {
 		t.Fatal("Metric foo not decoded")
 	}
 }
+
+func TestTextDecoderWithBOM(t *testing.T) {
+	example := "\xef\xbb\xbf# TYPE foo gauge\nfoo 1\nbar{label=\"value\"} 2\n"
+
+	dec := NewDecoder(strings.NewReader(example), FmtText)
+	got := map[string]int{}
+	for {
+		var mf dto.MetricFamily
+		if err := dec.Decode(&mf); err != nil {
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		got[mf.GetName()] = len(mf.Metric)
+	}
+	if expected := map[string]int{"foo": 1, "bar": 1}; !reflect.DeepEqual(got, expected) {
+		t.Errorf("Unexpected metric families: got %v, expected %v", got, expected)
+	}
+
+	// A BOM anywhere but at the start is still an error.
+	var p TextParser
+	if _, err := p.TextToMetricFamilies(strings.NewReader("foo 1\n\xef\xbb\xbfbar 2\n")); err == nil {
+		t.Error("Expected error for BOM in the middle of the input")
+	}
+}
+
+func TestDecodeEach(t *testing.T) {
+	example := `# TYPE foo gauge
+foo 1
+# TYPE bar counter
+bar{label="a"} 2
+bar{label="b"} 3
+baz 4
+`
+
+	got := map[string]int{}
+	err := DecodeEach(NewDecoder(strings.NewReader(example), FmtText), func(mf *dto.MetricFamily) error {
+		got[mf.GetName()] = len(mf.Metric)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if expected := map[string]int{"foo": 1, "bar": 2, "baz": 1}; !reflect.DeepEqual(got, expected) {
+		t.Errorf("Unexpected metric families: got %v, expected %v", got, expected)
+	}
+
+	// An error returned by the callback stops decoding.
+	errStop := errors.New("stop")
+	calls := 0
+	err = DecodeEach(NewDecoder(strings.NewReader(example), FmtText), func(*dto.MetricFamily) error {
+		calls++
+		return errStop
+	})
+	if !errors.Is(err, errStop) {
+		t.Errorf("Expected error %v, got %v", errStop, err)
+	}
+	if calls != 1 {
+		t.Errorf("Expected 1 callback invocation, got %d", calls)
+	}
+
+	// Decoding errors are passed on.
+	err = DecodeEach(NewDecoder(strings.NewReader("foo{ 1\n"), FmtText), func(*dto.MetricFamily) error {
+		return nil
+	})
+	if err == nil {
+		t.Error("Expected a decoding error")
+	}
+
+	// The delimited protobuf format is decoded family by family.
+	var buf bytes.Buffer
+	enc := NewEncoder(&buf, FmtProtoDelim)
+	for _, name := range []string{"foo", "bar"} {
+		if err := enc.Encode(&dto.MetricFamily{
+			Name:   proto.String(name),
+			Type:   dto.MetricType_GAUGE.Enum(),
+			Metric: []*dto.Metric{{Gauge: &dto.Gauge{Value: proto.Float64(1)}}},
+		}); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	}
+	var names []string
+	err = DecodeEach(NewDecoder(&buf, FmtProtoDelim), func(mf *dto.MetricFamily) error {
+		names = append(names, mf.GetName())
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if expected := []string{"foo", "bar"}; !reflect.DeepEqual(names, expected) {
+		t.Errorf("Unexpected metric families: got %v, expected %v", names, expected)
+	}
+}
+
+func TestTextDecoderDecodeEach(t *testing.T) {
+	example := `# TYPE foo gauge
+foo 1
+# TYPE bar counter
+bar{label="a"} 2
+bar{label="b"} 3
+baz 4
+`
+
+	// The text format is streamed in input order, and the families passed to
+	// the callback are not changed by later calls.
+	dec := NewDecoder(strings.NewReader(example), FmtText).(EachDecoder)
+	var got []*dto.MetricFamily
+	if err := dec.DecodeEach(func(mf *dto.MetricFamily) error {
+		got = append(got, mf)
+		return nil
+	}); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	var p TextParser
+	expected, err := p.TextToMetricFamiliesOrdered(strings.NewReader(example))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(got) != len(expected) {
+		t.Fatalf("Expected %d metric families, got %d", len(expected), len(got))
+	}
+	for i := range expected {
+		if !proto.Equal(got[i], expected[i]) {
+			t.Errorf("Expected metric family %v, got %v", expected[i], got[i])
+		}
+	}
+	if err := dec.(Decoder).Decode(&dto.MetricFamily{}); !errors.Is(err, io.EOF) {
+		t.Errorf("Expected io.EOF after DecodeEach, got %v", err)
+	}
+
+	// Interleaved families cannot be streamed.
+	interleaved := "a 1\nb 2\na 3\n"
+	err = DecodeEach(NewDecoder(strings.NewReader(interleaved), FmtText), func(*dto.MetricFamily) error { return nil })
+	var parseErr ParseError
+	if !errors.As(err, &parseErr) {
+		t.Errorf("Expected ParseError, got %v", err)
+	}
+
+	// After Decode, the remaining families are passed on.
+	d := NewDecoder(strings.NewReader(interleaved), FmtText)
+	if err := d.Decode(&dto.MetricFamily{}); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	calls := 0
+	if err := DecodeEach(d, func(*dto.MetricFamily) error {
+		calls++
+		return nil
+	}); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	if calls != 1 {
+		t.Errorf("Expected 1 callback invocation, got %d", calls)
+	}
+
+	// The validation error of the format is returned.
+	err = DecodeEach(NewDecoder(strings.NewReader(example), FmtText+FmtAllowUTF8), func(*dto.MetricFamily) error { return nil })
+	if !errors.Is(err, ErrInvalidContentType) {
+		t.Errorf("Expected error wrapping ErrInvalidContentType, got %v", err)
+	}
+}
@@ -14,12 +14,19 @@
 package expfmt
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
 
 	"google.golang.org/protobuf/encoding/protodelim"
 	"google.golang.org/protobuf/encoding/prototext"
+	"google.golang.org/protobuf/proto"
 
 	"github.com/prometheus/common/model"
 
@@ -40,13 +47,30 @@ type Encoder interface {
 // Closer, too, even if the Close call is a no-op. This happens in preparation
 // for adding a Close method to the Encoder interface directly in a (mildly
 // breaking) release in the future.
+//
+// For the Encoders returned from this package, only the first call of Close
+// has an effect. Further calls are no-ops.
 type Closer interface {
 	Close() error
 }
 
+// EscapingSchemeSetter is implemented by all Encoders returned by NewEncoder.
+// SetEscapingScheme changes the escaping scheme applied by subsequent Encode
+// calls, overriding both the escaping term of the Format and the
+// WithEscapingScheme option. Setting model.NoEscaping passes names outside of
+// the legacy character set through as is, which is only supported by formats
+// that allow UTF-8 names (for OpenMetrics, only version 2.0.0). For other
+// formats, Encode then returns an error or produces output that legacy
+// parsers reject. SetEscapingScheme must not be called concurrently with
+// Encode.
+type EscapingSchemeSetter interface {
+	SetEscapingScheme(model.EscapingScheme)
+}
+
 type encoderCloser struct {
-	encode func(*dto.MetricFamily) error
-	close  func() error
+	encode            func(*dto.MetricFamily) error
+	close             func() error
+	setEscapingScheme func(model.EscapingScheme)
 }
 
 func (ec encoderCloser) Encode(v *dto.MetricFamily) error {
@@ -57,142 +81,845 @@ func (ec encoderCloser) Close() error {
 	return ec.close()
 }
 
+func (ec encoderCloser) SetEscapingScheme(s model.EscapingScheme) {
+	ec.setEscapingScheme(s)
+}
+
+// NegotiationStatus is the detailed outcome of content negotiation as returned
+// by NegotiateWithStatus.
+type NegotiationStatus struct {
+	// Format is the negotiated format, identical to what
+	// NegotiateIncludingOpenMetrics returns for the same header.
+	Format Format
+	// RequestedMediaType is the media type ("type/subtype") of the most
+	// preferred entry of the Accept header, or the empty string if the header
+	// is empty or could not be parsed.
+	RequestedMediaType string
+	// EscapingScheme is the escaping scheme announced by the escaping term of
+	// Format, i.e. what Format.ToEscapingScheme returns for it.
+	EscapingScheme model.EscapingScheme
+}
+
+// OpenMetricsFallback returns true if the client's most preferred media type
+// was OpenMetrics (text or protobuf), but the negotiated format is not
+// OpenMetrics (for example because an unsupported OpenMetrics version was
+// requested and the negotiation fell back to the Prometheus text format).
+func (s NegotiationStatus) OpenMetricsFallback() bool {
+	return (s.RequestedMediaType == OpenMetricsType || s.RequestedMediaType == OpenMetricsProtoType) && !s.Format.IsOpenMetrics()
+}
+
 // Negotiate returns the Content-Type based on the given Accept header. If no
 // appropriate accepted type is found, FmtText is returned (which is the
-// Prometheus text format). This function will never negotiate FmtOpenMetrics,
-// as the support is still experimental. To include the option to negotiate
-// FmtOpenMetrics, use NegotiateOpenMetrics.
+// Prometheus text format). This includes a missing, empty, or malformed Accept
+// header, so FmtUnknown is never returned. This function will never negotiate
+// FmtOpenMetrics, as the support is still experimental. To include the option
+// to negotiate FmtOpenMetrics, use NegotiateOpenMetrics.
+//
+// If the request carries several Accept headers, their entries are combined.
+// Entries are considered in the order of their quality value (the q
+// parameter), and entries with q=0 are never selected. For equal
+// quality values, protobuf and OpenMetrics are preferred over the text format.
+//
+// A version parameter selects exactly that version. A version range of the
+// form version>=x.y.z selects the highest supported version of the media type,
+// provided it is at least x.y.z; otherwise, the entry is skipped.
+//
+// The escaping parameter (see model.EscapingKey) of the selected Accept entry
+// is carried over to the returned Format. An escaping=allow-utf-8 parameter
+// results in names not being escaped. The alternative spellings
+// escaping=allow-utf8, validchars=utf8, and validation-scheme=utf8 are
+// accepted as well, but the returned Format always uses the canonical
+// escaping=allow-utf-8 (see FmtAllowUTF8). If the selected entry has no (or an
+// unknown) escaping parameter, model.GetNameEscapingScheme() is used (but see
+// SetProtoNamesFollowValidationScheme for the protobuf formats).
+//
+// The returned Format always passes Format.Validate. As only version 1.0.0 of
+// the text format and version 2.0.0 of OpenMetrics support names outside of
+// the legacy character set, allow-utf-8 is replaced by the default escaping
+// scheme for earlier versions, or by model.ValueEncodingEscaping if the default
+// is model.NoEscaping. With model.NoEscaping as the default, the fallback
+// format is FmtText_1_0_0 rather than FmtText.
 func Negotiate(h http.Header) Format {
-	escapingScheme := Format(fmt.Sprintf("; escaping=%s", Format(model.NameEscapingScheme.String())))
-	for _, ac := range goautoneg.ParseAccept(h.Get(hdrAccept)) {
-		if escapeParam := ac.Params[model.EscapingKey]; escapeParam != "" {
-			switch Format(escapeParam) {
-			case model.AllowUTF8, model.EscapeUnderscores, model.EscapeDots, model.EscapeValues:
-				escapingScheme = Format(fmt.Sprintf("; escaping=%s", escapeParam))
-			default:
-				// If the escaping parameter is unknown, ignore it.
-			}
-		}
-		ver := ac.Params["version"]
-		if ac.Type+"/"+ac.SubType == ProtoType && ac.Params["proto"] == ProtoProtocol {
-			switch ac.Params["encoding"] {
-			case "delimited":
-				return FmtProtoDelim + escapingScheme
-			case "text":
-				return FmtProtoText + escapingScheme
-			case "compact-text":
-				return FmtProtoCompact + escapingScheme
-			}
+	return negotiate(h, false).Format
+}
+
+// ErrNotAcceptable is returned (wrapped) by NegotiateStrict if the Accept
+// header names no supported format. HTTP handlers should respond with status
+// 406 (Not Acceptable) in that case, listing SupportedMediaTypes in the body.
+var ErrNotAcceptable = errors.New("no acceptable format")
+
+// NegotiateStrict works like NegotiateIncludingOpenMetrics, but instead of
+// falling back to FmtText, it returns an error wrapping ErrNotAcceptable if
+// none of the entries of the Accept header names a supported format. A
+// missing or empty Accept header means that the client accepts any format
+// (RFC 7231, section 5.3.2), so FmtText is returned in that case, as it is for
+// a */* or text/* entry.
+func NegotiateStrict(h http.Header) (Format, error) {
+	header := acceptHeader(h)
+	defaultFormat, _ := fallbackFormat(model.GetNameEscapingScheme())
+	if strings.TrimSpace(header) == "" {
+		return defaultFormat, nil
+	}
+	for _, ac := range parseAccept(header) {
+		if f, _, ok := acceptFormat(ac, true, model.GetNameEscapingScheme()); ok {
+			return f, nil
 		}
-		if ac.Type == "text" && ac.SubType == "plain" && (ver == TextVersion || ver == "") {
-			return FmtText + escapingScheme
+		if ac.Type == "*" || (ac.Type == "text" && ac.SubType == "*") {
+			return defaultFormat, nil
 		}
 	}
-	return FmtText + escapingScheme
+	return FmtUnknown, fmt.Errorf("%w: %q", ErrNotAcceptable, header)
+}
+
+// SupportedMediaTypes returns the media types, including the parameters
+// selecting protocol, encoding, and version, that NegotiateStrict accepts. It
+// is meant for the body of a 406 (Not Acceptable) response. The returned slice
+// is newly allocated on each call.
+func SupportedMediaTypes() []string {
+	protoDelim := ProtoType + ";proto=" + ProtoProtocol + ";encoding="
+	return []string{
+		protoDelim + "delimited",
+		protoDelim + "text",
+		protoDelim + "compact-text",
+		"text/plain;version=" + TextVersion,
+		"text/plain;version=" + TextVersion_1_0_0,
+		OpenMetricsType + ";version=" + OpenMetricsVersion_0_0_1,
+		OpenMetricsType + ";version=" + OpenMetricsVersion_1_0_0,
+		OpenMetricsType + ";version=" + OpenMetricsVersion_2_0_0,
+		OpenMetricsProtoType + ";version=" + OpenMetricsVersion_1_0_0,
+	}
+}
+
+// DefaultAcceptHeader returns the Accept header that a scraper built on this
+// package should send. It prefers the delimited protobuf format, followed by
+// the text format and OpenMetrics, and finally accepts any other media type.
+// If allowUTF8 is true, each entry carries escaping=allow-utf-8 and the text
+// and OpenMetrics entries ask for the versions supporting UTF-8 names (text
+// 1.0.0 and OpenMetrics 2.0.0, followed by OpenMetrics 1.0.0 as a fallback).
+func DefaultAcceptHeader(allowUTF8 bool) string {
+	protoDelim := ProtoType + ";proto=" + ProtoProtocol + ";encoding=delimited"
+	if !allowUTF8 {
+		return strings.Join([]string{
+			protoDelim + ";q=0.6",
+			"text/plain;version=" + TextVersion + ";q=0.5",
+			OpenMetricsType + ";version=" + OpenMetricsVersion_1_0_0 + ";q=0.4",
+			OpenMetricsType + ";version=" + OpenMetricsVersion_0_0_1 + ";q=0.3",
+			"*/*;q=0.2",
+		}, ",")
+	}
+	allow := ";" + model.EscapingKey + "=" + model.AllowUTF8
+	return strings.Join([]string{
+		protoDelim + allow + ";q=0.6",
+		"text/plain;version=" + TextVersion_1_0_0 + allow + ";q=0.5",
+		OpenMetricsType + ";version=" + OpenMetricsVersion_2_0_0 + allow + ";q=0.4",
+		OpenMetricsType + ";version=" + OpenMetricsVersion_1_0_0 + ";q=0.3",
+		"*/*;q=0.2",
+	}, ",")
 }
 
 // NegotiateIncludingOpenMetrics works like Negotiate but includes
 // FmtOpenMetrics as an option for the result. Note that this function is
 // temporary and will disappear once FmtOpenMetrics is fully supported and as
 // such may be negotiated by the normal Negotiate function.
+//
+// The experimental OpenMetrics protobuf format (FmtOpenMetricsProto) is
+// negotiated by this function as well if the client asks for
+// application/openmetrics-protobuf.
 func NegotiateIncludingOpenMetrics(h http.Header) Format {
-	escapingScheme := Format(fmt.Sprintf("; escaping=%s", Format(model.NameEscapingScheme.String())))
-	for _, ac := range goautoneg.ParseAccept(h.Get(hdrAccept)) {
-		if escapeParam := ac.Params[model.EscapingKey]; escapeParam != "" {
-			switch Format(escapeParam) {
-			case model.AllowUTF8, model.EscapeUnderscores, model.EscapeDots, model.EscapeValues:
-				escapingScheme = Format(fmt.Sprintf("; escaping=%s", escapeParam))
-			default:
-				// If the escaping parameter is unknown, ignore it.
+	return negotiate(h, true).Format
+}
+
+// NegotiateWithStatus works like NegotiateIncludingOpenMetrics but returns a
+// NegotiationStatus, which additionally records the media type the client
+// originally asked for.
+func NegotiateWithStatus(h http.Header) NegotiationStatus {
+	return negotiate(h, true)
+}
+
+// NegotiateWithEscaping works like Negotiate, but additionally returns the
+// escaping scheme announced by the escaping term of the returned Format, so
+// that callers escaping names themselves do not need to parse the Format
+// again. The returned scheme always equals what Format.ToEscapingScheme
+// returns for the returned Format.
+func NegotiateWithEscaping(h http.Header) (Format, model.EscapingScheme) {
+	status := negotiate(h, false)
+	return status.Format, status.EscapingScheme
+}
+
+// NegotiateIncludingOpenMetricsWithEscaping works like NegotiateWithEscaping,
+// but includes the OpenMetrics formats as NegotiateIncludingOpenMetrics does.
+func NegotiateIncludingOpenMetricsWithEscaping(h http.Header) (Format, model.EscapingScheme) {
+	status := negotiate(h, true)
+	return status.Format, status.EscapingScheme
+}
+
+// NegotiateAndEscape negotiates the Format like Negotiate and returns fams
+// escaped with the escaping scheme of that Format (see
+// Format.ToEscapingScheme), e.g. unchanged for a client sending
+// escaping=allow-utf-8 (or validchars=utf8) and escaped with underscores for a
+// client sending escaping=underscores. fams itself is not modified (see
+// model.EscapeMetricFamilies).
+//
+// Escaping never changes names that are valid legacy names, and every
+// non-empty escaped name is a valid legacy name. Unless the scheme is
+// model.NoEscaping, all names in the returned families are thus valid legacy
+// names, which an Encoder for the returned Format leaves unchanged. Encoding
+// them with WithEscapingScheme(model.NoEscaping) produces the same output and
+// merely skips that check:
+//
+//	format, escaped := expfmt.NegotiateAndEscape(req.Header, fams)
+//	w.Header().Set("Content-Type", string(format))
+//	enc := expfmt.NewEncoder(w, format, expfmt.WithEscapingScheme(model.NoEscaping))
+func NegotiateAndEscape(h http.Header, fams []*dto.MetricFamily) (Format, []*dto.MetricFamily) {
+	status := negotiate(h, false)
+	return status.Format, model.EscapeMetricFamilies(fams, status.EscapingScheme)
+}
+
+// NegotiateWithTrace works like NegotiateIncludingOpenMetrics, but additionally
+// returns a human-readable trace of the negotiation for debugging, e.g. to find
+// out why a client did not get the protobuf format. The trace has one entry per
+// entry of the Accept header, in the order in which they were considered,
+// stating whether the entry was selected or why it was not (unsupported media
+// type, unsupported version, q=0, or a more preferred entry having been
+// selected). Entries with q=0 come last, as they are never considered. A final
+// entry reports the fallback format if no entry was selected. The trace is
+// meant for logging; its wording may change.
+func NegotiateWithTrace(h http.Header) (Format, []string) {
+	header := acceptHeader(h)
+	defaultEscapingScheme := model.GetNameEscapingScheme()
+	var (
+		trace    []string
+		selected Format
+	)
+	for _, ac := range parseAccept(header) {
+		switch f, _, ok := acceptFormat(ac, true, defaultEscapingScheme); {
+		case selected != "":
+			trace = append(trace, fmt.Sprintf("%s: not selected, a more preferred entry was selected", describeAccept(ac)))
+		case ok:
+			selected = f
+			trace = append(trace, fmt.Sprintf("%s: selected as %s", describeAccept(ac), f))
+		default:
+			trace = append(trace, fmt.Sprintf("%s: not selected, %s", describeAccept(ac), acceptRejectReason(ac)))
+		}
+	}
+	for _, part := range strings.Split(header, ",") {
+		for _, ac := range goautoneg.ParseAccept(part) {
+			if ac.Q <= 0 {
+				trace = append(trace, fmt.Sprintf("%s: not acceptable (q=0)", describeAccept(ac)))
 			}
 		}
-		ver := ac.Params["version"]
-		if ac.Type+"/"+ac.SubType == ProtoType && ac.Params["proto"] == ProtoProtocol {
-			switch ac.Params["encoding"] {
-			case "delimited":
-				return FmtProtoDelim + escapingScheme
-			case "text":
-				return FmtProtoText + escapingScheme
-			case "compact-text":
-				return FmtProtoCompact + escapingScheme
+	}
+	if selected == "" {
+		selected, _ = fallbackFormat(defaultEscapingScheme)
+		trace = append(trace, fmt.Sprintf("no supported entry, falling back to %s", selected))
+	}
+	return selected, trace
+}
+
+// describeAccept returns the media range of an Accept clause with its
+// parameters (except q) in a deterministic order.
+func describeAccept(ac goautoneg.Accept) string {
+	keys := make([]string, 0, len(ac.Params))
+	for k := range ac.Params {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var b strings.Builder
+	b.WriteString(ac.Type + "/" + ac.SubType)
+	for _, k := range keys {
+		b.WriteString(";" + k + "=" + ac.Params[k])
+	}
+	return b.String()
+}
+
+// acceptRejectReason returns why acceptFormat (with OpenMetrics included)
+// rejected the clause.
+func acceptRejectReason(ac goautoneg.Accept) string {
+	mediaType := ac.Type + "/" + ac.SubType
+	if minVer, isRange := versionRange(ac.Params); isRange && ac.Params["version"] == "" {
+		if _, versioned := acceptVersions[mediaType]; versioned {
+			return fmt.Sprintf("no supported version satisfies version>=%s", minVer)
+		}
+	}
+	switch {
+	case ac.Type == "*" || ac.SubType == "*":
+		return "wildcard media range, only served by the fallback format"
+	case mediaType == ProtoType && ac.Params["proto"] != ProtoProtocol:
+		return fmt.Sprintf("unsupported proto %q", ac.Params["proto"])
+	case mediaType == ProtoType:
+		return fmt.Sprintf("unsupported encoding %q", ac.Params["encoding"])
+	}
+	if _, versioned := acceptVersions[mediaType]; versioned {
+		return fmt.Sprintf("unsupported version %q", ac.Params["version"])
+	}
+	return "unsupported media type"
+}
+
+// NegotiateWithPreference works like NegotiateIncludingOpenMetrics, but lets
+// the server decide between the formats the client accepts: Among all entries
+// of the Accept header, the format whose FormatType comes first in prefs is
+// selected, independent of the order in which the client listed them. The
+// escaping parameter of the selected entry is carried over as in Negotiate. If
+// the client accepts none of the preferred types, FmtText is returned. An empty
+// prefs slice makes this function behave exactly like Negotiate, i.e. the
+// client's order of preference applies and OpenMetrics is not negotiated.
+func NegotiateWithPreference(h http.Header, prefs []FormatType) Format {
+	if len(prefs) == 0 {
+		return Negotiate(h)
+	}
+	defaultEscapingScheme := model.GetNameEscapingScheme()
+	var candidates []Format
+	for _, ac := range parseAccept(acceptHeader(h)) {
+		if f, _, ok := acceptFormat(ac, true, defaultEscapingScheme); ok {
+			candidates = append(candidates, f)
+		}
+	}
+	for _, pref := range prefs {
+		for _, f := range candidates {
+			if f.FormatType() == pref {
+				return f
+			}
+		}
+	}
+	f, _ := fallbackFormat(defaultEscapingScheme)
+	return f
+}
+
+// NegotiateWithCache works like Negotiate, but caches the parsed Accept header
+// in the returned context. Further calls with that context (or one derived
+// from it) and the same Accept header reuse the cached result instead of
+// parsing the header again, which is useful for middleware that negotiates
+// several times per request.
+func NegotiateWithCache(ctx context.Context, h http.Header) (context.Context, Format) {
+	header := acceptHeader(h)
+	if cached, ok := ctx.Value(acceptCacheKey{}).(*acceptCache); ok && cached.header == header {
+		return ctx, negotiateAccept(cached.clauses, false).Format
+	}
+	cached := &acceptCache{header: header, clauses: parseAccept(header)}
+	return context.WithValue(ctx, acceptCacheKey{}, cached), negotiateAccept(cached.clauses, false).Format
+}
+
+type acceptCacheKey struct{}
+
+// acceptCache holds a parsed Accept header for NegotiateWithCache.
+type acceptCache struct {
+	header  string
+	clauses []goautoneg.Accept
+}
+
+// acceptHeader returns all values of the Accept header in h, joined into a
+// single comma-separated list as permitted by RFC 7230, section 3.2.2.
+func acceptHeader(h http.Header) string {
+	return strings.Join(h.Values(hdrAccept), ",")
+}
+
+// parseAccept parses the value of an Accept header into its clauses, sorted by
+// preference. It is a variable so that tests can observe its invocations.
+//
+// Clauses are sorted by descending quality value (RFC 7231, section 5.3.1).
+// Clauses with q=0 are not acceptable and are dropped. For equal quality
+// values, clauses for protobuf and OpenMetrics come first, and otherwise the
+// order of the header is retained. (goautoneg.ParseAccept sorts as well, but
+// neither stably nor consistently, so the clauses are parsed one at a time
+// here.)
+var parseAccept = func(header string) []goautoneg.Accept {
+	var clauses []goautoneg.Accept
+	for _, part := range strings.Split(header, ",") {
+		for _, ac := range goautoneg.ParseAccept(part) {
+			if ac.Q > 0 {
+				clauses = append(clauses, ac)
+			}
+		}
+	}
+	sort.SliceStable(clauses, func(i, j int) bool {
+		if clauses[i].Q != clauses[j].Q {
+			return clauses[i].Q > clauses[j].Q
+		}
+		return isRichAccept(clauses[i]) && !isRichAccept(clauses[j])
+	})
+	return clauses
+}
+
+// isRichAccept returns true if the clause asks for protobuf or OpenMetrics,
+// which are preferred over the text format at equal quality values.
+func isRichAccept(ac goautoneg.Accept) bool {
+	mediaType := ac.Type + "/" + ac.SubType
+	return mediaType == ProtoType || mediaType == OpenMetricsType || mediaType == OpenMetricsProtoType
+}
+
+func negotiate(h http.Header, includeOpenMetrics bool) NegotiationStatus {
+	return negotiateAccept(parseAccept(acceptHeader(h)), includeOpenMetrics)
+}
+
+func negotiateAccept(clauses []goautoneg.Accept, includeOpenMetrics bool) NegotiationStatus {
+	var status NegotiationStatus
+	defaultEscapingScheme := model.GetNameEscapingScheme()
+	for i, ac := range clauses {
+		if i == 0 {
+			status.RequestedMediaType = ac.Type + "/" + ac.SubType
+		}
+		if f, scheme, ok := acceptFormat(ac, includeOpenMetrics, defaultEscapingScheme); ok {
+			status.Format, status.EscapingScheme = f, scheme
+			return status
+		}
+	}
+	status.Format, status.EscapingScheme = fallbackFormat(defaultEscapingScheme)
+	return status
+}
+
+// acceptFormat returns the Format to use for a single clause of an Accept
+// header along with the escaping scheme announced by its escaping term, and
+// false if the clause names no supported format.
+func acceptFormat(ac goautoneg.Accept, includeOpenMetrics bool, defaultEscapingScheme model.EscapingScheme) (Format, model.EscapingScheme, bool) {
+	// Only the escaping parameter of the selected clause applies, so that
+	// e.g. an allow-utf-8 request for an unsupported media type does not
+	// leak into the format that is eventually negotiated.
+	escapingScheme := defaultEscapingScheme
+	// If the escaping parameter is unknown, ignore it.
+	escapeParam, err := escapingParam(ac.Params)
+	if err == nil {
+		switch escapeParam {
+		case model.AllowUTF8, model.EscapeUnderscores, model.EscapeDots, model.EscapeValues:
+			escapingScheme, _ = model.ToEscapingScheme(escapeParam)
+		}
+	}
+	mediaType := ac.Type + "/" + ac.SubType
+	if err == nil && escapeParam == "" && (mediaType == ProtoType || mediaType == OpenMetricsProtoType) &&
+		protoNamesFollowValidation.Load() && model.GetNameValidationScheme() != model.LegacyValidation {
+		escapingScheme = model.NoEscaping
+	}
+	term := escapingTerm(escapingScheme)
+	ver := ac.Params["version"]
+	if minVer, isRange := versionRange(ac.Params); isRange && ver == "" {
+		if versions, versioned := acceptVersions[mediaType]; versioned {
+			var found bool
+			if ver, found = highestVersion(versions, minVer); !found {
+				return "", 0, false
 			}
 		}
-		if ac.Type == "text" && ac.SubType == "plain" && (ver == TextVersion || ver == "") {
-			return FmtText + escapingScheme
+	}
+	if mediaType == ProtoType && ac.Params["proto"] == ProtoProtocol {
+		switch ac.Params["encoding"] {
+		case "delimited":
+			return FmtProtoDelim + term, escapingScheme, true
+		case "text":
+			return FmtProtoText + term, escapingScheme, true
+		case "compact-text":
+			return FmtProtoCompact + term, escapingScheme, true
 		}
-		if ac.Type+"/"+ac.SubType == OpenMetricsType && (ver == OpenMetricsVersion_0_0_1 || ver == OpenMetricsVersion_1_0_0 || ver == "") {
-			switch ver {
-			case OpenMetricsVersion_1_0_0:
-				return FmtOpenMetrics_1_0_0 + escapingScheme
-			default:
-				return FmtOpenMetrics_0_0_1 + escapingScheme
+	}
+	if ac.Type == "text" && ac.SubType == "plain" {
+		switch ver {
+		case TextVersion, "":
+			// Only version 1.0.0 supports names outside of the legacy
+			// character set.
+			if escapingScheme == model.NoEscaping {
+				escapingScheme = legacyEscapingScheme(defaultEscapingScheme)
+				term = escapingTerm(escapingScheme)
 			}
+			return FmtText + term, escapingScheme, true
+		case TextVersion_1_0_0:
+			return FmtText_1_0_0 + term, escapingScheme, true
+		}
+	}
+	if includeOpenMetrics && mediaType == OpenMetricsType && (ver == OpenMetricsVersion_0_0_1 || ver == OpenMetricsVersion_1_0_0 || ver == OpenMetricsVersion_2_0_0 || ver == "") {
+		// Only OpenMetrics 2.0.0 supports names outside of the legacy
+		// character set.
+		if ver != OpenMetricsVersion_2_0_0 && escapingScheme == model.NoEscaping {
+			escapingScheme = legacyEscapingScheme(defaultEscapingScheme)
+			term = escapingTerm(escapingScheme)
+		}
+		switch ver {
+		case OpenMetricsVersion_1_0_0:
+			return FmtOpenMetrics_1_0_0 + term, escapingScheme, true
+		case OpenMetricsVersion_2_0_0:
+			return FmtOpenMetrics_2_0_0 + term, escapingScheme, true
+		default:
+			return FmtOpenMetrics_0_0_1 + term, escapingScheme, true
+		}
+	}
+	if includeOpenMetrics && mediaType == OpenMetricsProtoType && (ver == OpenMetricsVersion_1_0_0 || ver == "") {
+		return FmtOpenMetricsProto + term, escapingScheme, true
+	}
+	return "", 0, false
+}
+
+// legacyEscapingScheme returns the escaping scheme to use instead of
+// model.NoEscaping for formats that only support names within the legacy
+// character set: defaultEscapingScheme, or model.ValueEncodingEscaping if the
+// default is model.NoEscaping, too.
+func legacyEscapingScheme(defaultEscapingScheme model.EscapingScheme) model.EscapingScheme {
+	if defaultEscapingScheme == model.NoEscaping {
+		return model.ValueEncodingEscaping
+	}
+	return defaultEscapingScheme
+}
+
+// fallbackFormat returns the Format (and its escaping scheme) negotiated if the
+// client accepts no supported format: FmtText with defaultEscapingScheme, or
+// FmtText_1_0_0 if the default is model.NoEscaping, as only version 1.0.0 of
+// the text format supports names outside of the legacy character set.
+func fallbackFormat(defaultEscapingScheme model.EscapingScheme) (Format, model.EscapingScheme) {
+	if defaultEscapingScheme == model.NoEscaping {
+		return FmtText_1_0_0 + escapingTerm(defaultEscapingScheme), defaultEscapingScheme
+	}
+	return FmtText + escapingTerm(defaultEscapingScheme), defaultEscapingScheme
+}
+
+// escapingTerm returns the escaping term announcing scheme in a Format.
+func escapingTerm(scheme model.EscapingScheme) Format {
+	return Format("; " + model.EscapingKey + "=" + scheme.String())
+}
+
+// protoNamesFollowValidation is set by SetProtoNamesFollowValidationScheme.
+var protoNamesFollowValidation atomic.Bool
+
+// SetProtoNamesFollowValidationScheme changes how the negotiation functions of
+// this package treat an Accept entry for a protobuf format (FmtProtoDelim,
+// FmtProtoText, FmtProtoCompact, or FmtOpenMetricsProto) without an escaping
+// parameter (nor one of its alternative spellings). By default, such an entry
+// results in the global default escaping scheme (see
+// model.GetNameEscapingScheme), like for every other format. If enabled is
+// true and the global name validation scheme (see
+// model.GetNameValidationScheme) is not model.LegacyValidation, it results in
+// names not being escaped instead, as protobuf can carry any UTF-8 string.
+// Clients that ask for an escaping scheme explicitly still get it, and with
+// legacy validation, clients without an escaping parameter still get escaped
+// names. It is safe to call this function concurrently with negotiation.
+func SetProtoNamesFollowValidationScheme(enabled bool) {
+	protoNamesFollowValidation.Store(enabled)
+}
+
+// acceptVersions lists, in ascending order and by media type, the versions
+// that a version range in an Accept clause may resolve to.
+var acceptVersions = map[string][]string{
+	"text/plain":         {TextVersion, TextVersion_1_0_0},
+	OpenMetricsType:      {OpenMetricsVersion_0_0_1, OpenMetricsVersion_1_0_0, OpenMetricsVersion_2_0_0},
+	OpenMetricsProtoType: {OpenMetricsVersion_1_0_0},
+}
+
+// versionRange returns the minimum version requested by a "version>=x.y.z"
+// parameter. As goautoneg splits parameters at the first '=', such a
+// parameter shows up under the key "version>".
+func versionRange(params map[string]string) (string, bool) {
+	for k, v := range params {
+		if strings.ReplaceAll(k, " ", "") == "version>" {
+			return v, true
 		}
 	}
-	return FmtText + escapingScheme
+	return "", false
+}
+
+// highestVersion returns the highest of the given ascending versions if it is
+// at least minVer, and false if it is not or minVer cannot be parsed.
+func highestVersion(versions []string, minVer string) (string, bool) {
+	lowest, ok := parseVersion(minVer)
+	if !ok {
+		return "", false
+	}
+	highest := versions[len(versions)-1]
+	if v, _ := parseVersion(highest); compareVersions(v, lowest) < 0 {
+		return "", false
+	}
+	return highest, true
+}
+
+// parseVersion parses a version of the form major.minor.patch.
+func parseVersion(s string) ([3]int, bool) {
+	var v [3]int
+	parts := strings.Split(s, ".")
+	if len(parts) != len(v) {
+		return v, false
+	}
+	for i, p := range parts {
+		n, err := strconv.Atoi(p)
+		if err != nil || n < 0 {
+			return v, false
+		}
+		v[i] = n
+	}
+	return v, true
+}
+
+// compareVersions returns -1, 0, or 1 if a is lower than, equal to, or higher
+// than b, respectively.
+func compareVersions(a, b [3]int) int {
+	for i := range a {
+		switch {
+		case a[i] < b[i]:
+			return -1
+		case a[i] > b[i]:
+			return 1
+		}
+	}
+	return 0
 }
 
 // NewEncoder returns a new encoder based on content type negotiation. All
-// Encoder implementations returned by NewEncoder also implement Closer, and
-// callers should always call the Close method. It is currently only required
+// Encoder implementations returned by NewEncoder also implement Closer and
+// EscapingSchemeSetter, and callers should always call the Close method. It is currently only required
 // for FmtOpenMetrics, but a future (breaking) release will add the Close method
 // to the Encoder interface directly. The current version of the Encoder
 // interface is kept for backwards compatibility.
 // In cases where the Format does not allow for UTF-8 names, the global
-// NameEscapingScheme will be applied.
+// default escaping scheme (see model.GetNameEscapingScheme) will be applied.
 //
 // NewEncoder can be called with additional options to customize the OpenMetrics text output.
 // For example:
 // NewEncoder(w, FmtOpenMetrics_1_0_0, WithCreatedLines())
 //
-// Extra options are ignored for all other formats.
+// WithEscapingScheme, WithEscaper, WithValidationScheme, WithDefaultHelp, and
+// WithoutStaleSamples apply to all formats. WithoutRepeatedMetadata applies to
+// the text formats. All other extra options are ignored for formats other than
+// OpenMetrics. model.PercentEscaping is not an escaping scheme of the
+// exposition formats, so Encode returns an error if it is set with
+// WithEscapingScheme or SetEscapingScheme.
+//
+// The text format encoder writes names outside of the legacy character set in
+// the quoted syntax. FmtText_1_0_0 is the format that announces this syntax
+// to clients; for names within the legacy character set, its output is
+// identical to FmtText.
+//
+// Metric and label names outside of the legacy character set are written in
+// the quoted syntax by the OpenMetrics encoder only for OpenMetrics version
+// 2.0.0. For earlier OpenMetrics versions, Encode returns an error if such a
+// name remains after escaping.
+//
+// If the format is recognized but fails Format.Validate, e.g. FmtText with an
+// escaping=allow-utf-8 term, every call of Encode returns the validation error.
+// The formats returned by the Negotiate functions always pass Format.Validate.
 func NewEncoder(w io.Writer, format Format, options ...EncoderOption) Encoder {
+	toEnc := encoderOption{}
+	for _, option := range options {
+		option(&toEnc)
+	}
 	escapingScheme := format.ToEscapingScheme()
+	if toEnc.withEscapingScheme {
+		escapingScheme = toEnc.escapingScheme
+	}
+	// prepare applies the options to v before encoding. If lazy is true, the
+	// names are not escaped here. Instead, the returned nameEscaper is to be
+	// used by the text-based writers to escape names while writing them.
+	prepare := func(v *dto.MetricFamily, lazy bool) (*dto.MetricFamily, *nameEscaper, error) {
+		if escapingScheme == model.PercentEscaping {
+			// Its output is neither a legacy name nor meant to be quoted.
+			return nil, nil, fmt.Errorf("escaping scheme %s cannot be used for exposition", escapingScheme)
+		}
+		if toEnc.defaultHelp != nil && v.GetHelp() == "" {
+			if help := toEnc.defaultHelp(v.GetName()); help != "" {
+				v = &dto.MetricFamily{
+					Name:   v.Name,
+					Help:   proto.String(help),
+					Type:   v.Type,
+					Unit:   v.Unit,
+					Metric: v.Metric,
+				}
+			}
+		}
+		if toEnc.withoutStaleSamples {
+			if v = dropStaleMetrics(v); v == nil {
+				// Nothing left to encode.
+				return nil, nil, nil
+			}
+		}
+		var escaper *model.Escaper
+		if toEnc.escaper != nil && toEnc.escaper.Scheme() == escapingScheme {
+			escaper = toEnc.escaper
+		}
+		var esc *nameEscaper
+		switch {
+		case lazy:
+			esc = newNameEscaper(escapingScheme)
+			if esc != nil {
+				esc.shared = escaper
+			}
+		case escaper != nil:
+			v = escaper.EscapeMetricFamily(v)
+		default:
+			v = model.EscapeMetricFamily(v, escapingScheme)
+		}
+		if toEnc.withValidationScheme {
+			if err := validateMetricFamily(v, toEnc.validationScheme, esc); err != nil {
+				return nil, nil, err
+			}
+		}
+		return v, esc, nil
+	}
+	setEscapingScheme := func(s model.EscapingScheme) {
+		escapingScheme = s
+	}
+	// emitMetadata reports whether the metadata of v is to be written, and
+	// records its name for WithoutRepeatedMetadata.
+	var emitted map[string]struct{}
+	emitMetadata := func(v *dto.MetricFamily) bool {
+		if !toEnc.withoutRepeatedMetadata {
+			return true
+		}
+		if _, ok := emitted[v.GetName()]; ok {
+			return false
+		}
+		if emitted == nil {
+			emitted = map[string]struct{}{}
+		}
+		emitted[v.GetName()] = struct{}{}
+		return true
+	}
 
+	if err := format.Validate(); err != nil && format.FormatType() != TypeUnknown {
+		return encoderCloser{
+			encode:            func(*dto.MetricFamily) error { return err },
+			close:             func() error { return nil },
+			setEscapingScheme: setEscapingScheme,
+		}
+	}
 	switch format.FormatType() {
-	case TypeProtoDelim:
+	case TypeProtoDelim, TypeOpenMetricsProto:
 		return encoderCloser{
 			encode: func(v *dto.MetricFamily) error {
-				_, err := protodelim.MarshalTo(w, v)
+				v, _, err := prepare(v, false)
+				if err != nil || v == nil {
+					return err
+				}
+				_, err = protodelim.MarshalTo(w, v)
 				return err
 			},
-			close: func() error { return nil },
+			close:             func() error { return nil },
+			setEscapingScheme: setEscapingScheme,
 		}
 	case TypeProtoCompact:
 		return encoderCloser{
 			encode: func(v *dto.MetricFamily) error {
-				_, err := fmt.Fprintln(w, model.EscapeMetricFamily(v, escapingScheme).String())
+				v, _, err := prepare(v, false)
+				if err != nil || v == nil {
+					return err
+				}
+				_, err = fmt.Fprintln(w, v.String())
 				return err
 			},
-			close: func() error { return nil },
+			close:             func() error { return nil },
+			setEscapingScheme: setEscapingScheme,
 		}
 	case TypeProtoText:
 		return encoderCloser{
 			encode: func(v *dto.MetricFamily) error {
-				_, err := fmt.Fprintln(w, prototext.Format(model.EscapeMetricFamily(v, escapingScheme)))
+				v, _, err := prepare(v, false)
+				if err != nil || v == nil {
+					return err
+				}
+				_, err = fmt.Fprintln(w, prototext.Format(v))
 				return err
 			},
-			close: func() error { return nil },
+			close:             func() error { return nil },
+			setEscapingScheme: setEscapingScheme,
 		}
 	case TypeTextPlain:
 		return encoderCloser{
 			encode: func(v *dto.MetricFamily) error {
-				_, err := MetricFamilyToText(w, model.EscapeMetricFamily(v, escapingScheme))
+				v, esc, err := prepare(v, true)
+				if err != nil || v == nil {
+					return err
+				}
+				_, err = metricFamilyToText(w, v, esc, emitMetadata(v))
 				return err
 			},
-			close: func() error { return nil },
+			close:             func() error { return nil },
+			setEscapingScheme: setEscapingScheme,
 		}
 	case TypeOpenMetrics:
+		utf8Names := format.Version() == OpenMetricsVersion_2_0_0
+		// Only the first Close writes the final "# EOF" line.
+		var closed bool
 		return encoderCloser{
 			encode: func(v *dto.MetricFamily) error {
-				_, err := MetricFamilyToOpenMetrics(w, model.EscapeMetricFamily(v, escapingScheme), options...)
+				v, esc, err := prepare(v, true)
+				if err != nil || v == nil {
+					return err
+				}
+				if !utf8Names {
+					if err := validateMetricFamily(v, model.LegacyValidation, esc); err != nil {
+						return fmt.Errorf("%w: names outside of the legacy character set require OpenMetrics version %s", err, OpenMetricsVersion_2_0_0)
+					}
+				}
+				_, err = metricFamilyToOpenMetrics(w, v, esc, emitMetadata(v), options...)
 				return err
 			},
 			close: func() error {
+				if closed {
+					return nil
+				}
+				closed = true
 				_, err := FinalizeOpenMetrics(w)
 				return err
 			},
+			setEscapingScheme: setEscapingScheme,
 		}
 	}
 	panic(fmt.Errorf("expfmt.NewEncoder: unknown format %q", format))
 }
+
+// dropStaleMetrics returns v without the metrics whose value is the staleness
+// marker, or nil if no metric is left. If no metric is stale, v itself is
+// returned.
+func dropStaleMetrics(v *dto.MetricFamily) *dto.MetricFamily {
+	var metrics []*dto.Metric
+	stale := 0
+	for _, m := range v.GetMetric() {
+		if isStaleMetric(m) {
+			stale++
+			continue
+		}
+		metrics = append(metrics, m)
+	}
+	switch {
+	case stale == 0:
+		return v
+	case len(metrics) == 0:
+		return nil
+	}
+	return &dto.MetricFamily{
+		Name:   v.Name,
+		Help:   v.Help,
+		Type:   v.Type,
+		Unit:   v.Unit,
+		Metric: metrics,
+	}
+}
+
+func isStaleMetric(m *dto.Metric) bool {
+	switch {
+	case m.GetCounter() != nil:
+		return model.IsStaleNaN(m.GetCounter().GetValue())
+	case m.GetGauge() != nil:
+		return model.IsStaleNaN(m.GetGauge().GetValue())
+	case m.GetUntyped() != nil:
+		return model.IsStaleNaN(m.GetUntyped().GetValue())
+	case m.GetSummary() != nil:
+		return model.IsStaleNaN(m.GetSummary().GetSampleSum())
+	case m.GetHistogram() != nil:
+		return model.IsStaleNaN(m.GetHistogram().GetSampleSum())
+	}
+	return false
+}
+
+// validateMetricFamily checks the metric family name and all label names
+// against the given validation scheme, independent of the global
+// model.NameValidationScheme.
+func validateMetricFamily(v *dto.MetricFamily, scheme model.ValidationScheme, esc *nameEscaper) error {
+	if name := esc.metricName(v.GetName()); !model.IsValidMetricNameWithScheme(model.LabelValue(name), scheme) {
+		return fmt.Errorf("invalid metric name %q", name)
+	}
+	for _, m := range v.GetMetric() {
+		for _, l := range m.GetLabel() {
+			if l.GetName() == model.MetricNameLabel {
+				if value := esc.labelValue(l); !model.IsValidMetricNameWithScheme(model.LabelValue(value), scheme) {
+					return fmt.Errorf("invalid metric name %q", value)
+				}
+				continue
+			}
+			if name := esc.labelName(l.GetName()); !model.LabelName(name).IsValidWithScheme(scheme) {
+				return fmt.Errorf("invalid label name %q", name)
+			}
+		}
+	}
+	return nil
+}
@@ -15,13 +15,23 @@ package expfmt
 
 import (
 	"bytes"
+	"context"
+	"errors"
+	"math"
 	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
 	"testing"
 
 	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
 
 	"github.com/prometheus/common/model"
 
+	"github.com/munnerz/goautoneg"
+
 	dto "github.com/prometheus/client_model/go"
 )
 
@@ -77,18 +87,29 @@ func TestNegotiate(t *testing.T) {
 			acceptHeaderValue: "text/plain;version=0.0.4; escaping=values;",
 			expectedFmt:       "text/plain; version=0.0.4; charset=utf-8; escaping=values",
 		},
+		{
+			name:              "plain text format 1.0.0",
+			acceptHeaderValue: "text/plain;version=1.0.0",
+			expectedFmt:       "text/plain; version=1.0.0; charset=utf-8; escaping=underscores",
+		},
+		{
+			name:              "plain text format 1.0.0 utf-8",
+			acceptHeaderValue: "text/plain;version=1.0.0;escaping=allow-utf-8",
+			expectedFmt:       "text/plain; version=1.0.0; charset=utf-8; escaping=allow-utf-8",
+		},
 	}
 
-	oldDefault := model.NameEscapingScheme
-	model.NameEscapingScheme = model.UnderscoreEscaping
+	oldDefault := model.GetNameEscapingScheme()
+	model.SetNameEscapingScheme(model.UnderscoreEscaping)
 	defer func() {
-		model.NameEscapingScheme = oldDefault
+		model.SetNameEscapingScheme(oldDefault)
 	}()
 
 	for i, test := range tests {
 		t.Run(test.name, func(t *testing.T) {
 			h := http.Header{}
 			h.Add(hdrAccept, test.acceptHeaderValue)
+			checkNegotiateWithEscaping(t, h)
 			actualFmt := string(Negotiate(h))
 			if actualFmt != test.expectedFmt {
 				t.Errorf("case %d: expected Negotiate to return format %s, but got %s instead", i, test.expectedFmt, actualFmt)
@@ -97,6 +118,72 @@ func TestNegotiate(t *testing.T) {
 	}
 }
 
+// checkNegotiateWithEscaping checks that NegotiateWithEscaping and
+// NegotiateIncludingOpenMetricsWithEscaping agree with Negotiate and
+// NegotiateIncludingOpenMetrics, and that the returned escaping scheme matches
+// the escaping term of the returned Format. It is called for the Accept
+// headers of all negotiation tests.
+func checkNegotiateWithEscaping(t *testing.T, h http.Header) {
+	t.Helper()
+	for _, fns := range []struct {
+		name         string
+		negotiate    func(http.Header) Format
+		withEscaping func(http.Header) (Format, model.EscapingScheme)
+	}{
+		{"NegotiateWithEscaping", Negotiate, NegotiateWithEscaping},
+		{"NegotiateIncludingOpenMetricsWithEscaping", NegotiateIncludingOpenMetrics, NegotiateIncludingOpenMetricsWithEscaping},
+	} {
+		f, scheme := fns.withEscaping(h)
+		if expected := fns.negotiate(h); f != expected {
+			t.Errorf("%s: expected format %s, got %s", fns.name, expected, f)
+		}
+		if expected := f.ToEscapingScheme(); scheme != expected {
+			t.Errorf("%s: format %s announces escaping scheme %s, but %s was returned", fns.name, f, expected, scheme)
+		}
+	}
+}
+
+func TestNegotiateMalformedAccept(t *testing.T) {
+	oldDefault := model.GetNameEscapingScheme()
+	model.SetNameEscapingScheme(model.UnderscoreEscaping)
+	defer func() {
+		model.SetNameEscapingScheme(oldDefault)
+	}()
+
+	expectedFmt := FmtText + "; escaping=underscores"
+	tests := []struct {
+		name   string
+		header http.Header
+	}{
+		{name: "no Accept header", header: http.Header{}},
+		{name: "nil header", header: nil},
+		{name: "empty header", header: http.Header{hdrAccept: {""}}},
+		{name: "whitespace only", header: http.Header{hdrAccept: {"   "}}},
+		{name: "only semicolons", header: http.Header{hdrAccept: {";;;"}}},
+		{name: "only commas", header: http.Header{hdrAccept: {",,,"}}},
+		{name: "media type without subtype", header: http.Header{hdrAccept: {"application/"}}},
+		{name: "subtype without media type", header: http.Header{hdrAccept: {"/plain"}}},
+		{name: "lone slash", header: http.Header{hdrAccept: {"/"}}},
+		{name: "too many slashes", header: http.Header{hdrAccept: {"text/plain/extra"}}},
+		{name: "parameters without media type", header: http.Header{hdrAccept: {";version=0.0.4;q=1"}}},
+		{name: "broken parameters", header: http.Header{hdrAccept: {"application/;=;q=;escaping"}}},
+		{name: "invalid quality value", header: http.Header{hdrAccept: {"application/openmetrics-text;q=abc"}}},
+		{name: "garbage", header: http.Header{hdrAccept: {"\x00\xff garbage"}}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			checkNegotiateWithEscaping(t, test.header)
+			if got := Negotiate(test.header); got != expectedFmt {
+				t.Errorf("expected Negotiate to return %s, got %s", expectedFmt, got)
+			}
+			if got := NegotiateIncludingOpenMetrics(test.header); got != expectedFmt {
+				t.Errorf("expected NegotiateIncludingOpenMetrics to return %s, got %s", expectedFmt, got)
+			}
+		})
+	}
+}
+
 func TestNegotiateOpenMetrics(t *testing.T) {
 	acceptValuePrefix := "application/vnd.google.protobuf;proto=io.prometheus.client.MetricFamily"
 	tests := []struct {
@@ -129,6 +216,16 @@ func TestNegotiateOpenMetrics(t *testing.T) {
 			acceptHeaderValue: "application/openmetrics-text;version=1.0.0; escaping=values;",
 			expectedFmt:       "application/openmetrics-text; version=1.0.0; charset=utf-8; escaping=values",
 		},
+		{
+			name:              "OM format, 2.0.0 version",
+			acceptHeaderValue: "application/openmetrics-text;version=2.0.0",
+			expectedFmt:       "application/openmetrics-text; version=2.0.0; charset=utf-8; escaping=values",
+		},
+		{
+			name:              "OM format, 2.0.0 version with utf-8",
+			acceptHeaderValue: "application/openmetrics-text;version=2.0.0; escaping=allow-utf-8",
+			expectedFmt:       "application/openmetrics-text; version=2.0.0; charset=utf-8; escaping=allow-utf-8",
+		},
 		{
 			name:              "OM format, invalid version",
 			acceptHeaderValue: "application/openmetrics-text;version=0.0.4",
@@ -145,9 +242,9 @@ func TestNegotiateOpenMetrics(t *testing.T) {
 			expectedFmt:       "text/plain; version=0.0.4; charset=utf-8; escaping=values",
 		},
 		{
-			name:              "plain text format 0.0.4",
+			name:              "plain text format 0.0.4 does not allow utf-8",
 			acceptHeaderValue: "text/plain;version=0.0.4; escaping=allow-utf-8",
-			expectedFmt:       "text/plain; version=0.0.4; charset=utf-8; escaping=allow-utf-8",
+			expectedFmt:       "text/plain; version=0.0.4; charset=utf-8; escaping=values",
 		},
 		{
 			name:              "delimited format utf-8",
@@ -181,16 +278,17 @@ func TestNegotiateOpenMetrics(t *testing.T) {
 		},
 	}
 
-	oldDefault := model.NameEscapingScheme
-	model.NameEscapingScheme = model.ValueEncodingEscaping
+	oldDefault := model.GetNameEscapingScheme()
+	model.SetNameEscapingScheme(model.ValueEncodingEscaping)
 	defer func() {
-		model.NameEscapingScheme = oldDefault
+		model.SetNameEscapingScheme(oldDefault)
 	}()
 
 	for i, test := range tests {
 		t.Run(test.name, func(t *testing.T) {
 			h := http.Header{}
 			h.Add(hdrAccept, test.acceptHeaderValue)
+			checkNegotiateWithEscaping(t, h)
 			actualFmt := string(NegotiateIncludingOpenMetrics(h))
 			if actualFmt != test.expectedFmt {
 				t.Errorf("case %d: expected Negotiate to return format %s, but got %s instead", i, test.expectedFmt, actualFmt)
@@ -199,120 +297,75 @@ func TestNegotiateOpenMetrics(t *testing.T) {
 	}
 }
 
-func TestEncode(t *testing.T) {
-	metric1 := &dto.MetricFamily{
-		Name: proto.String("foo_metric"),
-		Type: dto.MetricType_UNTYPED.Enum(),
-		Unit: proto.String("seconds"),
-		Metric: []*dto.Metric{
-			{
-				Untyped: &dto.Untyped{
-					Value: proto.Float64(1.234),
-				},
-			},
-		},
-	}
-
-	scenarios := []struct {
-		metric  *dto.MetricFamily
-		format  Format
-		options []EncoderOption
-		expOut  string
+func TestNegotiateOpenMetricsProto(t *testing.T) {
+	tests := []struct {
+		name              string
+		acceptHeaderValue string
+		expectedFmt       string
 	}{
-		// 1: Untyped ProtoDelim
-		{
-			metric: metric1,
-			format: FmtProtoDelim,
-		},
-		// 2: Untyped FmtProtoCompact
 		{
-			metric: metric1,
-			format: FmtProtoCompact,
+			name:              "OM protobuf format, no version",
+			acceptHeaderValue: "application/openmetrics-protobuf",
+			expectedFmt:       "application/openmetrics-protobuf; version=1.0.0; escaping=values",
 		},
-		// 3: Untyped FmtProtoText
 		{
-			metric: metric1,
-			format: FmtProtoText,
+			name:              "OM protobuf format, 1.0.0 version",
+			acceptHeaderValue: "application/openmetrics-protobuf;version=1.0.0; escaping=underscores",
+			expectedFmt:       "application/openmetrics-protobuf; version=1.0.0; escaping=underscores",
 		},
-		// 4: Untyped FmtText
 		{
-			metric: metric1,
-			format: FmtText,
-			expOut: `# TYPE foo_metric untyped
-foo_metric 1.234
-`,
+			name:              "OM protobuf format with utf-8",
+			acceptHeaderValue: "application/openmetrics-protobuf;version=1.0.0; escaping=allow-utf-8",
+			expectedFmt:       "application/openmetrics-protobuf; version=1.0.0; escaping=allow-utf-8",
 		},
-		// 5: Untyped FmtOpenMetrics_0_0_1
 		{
-			metric: metric1,
-			format: FmtOpenMetrics_0_0_1,
-			expOut: `# TYPE foo_metric unknown
-foo_metric 1.234
-`,
+			name:              "OM protobuf format, version range",
+			acceptHeaderValue: "application/openmetrics-protobuf;version>=1.0.0",
+			expectedFmt:       "application/openmetrics-protobuf; version=1.0.0; escaping=values",
 		},
-		// 6: Untyped FmtOpenMetrics_1_0_0
 		{
-			metric: metric1,
-			format: FmtOpenMetrics_1_0_0,
-			expOut: `# TYPE foo_metric unknown
-foo_metric 1.234
-`,
+			name:              "OM protobuf format, invalid version, falls back to OM text",
+			acceptHeaderValue: "application/openmetrics-protobuf;version=2.0.0,application/openmetrics-text;version=1.0.0;q=0.5",
+			expectedFmt:       "application/openmetrics-text; version=1.0.0; charset=utf-8; escaping=values",
 		},
-		// 7: Simple Counter FmtOpenMetrics_0_0_1 unit opted in
 		{
-			metric:  metric1,
-			format:  FmtOpenMetrics_0_0_1,
-			options: []EncoderOption{WithUnit()},
-			expOut: `# TYPE foo_metric_seconds unknown
-# UNIT foo_metric_seconds seconds
-foo_metric_seconds 1.234
-`,
+			name:              "OM protobuf format preferred over OM text",
+			acceptHeaderValue: "application/openmetrics-text;version=1.0.0;q=0.5,application/openmetrics-protobuf;q=0.8",
+			expectedFmt:       "application/openmetrics-protobuf; version=1.0.0; escaping=values",
 		},
-		// 8: Simple Counter FmtOpenMetrics_1_0_0 unit opted out
 		{
-			metric: metric1,
-			format: FmtOpenMetrics_1_0_0,
-			expOut: `# TYPE foo_metric unknown
-foo_metric 1.234
-`,
+			name:              "OM text preferred over OM protobuf format",
+			acceptHeaderValue: "application/openmetrics-protobuf;q=0.5,application/openmetrics-text;version=1.0.0;q=0.8",
+			expectedFmt:       "application/openmetrics-text; version=1.0.0; charset=utf-8; escaping=values",
 		},
 	}
-	for i, scenario := range scenarios {
-		out := bytes.NewBuffer(make([]byte, 0, len(scenario.expOut)))
-		enc := NewEncoder(out, scenario.format, scenario.options...)
-		err := enc.Encode(scenario.metric)
-		if err != nil {
-			t.Errorf("%d. error: %s", i, err)
-			continue
-		}
 
-		if expected, got := len(scenario.expOut), len(out.Bytes()); expected != 0 && expected != got {
-			t.Errorf(
-				"%d. expected %d bytes written, got %d",
-				i, expected, got,
-			)
-		}
-		if expected, got := scenario.expOut, out.String(); expected != "" && expected != got {
-			t.Errorf(
-				"%d. expected out=%q, got %q",
-				i, expected, got,
-			)
-		}
+	oldDefault := model.GetNameEscapingScheme()
+	model.SetNameEscapingScheme(model.ValueEncodingEscaping)
+	defer func() {
+		model.SetNameEscapingScheme(oldDefault)
+	}()
 
-		if len(out.Bytes()) == 0 {
-			t.Errorf(
-				"%d. expected output not to be empty",
-				i,
-			)
-		}
+	for i, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			h := http.Header{}
+			h.Add(hdrAccept, test.acceptHeaderValue)
+			checkNegotiateWithEscaping(t, h)
+			actualFmt := string(NegotiateIncludingOpenMetrics(h))
+			if actualFmt != test.expectedFmt {
+				t.Errorf("case %d: expected NegotiateIncludingOpenMetrics to return format %s, but got %s instead", i, test.expectedFmt, actualFmt)
+			}
+			// Negotiate never selects the OpenMetrics protobuf format.
+			if f := Negotiate(h); f.FormatType() == TypeOpenMetricsProto {
+				t.Errorf("case %d: expected Negotiate not to return the OpenMetrics protobuf format, but got %s", i, f)
+			}
+		})
 	}
 }
 
-func TestEscapedEncode(t *testing.T) {
-	var buff bytes.Buffer
-	delimEncoder := NewEncoder(&buff, FmtProtoDelim+"; escaping=underscores")
+func TestEncodeOpenMetricsProto(t *testing.T) {
 	metric := &dto.MetricFamily{
-		Name: proto.String("foo.metric"),
+		Name: proto.String("foo_metric"),
 		Type: dto.MetricType_UNTYPED.Enum(),
 		Metric: []*dto.Metric{
 			{
@@ -320,67 +373,1186 @@ func TestEscapedEncode(t *testing.T) {
 					Value: proto.Float64(1.234),
 				},
 			},
-			{
-				Label: []*dto.LabelPair{
-					{
-						Name:  proto.String("dotted.label.name"),
-						Value: proto.String("my.label.value"),
-					},
-				},
-				Untyped: &dto.Untyped{
-					Value: proto.Float64(8),
-				},
-			},
 		},
 	}
 
-	err := delimEncoder.Encode(metric)
-	if err != nil {
-		t.Errorf("unexpected error during encode: %s", err.Error())
+	var exp, got bytes.Buffer
+	if err := NewEncoder(&exp, FmtProtoDelim).Encode(metric); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	enc := NewEncoder(&got, FmtOpenMetricsProto)
+	if err := enc.Encode(metric); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if err := enc.(Closer).Close(); err != nil {
+		t.Fatalf("unexpected error closing encoder: %s", err)
 	}
+	if !bytes.Equal(got.Bytes(), exp.Bytes()) {
+		t.Errorf("expected output %q, got %q", exp.Bytes(), got.Bytes())
+	}
+}
 
-	out := buff.Bytes()
-	if len(out) == 0 {
-		t.Errorf("expected the output bytes buffer to be non-empty")
+func TestNegotiateQualityValues(t *testing.T) {
+	protoDelim := "application/vnd.google.protobuf;proto=io.prometheus.client.MetricFamily;encoding=delimited"
+	tests := []struct {
+		name              string
+		acceptHeaderValue string
+		expectedFmt       Format
+		expectedFmtNoOM   Format
+	}{
+		{
+			name:              "higher q-value wins over header order",
+			acceptHeaderValue: "text/plain;q=0.3, application/openmetrics-text;q=0.9",
+			expectedFmt:       FmtOpenMetrics_0_0_1,
+			expectedFmtNoOM:   FmtText,
+		},
+		{
+			name:              "text preferred over protobuf by q-value",
+			acceptHeaderValue: protoDelim + ";q=0.4, text/plain;version=0.0.4;q=0.5",
+			expectedFmt:       FmtText,
+			expectedFmtNoOM:   FmtText,
+		},
+		{
+			name:              "q=0 is not acceptable",
+			acceptHeaderValue: "application/openmetrics-text;version=1.0.0;q=0, " + protoDelim + ";q=0, text/plain;version=0.0.4;q=0.1",
+			expectedFmt:       FmtText,
+			expectedFmtNoOM:   FmtText,
+		},
+		{
+			name:              "only q=0 falls back to text",
+			acceptHeaderValue: protoDelim + ";q=0",
+			expectedFmt:       FmtText,
+			expectedFmtNoOM:   FmtText,
+		},
+		{
+			name:              "protobuf preferred over text at equal q-value",
+			acceptHeaderValue: "text/plain;version=0.0.4;q=0.5, " + protoDelim + ";q=0.5",
+			expectedFmt:       FmtProtoDelim,
+			expectedFmtNoOM:   FmtProtoDelim,
+		},
+		{
+			name:              "OpenMetrics preferred over text at equal q-value",
+			acceptHeaderValue: "text/plain;version=0.0.4, application/openmetrics-text;version=1.0.0",
+			expectedFmt:       FmtOpenMetrics_1_0_0,
+			expectedFmtNoOM:   FmtText,
+		},
+		{
+			name:              "header order decides between rich formats at equal q-value",
+			acceptHeaderValue: "application/openmetrics-text;version=1.0.0;q=0.5, " + protoDelim + ";q=0.5",
+			expectedFmt:       FmtOpenMetrics_1_0_0,
+			expectedFmtNoOM:   FmtProtoDelim,
+		},
+		{
+			name:              "header order decides between rich formats at equal q-value, reversed",
+			acceptHeaderValue: protoDelim + ";q=0.5, application/openmetrics-text;version=1.0.0;q=0.5",
+			expectedFmt:       FmtProtoDelim,
+			expectedFmtNoOM:   FmtProtoDelim,
+		},
 	}
 
-	buff.Reset()
+	oldDefault := model.GetNameEscapingScheme()
+	model.SetNameEscapingScheme(model.UnderscoreEscaping)
+	defer func() {
+		model.SetNameEscapingScheme(oldDefault)
+	}()
 
-	compactEncoder := NewEncoder(&buff, FmtProtoCompact)
-	err = compactEncoder.Encode(metric)
-	if err != nil {
-		t.Errorf("unexpected error during encode: %s", err.Error())
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			h := http.Header{}
+			h.Add(hdrAccept, test.acceptHeaderValue)
+			checkNegotiateWithEscaping(t, h)
+			if got, expected := NegotiateIncludingOpenMetrics(h), test.expectedFmt+"; escaping=underscores"; got != expected {
+				t.Errorf("expected NegotiateIncludingOpenMetrics to return %s, got %s", expected, got)
+			}
+			if got, expected := Negotiate(h), test.expectedFmtNoOM+"; escaping=underscores"; got != expected {
+				t.Errorf("expected Negotiate to return %s, got %s", expected, got)
+			}
+		})
 	}
+}
 
-	out = buff.Bytes()
-	if len(out) == 0 {
-		t.Errorf("expected the output bytes buffer to be non-empty")
+func TestNegotiateVersionRange(t *testing.T) {
+	oldDefault := model.GetNameEscapingScheme()
+	model.SetNameEscapingScheme(model.UnderscoreEscaping)
+	defer func() {
+		model.SetNameEscapingScheme(oldDefault)
+	}()
+
+	tests := []struct {
+		name        string
+		accept      string
+		includeOM   bool
+		expectedFmt Format
+	}{
+		{
+			name:        "range selects newest OpenMetrics version",
+			accept:      "application/openmetrics-text;version>=1.0.0",
+			includeOM:   true,
+			expectedFmt: FmtOpenMetrics_2_0_0 + "; escaping=underscores",
+		},
+		{
+			name:        "range with spaces",
+			accept:      "application/openmetrics-text; version >= 0.0.1",
+			includeOM:   true,
+			expectedFmt: FmtOpenMetrics_2_0_0 + "; escaping=underscores",
+		},
+		{
+			name:        "exact version keeps exact semantics",
+			accept:      "application/openmetrics-text;version=1.0.0",
+			includeOM:   true,
+			expectedFmt: FmtOpenMetrics_1_0_0 + "; escaping=underscores",
+		},
+		{
+			name:        "unsatisfiable range is skipped",
+			accept:      "application/openmetrics-text;version>=3.0.0,text/plain;version=0.0.4;q=0.5",
+			includeOM:   true,
+			expectedFmt: FmtText + "; escaping=underscores",
+		},
+		{
+			name:        "invalid range is skipped",
+			accept:      "application/openmetrics-text;version>=latest,text/plain;version=0.0.4;q=0.5",
+			includeOM:   true,
+			expectedFmt: FmtText + "; escaping=underscores",
+		},
+		{
+			name:        "range selects newest text version",
+			accept:      "text/plain;version>=0.0.4",
+			expectedFmt: FmtText_1_0_0 + "; escaping=underscores",
+		},
+		{
+			name:        "OpenMetrics range without OpenMetrics negotiation",
+			accept:      "application/openmetrics-text;version>=1.0.0",
+			expectedFmt: FmtText + "; escaping=underscores",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			h := http.Header{}
+			h.Add(hdrAccept, test.accept)
+			var got Format
+			checkNegotiateWithEscaping(t, h)
+			if test.includeOM {
+				got = NegotiateIncludingOpenMetrics(h)
+			} else {
+				got = Negotiate(h)
+			}
+			if got != test.expectedFmt {
+				t.Errorf("expected %s, got %s", test.expectedFmt, got)
+			}
+		})
 	}
+}
 
-	buff.Reset()
+func TestDefaultAcceptHeader(t *testing.T) {
+	oldDefault := model.GetNameEscapingScheme()
+	model.SetNameEscapingScheme(model.UnderscoreEscaping)
+	defer func() {
+		model.SetNameEscapingScheme(oldDefault)
+	}()
 
-	protoTextEncoder := NewEncoder(&buff, FmtProtoText)
-	err = protoTextEncoder.Encode(metric)
-	if err != nil {
-		t.Errorf("unexpected error during encode: %s", err.Error())
+	tests := []struct {
+		allowUTF8   bool
+		expected    string
+		expectedFmt Format
+	}{
+		{
+			allowUTF8:   false,
+			expected:    "application/vnd.google.protobuf;proto=io.prometheus.client.MetricFamily;encoding=delimited;q=0.6,text/plain;version=0.0.4;q=0.5,application/openmetrics-text;version=1.0.0;q=0.4,application/openmetrics-text;version=0.0.1;q=0.3,*/*;q=0.2",
+			expectedFmt: FmtProtoDelim + "; escaping=underscores",
+		},
+		{
+			allowUTF8:   true,
+			expected:    "application/vnd.google.protobuf;proto=io.prometheus.client.MetricFamily;encoding=delimited;escaping=allow-utf-8;q=0.6,text/plain;version=1.0.0;escaping=allow-utf-8;q=0.5,application/openmetrics-text;version=2.0.0;escaping=allow-utf-8;q=0.4,application/openmetrics-text;version=1.0.0;q=0.3,*/*;q=0.2",
+			expectedFmt: FmtProtoDelim + FmtAllowUTF8,
+		},
 	}
-
-	out = buff.Bytes()
-	if len(out) == 0 {
-		t.Errorf("expected the output bytes buffer to be non-empty")
+	for _, test := range tests {
+		header := DefaultAcceptHeader(test.allowUTF8)
+		if header != test.expected {
+			t.Errorf("allowUTF8=%v: expected header %s, got %s", test.allowUTF8, test.expected, header)
+		}
+		h := http.Header{}
+		h.Add(hdrAccept, header)
+		checkNegotiateWithEscaping(t, h)
+		if got := Negotiate(h); got != test.expectedFmt {
+			t.Errorf("allowUTF8=%v: expected Negotiate to return %s, got %s", test.allowUTF8, test.expectedFmt, got)
+		}
+		if got := NegotiateIncludingOpenMetrics(h); got != test.expectedFmt {
+			t.Errorf("allowUTF8=%v: expected NegotiateIncludingOpenMetrics to return %s, got %s", test.allowUTF8, test.expectedFmt, got)
+		}
 	}
+}
 
-	buff.Reset()
+func TestNegotiateMultipleAcceptHeaders(t *testing.T) {
+	oldDefault := model.GetNameEscapingScheme()
+	model.SetNameEscapingScheme(model.UnderscoreEscaping)
+	defer func() {
+		model.SetNameEscapingScheme(oldDefault)
+	}()
 
-	textEncoder := NewEncoder(&buff, FmtText)
-	err = textEncoder.Encode(metric)
-	if err != nil {
-		t.Errorf("unexpected error during encode: %s", err.Error())
+	h := http.Header{}
+	h.Add(hdrAccept, "text/plain;version=0.0.4")
+	h.Add(hdrAccept, "application/vnd.google.protobuf;proto=io.prometheus.client.MetricFamily;encoding=delimited")
+	checkNegotiateWithEscaping(t, h)
+	if got, expected := Negotiate(h), FmtProtoDelim+"; escaping=underscores"; got != expected {
+		t.Errorf("expected Negotiate to return %s, got %s", expected, got)
 	}
 
-	out = buff.Bytes()
-	if len(out) == 0 {
-		t.Errorf("expected the output bytes buffer to be non-empty")
+	h = http.Header{}
+	h.Add(hdrAccept, "text/plain;version=0.0.4;q=0.5,application/json")
+	h.Add(hdrAccept, "application/openmetrics-text;version=1.0.0;q=0.6")
+	if got, expected := NegotiateIncludingOpenMetrics(h), FmtOpenMetrics_1_0_0+"; escaping=underscores"; got != expected {
+		t.Errorf("expected NegotiateIncludingOpenMetrics to return %s, got %s", expected, got)
+	}
+	if got, expected := NegotiateWithPreference(h, []FormatType{TypeTextPlain}), FmtText+"; escaping=underscores"; got != expected {
+		t.Errorf("expected NegotiateWithPreference to return %s, got %s", expected, got)
+	}
+
+	// The cache of NegotiateWithCache takes all header values into account.
+	ctx, _ := NegotiateWithCache(context.Background(), h)
+	h.Add(hdrAccept, "application/vnd.google.protobuf;proto=io.prometheus.client.MetricFamily;encoding=delimited")
+	if _, got := NegotiateWithCache(ctx, h); got != FmtProtoDelim+"; escaping=underscores" {
+		t.Errorf("expected NegotiateWithCache to return %s, got %s", FmtProtoDelim+"; escaping=underscores", got)
+	}
+}
+
+func TestNegotiateAllowUTF8(t *testing.T) {
+	tests := []struct {
+		name              string
+		acceptHeaderValue string
+		includeOM         bool
+		expectedFmt       string
+	}{
+		{
+			name:              "allow-utf-8 on selected proto clause",
+			acceptHeaderValue: "application/vnd.google.protobuf;proto=io.prometheus.client.MetricFamily;encoding=delimited;escaping=allow-utf-8",
+			expectedFmt:       "application/vnd.google.protobuf; proto=io.prometheus.client.MetricFamily; encoding=delimited; escaping=allow-utf-8",
+		},
+		{
+			name:              "allow-utf-8 on unsupported OM clause does not leak into text",
+			acceptHeaderValue: "application/openmetrics-text;version=1.0.0;escaping=allow-utf-8,text/plain;version=0.0.4;q=0.5",
+			expectedFmt:       "text/plain; version=0.0.4; charset=utf-8; escaping=underscores",
+		},
+		{
+			name:              "allow-utf-8 on OM 2.0.0 clause when OM is negotiable",
+			acceptHeaderValue: "application/openmetrics-text;version=2.0.0;escaping=allow-utf-8,text/plain;version=0.0.4;q=0.5",
+			includeOM:         true,
+			expectedFmt:       "application/openmetrics-text; version=2.0.0; charset=utf-8; escaping=allow-utf-8",
+		},
+		{
+			name:              "allow-utf-8 on OM 1.0.0 clause falls back to default escaping",
+			acceptHeaderValue: "application/openmetrics-text;version=1.0.0;escaping=allow-utf-8,text/plain;version=0.0.4;q=0.5",
+			includeOM:         true,
+			expectedFmt:       "application/openmetrics-text; version=1.0.0; charset=utf-8; escaping=underscores",
+		},
+		{
+			name:              "allow-utf-8 on text 0.0.4 clause falls back to default escaping",
+			acceptHeaderValue: "text/plain;version=0.0.4;escaping=allow-utf-8",
+			expectedFmt:       "text/plain; version=0.0.4; charset=utf-8; escaping=underscores",
+		},
+		{
+			name:              "allow-utf-8 on unversioned text clause falls back to default escaping",
+			acceptHeaderValue: "text/plain;escaping=allow-utf-8",
+			expectedFmt:       "text/plain; version=0.0.4; charset=utf-8; escaping=underscores",
+		},
+		{
+			name:              "allow-utf-8 on text 1.0.0 clause",
+			acceptHeaderValue: "text/plain;version=1.0.0;escaping=allow-utf-8",
+			expectedFmt:       "text/plain; version=1.0.0; charset=utf-8; escaping=allow-utf-8",
+		},
+		{
+			name:              "allow-utf-8 on OM 0.0.1 clause falls back to default escaping",
+			acceptHeaderValue: "application/openmetrics-text;version=0.0.1;escaping=allow-utf-8",
+			includeOM:         true,
+			expectedFmt:       "application/openmetrics-text; version=0.0.1; charset=utf-8; escaping=underscores",
+		},
+		{
+			name:              "allow-utf-8 on unsupported version falls back to default escaping",
+			acceptHeaderValue: "application/openmetrics-text;version=0.0.4;escaping=allow-utf-8",
+			includeOM:         true,
+			expectedFmt:       "text/plain; version=0.0.4; charset=utf-8; escaping=underscores",
+		},
+		{
+			name:              "validation-scheme=utf8 is canonicalized",
+			acceptHeaderValue: "text/plain;version=1.0.0;validation-scheme=utf8",
+			expectedFmt:       "text/plain; version=1.0.0; charset=utf-8; escaping=allow-utf-8",
+		},
+		{
+			name:              "escaping parameter takes precedence over validation-scheme",
+			acceptHeaderValue: "text/plain;version=0.0.4;validation-scheme=utf8;escaping=dots",
+			expectedFmt:       "text/plain; version=0.0.4; charset=utf-8; escaping=dots",
+		},
+		{
+			name:              "validation-scheme=legacy does not allow utf-8",
+			acceptHeaderValue: "text/plain;version=0.0.4;validation-scheme=legacy",
+			expectedFmt:       "text/plain; version=0.0.4; charset=utf-8; escaping=underscores",
+		},
+		{
+			name:              "alternative allow-utf8 spelling is canonicalized",
+			acceptHeaderValue: "text/plain;version=1.0.0;escaping=allow-utf8",
+			expectedFmt:       "text/plain; version=1.0.0; charset=utf-8; escaping=allow-utf-8",
+		},
+		{
+			name:              "validchars=utf8 is canonicalized",
+			acceptHeaderValue: "application/vnd.google.protobuf;proto=io.prometheus.client.MetricFamily;encoding=delimited;validchars=utf8",
+			expectedFmt:       "application/vnd.google.protobuf; proto=io.prometheus.client.MetricFamily; encoding=delimited; escaping=allow-utf-8",
+		},
+		{
+			name:              "escaping parameter takes precedence over validchars",
+			acceptHeaderValue: "text/plain;version=0.0.4;validchars=utf8;escaping=dots",
+			expectedFmt:       "text/plain; version=0.0.4; charset=utf-8; escaping=dots",
+		},
+		{
+			name:              "validchars=utf8 on OM 1.0.0 clause falls back to default escaping",
+			acceptHeaderValue: "application/openmetrics-text;version=1.0.0;validchars=utf8",
+			includeOM:         true,
+			expectedFmt:       "application/openmetrics-text; version=1.0.0; charset=utf-8; escaping=underscores",
+		},
+		{
+			name:              "validchars=utf8 on text 0.0.4 clause falls back to default escaping",
+			acceptHeaderValue: "text/plain;version=0.0.4;validchars=utf8",
+			expectedFmt:       "text/plain; version=0.0.4; charset=utf-8; escaping=underscores",
+		},
+		{
+			name:              "allow-utf-8 alongside validation-scheme parameter",
+			acceptHeaderValue: "text/plain;version=1.0.0;validation-scheme=utf8;escaping=allow-utf-8",
+			expectedFmt:       "text/plain; version=1.0.0; charset=utf-8; escaping=allow-utf-8",
+		},
+	}
+
+	oldDefault := model.GetNameEscapingScheme()
+	model.SetNameEscapingScheme(model.UnderscoreEscaping)
+	defer func() {
+		model.SetNameEscapingScheme(oldDefault)
+	}()
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			h := http.Header{}
+			h.Add(hdrAccept, test.acceptHeaderValue)
+			var actualFmt Format
+			checkNegotiateWithEscaping(t, h)
+			if test.includeOM {
+				actualFmt = NegotiateIncludingOpenMetrics(h)
+			} else {
+				actualFmt = Negotiate(h)
+			}
+			if string(actualFmt) != test.expectedFmt {
+				t.Errorf("expected format %s, got %s", test.expectedFmt, actualFmt)
+			}
+			wantScheme := model.UnderscoreEscaping
+			switch {
+			case strings.HasSuffix(test.expectedFmt, model.AllowUTF8):
+				wantScheme = model.NoEscaping
+			case strings.HasSuffix(test.expectedFmt, model.EscapeDots):
+				wantScheme = model.DotsEscaping
+			}
+			if got := actualFmt.ToEscapingScheme(); got != wantScheme {
+				t.Errorf("expected escaping scheme %v, got %v", wantScheme, got)
+			}
+		})
+	}
+
+	// Without a legacy default, the fallback is value encoding.
+	model.SetNameEscapingScheme(model.NoEscaping)
+	for accept, expected := range map[string]Format{
+		"text/plain;version=0.0.4;escaping=allow-utf-8":              FmtText + "; escaping=values",
+		"application/openmetrics-text;version=1.0.0;validchars=utf8": FmtOpenMetrics_1_0_0 + "; escaping=values",
+	} {
+		h := http.Header{}
+		h.Add(hdrAccept, accept)
+		if got := NegotiateIncludingOpenMetrics(h); got != expected {
+			t.Errorf("%q: expected format %s, got %s", accept, expected, got)
+		}
+	}
+}
+
+func TestSetProtoNamesFollowValidationScheme(t *testing.T) {
+	defer model.SetNameEscapingScheme(model.GetNameEscapingScheme())
+	defer model.SetNameValidationScheme(model.GetNameValidationScheme())
+	defer SetProtoNamesFollowValidationScheme(false)
+	model.SetNameEscapingScheme(model.UnderscoreEscaping)
+
+	const protoDelim = "application/vnd.google.protobuf;proto=io.prometheus.client.MetricFamily;encoding=delimited"
+	tests := []struct {
+		name       string
+		accept     string
+		includeOM  bool
+		enabled    bool
+		validation model.ValidationScheme
+		expected   Format
+	}{
+		{
+			name:       "disabled",
+			accept:     protoDelim,
+			validation: model.UTF8Validation,
+			expected:   FmtProtoDelim + "; escaping=underscores",
+		},
+		{
+			name:       "enabled with UTF-8 validation",
+			accept:     protoDelim,
+			enabled:    true,
+			validation: model.UTF8Validation,
+			expected:   FmtProtoDelim + FmtAllowUTF8,
+		},
+		{
+			name:       "enabled with legacy validation",
+			accept:     protoDelim,
+			enabled:    true,
+			validation: model.LegacyValidation,
+			expected:   FmtProtoDelim + "; escaping=underscores",
+		},
+		{
+			name:       "explicit escaping parameter",
+			accept:     protoDelim + ";escaping=values",
+			enabled:    true,
+			validation: model.UTF8Validation,
+			expected:   FmtProtoDelim + "; escaping=values",
+		},
+		{
+			name:       "unknown escaping parameter",
+			accept:     protoDelim + ";escaping=unknown",
+			enabled:    true,
+			validation: model.UTF8Validation,
+			expected:   FmtProtoDelim + "; escaping=underscores",
+		},
+		{
+			name:       "compact text",
+			accept:     "application/vnd.google.protobuf;proto=io.prometheus.client.MetricFamily;encoding=compact-text",
+			enabled:    true,
+			validation: model.UTF8NoControlValidation,
+			expected:   FmtProtoCompact + FmtAllowUTF8,
+		},
+		{
+			name:       "OpenMetrics protobuf",
+			accept:     "application/openmetrics-protobuf;version=1.0.0",
+			includeOM:  true,
+			enabled:    true,
+			validation: model.UTF8Validation,
+			expected:   FmtOpenMetricsProto + FmtAllowUTF8,
+		},
+		{
+			name:       "text format is unaffected",
+			accept:     "text/plain;version=1.0.0",
+			enabled:    true,
+			validation: model.UTF8Validation,
+			expected:   FmtText_1_0_0 + "; escaping=underscores",
+		},
+		{
+			name:       "fallback is unaffected",
+			accept:     "application/json",
+			enabled:    true,
+			validation: model.UTF8Validation,
+			expected:   FmtText + "; escaping=underscores",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			SetProtoNamesFollowValidationScheme(test.enabled)
+			model.SetNameValidationScheme(test.validation)
+			h := http.Header{}
+			h.Add(hdrAccept, test.accept)
+			checkNegotiateWithEscaping(t, h)
+			var got Format
+			if test.includeOM {
+				got = NegotiateIncludingOpenMetrics(h)
+			} else {
+				got = Negotiate(h)
+			}
+			if got != test.expected {
+				t.Errorf("expected format %s, got %s", test.expected, got)
+			}
+		})
+	}
+}
+
+func TestNegotiateAndEscape(t *testing.T) {
+	// The UTF-8 client has to accept the unescaped names.
+	defer model.SetNameValidationScheme(model.GetNameValidationScheme())
+	model.SetNameValidationScheme(model.UTF8Validation)
+
+	fams := []*dto.MetricFamily{
+		{
+			Name: proto.String("my.metric_total"),
+			Type: dto.MetricType_COUNTER.Enum(),
+			Metric: []*dto.Metric{
+				{
+					Label:   []*dto.LabelPair{{Name: proto.String("some.label"), Value: proto.String("v")}},
+					Counter: &dto.Counter{Value: proto.Float64(1)},
+				},
+			},
+		},
+	}
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		format, escaped := NegotiateAndEscape(r.Header, fams)
+		w.Header().Set(hdrContentType, string(format))
+		enc := NewEncoder(w, format, WithEscapingScheme(model.NoEscaping))
+		for _, mf := range escaped {
+			if err := enc.Encode(mf); err != nil {
+				t.Errorf("unexpected error during encode: %s", err)
+			}
+		}
+	})
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	scenarios := []struct {
+		name        string
+		accept      string
+		expMetric   string
+		expLabel    string
+		expEscaping model.EscapingScheme
+	}{
+		{
+			name:        "utf-8 client",
+			accept:      "application/vnd.google.protobuf;proto=io.prometheus.client.MetricFamily;encoding=delimited;validchars=utf8",
+			expMetric:   "my.metric_total",
+			expLabel:    "some.label",
+			expEscaping: model.NoEscaping,
+		},
+		{
+			name:        "underscores client",
+			accept:      "text/plain;version=0.0.4;escaping=underscores",
+			expMetric:   "my_metric_total",
+			expLabel:    "some_label",
+			expEscaping: model.UnderscoreEscaping,
+		},
+		{
+			name:        "dots client escapes only once",
+			accept:      "text/plain;version=0.0.4;escaping=dots",
+			expMetric:   "my_dot_metric__total",
+			expLabel:    "some_dot_label",
+			expEscaping: model.DotsEscaping,
+		},
+	}
+	for _, scenario := range scenarios {
+		t.Run(scenario.name, func(t *testing.T) {
+			req, err := http.NewRequest(http.MethodGet, server.URL, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.Header.Set(hdrAccept, scenario.accept)
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+
+			format := ResponseFormat(resp.Header)
+			if got := format.ToEscapingScheme(); got != scenario.expEscaping {
+				t.Errorf("expected escaping scheme %s, got %s", scenario.expEscaping, got)
+			}
+			var got []*dto.MetricFamily
+			if err := DecodeEach(NewDecoder(resp.Body, format), func(mf *dto.MetricFamily) error {
+				got = append(got, mf)
+				return nil
+			}); err != nil {
+				t.Fatalf("unexpected error during decode: %s", err)
+			}
+			if len(got) != 1 {
+				t.Fatalf("expected 1 metric family, got %d", len(got))
+			}
+			if name := got[0].GetName(); name != scenario.expMetric {
+				t.Errorf("expected metric name %q, got %q", scenario.expMetric, name)
+			}
+			if name := got[0].GetMetric()[0].GetLabel()[0].GetName(); name != scenario.expLabel {
+				t.Errorf("expected label name %q, got %q", scenario.expLabel, name)
+			}
+		})
+	}
+	if name := fams[0].GetName(); name != "my.metric_total" {
+		t.Errorf("input was modified, metric name is now %q", name)
+	}
+
+	// The escaped families are left alone by the Encoder, so skipping its
+	// escaping does not change the output.
+	for _, scenario := range scenarios {
+		h := http.Header{}
+		h.Set(hdrAccept, scenario.accept)
+		format, escaped := NegotiateAndEscape(h, fams)
+		var skipped, escapedAgain bytes.Buffer
+		for _, mf := range escaped {
+			if err := NewEncoder(&skipped, format, WithEscapingScheme(model.NoEscaping)).Encode(mf); err != nil {
+				t.Fatalf("%s: unexpected error during encode: %s", scenario.name, err)
+			}
+			if err := NewEncoder(&escapedAgain, format).Encode(mf); err != nil {
+				t.Fatalf("%s: unexpected error during encode: %s", scenario.name, err)
+			}
+		}
+		if !bytes.Equal(skipped.Bytes(), escapedAgain.Bytes()) {
+			t.Errorf("%s: expected the same output with and without escaping in the Encoder, got %q and %q", scenario.name, skipped.Bytes(), escapedAgain.Bytes())
+		}
+	}
+}
+
+func TestNegotiateWithTrace(t *testing.T) {
+	oldDefault := model.GetNameEscapingScheme()
+	model.SetNameEscapingScheme(model.UnderscoreEscaping)
+	defer func() {
+		model.SetNameEscapingScheme(oldDefault)
+	}()
+
+	tests := []struct {
+		name          string
+		accept        string
+		expectedFmt   Format
+		expectedTrace []string
+	}{
+		{
+			name:        "mixed",
+			accept:      "application/json, application/vnd.google.protobuf;proto=io.prometheus.client.MetricFamily;encoding=delimited;q=0, application/openmetrics-text;version=0.0.4;q=0.9, text/plain;version=0.0.4;q=0.5, */*;q=0.1",
+			expectedFmt: FmtText + "; escaping=underscores",
+			expectedTrace: []string{
+				"application/json: not selected, unsupported media type",
+				`application/openmetrics-text;version=0.0.4: not selected, unsupported version "0.0.4"`,
+				"text/plain;version=0.0.4: selected as text/plain; version=0.0.4; charset=utf-8; escaping=underscores",
+				"*/*: not selected, a more preferred entry was selected",
+				"application/vnd.google.protobuf;encoding=delimited;proto=io.prometheus.client.MetricFamily: not acceptable (q=0)",
+			},
+		},
+		{
+			name:        "fallback",
+			accept:      "application/vnd.google.protobuf;proto=io.prometheus.client.MetricFamily;encoding=json, application/vnd.google.protobuf;proto=other, application/openmetrics-text;version>=3.0.0, */*;q=0.1",
+			expectedFmt: FmtText + "; escaping=underscores",
+			expectedTrace: []string{
+				`application/vnd.google.protobuf;encoding=json;proto=io.prometheus.client.MetricFamily: not selected, unsupported encoding "json"`,
+				`application/vnd.google.protobuf;proto=other: not selected, unsupported proto "other"`,
+				"application/openmetrics-text;version>=3.0.0: not selected, no supported version satisfies version>=3.0.0",
+				"*/*: not selected, wildcard media range, only served by the fallback format",
+				"no supported entry, falling back to text/plain; version=0.0.4; charset=utf-8; escaping=underscores",
+			},
+		},
+		{
+			name:        "protobuf",
+			accept:      "application/vnd.google.protobuf;proto=io.prometheus.client.MetricFamily;encoding=delimited;escaping=allow-utf-8",
+			expectedFmt: FmtProtoDelim + FmtAllowUTF8,
+			expectedTrace: []string{
+				"application/vnd.google.protobuf;encoding=delimited;escaping=allow-utf-8;proto=io.prometheus.client.MetricFamily: selected as " + string(FmtProtoDelim+FmtAllowUTF8),
+			},
+		},
+		{
+			name:        "empty header",
+			expectedFmt: FmtText + "; escaping=underscores",
+			expectedTrace: []string{
+				"no supported entry, falling back to text/plain; version=0.0.4; charset=utf-8; escaping=underscores",
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			h := http.Header{}
+			if test.accept != "" {
+				h.Add(hdrAccept, test.accept)
+			}
+			f, trace := NegotiateWithTrace(h)
+			if f != test.expectedFmt {
+				t.Errorf("expected format %s, got %s", test.expectedFmt, f)
+			}
+			if f != NegotiateIncludingOpenMetrics(h) {
+				t.Errorf("expected format to match NegotiateIncludingOpenMetrics, got %s and %s", f, NegotiateIncludingOpenMetrics(h))
+			}
+			if !reflect.DeepEqual(trace, test.expectedTrace) {
+				t.Errorf("expected trace\n%s\ngot\n%s", strings.Join(test.expectedTrace, "\n"), strings.Join(trace, "\n"))
+			}
+		})
+	}
+}
+
+func TestNegotiateWithPreference(t *testing.T) {
+	acceptAll := "application/vnd.google.protobuf;proto=io.prometheus.client.MetricFamily;encoding=delimited;escaping=allow-utf-8," +
+		"application/openmetrics-text;version=1.0.0;escaping=dots;q=0.9," +
+		"text/plain;version=0.0.4;q=0.5"
+	tests := []struct {
+		name              string
+		acceptHeaderValue string
+		prefs             []FormatType
+		expectedFmt       string
+	}{
+		{
+			name:              "no preference behaves like Negotiate",
+			acceptHeaderValue: acceptAll,
+			expectedFmt:       "application/vnd.google.protobuf; proto=io.prometheus.client.MetricFamily; encoding=delimited; escaping=allow-utf-8",
+		},
+		{
+			name:              "no preference does not negotiate OpenMetrics",
+			acceptHeaderValue: "application/openmetrics-text;version=1.0.0,text/plain;version=0.0.4",
+			expectedFmt:       "text/plain; version=0.0.4; charset=utf-8; escaping=underscores",
+		},
+		{
+			name:              "no preference keeps the order of the client",
+			acceptHeaderValue: "text/plain;q=1,application/vnd.google.protobuf;proto=io.prometheus.client.MetricFamily;encoding=delimited;q=0.1",
+			prefs:             []FormatType{},
+			expectedFmt:       "text/plain; version=0.0.4; charset=utf-8; escaping=underscores",
+		},
+		{
+			name:              "server prefers OpenMetrics",
+			acceptHeaderValue: acceptAll,
+			prefs:             []FormatType{TypeOpenMetrics, TypeProtoDelim},
+			expectedFmt:       "application/openmetrics-text; version=1.0.0; charset=utf-8; escaping=dots",
+		},
+		{
+			name:              "server prefers text",
+			acceptHeaderValue: acceptAll,
+			prefs:             []FormatType{TypeTextPlain, TypeOpenMetrics},
+			expectedFmt:       "text/plain; version=0.0.4; charset=utf-8; escaping=underscores",
+		},
+		{
+			name:              "first preference not accepted by client",
+			acceptHeaderValue: acceptAll,
+			prefs:             []FormatType{TypeProtoText, TypeProtoDelim},
+			expectedFmt:       "application/vnd.google.protobuf; proto=io.prometheus.client.MetricFamily; encoding=delimited; escaping=allow-utf-8",
+		},
+		{
+			name:              "no preference accepted by client",
+			acceptHeaderValue: "application/openmetrics-text;version=1.0.0",
+			prefs:             []FormatType{TypeProtoDelim},
+			expectedFmt:       "text/plain; version=0.0.4; charset=utf-8; escaping=underscores",
+		},
+	}
+
+	oldDefault := model.GetNameEscapingScheme()
+	model.SetNameEscapingScheme(model.UnderscoreEscaping)
+	defer func() {
+		model.SetNameEscapingScheme(oldDefault)
+	}()
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			h := http.Header{}
+			h.Add(hdrAccept, test.acceptHeaderValue)
+			actualFmt := string(NegotiateWithPreference(h, test.prefs))
+			if actualFmt != test.expectedFmt {
+				t.Errorf("expected format %s, got %s", test.expectedFmt, actualFmt)
+			}
+			if len(test.prefs) == 0 && actualFmt != string(Negotiate(h)) {
+				t.Errorf("expected format to match Negotiate, got %s and %s", actualFmt, Negotiate(h))
+			}
+		})
+	}
+}
+
+func TestNegotiateWithCache(t *testing.T) {
+	parses := 0
+	oldParseAccept := parseAccept
+	parseAccept = func(header string) []goautoneg.Accept {
+		parses++
+		return oldParseAccept(header)
+	}
+	defer func() {
+		parseAccept = oldParseAccept
+	}()
+
+	h := http.Header{}
+	h.Add(hdrAccept, "application/vnd.google.protobuf;proto=io.prometheus.client.MetricFamily;encoding=delimited")
+
+	ctx, f := NegotiateWithCache(context.Background(), h)
+	if expected := Negotiate(h); f != expected {
+		t.Errorf("expected format %s, got %s", expected, f)
+	}
+	parses = 0
+
+	ctx, f2 := NegotiateWithCache(ctx, h)
+	if f2 != f {
+		t.Errorf("expected cached format %s, got %s", f, f2)
+	}
+	if parses != 0 {
+		t.Errorf("expected cached Accept header to be reused, got %d parses", parses)
+	}
+
+	// A different Accept header must not hit the cache.
+	h.Set(hdrAccept, "text/plain;version=0.0.4")
+	_, f3 := NegotiateWithCache(ctx, h)
+	if expected := Negotiate(h); f3 != expected {
+		t.Errorf("expected format %s, got %s", expected, f3)
+	}
+	if parses != 2 {
+		t.Errorf("expected changed Accept header to be parsed again, got %d parses", parses)
+	}
+}
+
+func TestNegotiateWithStatus(t *testing.T) {
+	tests := []struct {
+		name              string
+		acceptHeaderValue string
+		expectedFmt       string
+		expectedRequested string
+		expectedFallback  bool
+	}{
+		{
+			name:              "OM format, invalid version falls back to text",
+			acceptHeaderValue: "application/openmetrics-text;version=0.0.4",
+			expectedFmt:       "text/plain; version=0.0.4; charset=utf-8; escaping=values",
+			expectedRequested: OpenMetricsType,
+			expectedFallback:  true,
+		},
+		{
+			name:              "OM format, invalid version falls back to next accepted type",
+			acceptHeaderValue: "application/openmetrics-text;version=0.0.4,text/plain;version=0.0.4;q=0.5",
+			expectedFmt:       "text/plain; version=0.0.4; charset=utf-8; escaping=values",
+			expectedRequested: OpenMetricsType,
+			expectedFallback:  true,
+		},
+		{
+			name:              "OM format, valid version",
+			acceptHeaderValue: "application/openmetrics-text;version=1.0.0",
+			expectedFmt:       "application/openmetrics-text; version=1.0.0; charset=utf-8; escaping=values",
+			expectedRequested: OpenMetricsType,
+		},
+		{
+			name:              "OM protobuf format, invalid version falls back to text",
+			acceptHeaderValue: "application/openmetrics-protobuf;version=2.0.0",
+			expectedFmt:       "text/plain; version=0.0.4; charset=utf-8; escaping=values",
+			expectedRequested: OpenMetricsProtoType,
+			expectedFallback:  true,
+		},
+		{
+			name:              "OM protobuf format, invalid version falls back to OM text",
+			acceptHeaderValue: "application/openmetrics-protobuf;version=2.0.0,application/openmetrics-text;version=1.0.0;q=0.5",
+			expectedFmt:       "application/openmetrics-text; version=1.0.0; charset=utf-8; escaping=values",
+			expectedRequested: OpenMetricsProtoType,
+		},
+		{
+			name:              "plain text format",
+			acceptHeaderValue: "text/plain;version=0.0.4",
+			expectedFmt:       "text/plain; version=0.0.4; charset=utf-8; escaping=values",
+			expectedRequested: "text/plain",
+		},
+		{
+			name:        "empty header",
+			expectedFmt: "text/plain; version=0.0.4; charset=utf-8; escaping=values",
+		},
+	}
+
+	oldDefault := model.GetNameEscapingScheme()
+	model.SetNameEscapingScheme(model.ValueEncodingEscaping)
+	defer func() {
+		model.SetNameEscapingScheme(oldDefault)
+	}()
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			h := http.Header{}
+			if test.acceptHeaderValue != "" {
+				h.Add(hdrAccept, test.acceptHeaderValue)
+			}
+			checkNegotiateWithEscaping(t, h)
+			status := NegotiateWithStatus(h)
+			if string(status.Format) != test.expectedFmt {
+				t.Errorf("expected format %s, got %s", test.expectedFmt, status.Format)
+			}
+			if status.RequestedMediaType != test.expectedRequested {
+				t.Errorf("expected requested media type %q, got %q", test.expectedRequested, status.RequestedMediaType)
+			}
+			if status.OpenMetricsFallback() != test.expectedFallback {
+				t.Errorf("expected OpenMetrics fallback %v, got %v", test.expectedFallback, status.OpenMetricsFallback())
+			}
+			if status.Format != NegotiateIncludingOpenMetrics(h) {
+				t.Errorf("expected format to match NegotiateIncludingOpenMetrics, got %s and %s", status.Format, NegotiateIncludingOpenMetrics(h))
+			}
+		})
+	}
+}
+
+func TestNegotiateStrict(t *testing.T) {
+	tests := []struct {
+		name              string
+		acceptHeaderValue string
+		expectedFmt       string
+		notAcceptable     bool
+	}{
+		{
+			name:        "empty header",
+			expectedFmt: "text/plain; version=0.0.4; charset=utf-8; escaping=values",
+		},
+		{
+			name:              "OM format",
+			acceptHeaderValue: "application/openmetrics-text;version=1.0.0",
+			expectedFmt:       "application/openmetrics-text; version=1.0.0; charset=utf-8; escaping=values",
+		},
+		{
+			name:              "unsupported version falls back to next accepted type",
+			acceptHeaderValue: "application/openmetrics-text;version=0.0.4,text/plain;version=0.0.4;q=0.5",
+			expectedFmt:       "text/plain; version=0.0.4; charset=utf-8; escaping=values",
+		},
+		{
+			name:              "wildcard",
+			acceptHeaderValue: "application/json,*/*;q=0.1",
+			expectedFmt:       "text/plain; version=0.0.4; charset=utf-8; escaping=values",
+		},
+		{
+			name:              "text wildcard",
+			acceptHeaderValue: "text/*",
+			expectedFmt:       "text/plain; version=0.0.4; charset=utf-8; escaping=values",
+		},
+		{
+			name:              "unsupported media type",
+			acceptHeaderValue: "application/json",
+			notAcceptable:     true,
+		},
+		{
+			name:              "unsupported version",
+			acceptHeaderValue: "application/openmetrics-text;version=0.0.4",
+			notAcceptable:     true,
+		},
+		{
+			name:              "only q=0 entries",
+			acceptHeaderValue: "text/plain;q=0",
+			notAcceptable:     true,
+		},
+		{
+			name:              "malformed header",
+			acceptHeaderValue: "foo",
+			notAcceptable:     true,
+		},
+	}
+
+	oldDefault := model.GetNameEscapingScheme()
+	model.SetNameEscapingScheme(model.ValueEncodingEscaping)
+	defer func() {
+		model.SetNameEscapingScheme(oldDefault)
+	}()
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			h := http.Header{}
+			if test.acceptHeaderValue != "" {
+				h.Add(hdrAccept, test.acceptHeaderValue)
+			}
+			f, err := NegotiateStrict(h)
+			if test.notAcceptable {
+				if !errors.Is(err, ErrNotAcceptable) {
+					t.Fatalf("expected error wrapping ErrNotAcceptable, got %v", err)
+				}
+				if f != FmtUnknown {
+					t.Errorf("expected format %s, got %s", FmtUnknown, f)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if string(f) != test.expectedFmt {
+				t.Errorf("expected format %s, got %s", test.expectedFmt, f)
+			}
+		})
+	}
+}
+
+func TestSupportedMediaTypes(t *testing.T) {
+	expected := []string{
+		"application/vnd.google.protobuf;proto=io.prometheus.client.MetricFamily;encoding=delimited",
+		"application/vnd.google.protobuf;proto=io.prometheus.client.MetricFamily;encoding=text",
+		"application/vnd.google.protobuf;proto=io.prometheus.client.MetricFamily;encoding=compact-text",
+		"text/plain;version=0.0.4",
+		"text/plain;version=1.0.0",
+		"application/openmetrics-text;version=0.0.1",
+		"application/openmetrics-text;version=1.0.0",
+		"application/openmetrics-text;version=2.0.0",
+		"application/openmetrics-protobuf;version=1.0.0",
+	}
+	got := SupportedMediaTypes()
+	if !reflect.DeepEqual(got, expected) {
+		t.Fatalf("expected %v, got %v", expected, got)
+	}
+
+	// Each media type has to be accepted by NegotiateStrict.
+	for _, mediaType := range got {
+		h := http.Header{}
+		h.Add(hdrAccept, mediaType)
+		if _, err := NegotiateStrict(h); err != nil {
+			t.Errorf("media type %q: unexpected error: %s", mediaType, err)
+		}
+	}
+
+	// Callers must be able to modify the result.
+	got[0] = "modified"
+	if SupportedMediaTypes()[0] != expected[0] {
+		t.Error("modifying the result of SupportedMediaTypes affected later calls")
+	}
+}
+
+func TestEncode(t *testing.T) {
+	metric1 := &dto.MetricFamily{
+		Name: proto.String("foo_metric"),
+		Type: dto.MetricType_UNTYPED.Enum(),
+		Unit: proto.String("seconds"),
+		Metric: []*dto.Metric{
+			{
+				Untyped: &dto.Untyped{
+					Value: proto.Float64(1.234),
+				},
+			},
+		},
+	}
+
+	scenarios := []struct {
+		metric  *dto.MetricFamily
+		format  Format
+		options []EncoderOption
+		expOut  string
+	}{
+		// 1: Untyped ProtoDelim
+		{
+			metric: metric1,
+			format: FmtProtoDelim,
+		},
+		// 2: Untyped FmtProtoCompact
+		{
+			metric: metric1,
+			format: FmtProtoCompact,
+		},
+		// 3: Untyped FmtProtoText
+		{
+			metric: metric1,
+			format: FmtProtoText,
+		},
+		// 4: Untyped FmtText
+		{
+			metric: metric1,
+			format: FmtText,
+			expOut: `# TYPE foo_metric untyped
+foo_metric 1.234
+`,
+		},
+		// 5: Untyped FmtOpenMetrics_0_0_1
+		{
+			metric: metric1,
+			format: FmtOpenMetrics_0_0_1,
+			expOut: `# TYPE foo_metric unknown
+foo_metric 1.234
+`,
+		},
+		// 6: Untyped FmtOpenMetrics_1_0_0
+		{
+			metric: metric1,
+			format: FmtOpenMetrics_1_0_0,
+			expOut: `# TYPE foo_metric unknown
+foo_metric 1.234
+`,
+		},
+		// 7: Simple Counter FmtOpenMetrics_0_0_1 unit opted in
+		{
+			metric:  metric1,
+			format:  FmtOpenMetrics_0_0_1,
+			options: []EncoderOption{WithUnit()},
+			expOut: `# TYPE foo_metric_seconds unknown
+# UNIT foo_metric_seconds seconds
+foo_metric_seconds 1.234
+`,
+		},
+		// 8: Simple Counter FmtOpenMetrics_1_0_0 unit opted out
+		{
+			metric: metric1,
+			format: FmtOpenMetrics_1_0_0,
+			expOut: `# TYPE foo_metric unknown
+foo_metric 1.234
+`,
+		},
+	}
+	for i, scenario := range scenarios {
+		out := bytes.NewBuffer(make([]byte, 0, len(scenario.expOut)))
+		enc := NewEncoder(out, scenario.format, scenario.options...)
+		err := enc.Encode(scenario.metric)
+		if err != nil {
+			t.Errorf("%d. error: %s", i, err)
+			continue
+		}
+
+		if expected, got := len(scenario.expOut), len(out.Bytes()); expected != 0 && expected != got {
+			t.Errorf(
+				"%d. expected %d bytes written, got %d",
+				i, expected, got,
+			)
+		}
+		if expected, got := scenario.expOut, out.String(); expected != "" && expected != got {
+			t.Errorf(
+				"%d. expected out=%q, got %q",
+				i, expected, got,
+			)
+		}
+
+		if len(out.Bytes()) == 0 {
+			t.Errorf(
+				"%d. expected output not to be empty",
+				i,
+			)
+		}
+	}
+}
+
+func TestEscapedEncode(t *testing.T) {
+	var buff bytes.Buffer
+	delimEncoder := NewEncoder(&buff, FmtProtoDelim+"; escaping=underscores")
+	metric := &dto.MetricFamily{
+		Name: proto.String("foo.metric"),
+		Type: dto.MetricType_UNTYPED.Enum(),
+		Metric: []*dto.Metric{
+			{
+				Untyped: &dto.Untyped{
+					Value: proto.Float64(1.234),
+				},
+			},
+			{
+				Label: []*dto.LabelPair{
+					{
+						Name:  proto.String("dotted.label.name"),
+						Value: proto.String("my.label.value"),
+					},
+				},
+				Untyped: &dto.Untyped{
+					Value: proto.Float64(8),
+				},
+			},
+		},
+	}
+
+	err := delimEncoder.Encode(metric)
+	if err != nil {
+		t.Errorf("unexpected error during encode: %s", err.Error())
+	}
+
+	out := buff.Bytes()
+	if len(out) == 0 {
+		t.Errorf("expected the output bytes buffer to be non-empty")
+	}
+
+	buff.Reset()
+
+	compactEncoder := NewEncoder(&buff, FmtProtoCompact)
+	err = compactEncoder.Encode(metric)
+	if err != nil {
+		t.Errorf("unexpected error during encode: %s", err.Error())
+	}
+
+	out = buff.Bytes()
+	if len(out) == 0 {
+		t.Errorf("expected the output bytes buffer to be non-empty")
+	}
+
+	buff.Reset()
+
+	protoTextEncoder := NewEncoder(&buff, FmtProtoText)
+	err = protoTextEncoder.Encode(metric)
+	if err != nil {
+		t.Errorf("unexpected error during encode: %s", err.Error())
+	}
+
+	out = buff.Bytes()
+	if len(out) == 0 {
+		t.Errorf("expected the output bytes buffer to be non-empty")
+	}
+
+	buff.Reset()
+
+	textEncoder := NewEncoder(&buff, FmtText)
+	err = textEncoder.Encode(metric)
+	if err != nil {
+		t.Errorf("unexpected error during encode: %s", err.Error())
+	}
+
+	out = buff.Bytes()
+	if len(out) == 0 {
+		t.Errorf("expected the output bytes buffer to be non-empty")
 	}
 
 	expected := `# TYPE U__foo_2e_metric untyped
@@ -388,7 +1560,966 @@ U__foo_2e_metric 1.234
 U__foo_2e_metric{U__dotted_2e_label_2e_name="my.label.value"} 8
 `
 
-	if string(out) != expected {
-		t.Errorf("expected TextEncoder to return %s, but got %s instead", expected, string(out))
+	if string(out) != expected {
+		t.Errorf("expected TextEncoder to return %s, but got %s instead", expected, string(out))
+	}
+}
+
+func TestEncodeText_1_0_0(t *testing.T) {
+	metric := &dto.MetricFamily{
+		Name: proto.String("my.metric"),
+		Help: proto.String("some help"),
+		Type: dto.MetricType_UNTYPED.Enum(),
+		Metric: []*dto.Metric{
+			{
+				Label: []*dto.LabelPair{
+					{
+						Name:  proto.String("legacy_label"),
+						Value: proto.String("a"),
+					},
+					{
+						Name:  proto.String("dotted.label"),
+						Value: proto.String("b"),
+					},
+				},
+				Untyped: &dto.Untyped{
+					Value: proto.Float64(3.14),
+				},
+			},
+		},
+	}
+	legacyMetric := &dto.MetricFamily{
+		Name: proto.String("my_metric"),
+		Help: proto.String("some help"),
+		Type: dto.MetricType_UNTYPED.Enum(),
+		Metric: []*dto.Metric{
+			{
+				Label: []*dto.LabelPair{
+					{
+						Name:  proto.String("legacy_label"),
+						Value: proto.String("a"),
+					},
+				},
+				Untyped: &dto.Untyped{
+					Value: proto.Float64(3.14),
+				},
+			},
+		},
+	}
+
+	var buff bytes.Buffer
+	if err := NewEncoder(&buff, FmtText_1_0_0+"; escaping=allow-utf-8").Encode(metric); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	expected := `# HELP "my.metric" some help
+# TYPE "my.metric" untyped
+{"my.metric",legacy_label="a","dotted.label"="b"} 3.14
+`
+	if buff.String() != expected {
+		t.Errorf("expected output %q, got %q", expected, buff.String())
+	}
+
+	var legacyBuff, legacyBuff_1_0_0 bytes.Buffer
+	if err := NewEncoder(&legacyBuff, FmtText).Encode(legacyMetric); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if err := NewEncoder(&legacyBuff_1_0_0, FmtText_1_0_0+"; escaping=allow-utf-8").Encode(legacyMetric); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if legacyBuff.String() != legacyBuff_1_0_0.String() {
+		t.Errorf("expected 1.0.0 output %q to be identical to 0.0.4 output %q", legacyBuff_1_0_0.String(), legacyBuff.String())
+	}
+}
+
+func TestEncoderEscapingAndValidationOptions(t *testing.T) {
+	metric := &dto.MetricFamily{
+		Name: proto.String("foo.metric"),
+		Type: dto.MetricType_UNTYPED.Enum(),
+		Metric: []*dto.Metric{
+			{
+				Label: []*dto.LabelPair{
+					{
+						Name:  proto.String("dotted.label.name"),
+						Value: proto.String("my.label.value"),
+					},
+				},
+				Untyped: &dto.Untyped{
+					Value: proto.Float64(8),
+				},
+			},
+		},
+	}
+
+	scenarios := []struct {
+		name    string
+		format  Format
+		options []EncoderOption
+		expOut  string
+		expErr  bool
+	}{
+		{
+			name:   "escaping from format",
+			format: FmtText + "; escaping=underscores",
+			expOut: `# TYPE foo_metric untyped
+foo_metric{dotted_label_name="my.label.value"} 8
+`,
+		},
+		{
+			name:    "escaping option overrides format",
+			format:  FmtText + "; escaping=underscores",
+			options: []EncoderOption{WithEscapingScheme(model.DotsEscaping)},
+			expOut: `# TYPE foo_dot_metric untyped
+foo_dot_metric{dotted_dot_label_dot_name="my.label.value"} 8
+`,
+		},
+		{
+			name:    "escaping option allows utf-8",
+			format:  FmtText + "; escaping=underscores",
+			options: []EncoderOption{WithEscapingScheme(model.NoEscaping)},
+			expOut: `# TYPE "foo.metric" untyped
+{"foo.metric","dotted.label.name"="my.label.value"} 8
+`,
+		},
+		{
+			name:    "percent escaping is rejected",
+			format:  FmtText,
+			options: []EncoderOption{WithEscapingScheme(model.PercentEscaping)},
+			expErr:  true,
+		},
+		{
+			name:   "percent escaping term is rejected",
+			format: FmtText + "; escaping=percent",
+			expErr: true,
+		},
+		{
+			name:    "legacy validation of unescaped names fails",
+			format:  FmtText,
+			options: []EncoderOption{WithEscapingScheme(model.NoEscaping), WithValidationScheme(model.LegacyValidation)},
+			expErr:  true,
+		},
+		{
+			name:    "legacy validation of escaped names succeeds",
+			format:  FmtText,
+			options: []EncoderOption{WithEscapingScheme(model.UnderscoreEscaping), WithValidationScheme(model.LegacyValidation)},
+			expOut: `# TYPE foo_metric untyped
+foo_metric{dotted_label_name="my.label.value"} 8
+`,
+		},
+		{
+			name:    "utf-8 validation of unescaped names succeeds",
+			format:  FmtOpenMetrics_2_0_0,
+			options: []EncoderOption{WithEscapingScheme(model.NoEscaping), WithValidationScheme(model.UTF8Validation)},
+			expOut: `# TYPE "foo.metric" unknown
+{"foo.metric","dotted.label.name"="my.label.value"} 8.0
+`,
+		},
+	}
+
+	for _, scenario := range scenarios {
+		t.Run(scenario.name, func(t *testing.T) {
+			var buff bytes.Buffer
+			enc := NewEncoder(&buff, scenario.format, scenario.options...)
+			err := enc.Encode(metric)
+			if scenario.expErr {
+				if err == nil {
+					t.Errorf("expected error, got none")
+				}
+				if buff.Len() != 0 {
+					t.Errorf("expected no output, got %q", buff.String())
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if buff.String() != scenario.expOut {
+				t.Errorf("expected output %q, got %q", scenario.expOut, buff.String())
+			}
+		})
+	}
+
+	// UTF-8 validation rejects NUL bytes like model.IsValidMetricNameWithScheme.
+	nul := &dto.MetricFamily{
+		Name:   proto.String("foo\x00metric"),
+		Type:   dto.MetricType_UNTYPED.Enum(),
+		Metric: []*dto.Metric{{Untyped: &dto.Untyped{Value: proto.Float64(1)}}},
+	}
+	if err := NewEncoder(&bytes.Buffer{}, FmtOpenMetrics_2_0_0, WithEscapingScheme(model.NoEscaping), WithValidationScheme(model.UTF8Validation)).Encode(nul); err == nil {
+		t.Errorf("expected error for a metric name containing a NUL byte")
+	}
+
+	// The option also applies to protobuf formats.
+	var buff bytes.Buffer
+	enc := NewEncoder(&buff, FmtProtoDelim+"; escaping=underscores", WithEscapingScheme(model.DotsEscaping))
+	if err := enc.Encode(metric); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	var got dto.MetricFamily
+	if err := NewDecoder(&buff, FmtProtoDelim).Decode(&got); err != nil {
+		t.Fatalf("unexpected error decoding: %s", err)
+	}
+	if got.GetName() != "foo_dot_metric" {
+		t.Errorf("expected name foo_dot_metric, got %s", got.GetName())
+	}
+	if name := got.GetMetric()[0].GetLabel()[0].GetName(); name != "dotted_dot_label_dot_name" {
+		t.Errorf("expected label name dotted_dot_label_dot_name, got %s", name)
+	}
+}
+
+func TestEncoderSetEscapingScheme(t *testing.T) {
+	metric := &dto.MetricFamily{
+		Name: proto.String("foo.metric"),
+		Type: dto.MetricType_UNTYPED.Enum(),
+		Metric: []*dto.Metric{
+			{
+				Label: []*dto.LabelPair{
+					{
+						Name:  proto.String("dotted.label"),
+						Value: proto.String("value"),
+					},
+				},
+				Untyped: &dto.Untyped{
+					Value: proto.Float64(8),
+				},
+			},
+		},
+	}
+
+	var buff bytes.Buffer
+	enc := NewEncoder(&buff, FmtText+"; escaping=underscores", WithEscapingScheme(model.ValueEncodingEscaping))
+	setter, ok := enc.(EscapingSchemeSetter)
+	if !ok {
+		t.Fatalf("expected encoder to implement EscapingSchemeSetter")
+	}
+
+	setter.SetEscapingScheme(model.UnderscoreEscaping)
+	if err := enc.Encode(metric); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	first := buff.String()
+	buff.Reset()
+
+	setter.SetEscapingScheme(model.DotsEscaping)
+	if err := enc.Encode(metric); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	second := buff.String()
+
+	expFirst := `# TYPE foo_metric untyped
+foo_metric{dotted_label="value"} 8
+`
+	expSecond := `# TYPE foo_dot_metric untyped
+foo_dot_metric{dotted_dot_label="value"} 8
+`
+	if first != expFirst {
+		t.Errorf("expected output with underscores\n%s\ngot\n%s", expFirst, first)
+	}
+	if second != expSecond {
+		t.Errorf("expected output with dots\n%s\ngot\n%s", expSecond, second)
+	}
+}
+
+func TestEncoderWithEscaper(t *testing.T) {
+	families := []*dto.MetricFamily{
+		{
+			Name: proto.String("foo.metric"),
+			Type: dto.MetricType_COUNTER.Enum(),
+			Metric: []*dto.Metric{
+				{
+					Label: []*dto.LabelPair{
+						{Name: proto.String("dotted.label"), Value: proto.String("value")},
+						{Name: proto.String(model.MetricNameLabel), Value: proto.String("foo.metric")},
+					},
+					Counter: &dto.Counter{Value: proto.Float64(8)},
+				},
+			},
+		},
+		{
+			Name: proto.String("plain_metric"),
+			Type: dto.MetricType_GAUGE.Enum(),
+			Metric: []*dto.Metric{
+				{
+					Label: []*dto.LabelPair{{Name: proto.String("dotted.label"), Value: proto.String("other")}},
+					Gauge: &dto.Gauge{Value: proto.Float64(1)},
+				},
+			},
+		},
+	}
+
+	for _, format := range []Format{FmtText, FmtOpenMetrics_1_0_0, FmtProtoDelim, FmtProtoCompact} {
+		for _, scheme := range []model.EscapingScheme{model.UnderscoreEscaping, model.DotsEscaping, model.ValueEncodingEscaping} {
+			encode := func(option EncoderOption) string {
+				var buff bytes.Buffer
+				enc := NewEncoder(&buff, format, option)
+				for i := 0; i < 2; i++ {
+					for _, mf := range families {
+						if err := enc.Encode(mf); err != nil {
+							t.Fatalf("unexpected error: %v", err)
+						}
+					}
+				}
+				return buff.String()
+			}
+			escaper := model.NewEscaper(scheme, 100)
+			if got, want := encode(WithEscaper(escaper)), encode(WithEscapingScheme(scheme)); got != want {
+				t.Errorf("%s, %s: expected output\n%s\ngot\n%s", format, scheme, want, got)
+			}
+		}
+	}
+
+	// SetEscapingScheme takes precedence over the scheme of the Escaper.
+	var buff bytes.Buffer
+	enc := NewEncoder(&buff, FmtText, WithEscaper(model.NewEscaper(model.DotsEscaping, 100)))
+	enc.(EscapingSchemeSetter).SetEscapingScheme(model.UnderscoreEscaping)
+	if err := enc.Encode(families[0]); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !strings.HasPrefix(buff.String(), "# TYPE foo_metric counter\n") {
+		t.Errorf("expected underscore escaping, got\n%s", buff.String())
+	}
+}
+
+func TestEncodeTimestamps(t *testing.T) {
+	scenarios := []struct {
+		timestampMs int64
+		text        string
+		openMetrics string
+	}{
+		{timestampMs: 1700000000123, text: "1700000000123", openMetrics: "1.700000000123e+09"},
+		{timestampMs: 1500, text: "1500", openMetrics: "1.5"},
+		{timestampMs: 1, text: "1", openMetrics: "0.001"},
+		{timestampMs: 0, text: "0", openMetrics: "0.0"},
+		{timestampMs: -1500, text: "-1500", openMetrics: "-1.5"},
+	}
+
+	for _, scenario := range scenarios {
+		mf := &dto.MetricFamily{
+			Name: proto.String("foo"),
+			Type: dto.MetricType_GAUGE.Enum(),
+			Metric: []*dto.Metric{
+				{
+					Gauge:       &dto.Gauge{Value: proto.Float64(42)},
+					TimestampMs: proto.Int64(scenario.timestampMs),
+				},
+			},
+		}
+
+		// The text format uses milliseconds.
+		var buf bytes.Buffer
+		if err := NewEncoder(&buf, FmtText).Encode(mf); err != nil {
+			t.Fatalf("%d: unexpected error: %s", scenario.timestampMs, err)
+		}
+		expected := "# TYPE foo gauge\nfoo 42 " + scenario.text + "\n"
+		if got := buf.String(); got != expected {
+			t.Errorf("%d: expected text format %q, got %q", scenario.timestampMs, expected, got)
+		}
+
+		// OpenMetrics uses seconds, which have to convert back to the
+		// original milliseconds.
+		buf.Reset()
+		if err := NewEncoder(&buf, FmtOpenMetrics_1_0_0).Encode(mf); err != nil {
+			t.Fatalf("%d: unexpected error: %s", scenario.timestampMs, err)
+		}
+		expected = "# TYPE foo gauge\nfoo 42.0 " + scenario.openMetrics + "\n"
+		if got := buf.String(); got != expected {
+			t.Errorf("%d: expected OpenMetrics format %q, got %q", scenario.timestampMs, expected, got)
+		}
+		seconds, err := strconv.ParseFloat(scenario.openMetrics, 64)
+		if err != nil {
+			t.Fatalf("%d: unexpected error parsing %q: %s", scenario.timestampMs, scenario.openMetrics, err)
+		}
+		if ms := int64(math.Round(seconds * 1000)); ms != scenario.timestampMs {
+			t.Errorf("%d: OpenMetrics timestamp %q converts back to %d ms", scenario.timestampMs, scenario.openMetrics, ms)
+		}
+	}
+}
+
+func TestEncodeOpenMetricsCloseTwice(t *testing.T) {
+	metric := &dto.MetricFamily{
+		Name: proto.String("foo_metric"),
+		Type: dto.MetricType_UNTYPED.Enum(),
+		Metric: []*dto.Metric{
+			{
+				Untyped: &dto.Untyped{
+					Value: proto.Float64(1.234),
+				},
+			},
+		},
+	}
+
+	var buff bytes.Buffer
+	enc := NewEncoder(&buff, FmtOpenMetrics_1_0_0)
+	for i := 0; i < 2; i++ {
+		if err := enc.Encode(metric); err != nil {
+			t.Fatalf("unexpected error during encode: %s", err)
+		}
+	}
+	for i := 0; i < 2; i++ {
+		if err := enc.(Closer).Close(); err != nil {
+			t.Fatalf("unexpected error closing encoder: %s", err)
+		}
+	}
+
+	expected := `# TYPE foo_metric unknown
+foo_metric 1.234
+# TYPE foo_metric unknown
+foo_metric 1.234
+# EOF
+`
+	if buff.String() != expected {
+		t.Errorf("expected output %q, got %q", expected, buff.String())
+	}
+	if n := strings.Count(buff.String(), "# EOF"); n != 1 {
+		t.Errorf("expected exactly one EOF line, got %d", n)
+	}
+}
+
+func TestEncodeWithDefaultHelp(t *testing.T) {
+	metric := &dto.MetricFamily{
+		Name: proto.String("foo_metric"),
+		Type: dto.MetricType_UNTYPED.Enum(),
+		Metric: []*dto.Metric{
+			{
+				Untyped: &dto.Untyped{
+					Value: proto.Float64(1.234),
+				},
+			},
+		},
+	}
+	withHelp := &dto.MetricFamily{
+		Name:   proto.String("bar_metric"),
+		Help:   proto.String("existing help"),
+		Type:   dto.MetricType_UNTYPED.Enum(),
+		Metric: metric.Metric,
+	}
+	defaultHelp := WithDefaultHelp(func(name string) string {
+		return "help for " + name
+	})
+
+	scenarios := []struct {
+		name    string
+		metric  *dto.MetricFamily
+		format  Format
+		options []EncoderOption
+		expOut  string
+	}{
+		{
+			name:   "no option omits help",
+			metric: metric,
+			format: FmtText,
+			expOut: `# TYPE foo_metric untyped
+foo_metric 1.234
+`,
+		},
+		{
+			name:    "text with default help",
+			metric:  metric,
+			format:  FmtText,
+			options: []EncoderOption{defaultHelp},
+			expOut: `# HELP foo_metric help for foo_metric
+# TYPE foo_metric untyped
+foo_metric 1.234
+`,
+		},
+		{
+			name:    "openmetrics with default help",
+			metric:  metric,
+			format:  FmtOpenMetrics_1_0_0,
+			options: []EncoderOption{defaultHelp},
+			expOut: `# HELP foo_metric help for foo_metric
+# TYPE foo_metric unknown
+foo_metric 1.234
+`,
+		},
+		{
+			name:    "existing help is kept",
+			metric:  withHelp,
+			format:  FmtText,
+			options: []EncoderOption{defaultHelp},
+			expOut: `# HELP bar_metric existing help
+# TYPE bar_metric untyped
+bar_metric 1.234
+`,
+		},
+		{
+			name:   "empty default help omits help",
+			metric: metric,
+			format: FmtText,
+			options: []EncoderOption{WithDefaultHelp(func(string) string {
+				return ""
+			})},
+			expOut: `# TYPE foo_metric untyped
+foo_metric 1.234
+`,
+		},
+	}
+
+	for _, scenario := range scenarios {
+		t.Run(scenario.name, func(t *testing.T) {
+			var buff bytes.Buffer
+			enc := NewEncoder(&buff, scenario.format, scenario.options...)
+			if err := enc.Encode(scenario.metric); err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if buff.String() != scenario.expOut {
+				t.Errorf("expected output %q, got %q", scenario.expOut, buff.String())
+			}
+		})
+	}
+	if metric.Help != nil {
+		t.Errorf("expected input metric family to be unchanged, got help %q", metric.GetHelp())
+	}
+}
+
+func TestEncodeWithoutRepeatedMetadata(t *testing.T) {
+	family := func(name string, value float64) *dto.MetricFamily {
+		return &dto.MetricFamily{
+			Name: proto.String(name),
+			Help: proto.String("Some help."),
+			Type: dto.MetricType_GAUGE.Enum(),
+			Metric: []*dto.Metric{
+				{
+					Label: []*dto.LabelPair{{Name: proto.String("n"), Value: proto.String(strconv.FormatFloat(value, 'f', -1, 64))}},
+					Gauge: &dto.Gauge{Value: proto.Float64(value)},
+				},
+			},
+		}
+	}
+
+	scenarios := []struct {
+		name    string
+		format  Format
+		options []EncoderOption
+		expOut  string
+	}{
+		{
+			name:    "text",
+			format:  FmtText,
+			options: []EncoderOption{WithoutRepeatedMetadata()},
+			expOut: `# HELP foo Some help.
+# TYPE foo gauge
+foo{n="1"} 1
+foo{n="2"} 2
+# HELP bar Some help.
+# TYPE bar gauge
+bar{n="3"} 3
+foo{n="4"} 4
+`,
+		},
+		{
+			name:    "openmetrics",
+			format:  FmtOpenMetrics_1_0_0,
+			options: []EncoderOption{WithoutRepeatedMetadata()},
+			expOut: `# HELP foo Some help.
+# TYPE foo gauge
+foo{n="1"} 1.0
+foo{n="2"} 2.0
+# HELP bar Some help.
+# TYPE bar gauge
+bar{n="3"} 3.0
+foo{n="4"} 4.0
+# EOF
+`,
+		},
+		{
+			name:   "text without option",
+			format: FmtText,
+			expOut: `# HELP foo Some help.
+# TYPE foo gauge
+foo{n="1"} 1
+# HELP foo Some help.
+# TYPE foo gauge
+foo{n="2"} 2
+# HELP bar Some help.
+# TYPE bar gauge
+bar{n="3"} 3
+# HELP foo Some help.
+# TYPE foo gauge
+foo{n="4"} 4
+`,
+		},
+	}
+
+	for _, scenario := range scenarios {
+		t.Run(scenario.name, func(t *testing.T) {
+			var buff bytes.Buffer
+			enc := NewEncoder(&buff, scenario.format, scenario.options...)
+			for i, name := range []string{"foo", "foo", "bar", "foo"} {
+				if err := enc.Encode(family(name, float64(i+1))); err != nil {
+					t.Fatalf("unexpected error: %s", err)
+				}
+			}
+			if err := enc.(Closer).Close(); err != nil {
+				t.Fatalf("unexpected error closing encoder: %s", err)
+			}
+			if got := buff.String(); got != scenario.expOut {
+				t.Errorf("expected:\n%s\ngot:\n%s", scenario.expOut, got)
+			}
+		})
+	}
+}
+
+func TestEncodeStaleSamples(t *testing.T) {
+	staleNaN := math.Float64frombits(model.StaleNaN)
+	stale := &dto.MetricFamily{
+		Name: proto.String("foo_metric"),
+		Type: dto.MetricType_GAUGE.Enum(),
+		Metric: []*dto.Metric{
+			{
+				Gauge: &dto.Gauge{
+					Value: proto.Float64(staleNaN),
+				},
+			},
+		},
+	}
+	mixed := &dto.MetricFamily{
+		Name: proto.String("foo_metric"),
+		Type: dto.MetricType_GAUGE.Enum(),
+		Metric: []*dto.Metric{
+			{
+				Label: []*dto.LabelPair{
+					{
+						Name:  proto.String("instance"),
+						Value: proto.String("a"),
+					},
+				},
+				Gauge: &dto.Gauge{
+					Value: proto.Float64(staleNaN),
+				},
+			},
+			{
+				Label: []*dto.LabelPair{
+					{
+						Name:  proto.String("instance"),
+						Value: proto.String("b"),
+					},
+				},
+				Gauge: &dto.Gauge{
+					Value: proto.Float64(math.NaN()),
+				},
+			},
+		},
+	}
+
+	scenarios := []struct {
+		name    string
+		metric  *dto.MetricFamily
+		format  Format
+		options []EncoderOption
+		expOut  string
+	}{
+		{
+			name:   "stale marker is written as NaN",
+			metric: stale,
+			format: FmtText,
+			expOut: `# TYPE foo_metric gauge
+foo_metric NaN
+`,
+		},
+		{
+			name:    "stale sample is skipped",
+			metric:  stale,
+			format:  FmtText,
+			options: []EncoderOption{WithoutStaleSamples()},
+			expOut:  "",
+		},
+		{
+			name:    "stale sample is skipped in OpenMetrics",
+			metric:  stale,
+			format:  FmtOpenMetrics_1_0_0,
+			options: []EncoderOption{WithoutStaleSamples()},
+			expOut:  "",
+		},
+		{
+			name:    "only stale samples are skipped",
+			metric:  mixed,
+			format:  FmtText,
+			options: []EncoderOption{WithoutStaleSamples()},
+			expOut: `# TYPE foo_metric gauge
+foo_metric{instance="b"} NaN
+`,
+		},
+	}
+
+	for _, scenario := range scenarios {
+		t.Run(scenario.name, func(t *testing.T) {
+			var buff bytes.Buffer
+			enc := NewEncoder(&buff, scenario.format, scenario.options...)
+			if err := enc.Encode(scenario.metric); err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if buff.String() != scenario.expOut {
+				t.Errorf("expected output %q, got %q", scenario.expOut, buff.String())
+			}
+		})
+	}
+
+	// The protobuf format preserves the exact bit pattern.
+	var buff bytes.Buffer
+	if err := NewEncoder(&buff, FmtProtoDelim).Encode(stale); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	var decoded dto.MetricFamily
+	if err := NewDecoder(&buff, FmtProtoDelim).Decode(&decoded); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if v := decoded.GetMetric()[0].GetGauge().GetValue(); !model.IsStaleNaN(v) {
+		t.Errorf("expected stale marker, got bits %x", math.Float64bits(v))
+	}
+}
+
+func TestEncodeOpenMetricsUTF8Names(t *testing.T) {
+	metric := &dto.MetricFamily{
+		Name: proto.String("my.metric_total"),
+		Help: proto.String("some help"),
+		Type: dto.MetricType_COUNTER.Enum(),
+		Metric: []*dto.Metric{
+			{
+				Label: []*dto.LabelPair{
+					{
+						Name:  proto.String("legacy_label"),
+						Value: proto.String("a"),
+					},
+					{
+						Name:  proto.String("dotted.label"),
+						Value: proto.String("b"),
+					},
+				},
+				Counter: &dto.Counter{
+					Value: proto.Float64(1),
+				},
+			},
+		},
+	}
+	legacyMetric := &dto.MetricFamily{
+		Name: proto.String("my_metric_total"),
+		Type: dto.MetricType_COUNTER.Enum(),
+		Metric: []*dto.Metric{
+			{
+				Label: []*dto.LabelPair{
+					{
+						Name:  proto.String("legacy_label"),
+						Value: proto.String("a"),
+					},
+				},
+				Counter: &dto.Counter{
+					Value: proto.Float64(1),
+				},
+			},
+		},
+	}
+
+	scenarios := []struct {
+		name   string
+		metric *dto.MetricFamily
+		format Format
+		expOut string
+		expErr bool
+	}{
+		{
+			name:   "2.0.0 with utf-8 quotes names",
+			metric: metric,
+			format: FmtOpenMetrics_2_0_0 + "; escaping=allow-utf-8",
+			expOut: `# HELP "my.metric" some help
+# TYPE "my.metric" counter
+{"my.metric_total",legacy_label="a","dotted.label"="b"} 1.0
+# EOF
+`,
+		},
+		{
+			name:   "2.0.0 with escaping",
+			metric: metric,
+			format: FmtOpenMetrics_2_0_0 + "; escaping=underscores",
+			expOut: `# HELP my_metric some help
+# TYPE my_metric counter
+my_metric_total{legacy_label="a",dotted_label="b"} 1.0
+# EOF
+`,
+		},
+		{
+			name:   "2.0.0 with legacy names is identical to 1.0.0",
+			metric: legacyMetric,
+			format: FmtOpenMetrics_2_0_0 + "; escaping=allow-utf-8",
+			expOut: `# TYPE my_metric counter
+my_metric_total{legacy_label="a"} 1.0
+# EOF
+`,
+		},
+		{
+			name:   "1.0.0 with utf-8 names fails",
+			metric: metric,
+			format: FmtOpenMetrics_1_0_0 + "; escaping=allow-utf-8",
+			expErr: true,
+		},
+		{
+			name:   "0.0.1 with utf-8 names fails",
+			metric: metric,
+			format: FmtOpenMetrics_0_0_1 + "; escaping=allow-utf-8",
+			expErr: true,
+		},
+		{
+			name:   "1.0.0 with allow-utf-8 fails even for legacy names",
+			metric: legacyMetric,
+			format: FmtOpenMetrics_1_0_0 + "; escaping=allow-utf-8",
+			expErr: true,
+		},
+	}
+
+	for _, scenario := range scenarios {
+		t.Run(scenario.name, func(t *testing.T) {
+			var buff bytes.Buffer
+			enc := NewEncoder(&buff, scenario.format)
+			err := enc.Encode(scenario.metric)
+			if scenario.expErr {
+				if err == nil {
+					t.Errorf("expected error, got none")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if err := enc.(Closer).Close(); err != nil {
+				t.Fatalf("unexpected error closing encoder: %s", err)
+			}
+			if buff.String() != scenario.expOut {
+				t.Errorf("expected output %q, got %q", scenario.expOut, buff.String())
+			}
+		})
+	}
+}
+
+// TestEncodeLazyEscapingMatchesEscapedFamily verifies that the text and
+// OpenMetrics encoders, which escape names while writing them, produce the
+// same output as escaping the whole MetricFamily first and then encoding it.
+func TestEncodeLazyEscapingMatchesEscapedFamily(t *testing.T) {
+	metric := &dto.MetricFamily{
+		Name: proto.String("my.metric_total"),
+		Help: proto.String("some help"),
+		Type: dto.MetricType_COUNTER.Enum(),
+		Metric: []*dto.Metric{
+			{
+				Label: []*dto.LabelPair{
+					{
+						Name:  proto.String(model.MetricNameLabel),
+						Value: proto.String("my.metric_total"),
+					},
+					{
+						Name:  proto.String("legacy_label"),
+						Value: proto.String("a.b"),
+					},
+					{
+						Name:  proto.String("dotted.label"),
+						Value: proto.String("b"),
+					},
+					{
+						Name:  proto.String("colon:label"),
+						Value: proto.String("c"),
+					},
+				},
+				Counter: &dto.Counter{
+					Value:            proto.Float64(1),
+					CreatedTimestamp: &timestamppb.Timestamp{Seconds: 12345},
+					Exemplar: &dto.Exemplar{
+						Label: []*dto.LabelPair{
+							{
+								Name:  proto.String("trace.id"),
+								Value: proto.String("abc"),
+							},
+						},
+						Value:     proto.Float64(1),
+						Timestamp: &timestamppb.Timestamp{Seconds: 12345},
+					},
+				},
+			},
+			{
+				Label: []*dto.LabelPair{
+					{
+						Name:  proto.String("dotted.label"),
+						Value: proto.String("d"),
+					},
+				},
+				Counter: &dto.Counter{
+					Value: proto.Float64(2),
+				},
+			},
+		},
+	}
+
+	for _, scheme := range []model.EscapingScheme{
+		model.NoEscaping,
+		model.UnderscoreEscaping,
+		model.DotsEscaping,
+		model.ValueEncodingEscaping,
+	} {
+		t.Run(scheme.String(), func(t *testing.T) {
+			escaped := model.EscapeMetricFamily(metric, scheme)
+
+			var exp, got bytes.Buffer
+			if _, err := MetricFamilyToText(&exp, escaped); err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if err := NewEncoder(&got, FmtText, WithEscapingScheme(scheme)).Encode(metric); err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if got.String() != exp.String() {
+				t.Errorf("text: expected output %q, got %q", exp.String(), got.String())
+			}
+
+			exp.Reset()
+			got.Reset()
+			if _, err := MetricFamilyToOpenMetrics(&exp, escaped, WithCreatedLines()); err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			enc := NewEncoder(&got, FmtOpenMetrics_2_0_0, WithEscapingScheme(scheme), WithCreatedLines())
+			if err := enc.Encode(metric); err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if got.String() != exp.String() {
+				t.Errorf("OpenMetrics: expected output %q, got %q", exp.String(), got.String())
+			}
+		})
+	}
+}
+
+// TestNegotiatedFormatsAreValid checks that the Negotiate functions never
+// return a format that NewEncoder rejects, independent of the global default
+// escaping scheme.
+func TestNegotiatedFormatsAreValid(t *testing.T) {
+	defer model.SetNameEscapingScheme(model.GetNameEscapingScheme())
+
+	headers := []string{
+		"",
+		"*/*",
+		"image/png",
+		"text/plain;version=0.0.4",
+		"text/plain;version=0.0.4;escaping=allow-utf-8",
+		"text/plain;version=1.0.0;escaping=allow-utf-8",
+		"application/openmetrics-text;version=1.0.0;escaping=allow-utf-8",
+		"application/openmetrics-text;version=2.0.0;escaping=allow-utf-8",
+		"application/vnd.google.protobuf;proto=io.prometheus.client.MetricFamily;encoding=delimited;escaping=allow-utf-8",
+	}
+	for _, scheme := range []model.EscapingScheme{model.NoEscaping, model.UnderscoreEscaping, model.ValueEncodingEscaping} {
+		model.SetNameEscapingScheme(scheme)
+		for _, header := range headers {
+			h := http.Header{hdrAccept: []string{header}}
+			f, negotiated := NegotiateWithEscaping(h)
+			if err := f.Validate(); err != nil {
+				t.Errorf("default %s, Accept %q: negotiated invalid format: %s", scheme, header, err)
+			}
+			if got := f.ToEscapingScheme(); got != negotiated {
+				t.Errorf("default %s, Accept %q: expected escaping scheme %s, got %s", scheme, header, negotiated, got)
+			}
+			if f, err := NegotiateStrict(h); err == nil {
+				if err := f.Validate(); err != nil {
+					t.Errorf("default %s, Accept %q: NegotiateStrict returned invalid format: %s", scheme, header, err)
+				}
+			}
+			for _, f := range []Format{NegotiateIncludingOpenMetrics(h), NegotiateWithPreference(h, []FormatType{TypeOpenMetrics})} {
+				if err := f.Validate(); err != nil {
+					t.Errorf("default %s, Accept %q: negotiated invalid format: %s", scheme, header, err)
+				}
+			}
+		}
 	}
 }
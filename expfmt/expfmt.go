@@ -15,7 +15,9 @@
 package expfmt
 
 import (
+	"errors"
 	"fmt"
+	"mime"
 	"strings"
 
 	"github.com/prometheus/common/model"
@@ -40,13 +42,28 @@ const (
 	OpenMetricsType          = `application/openmetrics-text`
 	OpenMetricsVersion_0_0_1 = "0.0.1"
 	OpenMetricsVersion_1_0_0 = "1.0.0"
+	// OpenMetricsVersion_2_0_0 is the experimental OpenMetrics version that
+	// allows metric and label names outside of the legacy character set,
+	// written in the quoted syntax (`{"my.metric",label="x"} 1`).
+	OpenMetricsVersion_2_0_0 = "2.0.0"
+	// TextVersion_1_0_0 is the experimental text format version that allows
+	// metric and label names outside of the legacy character set, written in
+	// the quoted syntax (`{"my.metric",label="x"} 1`).
+	TextVersion_1_0_0 = "1.0.0"
+	// OpenMetricsProtoType is the media type of the experimental OpenMetrics
+	// protobuf encoding.
+	OpenMetricsProtoType = `application/openmetrics-protobuf`
 
 	// The Content-Type values for the different wire protocols. Do not do direct
-	// comparisons to these constants, instead use the comparison functions.
+	// comparisons to these constants, instead use the comparison functions
+	// (Format.Is, Format.FormatType, Format.IsProto, etc.).
 	// Deprecated: Use expfmt.NewFormat(expfmt.TypeUnknown) instead.
 	FmtUnknown Format = `<unknown>`
 	// Deprecated: Use expfmt.NewFormat(expfmt.TypeTextPlain) instead.
 	FmtText Format = `text/plain; version=` + TextVersion + `; charset=utf-8`
+	// FmtText_1_0_0 is experimental. NewFormat(TypeTextPlain) still returns
+	// FmtText.
+	FmtText_1_0_0 Format = `text/plain; version=` + TextVersion_1_0_0 + `; charset=utf-8`
 	// Deprecated: Use expfmt.NewFormat(expfmt.TypeProtoDelim) instead.
 	FmtProtoDelim Format = ProtoFmt + ` encoding=delimited`
 	// Deprecated: Use expfmt.NewFormat(expfmt.TypeProtoText) instead.
@@ -57,11 +74,27 @@ const (
 	FmtOpenMetrics_1_0_0 Format = OpenMetricsType + `; version=` + OpenMetricsVersion_1_0_0 + `; charset=utf-8`
 	// Deprecated: Use expfmt.NewFormat(expfmt.TypeOpenMetrics) instead.
 	FmtOpenMetrics_0_0_1 Format = OpenMetricsType + `; version=` + OpenMetricsVersion_0_0_1 + `; charset=utf-8`
+	// FmtOpenMetrics_2_0_0 is experimental. Use expfmt.NewOpenMetricsFormat
+	// to create it.
+	FmtOpenMetrics_2_0_0 Format = OpenMetricsType + `; version=` + OpenMetricsVersion_2_0_0 + `; charset=utf-8`
+	// FmtOpenMetricsProto is experimental. It is currently encoded like
+	// FmtProtoDelim, i.e. as length-delimited io.prometheus.client.MetricFamily
+	// messages.
+	FmtOpenMetricsProto Format = OpenMetricsProtoType + `; version=` + OpenMetricsVersion_1_0_0
+	// FmtAllowUTF8 is the escaping term to append to a Format to signal that
+	// names outside of the legacy character set are allowed, e.g.
+	// FmtText + FmtAllowUTF8. It uses the canonical spelling
+	// escaping=allow-utf-8. The alternative spellings escaping=allow-utf8,
+	// validchars=utf8, and validation-scheme=utf8 are accepted on input, but
+	// never emitted.
+	FmtAllowUTF8 Format = `; ` + model.EscapingKey + `=` + model.AllowUTF8
 )
 
 const (
-	hdrContentType = "Content-Type"
-	hdrAccept      = "Accept"
+	hdrContentType     = "Content-Type"
+	hdrContentEncoding = "Content-Encoding"
+	hdrAccept          = "Accept"
+	hdrAcceptEncoding  = "Accept-Encoding"
 )
 
 // FormatType is a Go enum representing the overall category for the given
@@ -77,12 +110,14 @@ const (
 	TypeProtoText
 	TypeTextPlain
 	TypeOpenMetrics
+	TypeOpenMetricsProto
 )
 
 // NewFormat generates a new Format from the type provided. Mostly used for
 // tests, most Formats should be generated as part of content negotiation in
-// encode.go. If a type has more than one version, the latest version will be
-// returned.
+// encode.go. If a type has more than one version, the latest stable version
+// will be returned. (For OpenMetrics, that is 1.0.0, use NewOpenMetricsFormat
+// to get the experimental version 2.0.0.)
 func NewFormat(t FormatType) Format {
 	switch t {
 	case TypeProtoCompact:
@@ -95,6 +130,8 @@ func NewFormat(t FormatType) Format {
 		return FmtText
 	case TypeOpenMetrics:
 		return FmtOpenMetrics_1_0_0
+	case TypeOpenMetricsProto:
+		return FmtOpenMetricsProto
 	default:
 		return FmtUnknown
 	}
@@ -109,76 +146,526 @@ func NewOpenMetricsFormat(version string) (Format, error) {
 	if version == OpenMetricsVersion_1_0_0 {
 		return FmtOpenMetrics_1_0_0, nil
 	}
+	if version == OpenMetricsVersion_2_0_0 {
+		return FmtOpenMetrics_2_0_0, nil
+	}
 	return FmtUnknown, fmt.Errorf("unknown open metrics version string")
 }
 
-// FormatType deduces an overall FormatType for the given format.
-func (f Format) FormatType() FormatType {
-	toks := strings.Split(string(f), ";")
-	params := make(map[string]string)
-	for i, t := range toks {
-		if i == 0 {
-			continue
+// ErrInvalidContentType is returned (wrapped) by ParseContentType and
+// ResponseFormatErr if a content type cannot be parsed or does not describe a
+// supported format.
+var ErrInvalidContentType = errors.New("invalid content type")
+
+// ParseContentType parses the value of a Content-Type header, as for example
+// received in a scrape response, into a Format. The media type has to be one
+// of the known exposition formats, and its parameters have to be supported
+// by that format, i.e. the returned Format has to pass Format.Validate. For
+// example, text/plain with version=0.0.4 and validchars=utf8 is rejected, as
+// version 0.0.4 of the text format does not support names outside of the
+// legacy character set. The returned Format is canonical, i.e. parameters are in the
+// same order and use the same spacing as the Fmt constants of this package, so
+// that the plain cases can still be compared to those constants directly.
+// Parameters that do not affect the format are dropped. Missing parameters
+// are filled in with the same defaults ResponseFormat and Negotiate use. If
+// the header cannot be parsed or describes an unsupported format, FmtUnknown
+// is returned alongside an error wrapping ErrInvalidContentType.
+func ParseContentType(header string) (Format, error) {
+	f, params, err := parseBaseFormat(header)
+	if err != nil {
+		return FmtUnknown, err
+	}
+	e, err := escapingParam(params)
+	if err != nil {
+		return FmtUnknown, fmt.Errorf("%w %q: %w", ErrInvalidContentType, header, err)
+	}
+	if e != "" {
+		f += Format("; " + model.EscapingKey + "=" + e)
+	}
+	if err := f.Validate(); err != nil {
+		return FmtUnknown, err
+	}
+	return f, nil
+}
+
+// parseBaseFormat works like ParseContentType, but the returned Format never
+// has an escaping term. Instead, the parsed media type parameters are returned
+// so that the caller can inspect them.
+func parseBaseFormat(header string) (Format, map[string]string, error) {
+	mediatype, params, err := mime.ParseMediaType(header)
+	if err != nil {
+		return FmtUnknown, nil, fmt.Errorf("%w %q: %w", ErrInvalidContentType, header, err)
+	}
+
+	var f Format
+	switch mediatype {
+	case ProtoType:
+		if p, ok := params["proto"]; ok && p != ProtoProtocol {
+			return FmtUnknown, nil, fmt.Errorf("%w %q: unsupported proto %q", ErrInvalidContentType, header, p)
 		}
-		args := strings.Split(t, "=")
-		if len(args) != 2 {
-			continue
+		switch e := params["encoding"]; e {
+		case "", "delimited":
+			f = FmtProtoDelim
+		case "text":
+			f = FmtProtoText
+		case "compact-text":
+			f = FmtProtoCompact
+		default:
+			return FmtUnknown, nil, fmt.Errorf("%w %q: unsupported encoding %q", ErrInvalidContentType, header, e)
 		}
-		params[strings.TrimSpace(args[0])] = strings.TrimSpace(args[1])
+	case "text/plain":
+		if c, ok := params["charset"]; ok && !strings.EqualFold(c, "utf-8") {
+			return FmtUnknown, nil, fmt.Errorf("%w %q: unsupported charset %q", ErrInvalidContentType, header, c)
+		}
+		switch v := params["version"]; v {
+		case "", TextVersion:
+			f = FmtText
+		case TextVersion_1_0_0:
+			f = FmtText_1_0_0
+		default:
+			return FmtUnknown, nil, fmt.Errorf("%w %q: unsupported text version %q", ErrInvalidContentType, header, v)
+		}
+	case OpenMetricsType:
+		if c, ok := params["charset"]; ok && !strings.EqualFold(c, "utf-8") {
+			return FmtUnknown, nil, fmt.Errorf("%w %q: unsupported charset %q", ErrInvalidContentType, header, c)
+		}
+		switch v := params["version"]; v {
+		case "", OpenMetricsVersion_0_0_1:
+			f = FmtOpenMetrics_0_0_1
+		case OpenMetricsVersion_1_0_0:
+			f = FmtOpenMetrics_1_0_0
+		case OpenMetricsVersion_2_0_0:
+			f = FmtOpenMetrics_2_0_0
+		default:
+			return FmtUnknown, nil, fmt.Errorf("%w %q: unsupported OpenMetrics version %q", ErrInvalidContentType, header, v)
+		}
+	case OpenMetricsProtoType:
+		switch v := params["version"]; v {
+		case "", OpenMetricsVersion_1_0_0:
+			f = FmtOpenMetricsProto
+		default:
+			return FmtUnknown, nil, fmt.Errorf("%w %q: unsupported OpenMetrics protobuf version %q", ErrInvalidContentType, header, v)
+		}
+	default:
+		return FmtUnknown, nil, fmt.Errorf("%w %q: unsupported media type %q", ErrInvalidContentType, header, mediatype)
 	}
 
-	switch strings.TrimSpace(toks[0]) {
+	return f, params, nil
+}
+
+// escapingParam returns the canonical spelling of the escaping term described
+// by the given media type parameters, or an empty string if there is none. The
+// escaping parameter takes precedence over validchars=utf8 and
+// validation-scheme=utf8, which are treated like escaping=allow-utf-8. An
+// unknown escaping parameter results in an error.
+func escapingParam(params map[string]string) (string, error) {
+	if e, ok := params[model.EscapingKey]; ok {
+		scheme, err := model.ToEscapingScheme(e)
+		if err != nil {
+			return "", err
+		}
+		return scheme.String(), nil
+	}
+	for k, v := range params {
+		if isUTF8Param(k, v) {
+			return model.AllowUTF8, nil
+		}
+	}
+	return "", nil
+}
+
+// isUTF8Param returns true if the given parameter is one of the older
+// spellings of escaping=allow-utf-8, i.e. validchars=utf8 or
+// validation-scheme=utf8.
+func isUTF8Param(key, value string) bool {
+	return (key == model.ValidCharsKey || key == model.ValidationSchemeKey) && value == model.ValidCharsUTF8
+}
+
+// FormatType deduces an overall FormatType for the given format. If the format
+// is not recognized, TypeUnknown is returned. Use FormatTypeErr to learn why a
+// format was not recognized.
+func (f Format) FormatType() FormatType {
+	t, _ := f.FormatTypeErr()
+	return t
+}
+
+// FormatTypeErr works like FormatType, but additionally returns an error
+// describing why the format was not recognized if the returned FormatType is
+// TypeUnknown.
+func (f Format) FormatTypeErr() (FormatType, error) {
+	if t, ok := knownFormatTypes[f]; ok {
+		return t, nil
+	}
+	return f.formatTypeUncached()
+}
+
+// formatTypeUncached implements FormatTypeErr without looking up
+// knownFormatTypes.
+func (f Format) formatTypeUncached() (FormatType, error) {
+	// Only the last occurrence of a parameter counts.
+	var (
+		proto, encoding, charset, version string
+		hasProto, hasVersion              bool
+	)
+	scanParams(f, true, func(key, value string) {
+		switch key {
+		case "proto":
+			proto, hasProto = value, true
+		case "encoding":
+			encoding = value
+		case "charset":
+			charset = value
+		case "version":
+			version, hasVersion = value, true
+		}
+	})
+
+	mediaType, _, _ := strings.Cut(string(f), ";")
+	switch mediaType = strings.TrimSpace(mediaType); mediaType {
 	case ProtoType:
-		if params["proto"] != ProtoProtocol {
-			return TypeUnknown
+		if !hasProto {
+			return TypeUnknown, fmt.Errorf("format %q: missing proto parameter", f)
+		}
+		if proto != ProtoProtocol {
+			return TypeUnknown, fmt.Errorf("format %q: unsupported proto %q, expected %q", f, proto, ProtoProtocol)
 		}
-		switch params["encoding"] {
+		switch e := encoding; e {
 		case "delimited":
-			return TypeProtoDelim
+			return TypeProtoDelim, nil
 		case "text":
-			return TypeProtoText
+			return TypeProtoText, nil
 		case "compact-text":
-			return TypeProtoCompact
+			return TypeProtoCompact, nil
+		case "":
+			return TypeUnknown, fmt.Errorf("format %q: missing encoding parameter", f)
 		default:
-			return TypeUnknown
+			return TypeUnknown, fmt.Errorf("format %q: unsupported encoding %q", f, e)
 		}
 	case OpenMetricsType:
-		if params["charset"] != "utf-8" {
-			return TypeUnknown
+		if charset != "utf-8" {
+			return TypeUnknown, fmt.Errorf("format %q: unsupported charset %q, expected \"utf-8\"", f, charset)
 		}
-		return TypeOpenMetrics
-	case "text/plain":
-		v, ok := params["version"]
-		if !ok {
-			return TypeTextPlain
+		return TypeOpenMetrics, nil
+	case OpenMetricsProtoType:
+		if hasVersion && version != OpenMetricsVersion_1_0_0 {
+			return TypeUnknown, fmt.Errorf("format %q: unsupported OpenMetrics protobuf version %q", f, version)
 		}
-		if v == TextVersion {
-			return TypeTextPlain
+		return TypeOpenMetricsProto, nil
+	case "text/plain":
+		if !hasVersion || version == TextVersion || version == TextVersion_1_0_0 {
+			return TypeTextPlain, nil
 		}
-		return TypeUnknown
+		return TypeUnknown, fmt.Errorf("format %q: unsupported text version %q", f, version)
+	default:
+		return TypeUnknown, fmt.Errorf("format %q: unsupported media type %q", f, mediaType)
+	}
+}
+
+// Matches returns true if f and other describe the same exposition format,
+// i.e. the same media type and version (and, for protobuf, the same
+// encoding). Unlike comparing the strings directly, it ignores the order and
+// spacing of parameters, the charset parameter, and the escaping term, and it
+// fills in missing parameters with their defaults as ParseContentType does, so
+// that e.g. "text/plain" matches FmtText. Formats that ParseContentType
+// rejects never match.
+func (f Format) Matches(other Format) bool {
+	a, _, err := parseBaseFormat(string(f))
+	if err != nil {
+		return false
+	}
+	b, _, err := parseBaseFormat(string(other))
+	if err != nil {
+		return false
+	}
+	return a == b
+}
+
+// Is returns true if f and other describe the same exposition format. It is
+// the same as Matches and meant to replace direct string comparisons, e.g.
+// f.Is(FmtProtoDelim) is true for every spelling of the delimited protobuf
+// format, whatever the order of its parameters and its escaping term.
+func (f Format) Is(other Format) bool {
+	return f.Matches(other)
+}
+
+// IsProto returns true if f is one of the protobuf formats, including the
+// OpenMetrics protobuf format.
+func (f Format) IsProto() bool {
+	switch f.FormatType() {
+	case TypeProtoCompact, TypeProtoDelim, TypeProtoText, TypeOpenMetricsProto:
+		return true
 	default:
-		return TypeUnknown
+		return false
 	}
 }
 
+// IsOpenMetrics returns true if f is one of the OpenMetrics formats, either
+// text or protobuf.
+func (f Format) IsOpenMetrics() bool {
+	switch f.FormatType() {
+	case TypeOpenMetrics, TypeOpenMetricsProto:
+		return true
+	default:
+		return false
+	}
+}
+
+// IsBinary returns true if f is a binary format, i.e. one of the length-delimited
+// protobuf formats: FmtProtoDelim and FmtOpenMetricsProto. The other protobuf
+// formats are human-readable text: FmtProtoText uses the protobuf text format,
+// and FmtProtoCompact (encoding=compact-text) uses the same format on a single
+// line per metric family, so IsBinary returns false for them.
+func (f Format) IsBinary() bool {
+	switch f.FormatType() {
+	case TypeProtoDelim, TypeOpenMetricsProto:
+		return true
+	default:
+		return false
+	}
+}
+
+// IsText returns true if f is the Prometheus text format (in any version). Use
+// TextVersion to tell the versions apart.
+func (f Format) IsText() bool {
+	return f.FormatType() == TypeTextPlain
+}
+
+// TextVersion returns the version of the Prometheus text format described by
+// f, i.e. TextVersion ("0.0.4") or TextVersion_1_0_0 ("1.0.0"), or the empty
+// string if f is not the text format. Both versions share the FormatType
+// TypeTextPlain. Version 1.0.0 announces that names outside of the legacy
+// character set may be written in the quoted syntax, so callers can use
+// TextVersion to decide whether names have to be escaped. Unlike Version, it
+// returns "0.0.4" for a text/plain format without version parameter, in line
+// with FormatType.
+func (f Format) TextVersion() string {
+	if !f.IsText() {
+		return ""
+	}
+	if v := f.Version(); v != "" {
+		return v
+	}
+	return TextVersion
+}
+
+// Encoding returns the value of the "encoding" parameter of the Format (e.g.
+// "delimited" for FmtProtoDelim), or the empty string if there is none.
+func (f Format) Encoding() string {
+	return formatParam(f, "encoding")
+}
+
+// Version returns the value of the "version" parameter of the Format (e.g.
+// "0.0.4" for FmtText), or the empty string if there is none.
+func (f Format) Version() string {
+	return formatParam(f, "version")
+}
+
+// WithoutCharset returns f without its charset parameter if f is the text
+// format, e.g. "text/plain; version=0.0.4" for FmtText, for compatibility with
+// older clients that do not accept a charset in the Content-Type. The result
+// is still classified as TypeTextPlain, as the charset of the text format
+// defaults to utf-8. Other formats are returned unchanged: The OpenMetrics text
+// format requires charset=utf-8 (see FormatTypeErr), and the protobuf formats
+// have no charset.
+func (f Format) WithoutCharset() Format {
+	if !f.IsText() {
+		return f
+	}
+	parts := strings.Split(string(f), ";")
+	kept := parts[:1]
+	for _, p := range parts[1:] {
+		if key, _, _ := strings.Cut(p, "="); strings.TrimSpace(key) != "charset" {
+			kept = append(kept, p)
+		}
+	}
+	return Format(strings.Join(kept, ";"))
+}
+
+// formatParam returns the value of the parameter with the given key in the
+// Format, or the empty string if there is no such parameter.
+func formatParam(f Format, key string) string {
+	var (
+		value string
+		found bool
+	)
+	scanParams(f, true, func(k, v string) {
+		if k == key && !found {
+			value, found = v, true
+		}
+	})
+	return value
+}
+
+// scanParams calls fn with the key and value of each parameter of f, in
+// order, with surrounding whitespace trimmed. It splits f at ';' and each part
+// at '=' without allocating. Parts that do not contain exactly one '=' are
+// skipped, and so is the media type before the first ';' if skipMediaType is
+// true. Quotes are not interpreted, i.e. they are part of keys and values.
+func scanParams(f Format, skipMediaType bool, fn func(key, value string)) {
+	s := string(f)
+	for first := true; ; first = false {
+		part, rest, more := strings.Cut(s, ";")
+		if !first || !skipMediaType {
+			if key, value, ok := strings.Cut(part, "="); ok && strings.IndexByte(value, '=') < 0 {
+				fn(strings.TrimSpace(key), strings.TrimSpace(value))
+			}
+		}
+		if !more {
+			return
+		}
+		s = rest
+	}
+}
+
+// knownFormatTypes and knownEscapingSchemes memoize the results of
+// FormatTypeErr and ToEscapingSchemeErr for the Fmt constants and for the
+// Fmt constants with an escaping term appended, as returned by the Negotiate
+// functions. The escaping scheme of a format without escaping term depends on
+// the global default, so the constants themselves are only in
+// knownFormatTypes.
+var knownFormatTypes, knownEscapingSchemes = func() (map[Format]FormatType, map[Format]model.EscapingScheme) {
+	types := map[Format]FormatType{}
+	schemes := map[Format]model.EscapingScheme{}
+	for _, f := range []Format{
+		FmtText, FmtText_1_0_0, FmtProtoDelim, FmtProtoText, FmtProtoCompact,
+		FmtOpenMetrics_0_0_1, FmtOpenMetrics_1_0_0, FmtOpenMetrics_2_0_0, FmtOpenMetricsProto,
+	} {
+		t, _ := f.formatTypeUncached()
+		types[f] = t
+		for _, scheme := range []model.EscapingScheme{
+			model.NoEscaping, model.UnderscoreEscaping, model.DotsEscaping, model.ValueEncodingEscaping,
+		} {
+			types[f+escapingTerm(scheme)] = t
+			schemes[f+escapingTerm(scheme)] = scheme
+		}
+	}
+	return types, schemes
+}()
+
 // ToEscapingScheme returns an EscapingScheme depending on the Format. Iff the
 // Format contains a escaping=allow-utf-8 term, it will select NoEscaping. If a valid
 // "escaping" term exists, that will be used. Otherwise, the global default will
-// be returned.
+// be returned. Unknown or conflicting "escaping" terms also result in the global
+// default, use ToEscapingSchemeErr to detect them. The alternative spellings
+// escaping=allow-utf8, validchars=utf8, and validation-scheme=utf8 are treated
+// like escaping=allow-utf-8.
 func (format Format) ToEscapingScheme() model.EscapingScheme {
-	for _, p := range strings.Split(string(format), ";") {
-		toks := strings.Split(p, "=")
-		if len(toks) != 2 {
-			continue
-		}
-		key, value := strings.TrimSpace(toks[0]), strings.TrimSpace(toks[1])
-		if key == model.EscapingKey {
-			scheme, err := model.ToEscapingScheme(value)
-			if err != nil {
-				return model.NameEscapingScheme
+	scheme, err := format.ToEscapingSchemeErr()
+	if err != nil {
+		return model.GetNameEscapingScheme()
+	}
+	return scheme
+}
+
+// ToEscapingSchemeErr works like ToEscapingScheme, but returns an error if the
+// Format contains an unknown "escaping" term or several conflicting ones. In
+// that case, the global default is returned alongside the error so that
+// callers may still fall back to it.
+func (format Format) ToEscapingSchemeErr() (model.EscapingScheme, error) {
+	if scheme, ok := knownEscapingSchemes[format]; ok {
+		return scheme, nil
+	}
+	var (
+		scheme     = model.GetNameEscapingScheme()
+		found      string
+		validChars bool
+		err        error
+	)
+	scanParams(format, false, func(key, value string) {
+		if err != nil {
+			return
+		}
+		if isUTF8Param(key, value) {
+			validChars = true
+			return
+		}
+		if key != model.EscapingKey {
+			return
+		}
+		s, parseErr := model.ToEscapingScheme(value)
+		if parseErr != nil {
+			err = fmt.Errorf("invalid escaping term in format %q: %w", format, parseErr)
+			return
+		}
+		if found != "" {
+			if s != scheme {
+				err = fmt.Errorf("conflicting escaping terms %q and %q in format %q", found, value, format)
 			}
-			return scheme
+			return
 		}
+		scheme, found = s, value
+	})
+	if err != nil {
+		return model.GetNameEscapingScheme(), err
 	}
-	return model.NameEscapingScheme
+	if found == "" && validChars {
+		return model.NoEscaping, nil
+	}
+	return scheme, nil
+}
+
+// ValidationScheme returns the name validation scheme implied by f:
+// model.UTF8Validation if f opts in to names outside of the legacy character
+// set with escaping=allow-utf-8 (or one of its alternative spellings like
+// validchars=utf8), and model.LegacyValidation otherwise, i.e. for formats with
+// an escaping scheme other than model.NoEscaping, without any escaping term, or
+// with an invalid one. Unlike ToEscapingScheme, it does not depend on the
+// global default escaping scheme. The names in an exposition in format f are
+// valid according to the returned scheme, provided they were escaped with the
+// scheme returned by ToEscapingScheme.
+func (f Format) ValidationScheme() model.ValidationScheme {
+	if scheme, err := f.ToEscapingSchemeErr(); err == nil && scheme == model.NoEscaping && f.hasEscapingTerm() {
+		return model.UTF8Validation
+	}
+	return model.LegacyValidation
+}
+
+// Validate returns an error wrapping ErrInvalidContentType if f is not a format
+// the encoders and decoders of this package can handle consistently. On top of
+// the checks of FormatTypeErr, it rejects unknown or conflicting escaping terms
+// (see ToEscapingSchemeErr), i.e. escaping values other than allow-utf-8 (or
+// allow-utf8), underscores, dots, and values. A format without escaping term
+// is rejected if the global default escaping scheme is model.PercentEscaping,
+// which is not an escaping scheme of the exposition formats. Validate also
+// rejects charsets other than utf-8 and formats that opt in to names outside
+// of the legacy character set (with escaping=allow-utf-8 or one of its
+// alternative spellings like validchars=utf8) although their syntax does not
+// support such names. Only the protobuf formats, version 1.0.0 of the
+// text format, and version 2.0.0 of OpenMetrics support them. All Fmt
+// constants except FmtUnknown are valid, with or without the FmtAllowUTF8 term
+// where supported.
+func (f Format) Validate() error {
+	t, err := f.FormatTypeErr()
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrInvalidContentType, err)
+	}
+	scheme, err := f.ToEscapingSchemeErr()
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrInvalidContentType, err)
+	}
+	if scheme == model.PercentEscaping {
+		return fmt.Errorf("%w %q: escaping scheme %s cannot be used for exposition", ErrInvalidContentType, f, scheme)
+	}
+	if c := formatParam(f, "charset"); c != "" && !strings.EqualFold(c, "utf-8") {
+		return fmt.Errorf("%w %q: unsupported charset %q", ErrInvalidContentType, f, c)
+	}
+	if scheme != model.NoEscaping || !f.hasEscapingTerm() {
+		return nil
+	}
+	switch {
+	case t == TypeTextPlain && f.TextVersion() != TextVersion_1_0_0:
+		return fmt.Errorf("%w %q: names outside of the legacy character set require text format version %s", ErrInvalidContentType, f, TextVersion_1_0_0)
+	case t == TypeOpenMetrics && f.Version() != OpenMetricsVersion_2_0_0:
+		return fmt.Errorf("%w %q: names outside of the legacy character set require OpenMetrics version %s", ErrInvalidContentType, f, OpenMetricsVersion_2_0_0)
+	}
+	return nil
+}
+
+// hasEscapingTerm returns true if f contains an "escaping" term or one of the
+// alternative spellings of escaping=allow-utf-8, i.e. if the escaping scheme of
+// f is not just the global default.
+func (f Format) hasEscapingTerm() bool {
+	return formatParam(f, model.EscapingKey) != "" ||
+		isUTF8Param(model.ValidCharsKey, formatParam(f, model.ValidCharsKey)) ||
+		isUTF8Param(model.ValidationSchemeKey, formatParam(f, model.ValidationSchemeKey))
 }
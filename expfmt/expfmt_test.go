@@ -14,8 +14,14 @@
 package expfmt
 
 import (
+	"bytes"
+	"errors"
+	"strings"
 	"testing"
 
+	dto "github.com/prometheus/client_model/go"
+	"google.golang.org/protobuf/proto"
+
 	"github.com/prometheus/common/model"
 )
 
@@ -47,10 +53,30 @@ func TestToFormatType(t *testing.T) {
 			format:   FmtText,
 			expected: TypeTextPlain,
 		},
+		{
+			format:   FmtText_1_0_0,
+			expected: TypeTextPlain,
+		},
 		{
 			format:   FmtOpenMetrics_0_0_1,
 			expected: TypeOpenMetrics,
 		},
+		{
+			format:   FmtOpenMetrics_2_0_0,
+			expected: TypeOpenMetrics,
+		},
+		{
+			format:   FmtOpenMetricsProto,
+			expected: TypeOpenMetricsProto,
+		},
+		{
+			format:   "application/openmetrics-protobuf",
+			expected: TypeOpenMetricsProto,
+		},
+		{
+			format:   "application/openmetrics-protobuf; version=2.0.0",
+			expected: TypeUnknown,
+		},
 		{
 			format:   "application/vnd.google.protobuf; proto=BadProtocol; encoding=text",
 			expected: TypeUnknown,
@@ -98,6 +124,653 @@ func TestToFormatType(t *testing.T) {
 	}
 }
 
+func TestParseContentType(t *testing.T) {
+	tests := []struct {
+		name        string
+		header      string
+		expected    Format
+		expectedErr bool
+	}{
+		{
+			name:     "text plain",
+			header:   "text/plain; version=0.0.4; charset=utf-8",
+			expected: FmtText,
+		},
+		{
+			name:     "text plain, no parameters",
+			header:   "text/plain",
+			expected: FmtText,
+		},
+		{
+			name:     "text plain, reordered parameters and odd spacing",
+			header:   "text/plain;charset=UTF-8 ;version=0.0.4",
+			expected: FmtText,
+		},
+		{
+			name:     "text plain with escaping",
+			header:   "text/plain; escaping=underscores; version=0.0.4",
+			expected: FmtText + "; escaping=underscores",
+		},
+		{
+			name:     "text plain with alternative allow-utf8 spelling",
+			header:   "text/plain; version=1.0.0; escaping=allow-utf8",
+			expected: FmtText_1_0_0 + FmtAllowUTF8,
+		},
+		{
+			name:     "text plain with validchars",
+			header:   "text/plain; version=1.0.0; validchars=utf8",
+			expected: FmtText_1_0_0 + FmtAllowUTF8,
+		},
+		{
+			name:     "text plain with validation-scheme",
+			header:   "text/plain; version=1.0.0; validation-scheme=utf8",
+			expected: FmtText_1_0_0 + FmtAllowUTF8,
+		},
+		{
+			name:        "text plain 0.0.4 with validchars",
+			header:      "text/plain; version=0.0.4; validchars=utf8",
+			expected:    FmtUnknown,
+			expectedErr: true,
+		},
+		{
+			name:        "text plain without version with allow-utf-8",
+			header:      "text/plain; escaping=allow-utf-8",
+			expected:    FmtUnknown,
+			expectedErr: true,
+		},
+		{
+			name:        "OpenMetrics 1.0.0 with allow-utf-8",
+			header:      "application/openmetrics-text; version=1.0.0; escaping=allow-utf-8",
+			expected:    FmtUnknown,
+			expectedErr: true,
+		},
+		{
+			name:     "text plain 1.0.0",
+			header:   "text/plain; version=1.0.0; charset=utf-8; escaping=allow-utf-8",
+			expected: FmtText_1_0_0 + "; escaping=allow-utf-8",
+		},
+		{
+			name:     "proto delimited",
+			header:   "application/vnd.google.protobuf; encoding=delimited; proto=io.prometheus.client.MetricFamily",
+			expected: FmtProtoDelim,
+		},
+		{
+			name:     "proto without encoding defaults to delimited",
+			header:   "application/vnd.google.protobuf; proto=io.prometheus.client.MetricFamily",
+			expected: FmtProtoDelim,
+		},
+		{
+			name:     "proto text with unknown parameter",
+			header:   "application/vnd.google.protobuf; proto=io.prometheus.client.MetricFamily; encoding=text; foo=bar",
+			expected: FmtProtoText,
+		},
+		{
+			name:     "OpenMetrics 1.0.0",
+			header:   "application/openmetrics-text; charset=utf-8; version=1.0.0",
+			expected: FmtOpenMetrics_1_0_0,
+		},
+		{
+			name:     "OpenMetrics without version",
+			header:   "application/openmetrics-text",
+			expected: FmtOpenMetrics_0_0_1,
+		},
+		{
+			name:     "OpenMetrics 2.0.0",
+			header:   "application/openmetrics-text; version=2.0.0; escaping=allow-utf-8",
+			expected: FmtOpenMetrics_2_0_0 + "; escaping=allow-utf-8",
+		},
+		{
+			name:     "OpenMetrics protobuf",
+			header:   "application/openmetrics-protobuf; version=1.0.0",
+			expected: FmtOpenMetricsProto,
+		},
+		{
+			name:     "OpenMetrics protobuf without version",
+			header:   "application/openmetrics-protobuf; escaping=underscores",
+			expected: FmtOpenMetricsProto + "; escaping=underscores",
+		},
+		{
+			name:        "OpenMetrics protobuf, unsupported version",
+			header:      "application/openmetrics-protobuf; version=2.0.0",
+			expected:    FmtUnknown,
+			expectedErr: true,
+		},
+		{
+			name:        "OpenMetrics with text version",
+			header:      "application/openmetrics-text; version=0.0.4",
+			expected:    FmtUnknown,
+			expectedErr: true,
+		},
+		{
+			name:        "text plain with unknown escaping",
+			header:      "text/plain; version=0.0.4; escaping=bogus",
+			expected:    FmtUnknown,
+			expectedErr: true,
+		},
+		{
+			name:        "text plain with wrong charset",
+			header:      "text/plain; version=0.0.4; charset=latin1",
+			expected:    FmtUnknown,
+			expectedErr: true,
+		},
+		{
+			name:        "proto with wrong protocol",
+			header:      "application/vnd.google.protobuf; proto=BadProtocol",
+			expected:    FmtUnknown,
+			expectedErr: true,
+		},
+		{
+			name:        "unknown media type",
+			header:      "application/json",
+			expected:    FmtUnknown,
+			expectedErr: true,
+		},
+		{
+			name:        "unparsable",
+			header:      "text/plain; version",
+			expected:    FmtUnknown,
+			expectedErr: true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := ParseContentType(test.header)
+			if got != test.expected {
+				t.Errorf("expected %q got %q", test.expected, got)
+			}
+			if (err != nil) != test.expectedErr {
+				t.Errorf("expected error %v, got %v", test.expectedErr, err)
+			}
+		})
+	}
+}
+
+func TestFormatTypeErr(t *testing.T) {
+	tests := []struct {
+		name        string
+		format      Format
+		expected    FormatType
+		expectedErr string
+	}{
+		{
+			name:     "valid format",
+			format:   FmtProtoDelim,
+			expected: TypeProtoDelim,
+		},
+		{
+			name:        "bad media type",
+			format:      "gobbledygook",
+			expected:    TypeUnknown,
+			expectedErr: `unsupported media type "gobbledygook"`,
+		},
+		{
+			name:        "missing proto",
+			format:      "application/vnd.google.protobuf; encoding=delimited",
+			expected:    TypeUnknown,
+			expectedErr: "missing proto parameter",
+		},
+		{
+			name:        "wrong proto",
+			format:      "application/vnd.google.protobuf; proto=BadProtocol; encoding=text",
+			expected:    TypeUnknown,
+			expectedErr: `unsupported proto "BadProtocol"`,
+		},
+		{
+			name:        "missing encoding",
+			format:      "application/vnd.google.protobuf; proto=io.prometheus.client.MetricFamily",
+			expected:    TypeUnknown,
+			expectedErr: "missing encoding parameter",
+		},
+		{
+			name:        "wrong encoding",
+			format:      "application/vnd.google.protobuf; proto=io.prometheus.client.MetricFamily; encoding=textual",
+			expected:    TypeUnknown,
+			expectedErr: `unsupported encoding "textual"`,
+		},
+		{
+			name:        "wrong charset",
+			format:      "application/openmetrics-text; version=1.0.0; charset=ascii",
+			expected:    TypeUnknown,
+			expectedErr: `unsupported charset "ascii"`,
+		},
+		{
+			name:        "wrong text version",
+			format:      "text/plain; version=invalid",
+			expected:    TypeUnknown,
+			expectedErr: `unsupported text version "invalid"`,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := test.format.FormatTypeErr()
+			if got != test.expected {
+				t.Errorf("expected %v got %v", test.expected, got)
+			}
+			if got != test.format.FormatType() {
+				t.Errorf("expected FormatType to return %v, got %v", got, test.format.FormatType())
+			}
+			if test.expectedErr == "" {
+				if err != nil {
+					t.Errorf("unexpected error: %s", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), test.expectedErr) {
+				t.Errorf("expected error containing %q, got %v", test.expectedErr, err)
+			}
+		})
+	}
+}
+
+func TestFormatEncodingAndVersion(t *testing.T) {
+	tests := []struct {
+		format           Format
+		expectedEncoding string
+		expectedVersion  string
+	}{
+		{format: FmtUnknown},
+		{format: FmtText, expectedVersion: "0.0.4"},
+		{format: FmtText_1_0_0, expectedVersion: "1.0.0"},
+		{format: FmtProtoDelim, expectedEncoding: "delimited"},
+		{format: FmtProtoText, expectedEncoding: "text"},
+		{format: FmtProtoCompact, expectedEncoding: "compact-text"},
+		{format: FmtOpenMetrics_0_0_1, expectedVersion: "0.0.1"},
+		{format: FmtOpenMetrics_1_0_0, expectedVersion: "1.0.0"},
+		{format: FmtOpenMetrics_2_0_0, expectedVersion: "2.0.0"},
+		{
+			format:           "application/vnd.google.protobuf; proto=io.prometheus.client.MetricFamily; encoding=compact-text; escaping=underscores",
+			expectedEncoding: "compact-text",
+		},
+		{
+			format:          "text/plain; version=0.0.4; charset=utf-8; escaping=allow-utf-8",
+			expectedVersion: "0.0.4",
+		},
+		{
+			format:          "application/openmetrics-text; version=2.0.0; charset=utf-8; escaping=values",
+			expectedVersion: "2.0.0",
+		},
+		{
+			format: "text/plain",
+		},
+	}
+	for _, test := range tests {
+		if got := test.format.Encoding(); got != test.expectedEncoding {
+			t.Errorf("%s: expected encoding %q, got %q", test.format, test.expectedEncoding, got)
+		}
+		if got := test.format.Version(); got != test.expectedVersion {
+			t.Errorf("%s: expected version %q, got %q", test.format, test.expectedVersion, got)
+		}
+	}
+}
+
+func TestFormatTextVersion(t *testing.T) {
+	tests := []struct {
+		format   Format
+		expected string
+	}{
+		{format: FmtText, expected: TextVersion},
+		{format: FmtText_1_0_0, expected: TextVersion_1_0_0},
+		{format: FmtText + "; escaping=underscores", expected: TextVersion},
+		{format: FmtText_1_0_0 + FmtAllowUTF8, expected: TextVersion_1_0_0},
+		{format: "text/plain; charset=utf-8; version=1.0.0", expected: TextVersion_1_0_0},
+		{format: "text/plain", expected: TextVersion},
+		{format: FmtOpenMetrics_1_0_0},
+		{format: FmtProtoDelim},
+		{format: FmtUnknown},
+	}
+	for _, test := range tests {
+		if got := test.format.TextVersion(); got != test.expected {
+			t.Errorf("%s: expected text version %q, got %q", test.format, test.expected, got)
+		}
+	}
+
+	if FmtText.FormatType() != FmtText_1_0_0.FormatType() {
+		t.Errorf("expected both text versions to share a FormatType")
+	}
+	if FmtText.TextVersion() == FmtText_1_0_0.TextVersion() {
+		t.Errorf("expected TextVersion to distinguish %s from %s", FmtText, FmtText_1_0_0)
+	}
+}
+
+// formatTypeAndSchemeSplit is the original implementation of FormatTypeErr
+// and ToEscapingSchemeErr (without error messages), which split each format
+// into a map of parameters. It serves as a reference for the allocation-free
+// implementations.
+func formatTypeAndSchemeSplit(f Format) (FormatType, model.EscapingScheme, bool) {
+	toks := strings.Split(string(f), ";")
+	params := make(map[string]string)
+	for i, t := range toks {
+		if i == 0 {
+			continue
+		}
+		args := strings.Split(t, "=")
+		if len(args) != 2 {
+			continue
+		}
+		params[strings.TrimSpace(args[0])] = strings.TrimSpace(args[1])
+	}
+	t := TypeUnknown
+	switch strings.TrimSpace(toks[0]) {
+	case ProtoType:
+		if params["proto"] == ProtoProtocol {
+			switch params["encoding"] {
+			case "delimited":
+				t = TypeProtoDelim
+			case "text":
+				t = TypeProtoText
+			case "compact-text":
+				t = TypeProtoCompact
+			}
+		}
+	case OpenMetricsType:
+		if params["charset"] == "utf-8" {
+			t = TypeOpenMetrics
+		}
+	case OpenMetricsProtoType:
+		if v, ok := params["version"]; !ok || v == OpenMetricsVersion_1_0_0 {
+			t = TypeOpenMetricsProto
+		}
+	case "text/plain":
+		if v, ok := params["version"]; !ok || v == TextVersion || v == TextVersion_1_0_0 {
+			t = TypeTextPlain
+		}
+	}
+
+	var (
+		scheme     = model.GetNameEscapingScheme()
+		found      string
+		validChars bool
+	)
+	for _, p := range toks {
+		args := strings.Split(p, "=")
+		if len(args) != 2 {
+			continue
+		}
+		key, value := strings.TrimSpace(args[0]), strings.TrimSpace(args[1])
+		if isUTF8Param(key, value) {
+			validChars = true
+			continue
+		}
+		if key != model.EscapingKey {
+			continue
+		}
+		s, err := model.ToEscapingScheme(value)
+		if err != nil || (found != "" && s != scheme) {
+			return t, model.GetNameEscapingScheme(), false
+		}
+		if found == "" {
+			scheme, found = s, value
+		}
+	}
+	if found == "" && validChars {
+		scheme = model.NoEscaping
+	}
+	return t, scheme, true
+}
+
+func TestFormatParsingMatchesSplit(t *testing.T) {
+	defer model.SetNameEscapingScheme(model.GetNameEscapingScheme())
+	model.SetNameEscapingScheme(model.DotsEscaping)
+
+	formats := []Format{
+		FmtText,
+		FmtText_1_0_0 + FmtAllowUTF8,
+		FmtOpenMetrics_2_0_0 + "; escaping=values",
+		"  text/plain  ;  version = 0.0.4 ; charset = utf-8 ",
+		"text/plain;version=1.0.0;escaping=underscores;",
+		`text/plain; version="0.0.4"`,
+		`text/plain; version=0.0.4; escaping="dots"`,
+		`application/openmetrics-text; version=1.0.0; charset="utf-8"`,
+		"application/openmetrics-text; version=1.0.0; charset=utf-8=x",
+		"application/openmetrics-text; charset=utf-8; charset=latin1",
+		"application/openmetrics-text; charset",
+		"application/vnd.google.protobuf; proto=io.prometheus.client.MetricFamily; encoding=delimited; encoding=text",
+		"application/vnd.google.protobuf;proto = io.prometheus.client.MetricFamily;encoding=compact-text",
+		"application/vnd.google.protobuf; encoding=delimited",
+		"application/openmetrics-protobuf; version=",
+		"text/plain; version=",
+		"text/plain;;; validchars=utf8",
+		"text/plain; validchars=utf8; escaping=dots",
+		"text/plain; escaping=dots; escaping=values",
+		"text/plain; escaping=allow-utf8; escaping=allow-utf-8",
+		"text/plain; escaping = base64",
+		"escaping=values",
+		"",
+		";",
+		"=",
+	}
+	for _, f := range formats {
+		wantType, wantScheme, wantOK := formatTypeAndSchemeSplit(f)
+		if got := f.FormatType(); got != wantType {
+			t.Errorf("%q: expected FormatType %v, got %v", f, wantType, got)
+		}
+		gotScheme, err := f.ToEscapingSchemeErr()
+		if gotScheme != wantScheme || (err == nil) != wantOK {
+			t.Errorf("%q: expected escaping scheme %s (ok %t), got %s (error %v)", f, wantScheme, wantOK, gotScheme, err)
+		}
+	}
+}
+
+func TestFormatParsingAllocs(t *testing.T) {
+	for _, f := range []Format{
+		FmtText, FmtText_1_0_0, FmtProtoDelim, FmtOpenMetrics_1_0_0, FmtOpenMetricsProto,
+		FmtText + FmtAllowUTF8, FmtProtoDelim + "; escaping=underscores", FmtOpenMetrics_2_0_0 + "; escaping=values",
+		"text/plain;version=0.0.4;escaping=dots",
+	} {
+		if allocs := testing.AllocsPerRun(100, func() {
+			f.FormatType()
+			f.ToEscapingScheme()
+			f.Version()
+		}); allocs != 0 {
+			t.Errorf("%q: expected no allocations, got %v", f, allocs)
+		}
+	}
+}
+
+func TestFormatWithoutCharset(t *testing.T) {
+	scenarios := []struct {
+		format   Format
+		expected Format
+	}{
+		{format: FmtText, expected: "text/plain; version=0.0.4"},
+		{format: FmtText_1_0_0 + FmtAllowUTF8, expected: "text/plain; version=1.0.0; escaping=allow-utf-8"},
+		{format: "text/plain;charset=UTF-8;version=0.0.4", expected: "text/plain;version=0.0.4"},
+		{format: "text/plain; version=0.0.4", expected: "text/plain; version=0.0.4"},
+		{format: FmtOpenMetrics_1_0_0, expected: FmtOpenMetrics_1_0_0},
+		{format: FmtProtoDelim, expected: FmtProtoDelim},
+		{format: FmtUnknown, expected: FmtUnknown},
+	}
+	for _, s := range scenarios {
+		got := s.format.WithoutCharset()
+		if got != s.expected {
+			t.Errorf("%q: expected %q, got %q", s.format, s.expected, got)
+		}
+		if got.FormatType() != s.format.FormatType() {
+			t.Errorf("%q: expected FormatType %v, got %v", s.format, s.format.FormatType(), got.FormatType())
+		}
+		if s.format.FormatType() != TypeUnknown && !got.Matches(s.format) {
+			t.Errorf("%q: expected %q to match the original format", s.format, got)
+		}
+		if got.TextVersion() != s.format.TextVersion() || got.ToEscapingScheme() != s.format.ToEscapingScheme() {
+			t.Errorf("%q: expected the same version and escaping scheme for %q", s.format, got)
+		}
+	}
+}
+
+func TestFormatValidationScheme(t *testing.T) {
+	defer model.SetNameEscapingScheme(model.GetNameEscapingScheme())
+
+	scenarios := []struct {
+		format   Format
+		expected model.ValidationScheme
+	}{
+		{format: FmtText_1_0_0 + FmtAllowUTF8, expected: model.UTF8Validation},
+		{format: FmtProtoDelim + "; escaping=allow-utf8", expected: model.UTF8Validation},
+		{format: FmtOpenMetrics_2_0_0 + "; validchars=utf8", expected: model.UTF8Validation},
+		{format: FmtOpenMetricsProto + "; validation-scheme=utf8", expected: model.UTF8Validation},
+		{format: FmtText + "; escaping=underscores", expected: model.LegacyValidation},
+		{format: FmtText + "; escaping=dots", expected: model.LegacyValidation},
+		{format: FmtProtoDelim + "; escaping=values", expected: model.LegacyValidation},
+		{format: FmtText_1_0_0 + "; validchars=utf8; escaping=underscores", expected: model.LegacyValidation},
+		{format: FmtText + "; escaping=base64", expected: model.LegacyValidation},
+		{format: FmtText, expected: model.LegacyValidation},
+		{format: FmtProtoDelim, expected: model.LegacyValidation},
+	}
+	// The result must not depend on the global default escaping scheme.
+	for _, scheme := range []model.EscapingScheme{model.NoEscaping, model.UnderscoreEscaping} {
+		model.SetNameEscapingScheme(scheme)
+		for _, s := range scenarios {
+			if got := s.format.ValidationScheme(); got != s.expected {
+				t.Errorf("default %s, %q: expected %s, got %s", scheme, s.format, s.expected, got)
+			}
+		}
+	}
+}
+
+func TestFormatValidate(t *testing.T) {
+	valid := []Format{
+		FmtText, FmtText_1_0_0, FmtProtoDelim, FmtProtoText, FmtProtoCompact,
+		FmtOpenMetrics_0_0_1, FmtOpenMetrics_1_0_0, FmtOpenMetrics_2_0_0, FmtOpenMetricsProto,
+		FmtText_1_0_0 + FmtAllowUTF8,
+		FmtProtoDelim + FmtAllowUTF8,
+		FmtOpenMetrics_2_0_0 + FmtAllowUTF8,
+		FmtOpenMetricsProto + FmtAllowUTF8,
+		FmtText + "; escaping=underscores",
+		FmtOpenMetrics_1_0_0 + "; escaping=values",
+		"text/plain",
+		"text/plain; version=1.0.0; validchars=utf8",
+		"text/plain; version=0.0.4; charset=UTF-8",
+	}
+	for _, f := range valid {
+		if err := f.Validate(); err != nil {
+			t.Errorf("%q: unexpected error: %s", f, err)
+		}
+	}
+
+	invalid := []Format{
+		FmtUnknown,
+		"text/plain; version=0.0.4; validchars=utf8",
+		FmtText + FmtAllowUTF8,
+		"text/plain; escaping=allow-utf8",
+		FmtOpenMetrics_1_0_0 + FmtAllowUTF8,
+		FmtOpenMetrics_0_0_1 + "; validation-scheme=utf8",
+		"application/openmetrics-text; charset=utf-8; escaping=allow-utf-8",
+		FmtText + "; escaping=base64",
+		FmtText + "; escaping=percent",
+		FmtProtoDelim + "; escaping=dots; escaping=values",
+		"text/plain; version=0.0.4; charset=latin1",
+		"application/openmetrics-text; version=2.0.0",
+		"text/plain; version=0.0.5",
+	}
+	for _, f := range invalid {
+		if err := f.Validate(); !errors.Is(err, ErrInvalidContentType) {
+			t.Errorf("%q: expected error wrapping ErrInvalidContentType, got %v", f, err)
+		}
+	}
+
+	// A format without escaping term uses the global default.
+	defer model.SetNameEscapingScheme(model.GetNameEscapingScheme())
+	model.SetNameEscapingScheme(model.PercentEscaping)
+	if err := FmtText.Validate(); !errors.Is(err, ErrInvalidContentType) {
+		t.Errorf("expected error wrapping ErrInvalidContentType with percent escaping as the default, got %v", err)
+	}
+	if err := (FmtText + "; escaping=underscores").Validate(); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+}
+
+func TestFormatMatches(t *testing.T) {
+	tests := []struct {
+		a, b     Format
+		expected bool
+	}{
+		{a: FmtText, b: FmtText, expected: true},
+		{a: FmtText, b: "text/plain", expected: true},
+		{a: FmtText, b: "text/plain;charset=UTF-8 ;version=0.0.4", expected: true},
+		{a: FmtText, b: FmtText + FmtAllowUTF8, expected: true},
+		{a: FmtText + "; escaping=underscores", b: FmtText + "; escaping=dots", expected: true},
+		{a: FmtText, b: FmtText_1_0_0},
+		{a: FmtProtoDelim, b: "application/vnd.google.protobuf; encoding=delimited; proto=io.prometheus.client.MetricFamily", expected: true},
+		{a: FmtProtoDelim, b: "application/vnd.google.protobuf; proto=io.prometheus.client.MetricFamily", expected: true},
+		{a: FmtProtoDelim, b: FmtProtoCompact},
+		{a: FmtOpenMetrics_1_0_0, b: "application/openmetrics-text; charset=utf-8; version=1.0.0; escaping=values", expected: true},
+		{a: FmtOpenMetrics_0_0_1, b: "application/openmetrics-text", expected: true},
+		{a: FmtOpenMetrics_1_0_0, b: FmtOpenMetrics_2_0_0},
+		{a: FmtOpenMetricsProto, b: "application/openmetrics-protobuf", expected: true},
+		{a: FmtOpenMetricsProto, b: FmtProtoDelim},
+		{a: FmtProtoDelim + "; escaping=dots", b: "application/vnd.google.protobuf; encoding=delimited; validchars=utf8; proto=io.prometheus.client.MetricFamily", expected: true},
+		{a: FmtText_1_0_0, b: "text/plain; validation-scheme=utf8; version=1.0.0", expected: true},
+		{a: FmtUnknown, b: FmtUnknown},
+		{a: "application/json", b: "application/json"},
+	}
+	for _, test := range tests {
+		if got := test.a.Matches(test.b); got != test.expected {
+			t.Errorf("%q.Matches(%q): expected %v, got %v", test.a, test.b, test.expected, got)
+		}
+		if got := test.b.Matches(test.a); got != test.expected {
+			t.Errorf("%q.Matches(%q): expected %v, got %v", test.b, test.a, test.expected, got)
+		}
+	}
+}
+
+func TestFormatIs(t *testing.T) {
+	tests := []struct {
+		a, b Format
+	}{
+		{a: FmtProtoDelim, b: "application/vnd.google.protobuf; encoding=delimited; proto=io.prometheus.client.MetricFamily"},
+		{a: FmtText, b: "text/plain; charset=utf-8; version=0.0.4"},
+		{a: FmtText_1_0_0 + FmtAllowUTF8, b: "text/plain; validchars=utf8; version=1.0.0"},
+		{a: FmtOpenMetrics_1_0_0, b: "application/openmetrics-text; charset=utf-8; version=1.0.0; escaping=underscores"},
+	}
+	for _, test := range tests {
+		if test.a == test.b {
+			t.Fatalf("%q and %q are equal strings", test.a, test.b)
+		}
+		if !test.a.Is(test.b) || !test.b.Is(test.a) {
+			t.Errorf("expected %q and %q to be the same format", test.a, test.b)
+		}
+	}
+	if FmtProtoDelim.Is(FmtProtoText) {
+		t.Errorf("expected %q and %q to be different formats", FmtProtoDelim, FmtProtoText)
+	}
+}
+
+func TestFormatIsHelpers(t *testing.T) {
+	tests := []struct {
+		format                               Format
+		isProto, isOM, isPlainText, isBinary bool
+	}{
+		{format: FmtUnknown},
+		{format: FmtText, isPlainText: true},
+		{format: FmtText_1_0_0 + FmtAllowUTF8, isPlainText: true},
+		{format: "text/plain", isPlainText: true},
+		{format: FmtProtoDelim, isProto: true, isBinary: true},
+		{format: FmtProtoText, isProto: true},
+		{format: FmtProtoCompact + "; escaping=underscores", isProto: true},
+		{format: FmtOpenMetrics_0_0_1, isOM: true},
+		{format: FmtOpenMetrics_1_0_0, isOM: true},
+		{format: FmtOpenMetrics_2_0_0 + FmtAllowUTF8, isOM: true},
+		{format: FmtOpenMetricsProto, isProto: true, isOM: true, isBinary: true},
+		{format: ProtoFmt + " encoding=delimited; escaping=allow-utf-8", isProto: true, isBinary: true},
+		{format: ProtoFmt + " encoding=text", isProto: true},
+		{format: "application/json"},
+	}
+	for _, test := range tests {
+		if got := test.format.IsProto(); got != test.isProto {
+			t.Errorf("%s: expected IsProto %v, got %v", test.format, test.isProto, got)
+		}
+		if got := test.format.IsOpenMetrics(); got != test.isOM {
+			t.Errorf("%s: expected IsOpenMetrics %v, got %v", test.format, test.isOM, got)
+		}
+		if got := test.format.IsText(); got != test.isPlainText {
+			t.Errorf("%s: expected IsText %v, got %v", test.format, test.isPlainText, got)
+		}
+		if got := test.format.IsBinary(); got != test.isBinary {
+			t.Errorf("%s: expected IsBinary %v, got %v", test.format, test.isBinary, got)
+		}
+	}
+}
+
 func TestToEscapingScheme(t *testing.T) {
 	tests := []struct {
 		format   Format
@@ -118,7 +791,7 @@ func TestToEscapingScheme(t *testing.T) {
 		// error returns default
 		{
 			format:   "application/openmetrics-text; version=1.0.0; charset=utf-8; escaping=invalid",
-			expected: model.NameEscapingScheme,
+			expected: model.GetNameEscapingScheme(),
 		},
 	}
 	for _, test := range tests {
@@ -127,3 +800,122 @@ func TestToEscapingScheme(t *testing.T) {
 		}
 	}
 }
+
+func TestToEscapingSchemeErr(t *testing.T) {
+	tests := []struct {
+		format      Format
+		expected    model.EscapingScheme
+		expectedErr bool
+	}{
+		{
+			format:   FmtText,
+			expected: model.GetNameEscapingScheme(),
+		},
+		{
+			format:   "text/plain; version=0.0.4; charset=utf-8; escaping=dots",
+			expected: model.DotsEscaping,
+		},
+		{
+			format:   "text/plain; version=0.0.4; charset=utf-8; escaping=dots; escaping=dots",
+			expected: model.DotsEscaping,
+		},
+		{
+			format:      "text/plain; version=0.0.4; charset=utf-8; escaping=bogus",
+			expected:    model.GetNameEscapingScheme(),
+			expectedErr: true,
+		},
+		{
+			format:      "text/plain; version=0.0.4; charset=utf-8; escaping=",
+			expected:    model.GetNameEscapingScheme(),
+			expectedErr: true,
+		},
+		{
+			format:      "text/plain; version=0.0.4; charset=utf-8; escaping=allow-utf-8; escaping=underscores",
+			expected:    model.GetNameEscapingScheme(),
+			expectedErr: true,
+		},
+		{
+			format:   "text/plain; version=0.0.4; charset=utf-8; escaping=allow-utf8",
+			expected: model.NoEscaping,
+		},
+		{
+			format:   "text/plain; version=0.0.4; charset=utf-8; validchars=utf8",
+			expected: model.NoEscaping,
+		},
+		{
+			format:   "text/plain; version=0.0.4; charset=utf-8; validation-scheme=utf8",
+			expected: model.NoEscaping,
+		},
+		{
+			format:   "text/plain; version=0.0.4; charset=utf-8; validation-scheme=utf8; escaping=dots",
+			expected: model.DotsEscaping,
+		},
+		{
+			format:   "text/plain; version=0.0.4; charset=utf-8; escaping=allow-utf8; escaping=allow-utf-8",
+			expected: model.NoEscaping,
+		},
+		{
+			format:   "text/plain; version=0.0.4; charset=utf-8; validchars=utf8; escaping=underscores",
+			expected: model.UnderscoreEscaping,
+		},
+		{
+			format:   FmtText + FmtAllowUTF8,
+			expected: model.NoEscaping,
+		},
+	}
+	for _, test := range tests {
+		got, err := test.format.ToEscapingSchemeErr()
+		if got != test.expected {
+			t.Errorf("%s: expected %v got %v", test.format, test.expected, got)
+		}
+		if (err != nil) != test.expectedErr {
+			t.Errorf("%s: expected error %v, got %v", test.format, test.expectedErr, err)
+		}
+		// ToEscapingScheme must never fail and agree on the scheme.
+		if test.format.ToEscapingScheme() != got {
+			t.Errorf("%s: expected ToEscapingScheme to return %v, got %v", test.format, got, test.format.ToEscapingScheme())
+		}
+	}
+}
+
+// TestUnknownEscapingDoesNotPanic checks that an unknown escaping term, as
+// sent by a misbehaving or future peer, never crashes a caller. Encoders and
+// decoders for such a format report an error instead.
+func TestUnknownEscapingDoesNotPanic(t *testing.T) {
+	for _, format := range []Format{
+		FmtText + "; escaping=base64",
+		FmtOpenMetrics_1_0_0 + "; escaping=base64",
+		FmtProtoDelim + "; escaping=base64",
+	} {
+		if got := format.ToEscapingScheme(); got != model.GetNameEscapingScheme() {
+			t.Errorf("%s: expected the default escaping scheme, got %v", format, got)
+		}
+		if _, err := format.ToEscapingSchemeErr(); err == nil {
+			t.Errorf("%s: expected an error for the unknown escaping term", format)
+		}
+
+		var buf bytes.Buffer
+		enc := NewEncoder(&buf, format)
+		mf := &dto.MetricFamily{
+			Name:   proto.String("my.metric"),
+			Type:   dto.MetricType_GAUGE.Enum(),
+			Metric: []*dto.Metric{{Gauge: &dto.Gauge{Value: proto.Float64(1)}}},
+		}
+		if err := enc.Encode(mf); !errors.Is(err, ErrInvalidContentType) {
+			t.Errorf("%s: expected error wrapping ErrInvalidContentType during encode, got %v", format, err)
+		}
+		if closer, ok := enc.(Closer); ok {
+			if err := closer.Close(); err != nil {
+				t.Errorf("%s: unexpected error closing the encoder: %s", format, err)
+			}
+		}
+		if buf.Len() != 0 {
+			t.Errorf("%s: expected no output, got %q", format, buf.String())
+		}
+
+		dec := NewDecoder(strings.NewReader("my_metric 1\n"), format)
+		if err := dec.Decode(&dto.MetricFamily{}); !errors.Is(err, ErrInvalidContentType) {
+			t.Errorf("%s: expected error wrapping ErrInvalidContentType during decode, got %v", format, err)
+		}
+	}
+}
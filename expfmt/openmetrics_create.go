@@ -30,8 +30,17 @@ import (
 )
 
 type encoderOption struct {
-	withCreatedLines bool
-	withUnit         bool
+	withCreatedLines     bool
+	withUnit             bool
+	withEscapingScheme   bool
+	escapingScheme       model.EscapingScheme
+	withValidationScheme bool
+	validationScheme     model.ValidationScheme
+	defaultHelp          func(name string) string
+	withoutStaleSamples  bool
+	escaper              *model.Escaper
+
+	withoutRepeatedMetadata bool
 }
 
 type EncoderOption func(*encoderOption)
@@ -63,6 +72,79 @@ func WithUnit() EncoderOption {
 	}
 }
 
+// WithEscapingScheme is an EncoderOption overriding the escaping scheme that
+// NewEncoder would otherwise derive from the "escaping" term of the Format (or
+// the global default returned by model.GetNameEscapingScheme). It applies to
+// all formats.
+func WithEscapingScheme(s model.EscapingScheme) EncoderOption {
+	return func(t *encoderOption) {
+		t.withEscapingScheme = true
+		t.escapingScheme = s
+	}
+}
+
+// WithEscaper is an EncoderOption making the Encoder escape names with the
+// given model.Escaper, so that escaped names are cached across Encode calls
+// and across all Encoders sharing the Escaper. It implies
+// WithEscapingScheme(e.Scheme()). If a different escaping scheme is set later
+// with SetEscapingScheme, the Escaper is not used. It applies to all formats.
+func WithEscaper(e *model.Escaper) EncoderOption {
+	return func(t *encoderOption) {
+		t.withEscapingScheme = true
+		t.escapingScheme = e.Scheme()
+		t.escaper = e
+	}
+}
+
+// WithValidationScheme is an EncoderOption making the Encoder validate the
+// metric and label names of each MetricFamily (after escaping) according to
+// the given validation scheme before encoding it. Encode returns an error for
+// metric families with invalid names. Without this option, names are not
+// validated. It applies to all formats.
+func WithValidationScheme(s model.ValidationScheme) EncoderOption {
+	return func(t *encoderOption) {
+		t.withValidationScheme = true
+		t.validationScheme = s
+	}
+}
+
+// WithDefaultHelp is an EncoderOption supplying a help string for metric
+// families without one (i.e. with a nil or empty Help field), for consumers
+// that require a HELP line for every metric family. fn is called with the
+// (unescaped) name of the metric family. If it returns the empty string, the
+// metric family is encoded without help as before. It applies to all formats.
+func WithDefaultHelp(fn func(name string) string) EncoderOption {
+	return func(t *encoderOption) {
+		t.defaultHelp = fn
+	}
+}
+
+// WithoutRepeatedMetadata is an EncoderOption making the Encoder write the
+// HELP and TYPE lines (and, for OpenMetrics, the UNIT line) of a metric family
+// only the first time a metric family of that name is encoded. Later Encode
+// calls for the same name only write the samples, so that the metrics of a
+// family may be encoded in separate calls without repeating its metadata. The
+// help text, type, and unit of later calls are ignored. Names are tracked for
+// the lifetime of the Encoder. It applies to the text formats; the protobuf
+// formats ignore it.
+func WithoutRepeatedMetadata() EncoderOption {
+	return func(t *encoderOption) {
+		t.withoutRepeatedMetadata = true
+	}
+}
+
+// WithoutStaleSamples is an EncoderOption making the Encoder skip metrics whose
+// value is the staleness marker (see model.StaleNaN). For summaries and
+// histograms, the sample sum is checked. A metric family that only contains
+// stale metrics is skipped entirely. Without this option, the text formats
+// write stale markers like any other NaN value, while the protobuf formats
+// preserve the exact bit pattern. It applies to all formats.
+func WithoutStaleSamples() EncoderOption {
+	return func(t *encoderOption) {
+		t.withoutStaleSamples = true
+	}
+}
+
 // MetricFamilyToOpenMetrics converts a MetricFamily proto message into the
 // OpenMetrics text format and writes the resulting lines to 'out'. It returns
 // the number of bytes written and any error encountered. The output will have
@@ -118,12 +200,19 @@ func WithUnit() EncoderOption {
 //   - The value of Counters is not checked. (OpenMetrics doesn't allow counters
 //     with a `NaN` value.)
 func MetricFamilyToOpenMetrics(out io.Writer, in *dto.MetricFamily, options ...EncoderOption) (written int, err error) {
+	return metricFamilyToOpenMetrics(out, in, nil, true, options...)
+}
+
+// metricFamilyToOpenMetrics implements MetricFamilyToOpenMetrics, escaping
+// metric and label names with esc while writing them. If metadata is false,
+// the HELP, TYPE, and UNIT lines are left out.
+func metricFamilyToOpenMetrics(out io.Writer, in *dto.MetricFamily, esc *nameEscaper, metadata bool, options ...EncoderOption) (written int, err error) {
 	toOM := encoderOption{}
 	for _, option := range options {
 		option(&toOM)
 	}
 
-	name := in.GetName()
+	name := esc.metricName(in.GetName())
 	if name == "" {
 		return 0, fmt.Errorf("MetricFamily has no name: %s", in)
 	}
@@ -157,7 +246,7 @@ func MetricFamilyToOpenMetrics(out io.Writer, in *dto.MetricFamily, options ...E
 	}
 
 	// Comments, first HELP, then TYPE.
-	if in.Help != nil {
+	if in.Help != nil && metadata {
 		n, err = w.WriteString("# HELP ")
 		written += n
 		if err != nil {
@@ -184,39 +273,43 @@ func MetricFamilyToOpenMetrics(out io.Writer, in *dto.MetricFamily, options ...E
 			return
 		}
 	}
-	n, err = w.WriteString("# TYPE ")
-	written += n
-	if err != nil {
-		return
-	}
-	n, err = writeName(w, compliantName)
-	written += n
-	if err != nil {
-		return
-	}
+	var typeName string
 	switch metricType {
 	case dto.MetricType_COUNTER:
 		if strings.HasSuffix(name, "_total") {
-			n, err = w.WriteString(" counter\n")
+			typeName = " counter\n"
 		} else {
-			n, err = w.WriteString(" unknown\n")
+			typeName = " unknown\n"
 		}
 	case dto.MetricType_GAUGE:
-		n, err = w.WriteString(" gauge\n")
+		typeName = " gauge\n"
 	case dto.MetricType_SUMMARY:
-		n, err = w.WriteString(" summary\n")
+		typeName = " summary\n"
 	case dto.MetricType_UNTYPED:
-		n, err = w.WriteString(" unknown\n")
+		typeName = " unknown\n"
 	case dto.MetricType_HISTOGRAM:
-		n, err = w.WriteString(" histogram\n")
+		typeName = " histogram\n"
 	default:
 		return written, fmt.Errorf("unknown metric type %s", metricType.String())
 	}
-	written += n
-	if err != nil {
-		return
+	if metadata {
+		n, err = w.WriteString("# TYPE ")
+		written += n
+		if err != nil {
+			return
+		}
+		n, err = writeName(w, compliantName)
+		written += n
+		if err != nil {
+			return
+		}
+		n, err = w.WriteString(typeName)
+		written += n
+		if err != nil {
+			return
+		}
 	}
-	if toOM.withUnit && in.Unit != nil {
+	if toOM.withUnit && in.Unit != nil && metadata {
 		n, err = w.WriteString("# UNIT ")
 		written += n
 		if err != nil {
@@ -260,12 +353,12 @@ func MetricFamilyToOpenMetrics(out io.Writer, in *dto.MetricFamily, options ...E
 				)
 			}
 			n, err = writeOpenMetricsSample(
-				w, compliantName, "", metric, "", 0,
+				w, esc, compliantName, "", metric, "", 0,
 				metric.Counter.GetValue(), 0, false,
 				metric.Counter.Exemplar,
 			)
 			if toOM.withCreatedLines && metric.Counter.CreatedTimestamp != nil {
-				createdTsBytesWritten, err = writeOpenMetricsCreated(w, compliantName, "_total", metric, "", 0, metric.Counter.GetCreatedTimestamp())
+				createdTsBytesWritten, err = writeOpenMetricsCreated(w, esc, compliantName, "_total", metric, "", 0, metric.Counter.GetCreatedTimestamp())
 				n += createdTsBytesWritten
 			}
 		case dto.MetricType_GAUGE:
@@ -275,7 +368,7 @@ func MetricFamilyToOpenMetrics(out io.Writer, in *dto.MetricFamily, options ...E
 				)
 			}
 			n, err = writeOpenMetricsSample(
-				w, compliantName, "", metric, "", 0,
+				w, esc, compliantName, "", metric, "", 0,
 				metric.Gauge.GetValue(), 0, false,
 				nil,
 			)
@@ -286,7 +379,7 @@ func MetricFamilyToOpenMetrics(out io.Writer, in *dto.MetricFamily, options ...E
 				)
 			}
 			n, err = writeOpenMetricsSample(
-				w, compliantName, "", metric, "", 0,
+				w, esc, compliantName, "", metric, "", 0,
 				metric.Untyped.GetValue(), 0, false,
 				nil,
 			)
@@ -298,7 +391,7 @@ func MetricFamilyToOpenMetrics(out io.Writer, in *dto.MetricFamily, options ...E
 			}
 			for _, q := range metric.Summary.Quantile {
 				n, err = writeOpenMetricsSample(
-					w, compliantName, "", metric,
+					w, esc, compliantName, "", metric,
 					model.QuantileLabel, q.GetQuantile(),
 					q.GetValue(), 0, false,
 					nil,
@@ -309,7 +402,7 @@ func MetricFamilyToOpenMetrics(out io.Writer, in *dto.MetricFamily, options ...E
 				}
 			}
 			n, err = writeOpenMetricsSample(
-				w, compliantName, "_sum", metric, "", 0,
+				w, esc, compliantName, "_sum", metric, "", 0,
 				metric.Summary.GetSampleSum(), 0, false,
 				nil,
 			)
@@ -318,12 +411,12 @@ func MetricFamilyToOpenMetrics(out io.Writer, in *dto.MetricFamily, options ...E
 				return
 			}
 			n, err = writeOpenMetricsSample(
-				w, compliantName, "_count", metric, "", 0,
+				w, esc, compliantName, "_count", metric, "", 0,
 				0, metric.Summary.GetSampleCount(), true,
 				nil,
 			)
 			if toOM.withCreatedLines && metric.Summary.CreatedTimestamp != nil {
-				createdTsBytesWritten, err = writeOpenMetricsCreated(w, compliantName, "", metric, "", 0, metric.Summary.GetCreatedTimestamp())
+				createdTsBytesWritten, err = writeOpenMetricsCreated(w, esc, compliantName, "", metric, "", 0, metric.Summary.GetCreatedTimestamp())
 				n += createdTsBytesWritten
 			}
 		case dto.MetricType_HISTOGRAM:
@@ -335,7 +428,7 @@ func MetricFamilyToOpenMetrics(out io.Writer, in *dto.MetricFamily, options ...E
 			infSeen := false
 			for _, b := range metric.Histogram.Bucket {
 				n, err = writeOpenMetricsSample(
-					w, compliantName, "_bucket", metric,
+					w, esc, compliantName, "_bucket", metric,
 					model.BucketLabel, b.GetUpperBound(),
 					0, b.GetCumulativeCount(), true,
 					b.Exemplar,
@@ -350,7 +443,7 @@ func MetricFamilyToOpenMetrics(out io.Writer, in *dto.MetricFamily, options ...E
 			}
 			if !infSeen {
 				n, err = writeOpenMetricsSample(
-					w, compliantName, "_bucket", metric,
+					w, esc, compliantName, "_bucket", metric,
 					model.BucketLabel, math.Inf(+1),
 					0, metric.Histogram.GetSampleCount(), true,
 					nil,
@@ -361,7 +454,7 @@ func MetricFamilyToOpenMetrics(out io.Writer, in *dto.MetricFamily, options ...E
 				}
 			}
 			n, err = writeOpenMetricsSample(
-				w, compliantName, "_sum", metric, "", 0,
+				w, esc, compliantName, "_sum", metric, "", 0,
 				metric.Histogram.GetSampleSum(), 0, false,
 				nil,
 			)
@@ -370,12 +463,12 @@ func MetricFamilyToOpenMetrics(out io.Writer, in *dto.MetricFamily, options ...E
 				return
 			}
 			n, err = writeOpenMetricsSample(
-				w, compliantName, "_count", metric, "", 0,
+				w, esc, compliantName, "_count", metric, "", 0,
 				0, metric.Histogram.GetSampleCount(), true,
 				nil,
 			)
 			if toOM.withCreatedLines && metric.Histogram.CreatedTimestamp != nil {
-				createdTsBytesWritten, err = writeOpenMetricsCreated(w, compliantName, "", metric, "", 0, metric.Histogram.GetCreatedTimestamp())
+				createdTsBytesWritten, err = writeOpenMetricsCreated(w, esc, compliantName, "", metric, "", 0, metric.Histogram.GetCreatedTimestamp())
 				n += createdTsBytesWritten
 			}
 		default:
@@ -404,6 +497,7 @@ func FinalizeOpenMetrics(w io.Writer) (written int, err error) {
 // function returns the number of bytes written and any error encountered.
 func writeOpenMetricsSample(
 	w enhancedWriter,
+	esc *nameEscaper,
 	name, suffix string,
 	metric *dto.Metric,
 	additionalLabelName string, additionalLabelValue float64,
@@ -412,7 +506,7 @@ func writeOpenMetricsSample(
 ) (int, error) {
 	written := 0
 	n, err := writeOpenMetricsNameAndLabelPairs(
-		w, name+suffix, metric.Label, additionalLabelName, additionalLabelValue,
+		w, esc, name+suffix, metric.Label, additionalLabelName, additionalLabelValue,
 	)
 	written += n
 	if err != nil {
@@ -446,7 +540,7 @@ func writeOpenMetricsSample(
 		}
 	}
 	if exemplar != nil && len(exemplar.Label) > 0 {
-		n, err = writeExemplar(w, exemplar)
+		n, err = writeExemplar(w, esc, exemplar)
 		written += n
 		if err != nil {
 			return written, err
@@ -464,6 +558,7 @@ func writeOpenMetricsSample(
 // formats the float in OpenMetrics style.
 func writeOpenMetricsNameAndLabelPairs(
 	w enhancedWriter,
+	esc *nameEscaper,
 	name string,
 	in []*dto.LabelPair,
 	additionalLabelName string, additionalLabelValue float64,
@@ -511,7 +606,7 @@ func writeOpenMetricsNameAndLabelPairs(
 		if err != nil {
 			return written, err
 		}
-		n, err := writeName(w, lp.GetName())
+		n, err := writeName(w, esc.labelName(lp.GetName()))
 		written += n
 		if err != nil {
 			return written, err
@@ -521,7 +616,7 @@ func writeOpenMetricsNameAndLabelPairs(
 		if err != nil {
 			return written, err
 		}
-		n, err = writeEscapedString(w, lp.GetValue(), true)
+		n, err = writeEscapedString(w, esc.labelValue(lp), true)
 		written += n
 		if err != nil {
 			return written, err
@@ -574,14 +669,14 @@ func writeOpenMetricsNameAndLabelPairs(
 // an additional label name with a float64 value (use empty string as label name if
 // not required) and the timestamp that represents the created timestamp.
 // The function returns the number of bytes written and any error encountered.
-func writeOpenMetricsCreated(w enhancedWriter,
+func writeOpenMetricsCreated(w enhancedWriter, esc *nameEscaper,
 	name, suffixToTrim string, metric *dto.Metric,
 	additionalLabelName string, additionalLabelValue float64,
 	createdTimestamp *timestamppb.Timestamp,
 ) (int, error) {
 	written := 0
 	n, err := writeOpenMetricsNameAndLabelPairs(
-		w, strings.TrimSuffix(name, suffixToTrim)+"_created", metric.Label, additionalLabelName, additionalLabelValue,
+		w, esc, strings.TrimSuffix(name, suffixToTrim)+"_created", metric.Label, additionalLabelName, additionalLabelValue,
 	)
 	written += n
 	if err != nil {
@@ -613,14 +708,14 @@ func writeOpenMetricsCreated(w enhancedWriter,
 
 // writeExemplar writes the provided exemplar in OpenMetrics format to w. The
 // function returns the number of bytes written and any error encountered.
-func writeExemplar(w enhancedWriter, e *dto.Exemplar) (int, error) {
+func writeExemplar(w enhancedWriter, esc *nameEscaper, e *dto.Exemplar) (int, error) {
 	written := 0
 	n, err := w.WriteString(" # ")
 	written += n
 	if err != nil {
 		return written, err
 	}
-	n, err = writeOpenMetricsNameAndLabelPairs(w, "", e.Label, "", 0)
+	n, err = writeOpenMetricsNameAndLabelPairs(w, esc, "", e.Label, "", 0)
 	written += n
 	if err != nil {
 		return written, err
@@ -0,0 +1,652 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package expfmt
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	dto "github.com/prometheus/client_model/go"
+
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	"github.com/prometheus/common/model"
+)
+
+// openMetricsSuffixes lists, by OpenMetrics type, the suffixes that the names
+// of the samples of a metric family of that type may have.
+var openMetricsSuffixes = map[string][]string{
+	"counter":        {"_total", "_created"},
+	"gauge":          {""},
+	"unknown":        {""},
+	"stateset":       {""},
+	"info":           {"_info"},
+	"summary":        {"", "_sum", "_count", "_created"},
+	"histogram":      {"_bucket", "_sum", "_count", "_created"},
+	"gaugehistogram": {"_bucket", "_gsum", "_gcount"},
+}
+
+// openMetricsTypes maps OpenMetrics types to the MetricType used for them in
+// the MetricFamily proto message. States and info metrics are represented as
+// gauges.
+var openMetricsTypes = map[string]dto.MetricType{
+	"counter":        dto.MetricType_COUNTER,
+	"gauge":          dto.MetricType_GAUGE,
+	"unknown":        dto.MetricType_UNTYPED,
+	"stateset":       dto.MetricType_GAUGE,
+	"info":           dto.MetricType_GAUGE,
+	"summary":        dto.MetricType_SUMMARY,
+	"histogram":      dto.MetricType_HISTOGRAM,
+	"gaugehistogram": dto.MetricType_GAUGE_HISTOGRAM,
+}
+
+// openMetricsParser parses the OpenMetrics text format into MetricFamily proto
+// messages.
+type openMetricsParser struct {
+	utf8Names bool // Whether names may be quoted (OpenMetrics 2.0.0).
+	lineCount int
+	families  []*dto.MetricFamily
+	seen      map[string]bool // Names of all metric families started so far.
+	cur       *openMetricsFamily
+}
+
+// openMetricsFamily collects the metadata and samples of the metric family
+// currently being parsed.
+type openMetricsFamily struct {
+	name       string
+	typ        string
+	help, unit *string
+	metrics    []*dto.Metric
+	byLabels   map[string]*dto.Metric // Key is created with labelsKey.
+}
+
+// parseOpenMetrics reads in as the OpenMetrics text format of the given version
+// and returns the MetricFamily proto messages in the order of their appearance.
+// Metric families without samples are dropped. The input has to end with a
+// `# EOF` line. Quoted metric and label names are only accepted for version
+// 2.0.0.
+//
+// Counters are named with their `_total` suffix and info metrics with their
+// `_info` suffix, as in the Prometheus text format. States and info metrics
+// are represented as gauges. Exemplars are attached to counters and histogram
+// buckets, created timestamps are stored in the CreatedTimestamp fields.
+func parseOpenMetrics(in io.Reader, version string) ([]*dto.MetricFamily, error) {
+	p := openMetricsParser{seen: map[string]bool{}}
+	switch version {
+	case "", OpenMetricsVersion_0_0_1, OpenMetricsVersion_1_0_0:
+	case OpenMetricsVersion_2_0_0:
+		p.utf8Names = true
+	default:
+		return nil, fmt.Errorf("unsupported OpenMetrics version %q", version)
+	}
+
+	buf := bufio.NewReader(in)
+	var eof bool
+	for {
+		line, err := buf.ReadString('\n')
+		if err != nil && !errors.Is(err, io.EOF) {
+			return nil, err
+		}
+		if line == "" && err != nil {
+			break
+		}
+		p.lineCount++
+		if eof {
+			return nil, p.parseError("unexpected content after # EOF")
+		}
+		line = strings.TrimSuffix(line, "\n")
+		err = nil
+		switch {
+		case line == "# EOF":
+			eof = true
+		case line == "":
+			return nil, p.parseError("unexpected empty line")
+		case line[0] == '#':
+			err = p.parseMetadata(line)
+		default:
+			err = p.parseSample(line)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	if !eof {
+		return nil, p.parseError("missing # EOF at end of input")
+	}
+	p.finishFamily()
+	return p.families, nil
+}
+
+func (p *openMetricsParser) parseError(format string, args ...interface{}) error {
+	return ParseError{
+		Line: p.lineCount,
+		Msg:  fmt.Sprintf(format, args...),
+	}
+}
+
+// parseMetadata parses a `# HELP`, `# TYPE`, or `# UNIT` line.
+func (p *openMetricsParser) parseMetadata(line string) error {
+	rest, ok := strings.CutPrefix(line, "# ")
+	if !ok {
+		return p.parseError("invalid comment line %q", line)
+	}
+	keyword, rest, _ := strings.Cut(rest, " ")
+	if keyword != "HELP" && keyword != "TYPE" && keyword != "UNIT" {
+		return p.parseError("invalid comment line %q", line)
+	}
+	name, rest, err := p.readMetricName(rest)
+	if err != nil {
+		return err
+	}
+	rest, ok = strings.CutPrefix(rest, " ")
+	if !ok {
+		return p.parseError("missing value in %s line for metric family %q", keyword, name)
+	}
+
+	f := p.cur
+	if f == nil || f.name != name {
+		if f, err = p.startFamily(name); err != nil {
+			return err
+		}
+	}
+	if len(f.metrics) > 0 {
+		return p.parseError("%s line for metric family %q after its samples", keyword, name)
+	}
+	switch keyword {
+	case "HELP":
+		if f.help != nil {
+			return p.parseError("second HELP line for metric family %q", name)
+		}
+		help, err := p.unescape(rest)
+		if err != nil {
+			return err
+		}
+		f.help = proto.String(help)
+	case "TYPE":
+		if f.typ != "" {
+			return p.parseError("second TYPE line for metric family %q", name)
+		}
+		if _, ok := openMetricsTypes[rest]; !ok {
+			return p.parseError("unknown metric type %q", rest)
+		}
+		f.typ = rest
+	case "UNIT":
+		if f.unit != nil {
+			return p.parseError("second UNIT line for metric family %q", name)
+		}
+		f.unit = proto.String(rest)
+	}
+	return nil
+}
+
+// startFamily finishes the current metric family and starts a new one with the
+// given name.
+func (p *openMetricsParser) startFamily(name string) (*openMetricsFamily, error) {
+	if p.seen[name] {
+		return nil, p.parseError("metric family %q is interleaved with other metric families", name)
+	}
+	p.finishFamily()
+	p.seen[name] = true
+	p.cur = &openMetricsFamily{name: name, byLabels: map[string]*dto.Metric{}}
+	return p.cur, nil
+}
+
+// finishFamily converts the current metric family into a MetricFamily proto
+// message.
+func (p *openMetricsParser) finishFamily() {
+	f := p.cur
+	p.cur = nil
+	if f == nil || len(f.metrics) == 0 {
+		return
+	}
+	name := f.name
+	switch f.typ {
+	case "counter":
+		name += "_total"
+	case "info":
+		name += "_info"
+	}
+	p.families = append(p.families, &dto.MetricFamily{
+		Name:   proto.String(name),
+		Help:   f.help,
+		Type:   openMetricsTypes[f.typ].Enum(),
+		Unit:   f.unit,
+		Metric: f.metrics,
+	})
+}
+
+// parseSample parses a line with a single sample.
+func (p *openMetricsParser) parseSample(line string) error {
+	var (
+		name, rest string
+		labels     []*dto.LabelPair
+		err        error
+	)
+	if line[0] != '{' {
+		if name, rest, err = p.readMetricName(line); err != nil {
+			return err
+		}
+	} else {
+		rest = line
+	}
+	if strings.HasPrefix(rest, "{") {
+		var quotedName string
+		if quotedName, labels, rest, err = p.readLabels(rest, name == ""); err != nil {
+			return err
+		}
+		if quotedName != "" {
+			name = quotedName
+		}
+	}
+	if name == "" {
+		return p.parseError("missing metric name")
+	}
+	rest, ok := strings.CutPrefix(rest, " ")
+	if !ok {
+		return p.parseError("missing value for sample %q", name)
+	}
+	var valueStr, tsStr, exemplarStr string
+	rest, exemplarStr, hasExemplar := strings.Cut(rest, " # ")
+	valueStr, tsStr, hasTS := strings.Cut(rest, " ")
+	value, err := p.parseFloat(valueStr, "value")
+	if err != nil {
+		return err
+	}
+	var ts *int64
+	if hasTS {
+		t, err := p.parseFloat(tsStr, "timestamp")
+		if err != nil {
+			return err
+		}
+		ts = proto.Int64(int64(math.Round(t * 1000)))
+	}
+	var exemplar *dto.Exemplar
+	if hasExemplar {
+		if exemplar, err = p.parseExemplar(exemplarStr); err != nil {
+			return err
+		}
+	}
+
+	f, suffix, err := p.familyOf(name)
+	if err != nil {
+		return err
+	}
+	return p.addSample(f, name, suffix, labels, value, ts, exemplar)
+}
+
+// familyOf returns the metric family the sample with the given name belongs
+// to, and the suffix of the sample name. A sample that does not belong to the
+// current metric family starts a new metric family of unknown type.
+func (p *openMetricsParser) familyOf(name string) (*openMetricsFamily, string, error) {
+	if f := p.cur; f != nil {
+		typ := f.typ
+		if typ == "" {
+			typ = "unknown"
+		}
+		for _, suffix := range openMetricsSuffixes[typ] {
+			if name == f.name+suffix {
+				f.typ = typ
+				return f, suffix, nil
+			}
+		}
+		if name == f.name {
+			return nil, "", p.parseError("invalid sample name %q for %s metric family %q", name, typ, f.name)
+		}
+	}
+	f, err := p.startFamily(name)
+	if err != nil {
+		return nil, "", err
+	}
+	f.typ = "unknown"
+	return f, "", nil
+}
+
+// addSample adds a sample to the metric in f identified by labels.
+func (p *openMetricsParser) addSample(
+	f *openMetricsFamily, name, suffix string, labels []*dto.LabelPair,
+	value float64, ts *int64, exemplar *dto.Exemplar,
+) error {
+	var extraLabel string
+	switch {
+	case f.typ == "summary" && suffix == "":
+		extraLabel = model.QuantileLabel
+	case suffix == "_bucket":
+		extraLabel = model.BucketLabel
+	}
+	var extraValue float64
+	if extraLabel != "" {
+		i := labelIndex(labels, extraLabel)
+		if i < 0 {
+			return p.parseError("missing %q label for sample %q", extraLabel, name)
+		}
+		var err error
+		if extraValue, err = p.parseFloat(labels[i].GetValue(), extraLabel+" label"); err != nil {
+			return err
+		}
+		labels = append(labels[:i:i], labels[i+1:]...)
+	}
+	if exemplar != nil && suffix != "_bucket" && !(f.typ == "counter" && suffix == "_total") {
+		return p.parseError("exemplar on sample %q, only counters and histogram buckets may have exemplars", name)
+	}
+
+	key := labelsKey(labels)
+	m, ok := f.byLabels[key]
+	if !ok {
+		m = &dto.Metric{Label: labels}
+		switch f.typ {
+		case "counter":
+			m.Counter = &dto.Counter{}
+		case "gauge", "stateset", "info":
+			m.Gauge = &dto.Gauge{}
+		case "unknown":
+			m.Untyped = &dto.Untyped{}
+		case "summary":
+			m.Summary = &dto.Summary{}
+		case "histogram", "gaugehistogram":
+			m.Histogram = &dto.Histogram{}
+		}
+		f.byLabels[key] = m
+		f.metrics = append(f.metrics, m)
+	}
+	if ts != nil {
+		m.TimestampMs = ts
+	}
+
+	if suffix == "_created" {
+		created := timestampFromSeconds(value)
+		switch {
+		case m.Counter != nil:
+			m.Counter.CreatedTimestamp = created
+		case m.Summary != nil:
+			m.Summary.CreatedTimestamp = created
+		case m.Histogram != nil:
+			m.Histogram.CreatedTimestamp = created
+		}
+		return nil
+	}
+	switch f.typ {
+	case "counter":
+		m.Counter.Value = proto.Float64(value)
+		m.Counter.Exemplar = exemplar
+	case "gauge", "stateset", "info":
+		m.Gauge.Value = proto.Float64(value)
+	case "unknown":
+		m.Untyped.Value = proto.Float64(value)
+	case "summary":
+		switch suffix {
+		case "":
+			m.Summary.Quantile = append(m.Summary.Quantile, &dto.Quantile{
+				Quantile: proto.Float64(extraValue),
+				Value:    proto.Float64(value),
+			})
+		case "_sum":
+			m.Summary.SampleSum = proto.Float64(value)
+		case "_count":
+			count, err := p.toCount(value, name)
+			if err != nil {
+				return err
+			}
+			m.Summary.SampleCount = proto.Uint64(count)
+		}
+	case "histogram", "gaugehistogram":
+		switch suffix {
+		case "_bucket":
+			count, err := p.toCount(value, name)
+			if err != nil {
+				return err
+			}
+			m.Histogram.Bucket = append(m.Histogram.Bucket, &dto.Bucket{
+				UpperBound:      proto.Float64(extraValue),
+				CumulativeCount: proto.Uint64(count),
+				Exemplar:        exemplar,
+			})
+		case "_sum", "_gsum":
+			m.Histogram.SampleSum = proto.Float64(value)
+		case "_count", "_gcount":
+			count, err := p.toCount(value, name)
+			if err != nil {
+				return err
+			}
+			m.Histogram.SampleCount = proto.Uint64(count)
+		}
+	}
+	return nil
+}
+
+// parseExemplar parses the part of a sample line after " # ".
+func (p *openMetricsParser) parseExemplar(s string) (*dto.Exemplar, error) {
+	if !strings.HasPrefix(s, "{") {
+		return nil, p.parseError("invalid exemplar %q", s)
+	}
+	_, labels, rest, err := p.readLabels(s, false)
+	if err != nil {
+		return nil, err
+	}
+	rest, ok := strings.CutPrefix(rest, " ")
+	if !ok {
+		return nil, p.parseError("missing value for exemplar %q", s)
+	}
+	valueStr, tsStr, hasTS := strings.Cut(rest, " ")
+	value, err := p.parseFloat(valueStr, "exemplar value")
+	if err != nil {
+		return nil, err
+	}
+	e := &dto.Exemplar{Label: labels, Value: proto.Float64(value)}
+	if hasTS {
+		ts, err := p.parseFloat(tsStr, "exemplar timestamp")
+		if err != nil {
+			return nil, err
+		}
+		e.Timestamp = timestampFromSeconds(ts)
+	}
+	return e, nil
+}
+
+// readMetricName reads a metric name at the start of s, which is quoted if
+// p.utf8Names is true and the name is outside of the legacy character set. It
+// returns the name and the remainder of s.
+func (p *openMetricsParser) readMetricName(s string) (string, string, error) {
+	if strings.HasPrefix(s, `"`) {
+		if !p.utf8Names {
+			return "", "", p.parseError("quoted metric names require OpenMetrics version %s", OpenMetricsVersion_2_0_0)
+		}
+		return p.readQuoted(s)
+	}
+	i := 0
+	for i < len(s) && (isValidMetricNameStart(s[i]) || i > 0 && isValidMetricNameContinuation(s[i])) {
+		i++
+	}
+	if i == 0 {
+		return "", "", p.parseError("invalid metric name in line %q", s)
+	}
+	return s[:i], s[i:], nil
+}
+
+// readLabels reads a label set at the start of s, which has to start with '{'.
+// If allowName is true and p.utf8Names is true, the first entry may be a quoted
+// metric name, which is returned as the first return value. The remainder of s
+// after the closing '}' is returned as the last return value.
+func (p *openMetricsParser) readLabels(s string, allowName bool) (string, []*dto.LabelPair, string, error) {
+	var (
+		name   string
+		labels []*dto.LabelPair
+	)
+	s = s[1:]
+	if rest, ok := strings.CutPrefix(s, "}"); ok {
+		return "", nil, rest, nil
+	}
+	for first := true; ; first = false {
+		var (
+			ln     string
+			quoted bool
+			err    error
+		)
+		if strings.HasPrefix(s, `"`) {
+			quoted = true
+			if !p.utf8Names {
+				return "", nil, "", p.parseError("quoted label names require OpenMetrics version %s", OpenMetricsVersion_2_0_0)
+			}
+			if ln, s, err = p.readQuoted(s); err != nil {
+				return "", nil, "", err
+			}
+		} else {
+			i := 0
+			for i < len(s) && (isValidLabelNameStart(s[i]) || i > 0 && isValidLabelNameContinuation(s[i])) {
+				i++
+			}
+			if i == 0 {
+				return "", nil, "", p.parseError("invalid label name in %q", s)
+			}
+			ln, s = s[:i], s[i:]
+		}
+		if quoted && first && allowName && !strings.HasPrefix(s, "=") {
+			// A quoted metric name inside the braces.
+			name = ln
+		} else if labels, s, err = p.readLabelValue(ln, s, labels); err != nil {
+			return "", nil, "", err
+		}
+		switch {
+		case strings.HasPrefix(s, ","):
+			s = s[1:]
+		case strings.HasPrefix(s, "}"):
+			return name, labels, s[1:], nil
+		default:
+			return "", nil, "", p.parseError("expected ',' or '}' after label, got %q", s)
+		}
+	}
+}
+
+// readLabelValue reads `="value"` at the start of s and appends the label with
+// the given name and the read value to labels. It returns the new labels and
+// the remainder of s.
+func (p *openMetricsParser) readLabelValue(ln, s string, labels []*dto.LabelPair) ([]*dto.LabelPair, string, error) {
+	s, ok := strings.CutPrefix(s, "=")
+	if !ok || !strings.HasPrefix(s, `"`) {
+		return nil, "", p.parseError("expected '=\"' after label name %q", ln)
+	}
+	lv, s, err := p.readQuoted(s)
+	if err != nil {
+		return nil, "", err
+	}
+	if labelIndex(labels, ln) >= 0 {
+		return nil, "", p.parseError("duplicate label name %q", ln)
+	}
+	return append(labels, &dto.LabelPair{Name: proto.String(ln), Value: proto.String(lv)}), s, nil
+}
+
+// readQuoted reads a quoted and escaped string at the start of s, which has to
+// start with '"'. It returns the unescaped string and the remainder of s after
+// the closing '"'.
+func (p *openMetricsParser) readQuoted(s string) (string, string, error) {
+	for i := 1; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			i++
+		case '"':
+			v, err := p.unescape(s[1:i])
+			if err != nil {
+				return "", "", err
+			}
+			return v, s[i+1:], nil
+		}
+	}
+	return "", "", p.parseError("unterminated quoted string %q", s)
+}
+
+// unescape resolves the escape sequences `\\`, `\"`, and `\n` in s and checks
+// that the result is valid UTF-8.
+func (p *openMetricsParser) unescape(s string) (string, error) {
+	if !utf8.ValidString(s) {
+		return "", p.parseError("invalid UTF-8 in %q", s)
+	}
+	if !strings.Contains(s, `\`) {
+		return s, nil
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' {
+			b.WriteByte(s[i])
+			continue
+		}
+		i++
+		if i == len(s) {
+			return "", p.parseError("invalid escape sequence at end of %q", s)
+		}
+		switch s[i] {
+		case '\\', '"':
+			b.WriteByte(s[i])
+		case 'n':
+			b.WriteByte('\n')
+		default:
+			return "", p.parseError("invalid escape sequence '\\%c'", s[i])
+		}
+	}
+	return b.String(), nil
+}
+
+func (p *openMetricsParser) parseFloat(s, what string) (float64, error) {
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return 0, p.parseError("invalid %s %q", what, s)
+	}
+	return f, nil
+}
+
+// toCount converts the value of a count sample to an integer.
+func (p *openMetricsParser) toCount(v float64, name string) (uint64, error) {
+	if v < 0 || v != math.Trunc(v) || math.IsInf(v, 0) {
+		return 0, p.parseError("invalid count %v for sample %q", v, name)
+	}
+	return uint64(v), nil
+}
+
+// labelIndex returns the index of the label with the given name in labels, or
+// -1 if there is none.
+func labelIndex(labels []*dto.LabelPair, name string) int {
+	for i, lp := range labels {
+		if lp.GetName() == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// labelsKey returns a key identifying the given label set independent of the
+// order of the labels.
+func labelsKey(labels []*dto.LabelPair) string {
+	pairs := make([]string, 0, len(labels))
+	for _, lp := range labels {
+		pairs = append(pairs, lp.GetName()+string(model.SeparatorByte)+lp.GetValue())
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, string(model.SeparatorByte))
+}
+
+// timestampFromSeconds converts a timestamp in seconds into a Timestamp proto
+// message.
+func timestampFromSeconds(s float64) *timestamppb.Timestamp {
+	sec := math.Floor(s)
+	return &timestamppb.Timestamp{
+		Seconds: int64(sec),
+		Nanos:   int32(math.Round((s - sec) * 1e9)),
+	}
+}
@@ -0,0 +1,426 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package expfmt
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"math"
+	"strings"
+	"testing"
+
+	dto "github.com/prometheus/client_model/go"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+func TestOpenMetricsDecoderRoundTrip(t *testing.T) {
+	in := []*dto.MetricFamily{
+		{
+			Name: proto.String("requests_seconds_total"),
+			Help: proto.String("Total time spent on \"requests\".\nSecond line."),
+			Type: dto.MetricType_COUNTER.Enum(),
+			Unit: proto.String("seconds"),
+			Metric: []*dto.Metric{
+				{
+					Label: []*dto.LabelPair{
+						{Name: proto.String("code"), Value: proto.String("200")},
+						{Name: proto.String("path"), Value: proto.String(`C:\ "x"`)},
+					},
+					Counter: &dto.Counter{
+						Value:            proto.Float64(42),
+						CreatedTimestamp: &timestamppb.Timestamp{Seconds: 12345, Nanos: 600000000},
+						Exemplar: &dto.Exemplar{
+							Label:     []*dto.LabelPair{{Name: proto.String("trace_id"), Value: proto.String("abc")}},
+							Value:     proto.Float64(0.5),
+							Timestamp: &timestamppb.Timestamp{Seconds: 12346},
+						},
+					},
+					TimestampMs: proto.Int64(1234567),
+				},
+				{
+					Label: []*dto.LabelPair{
+						{Name: proto.String("code"), Value: proto.String("500")},
+						{Name: proto.String("path"), Value: proto.String("/")},
+					},
+					Counter: &dto.Counter{
+						Value: proto.Float64(1),
+					},
+				},
+			},
+		},
+		{
+			Name: proto.String("temperature"),
+			Type: dto.MetricType_GAUGE.Enum(),
+			Metric: []*dto.Metric{
+				{Gauge: &dto.Gauge{Value: proto.Float64(-3.5)}},
+			},
+		},
+		{
+			Name: proto.String("untyped_metric"),
+			Type: dto.MetricType_UNTYPED.Enum(),
+			Metric: []*dto.Metric{
+				{Untyped: &dto.Untyped{Value: proto.Float64(math.Inf(-1))}},
+			},
+		},
+		{
+			Name: proto.String("rpc_latency"),
+			Help: proto.String("RPC latency."),
+			Type: dto.MetricType_SUMMARY.Enum(),
+			Metric: []*dto.Metric{
+				{
+					Label: []*dto.LabelPair{{Name: proto.String("service"), Value: proto.String("a")}},
+					Summary: &dto.Summary{
+						SampleCount: proto.Uint64(10),
+						SampleSum:   proto.Float64(4.5),
+						Quantile: []*dto.Quantile{
+							{Quantile: proto.Float64(0.5), Value: proto.Float64(0.3)},
+							{Quantile: proto.Float64(0.99), Value: proto.Float64(1.2)},
+						},
+						CreatedTimestamp: &timestamppb.Timestamp{Seconds: 12345},
+					},
+				},
+			},
+		},
+		{
+			Name: proto.String("request_size"),
+			Type: dto.MetricType_HISTOGRAM.Enum(),
+			Metric: []*dto.Metric{
+				{
+					Histogram: &dto.Histogram{
+						SampleCount: proto.Uint64(7),
+						SampleSum:   proto.Float64(1234.5),
+						Bucket: []*dto.Bucket{
+							{
+								UpperBound:      proto.Float64(100),
+								CumulativeCount: proto.Uint64(3),
+								Exemplar: &dto.Exemplar{
+									Label: []*dto.LabelPair{{Name: proto.String("trace_id"), Value: proto.String("def")}},
+									Value: proto.Float64(42),
+								},
+							},
+							{UpperBound: proto.Float64(1000), CumulativeCount: proto.Uint64(6)},
+							{UpperBound: proto.Float64(math.Inf(1)), CumulativeCount: proto.Uint64(7)},
+						},
+						CreatedTimestamp: &timestamppb.Timestamp{Seconds: 12345},
+					},
+				},
+			},
+		},
+	}
+
+	for _, format := range []Format{FmtOpenMetrics_0_0_1, FmtOpenMetrics_1_0_0, FmtOpenMetrics_2_0_0} {
+		t.Run(string(format), func(t *testing.T) {
+			var buf bytes.Buffer
+			enc := NewEncoder(&buf, format, WithCreatedLines(), WithUnit())
+			for _, mf := range in {
+				if err := enc.Encode(mf); err != nil {
+					t.Fatalf("unexpected error during encode: %s", err)
+				}
+			}
+			if err := enc.(Closer).Close(); err != nil {
+				t.Fatalf("unexpected error closing encoder: %s", err)
+			}
+
+			dec := NewDecoder(&buf, format)
+			for i, want := range in {
+				got := &dto.MetricFamily{}
+				if err := dec.Decode(got); err != nil {
+					t.Fatalf("%d: unexpected error during decode: %s", i, err)
+				}
+				if !proto.Equal(got, want) {
+					t.Errorf("%d: expected %v, got %v", i, want, got)
+				}
+			}
+			if err := dec.Decode(&dto.MetricFamily{}); !errors.Is(err, io.EOF) {
+				t.Errorf("expected io.EOF after the last metric family, got %v", err)
+			}
+		})
+	}
+}
+
+func TestOpenMetricsDecoder(t *testing.T) {
+	scenarios := []struct {
+		name   string
+		format Format
+		in     string
+		out    []*dto.MetricFamily
+	}{
+		{
+			name:   "empty exposition",
+			format: FmtOpenMetrics_1_0_0,
+			in:     "# EOF\n",
+		},
+		{
+			name:   "EOF without newline and metric without metadata",
+			format: FmtOpenMetrics_0_0_1,
+			in:     "foo_total 1\n# EOF",
+			out: []*dto.MetricFamily{
+				{
+					Name:   proto.String("foo_total"),
+					Type:   dto.MetricType_UNTYPED.Enum(),
+					Metric: []*dto.Metric{{Untyped: &dto.Untyped{Value: proto.Float64(1)}}},
+				},
+			},
+		},
+		{
+			name:   "metadata without samples is dropped",
+			format: FmtOpenMetrics_1_0_0,
+			in: `# TYPE foo gauge
+# HELP foo help
+# TYPE bar gauge
+bar 1
+# EOF
+`,
+			out: []*dto.MetricFamily{
+				{
+					Name:   proto.String("bar"),
+					Type:   dto.MetricType_GAUGE.Enum(),
+					Metric: []*dto.Metric{{Gauge: &dto.Gauge{Value: proto.Float64(1)}}},
+				},
+			},
+		},
+		{
+			name:   "info and stateset",
+			format: FmtOpenMetrics_1_0_0,
+			in: `# TYPE build info
+build_info{version="1.2.3"} 1
+# TYPE state stateset
+state{state="a"} 1
+state{state="b"} 0
+# EOF
+`,
+			out: []*dto.MetricFamily{
+				{
+					Name: proto.String("build_info"),
+					Type: dto.MetricType_GAUGE.Enum(),
+					Metric: []*dto.Metric{
+						{
+							Label: []*dto.LabelPair{{Name: proto.String("version"), Value: proto.String("1.2.3")}},
+							Gauge: &dto.Gauge{Value: proto.Float64(1)},
+						},
+					},
+				},
+				{
+					Name: proto.String("state"),
+					Type: dto.MetricType_GAUGE.Enum(),
+					Metric: []*dto.Metric{
+						{
+							Label: []*dto.LabelPair{{Name: proto.String("state"), Value: proto.String("a")}},
+							Gauge: &dto.Gauge{Value: proto.Float64(1)},
+						},
+						{
+							Label: []*dto.LabelPair{{Name: proto.String("state"), Value: proto.String("b")}},
+							Gauge: &dto.Gauge{Value: proto.Float64(0)},
+						},
+					},
+				},
+			},
+		},
+		{
+			name:   "gaugehistogram",
+			format: FmtOpenMetrics_1_0_0,
+			in: `# TYPE queue gaugehistogram
+queue_bucket{le="1.0"} 2
+queue_bucket{le="+Inf"} 3
+queue_gcount 3
+queue_gsum 2.5
+# EOF
+`,
+			out: []*dto.MetricFamily{
+				{
+					Name: proto.String("queue"),
+					Type: dto.MetricType_GAUGE_HISTOGRAM.Enum(),
+					Metric: []*dto.Metric{
+						{
+							Histogram: &dto.Histogram{
+								SampleCount: proto.Uint64(3),
+								SampleSum:   proto.Float64(2.5),
+								Bucket: []*dto.Bucket{
+									{UpperBound: proto.Float64(1), CumulativeCount: proto.Uint64(2)},
+									{UpperBound: proto.Float64(math.Inf(1)), CumulativeCount: proto.Uint64(3)},
+								},
+							},
+						},
+					},
+				},
+			},
+		},
+		{
+			name:   "quoted names in 2.0.0",
+			format: FmtOpenMetrics_2_0_0,
+			in: `# HELP "my.metric" some help
+# TYPE "my.metric" counter
+{"my.metric_total",legacy_label="a","dotted.label"="b"} 1.0
+# EOF
+`,
+			out: []*dto.MetricFamily{
+				{
+					Name: proto.String("my.metric_total"),
+					Help: proto.String("some help"),
+					Type: dto.MetricType_COUNTER.Enum(),
+					Metric: []*dto.Metric{
+						{
+							Label: []*dto.LabelPair{
+								{Name: proto.String("legacy_label"), Value: proto.String("a")},
+								{Name: proto.String("dotted.label"), Value: proto.String("b")},
+							},
+							Counter: &dto.Counter{Value: proto.Float64(1)},
+						},
+					},
+				},
+			},
+		},
+	}
+
+	for _, scenario := range scenarios {
+		t.Run(scenario.name, func(t *testing.T) {
+			dec := NewDecoder(strings.NewReader(scenario.in), scenario.format)
+			var got []*dto.MetricFamily
+			if err := DecodeEach(dec, func(mf *dto.MetricFamily) error {
+				got = append(got, mf)
+				return nil
+			}); err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if len(got) != len(scenario.out) {
+				t.Fatalf("expected %d metric families, got %d: %v", len(scenario.out), len(got), got)
+			}
+			for i, want := range scenario.out {
+				if !proto.Equal(got[i], want) {
+					t.Errorf("%d: expected %v, got %v", i, want, got[i])
+				}
+			}
+		})
+	}
+}
+
+func TestOpenMetricsDecoderErrors(t *testing.T) {
+	scenarios := []struct {
+		name   string
+		format Format
+		in     string
+		err    string
+	}{
+		{
+			name:   "missing EOF",
+			format: FmtOpenMetrics_1_0_0,
+			in:     "foo 1\n",
+			err:    "missing # EOF",
+		},
+		{
+			name:   "empty input",
+			format: FmtOpenMetrics_1_0_0,
+			err:    "missing # EOF",
+		},
+		{
+			name:   "content after EOF",
+			format: FmtOpenMetrics_1_0_0,
+			in:     "# EOF\nfoo 1\n",
+			err:    "after # EOF",
+		},
+		{
+			name:   "empty line",
+			format: FmtOpenMetrics_1_0_0,
+			in:     "foo 1\n\n# EOF\n",
+			err:    "empty line",
+		},
+		{
+			name:   "plain comment",
+			format: FmtOpenMetrics_1_0_0,
+			in:     "# some comment\n# EOF\n",
+			err:    "invalid comment line",
+		},
+		{
+			name:   "quoted names before 2.0.0",
+			format: FmtOpenMetrics_1_0_0,
+			in:     "{\"my.metric\"} 1\n# EOF\n",
+			err:    "require OpenMetrics version 2.0.0",
+		},
+		{
+			name:   "unknown type",
+			format: FmtOpenMetrics_1_0_0,
+			in:     "# TYPE foo bogus\n# EOF\n",
+			err:    "unknown metric type",
+		},
+		{
+			name:   "counter sample without suffix",
+			format: FmtOpenMetrics_1_0_0,
+			in:     "# TYPE foo counter\nfoo 1\n# EOF\n",
+			err:    "invalid sample name",
+		},
+		{
+			name:   "interleaved families",
+			format: FmtOpenMetrics_1_0_0,
+			in:     "foo 1\nbar 1\nfoo{a=\"b\"} 1\n# EOF\n",
+			err:    "interleaved",
+		},
+		{
+			name:   "metadata after samples",
+			format: FmtOpenMetrics_1_0_0,
+			in:     "# TYPE foo gauge\nfoo 1\n# HELP foo help\n# EOF\n",
+			err:    "after its samples",
+		},
+		{
+			name:   "exemplar on gauge",
+			format: FmtOpenMetrics_1_0_0,
+			in:     "# TYPE foo gauge\nfoo 1 # {a=\"b\"} 1\n# EOF\n",
+			err:    "exemplar",
+		},
+		{
+			name:   "invalid escape sequence",
+			format: FmtOpenMetrics_1_0_0,
+			in:     "foo{a=\"\\t\"} 1\n# EOF\n",
+			err:    "invalid escape sequence",
+		},
+		{
+			name:   "invalid value",
+			format: FmtOpenMetrics_1_0_0,
+			in:     "foo one\n# EOF\n",
+			err:    "invalid value",
+		},
+		{
+			name:   "histogram bucket without le",
+			format: FmtOpenMetrics_1_0_0,
+			in:     "# TYPE foo histogram\nfoo_bucket 1\n# EOF\n",
+			err:    `missing "le" label`,
+		},
+		{
+			name:   "fractional count",
+			format: FmtOpenMetrics_1_0_0,
+			in:     "# TYPE foo histogram\nfoo_count 1.5\n# EOF\n",
+			err:    "invalid count",
+		},
+		{
+			name:   "unsupported version",
+			format: OpenMetricsType + "; version=3.0.0; charset=utf-8",
+			in:     "# EOF\n",
+			err:    "unsupported OpenMetrics version",
+		},
+	}
+
+	for _, scenario := range scenarios {
+		t.Run(scenario.name, func(t *testing.T) {
+			dec := NewDecoder(strings.NewReader(scenario.in), scenario.format)
+			err := dec.Decode(&dto.MetricFamily{})
+			if err == nil {
+				t.Fatalf("expected error containing %q, got none", scenario.err)
+			}
+			if !strings.Contains(err.Error(), scenario.err) {
+				t.Errorf("expected error containing %q, got %q", scenario.err, err)
+			}
+		})
+	}
+}
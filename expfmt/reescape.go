@@ -0,0 +1,255 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package expfmt
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"strings"
+
+	dto "github.com/prometheus/client_model/go"
+	"google.golang.org/protobuf/proto"
+
+	"github.com/prometheus/common/model"
+)
+
+// ReescapeTextStream copies the text format exposition read from r to w,
+// changing the escaping of all metric and label names (including the value of
+// a model.MetricNameLabel label) from the scheme from to the scheme to. Names
+// are unescaped with model.UnescapeName and then escaped as the encoder
+// returned by NewEncoder would escape them. Names that are not valid legacy
+// names after escaping, as is possible with model.NoEscaping, are quoted.
+//
+// The input is processed line by line without parsing metric families, so
+// that ReescapeTextStream can be used on streams of any size. Only the names
+// in HELP and TYPE lines and in sample lines are rewritten. Other comments,
+// empty lines, help texts, values, and timestamps are copied verbatim. The
+// label pairs of a sample are written in the normalized form used by the
+// encoder, i.e. without whitespace, also between the metric name and the
+// opening brace. As the encoder escapes the name of a
+// metric family before appending suffixes like _bucket or _count, a sample
+// name consisting of the name of the preceding TYPE line and such a suffix is
+// re-escaped the same way.
+//
+// Note that model.UnderscoreEscaping cannot be reversed, so using it as from
+// leaves the names unchanged before they are escaped with to.
+//
+// A line that cannot be read results in a ParseError. Lines before the
+// offending line have already been written to w at that point.
+func ReescapeTextStream(r io.Reader, from, to model.EscapingScheme, w io.Writer) error {
+	re := textReescaper{
+		p:    openMetricsParser{utf8Names: true},
+		from: from,
+		esc:  newNameEscaper(to),
+	}
+	in := bufio.NewReader(r)
+	out := bufio.NewWriter(w)
+	for {
+		line, readErr := in.ReadString('\n')
+		if readErr != nil && !errors.Is(readErr, io.EOF) {
+			return readErr
+		}
+		if line == "" {
+			break
+		}
+		re.p.lineCount++
+		line, newline := strings.CutSuffix(line, "\n")
+		if err := re.reescapeLine(out, line); err != nil {
+			return err
+		}
+		if newline {
+			if err := out.WriteByte('\n'); err != nil {
+				return err
+			}
+		}
+		if readErr != nil {
+			break
+		}
+	}
+	return out.Flush()
+}
+
+// textSampleSuffixes are the suffixes the text encoder appends to the name of
+// a metric family for its samples.
+var textSampleSuffixes = []string{"_bucket", "_sum", "_count"}
+
+// textReescaper holds the state of ReescapeTextStream.
+type textReescaper struct {
+	p    openMetricsParser // Used for reading names and quoted strings.
+	from model.EscapingScheme
+	esc  *nameEscaper
+
+	// family is the name read from the last TYPE line, and escapedFamily
+	// the same name re-escaped.
+	family, escapedFamily string
+}
+
+// metricName returns the re-escaped version of a metric name.
+func (re *textReescaper) metricName(name string) string {
+	return re.esc.metricName(model.UnescapeName(name, re.from))
+}
+
+// sampleName is like metricName, but takes the suffixes of the samples of the
+// current metric family into account.
+func (re *textReescaper) sampleName(name string) string {
+	if re.family != "" {
+		if suffix, ok := strings.CutPrefix(name, re.family); ok {
+			for _, s := range textSampleSuffixes {
+				if suffix == s {
+					return re.escapedFamily + suffix
+				}
+			}
+		}
+	}
+	return re.metricName(name)
+}
+
+// reescapeLine writes a single line of the text format to w with its names
+// re-escaped.
+func (re *textReescaper) reescapeLine(w enhancedWriter, line string) error {
+	for _, prefix := range []string{"# HELP ", "# TYPE "} {
+		rest, ok := strings.CutPrefix(line, prefix)
+		if !ok {
+			continue
+		}
+		name, rest, err := re.p.readMetricName(rest)
+		if err != nil {
+			return err
+		}
+		escaped := re.metricName(name)
+		if prefix == "# TYPE " {
+			re.family, re.escapedFamily = name, escaped
+		}
+		if _, err := w.WriteString(prefix); err != nil {
+			return err
+		}
+		if _, err := writeName(w, escaped); err != nil {
+			return err
+		}
+		_, err = w.WriteString(rest)
+		return err
+	}
+	if line == "" || line[0] == '#' {
+		_, err := w.WriteString(line)
+		return err
+	}
+
+	var (
+		name   string
+		labels []*dto.LabelPair
+		rest   = line
+		err    error
+	)
+	if !strings.HasPrefix(line, "{") {
+		if name, rest, err = re.p.readMetricName(line); err != nil {
+			return err
+		}
+	}
+	if trimmed := strings.TrimLeft(rest, " \t"); strings.HasPrefix(trimmed, "{") {
+		var quotedName string
+		if quotedName, labels, rest, err = re.readLabels(trimmed, name == ""); err != nil {
+			return err
+		}
+		if quotedName != "" {
+			name = quotedName
+		}
+	}
+	for _, lp := range labels {
+		if lp.GetName() == model.MetricNameLabel {
+			// Written by writeNameAndLabelPairs as escaped by re.esc.
+			lp.Value = proto.String(model.UnescapeName(lp.GetValue(), re.from))
+			continue
+		}
+		lp.Name = proto.String(model.UnescapeName(lp.GetName(), re.from))
+	}
+	if name != "" {
+		name = re.sampleName(name)
+	}
+	if _, err := writeNameAndLabelPairs(w, re.esc, name, labels, "", 0); err != nil {
+		return err
+	}
+	_, err = w.WriteString(rest)
+	return err
+}
+
+// readLabels reads a label set at the start of s, which has to start with '{',
+// like openMetricsParser.readLabels, but following the rules of the text
+// format as implemented by TextParser: Whitespace is allowed around label
+// names, '=', and ',', and the last label pair may be followed by a ','.
+func (re *textReescaper) readLabels(s string, allowName bool) (string, []*dto.LabelPair, string, error) {
+	var (
+		name   string
+		labels []*dto.LabelPair
+	)
+	s = trimTextBlank(s[1:])
+	for first := true; ; first = false {
+		if rest, ok := strings.CutPrefix(s, "}"); ok {
+			return name, labels, rest, nil
+		}
+		var (
+			ln     string
+			quoted bool
+			err    error
+		)
+		if strings.HasPrefix(s, `"`) {
+			quoted = true
+			if ln, s, err = re.p.readQuoted(s); err != nil {
+				return "", nil, "", err
+			}
+		} else {
+			i := 0
+			for i < len(s) && (isValidLabelNameStart(s[i]) || i > 0 && isValidLabelNameContinuation(s[i])) {
+				i++
+			}
+			if i == 0 {
+				return "", nil, "", re.p.parseError("invalid label name in %q", s)
+			}
+			ln, s = s[:i], s[i:]
+		}
+		s = trimTextBlank(s)
+		if quoted && first && allowName && !strings.HasPrefix(s, "=") {
+			// A quoted metric name inside the braces.
+			name = ln
+		} else {
+			rest, ok := strings.CutPrefix(s, "=")
+			if rest = trimTextBlank(rest); !ok || !strings.HasPrefix(rest, `"`) {
+				return "", nil, "", re.p.parseError("expected '=\"' after label name %q", ln)
+			}
+			var lv string
+			if lv, s, err = re.p.readQuoted(rest); err != nil {
+				return "", nil, "", err
+			}
+			if labelIndex(labels, ln) >= 0 {
+				return "", nil, "", re.p.parseError("duplicate label name %q", ln)
+			}
+			labels = append(labels, &dto.LabelPair{Name: proto.String(ln), Value: proto.String(lv)})
+		}
+		s = trimTextBlank(s)
+		switch {
+		case strings.HasPrefix(s, ","):
+			s = trimTextBlank(s[1:])
+		case strings.HasPrefix(s, "}"):
+			return name, labels, s[1:], nil
+		default:
+			return "", nil, "", re.p.parseError("expected ',' or '}' after label, got %q", s)
+		}
+	}
+}
+
+// trimTextBlank removes the blanks and tabs the text format allows between
+// tokens from the start of s.
+func trimTextBlank(s string) string {
+	return strings.TrimLeft(s, " \t")
+}
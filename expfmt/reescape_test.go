@@ -0,0 +1,236 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package expfmt
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+
+	dto "github.com/prometheus/client_model/go"
+	"google.golang.org/protobuf/proto"
+
+	"github.com/prometheus/common/model"
+)
+
+func TestReescapeTextStream(t *testing.T) {
+	scenarios := []struct {
+		name     string
+		in       string
+		from, to model.EscapingScheme
+		out      string
+	}{
+		{
+			name: "values to underscores",
+			in: `# HELP U__my_2e_metric Some "help" text.
+# TYPE U__my_2e_metric counter
+U__my_2e_metric{U__label_2e_name="a\"b",code="200"} 1 1234
+U__my_2e_metric{code="500"} 2
+plain_metric 3
+`,
+			from: model.ValueEncodingEscaping,
+			to:   model.UnderscoreEscaping,
+			out: `# HELP my_metric Some "help" text.
+# TYPE my_metric counter
+my_metric{label_name="a\"b",code="200"} 1 1234
+my_metric{code="500"} 2
+plain_metric 3
+`,
+		},
+		{
+			name: "values to no escaping quotes names",
+			in: `# TYPE U__my_2e_metric gauge
+U__my_2e_metric{U__label_2e_name="x"} 1
+U__my_2e_metric 2
+`,
+			from: model.ValueEncodingEscaping,
+			to:   model.NoEscaping,
+			out: `# TYPE "my.metric" gauge
+{"my.metric","label.name"="x"} 1
+{"my.metric"} 2
+`,
+		},
+		{
+			name: "quoted names to values",
+			in: `# HELP "my.metric" help
+{"my.metric","label.name"="x",other="y"} 1
+{"my.metric"} 2
+`,
+			from: model.NoEscaping,
+			to:   model.ValueEncodingEscaping,
+			out: `# HELP U__my_2e_metric help
+U__my_2e_metric{U__label_2e_name="x",other="y"} 1
+U__my_2e_metric 2
+`,
+		},
+		{
+			name: "dots to values with name label",
+			in: `{__name__="my_dot_metric",a_dot_b="c"} 1
+`,
+			from: model.DotsEscaping,
+			to:   model.ValueEncodingEscaping,
+			out: `{__name__="U__my_2e_metric",U__a_2e_b="c"} 1
+`,
+		},
+		{
+			name: "whitespace around label pairs",
+			in: `U__my_2e_metric{ U__a_2e_b = "c" , d="e"} 1
+U__my_2e_metric{a="b", U__c_2e_d="e"} 2
+`,
+			from: model.ValueEncodingEscaping,
+			to:   model.UnderscoreEscaping,
+			out: `my_metric{a_b="c",d="e"} 1
+my_metric{a="b",c_d="e"} 2
+`,
+		},
+		{
+			name: "trailing comma",
+			in: `U__my_2e_metric{U__a_2e_b="c",} 1
+`,
+			from: model.ValueEncodingEscaping,
+			to:   model.UnderscoreEscaping,
+			out: `my_metric{a_b="c"} 1
+`,
+		},
+		{
+			name: "whitespace between metric name and labels",
+			in: `U__my_2e_metric {U__a_2e_b="c"} 1
+U__my_2e_metric	{} 2
+`,
+			from: model.ValueEncodingEscaping,
+			to:   model.UnderscoreEscaping,
+			out: `my_metric{a_b="c"} 1
+my_metric 2
+`,
+		},
+		{
+			name: "comments, empty lines, and missing final newline",
+			in: `# Just a comment with U__my_2e_metric.
+
+U__my_2e_metric{} 1`,
+			from: model.ValueEncodingEscaping,
+			to:   model.DotsEscaping,
+			out: `# Just a comment with U__my_2e_metric.
+
+my_dot_metric 1`,
+		},
+	}
+
+	for _, scenario := range scenarios {
+		t.Run(scenario.name, func(t *testing.T) {
+			var out bytes.Buffer
+			if err := ReescapeTextStream(strings.NewReader(scenario.in), scenario.from, scenario.to, &out); err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if got := out.String(); got != scenario.out {
+				t.Errorf("expected:\n%s\ngot:\n%s", scenario.out, got)
+			}
+		})
+	}
+}
+
+// TestReescapeTextStreamMatchesEncoder checks that re-escaping the output of
+// an encoder using value encoding yields the output of an encoder using
+// underscore escaping.
+func TestReescapeTextStreamMatchesEncoder(t *testing.T) {
+	mfs := []*dto.MetricFamily{
+		{
+			Name: proto.String("my.counter_total"),
+			Help: proto.String("A counter with a dotted name."),
+			Type: dto.MetricType_COUNTER.Enum(),
+			Metric: []*dto.Metric{
+				{
+					Label:   []*dto.LabelPair{{Name: proto.String("some.label"), Value: proto.String("v")}},
+					Counter: &dto.Counter{Value: proto.Float64(1)},
+				},
+			},
+		},
+		{
+			Name: proto.String("my.histogram"),
+			Type: dto.MetricType_HISTOGRAM.Enum(),
+			Metric: []*dto.Metric{
+				{
+					Histogram: &dto.Histogram{
+						SampleCount: proto.Uint64(2),
+						SampleSum:   proto.Float64(3),
+						Bucket: []*dto.Bucket{
+							{UpperBound: proto.Float64(1), CumulativeCount: proto.Uint64(1)},
+						},
+					},
+				},
+			},
+		},
+	}
+	encode := func(scheme model.EscapingScheme) string {
+		var buf bytes.Buffer
+		enc := NewEncoder(&buf, FmtText+Format("; escaping="+scheme.String()))
+		for _, mf := range mfs {
+			if err := enc.Encode(mf); err != nil {
+				t.Fatalf("unexpected error during encode: %s", err)
+			}
+		}
+		return buf.String()
+	}
+
+	var out bytes.Buffer
+	if err := ReescapeTextStream(strings.NewReader(encode(model.ValueEncodingEscaping)), model.ValueEncodingEscaping, model.UnderscoreEscaping, &out); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if got, want := out.String(), encode(model.UnderscoreEscaping); got != want {
+		t.Errorf("expected:\n%s\ngot:\n%s", want, got)
+	}
+}
+
+func TestReescapeTextStreamErrors(t *testing.T) {
+	scenarios := []struct {
+		name string
+		in   string
+		line int
+	}{
+		{
+			name: "invalid metric name",
+			in:   "# TYPE foo counter\n-foo 1\n",
+			line: 2,
+		},
+		{
+			name: "unterminated label value",
+			in:   "foo 1\nfoo{a=\"b} 1\n",
+			line: 2,
+		},
+		{
+			name: "comma without label pair",
+			in:   "foo{a=\"b\"} 1\nfoo{ , } 1\n",
+			line: 2,
+		},
+		{
+			name: "invalid HELP line",
+			in:   "# HELP \n",
+			line: 1,
+		},
+	}
+
+	for _, scenario := range scenarios {
+		t.Run(scenario.name, func(t *testing.T) {
+			err := ReescapeTextStream(strings.NewReader(scenario.in), model.ValueEncodingEscaping, model.UnderscoreEscaping, &bytes.Buffer{})
+			var parseErr ParseError
+			if !errors.As(err, &parseErr) {
+				t.Fatalf("expected ParseError, got %v", err)
+			}
+			if parseErr.Line != scenario.line {
+				t.Errorf("expected error in line %d, got %d", scenario.line, parseErr.Line)
+			}
+		})
+	}
+}
@@ -0,0 +1,82 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package testutil provides helpers for tests dealing with metric families
+// in the exposition formats of package expfmt.
+package testutil
+
+import (
+	"google.golang.org/protobuf/proto"
+
+	"github.com/prometheus/common/model"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+// MetricFamilyEqualUnescaped returns true if a and b are equal after the
+// metric name, all label names, and the values of all __name__ labels
+// (including those of exemplars) in both of them have been unescaped with
+// model.UnescapeName and the given scheme. This way, an escaped MetricFamily,
+// e.g. as decoded from an exposition, can be compared to the original
+// MetricFamily with names outside of the legacy character set. Note that
+// only schemes that can be unescaped (see model.UnescapeName) allow such a
+// comparison. Neither a nor b is modified.
+func MetricFamilyEqualUnescaped(a, b *dto.MetricFamily, scheme model.EscapingScheme) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return proto.Equal(unescapeMetricFamily(a, scheme), unescapeMetricFamily(b, scheme))
+}
+
+// unescapeMetricFamily returns a copy of v with all names unescaped.
+func unescapeMetricFamily(v *dto.MetricFamily, scheme model.EscapingScheme) *dto.MetricFamily {
+	out := proto.Clone(v).(*dto.MetricFamily)
+	if out.Name != nil {
+		out.Name = proto.String(model.UnescapeName(out.GetName(), scheme))
+	}
+	for _, m := range out.Metric {
+		unescapeLabelPairs(m.Label, scheme)
+		for _, e := range exemplars(m) {
+			unescapeLabelPairs(e.Label, scheme)
+		}
+	}
+	return out
+}
+
+func unescapeLabelPairs(lps []*dto.LabelPair, scheme model.EscapingScheme) {
+	for _, lp := range lps {
+		if lp.GetName() == model.MetricNameLabel {
+			if lp.Value != nil {
+				lp.Value = proto.String(model.UnescapeName(lp.GetValue(), scheme))
+			}
+			continue
+		}
+		if lp.Name != nil {
+			lp.Name = proto.String(model.UnescapeName(lp.GetName(), scheme))
+		}
+	}
+}
+
+// exemplars returns all exemplars of m.
+func exemplars(m *dto.Metric) []*dto.Exemplar {
+	var es []*dto.Exemplar
+	if e := m.GetCounter().GetExemplar(); e != nil {
+		es = append(es, e)
+	}
+	for _, b := range m.GetHistogram().GetBucket() {
+		if e := b.GetExemplar(); e != nil {
+			es = append(es, e)
+		}
+	}
+	return append(es, m.GetHistogram().GetExemplars()...)
+}
@@ -0,0 +1,85 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package testutil
+
+import (
+	"testing"
+
+	"google.golang.org/protobuf/proto"
+
+	"github.com/prometheus/common/model"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+func TestMetricFamilyEqualUnescaped(t *testing.T) {
+	original := &dto.MetricFamily{
+		Name: proto.String("my.metric"),
+		Help: proto.String("some help"),
+		Type: dto.MetricType_COUNTER.Enum(),
+		Metric: []*dto.Metric{
+			{
+				Label: []*dto.LabelPair{
+					{
+						Name:  proto.String(model.MetricNameLabel),
+						Value: proto.String("my.metric"),
+					},
+					{
+						Name:  proto.String("dotted.label"),
+						Value: proto.String("a.b"),
+					},
+					{
+						Name:  proto.String("legacy_label"),
+						Value: proto.String("c"),
+					},
+				},
+				Counter: &dto.Counter{
+					Value: proto.Float64(1),
+				},
+			},
+		},
+	}
+	escaped := model.EscapeMetricFamily(original, model.ValueEncodingEscaping)
+	if proto.Equal(original, escaped) {
+		t.Fatalf("expected escaped family to differ from the original")
+	}
+
+	if !MetricFamilyEqualUnescaped(escaped, original, model.ValueEncodingEscaping) {
+		t.Errorf("expected escaped family %v to equal original %v", escaped, original)
+	}
+	if !MetricFamilyEqualUnescaped(original, escaped, model.ValueEncodingEscaping) {
+		t.Errorf("expected equality to be symmetric")
+	}
+	if escaped.GetName() != "U__my_2e_metric" {
+		t.Errorf("expected escaped family not to be modified, got name %q", escaped.GetName())
+	}
+
+	// Underscore escaping cannot be unescaped.
+	if MetricFamilyEqualUnescaped(model.EscapeMetricFamily(original, model.UnderscoreEscaping), original, model.UnderscoreEscaping) {
+		t.Errorf("expected underscore-escaped family not to equal the original")
+	}
+
+	other := proto.Clone(original).(*dto.MetricFamily)
+	other.Metric[0].Label[2].Value = proto.String("d")
+	if MetricFamilyEqualUnescaped(escaped, other, model.ValueEncodingEscaping) {
+		t.Errorf("expected families with different label values not to be equal")
+	}
+
+	if !MetricFamilyEqualUnescaped(nil, nil, model.ValueEncodingEscaping) {
+		t.Errorf("expected nil families to be equal")
+	}
+	if MetricFamilyEqualUnescaped(escaped, nil, model.ValueEncodingEscaping) {
+		t.Errorf("expected nil and non-nil families not to be equal")
+	}
+}
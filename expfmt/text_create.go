@@ -76,11 +76,18 @@ var (
 //
 // This method fulfills the type 'prometheus.encoder'.
 func MetricFamilyToText(out io.Writer, in *dto.MetricFamily) (written int, err error) {
+	return metricFamilyToText(out, in, nil, true)
+}
+
+// metricFamilyToText implements MetricFamilyToText, escaping metric and label
+// names with esc while writing them. If metadata is false, the HELP and TYPE
+// lines are left out.
+func metricFamilyToText(out io.Writer, in *dto.MetricFamily, esc *nameEscaper, metadata bool) (written int, err error) {
 	// Fail-fast checks.
 	if len(in.Metric) == 0 {
 		return 0, fmt.Errorf("MetricFamily has no metrics: %s", in)
 	}
-	name := in.GetName()
+	name := esc.metricName(in.GetName())
 	if name == "" {
 		return 0, fmt.Errorf("MetricFamily has no name: %s", in)
 	}
@@ -104,7 +111,7 @@ func MetricFamilyToText(out io.Writer, in *dto.MetricFamily) (written int, err e
 	var n int
 
 	// Comments, first HELP, then TYPE.
-	if in.Help != nil {
+	if in.Help != nil && metadata {
 		n, err = w.WriteString("# HELP ")
 		written += n
 		if err != nil {
@@ -131,34 +138,38 @@ func MetricFamilyToText(out io.Writer, in *dto.MetricFamily) (written int, err e
 			return
 		}
 	}
-	n, err = w.WriteString("# TYPE ")
-	written += n
-	if err != nil {
-		return
-	}
-	n, err = writeName(w, name)
-	written += n
-	if err != nil {
-		return
-	}
 	metricType := in.GetType()
+	var typeName string
 	switch metricType {
 	case dto.MetricType_COUNTER:
-		n, err = w.WriteString(" counter\n")
+		typeName = " counter\n"
 	case dto.MetricType_GAUGE:
-		n, err = w.WriteString(" gauge\n")
+		typeName = " gauge\n"
 	case dto.MetricType_SUMMARY:
-		n, err = w.WriteString(" summary\n")
+		typeName = " summary\n"
 	case dto.MetricType_UNTYPED:
-		n, err = w.WriteString(" untyped\n")
+		typeName = " untyped\n"
 	case dto.MetricType_HISTOGRAM:
-		n, err = w.WriteString(" histogram\n")
+		typeName = " histogram\n"
 	default:
 		return written, fmt.Errorf("unknown metric type %s", metricType.String())
 	}
-	written += n
-	if err != nil {
-		return
+	if metadata {
+		n, err = w.WriteString("# TYPE ")
+		written += n
+		if err != nil {
+			return
+		}
+		n, err = writeName(w, name)
+		written += n
+		if err != nil {
+			return
+		}
+		n, err = w.WriteString(typeName)
+		written += n
+		if err != nil {
+			return
+		}
 	}
 
 	// Finally the samples, one line for each.
@@ -171,7 +182,7 @@ func MetricFamilyToText(out io.Writer, in *dto.MetricFamily) (written int, err e
 				)
 			}
 			n, err = writeSample(
-				w, name, "", metric, "", 0,
+				w, esc, name, "", metric, "", 0,
 				metric.Counter.GetValue(),
 			)
 		case dto.MetricType_GAUGE:
@@ -181,7 +192,7 @@ func MetricFamilyToText(out io.Writer, in *dto.MetricFamily) (written int, err e
 				)
 			}
 			n, err = writeSample(
-				w, name, "", metric, "", 0,
+				w, esc, name, "", metric, "", 0,
 				metric.Gauge.GetValue(),
 			)
 		case dto.MetricType_UNTYPED:
@@ -191,7 +202,7 @@ func MetricFamilyToText(out io.Writer, in *dto.MetricFamily) (written int, err e
 				)
 			}
 			n, err = writeSample(
-				w, name, "", metric, "", 0,
+				w, esc, name, "", metric, "", 0,
 				metric.Untyped.GetValue(),
 			)
 		case dto.MetricType_SUMMARY:
@@ -202,7 +213,7 @@ func MetricFamilyToText(out io.Writer, in *dto.MetricFamily) (written int, err e
 			}
 			for _, q := range metric.Summary.Quantile {
 				n, err = writeSample(
-					w, name, "", metric,
+					w, esc, name, "", metric,
 					model.QuantileLabel, q.GetQuantile(),
 					q.GetValue(),
 				)
@@ -212,7 +223,7 @@ func MetricFamilyToText(out io.Writer, in *dto.MetricFamily) (written int, err e
 				}
 			}
 			n, err = writeSample(
-				w, name, "_sum", metric, "", 0,
+				w, esc, name, "_sum", metric, "", 0,
 				metric.Summary.GetSampleSum(),
 			)
 			written += n
@@ -220,7 +231,7 @@ func MetricFamilyToText(out io.Writer, in *dto.MetricFamily) (written int, err e
 				return
 			}
 			n, err = writeSample(
-				w, name, "_count", metric, "", 0,
+				w, esc, name, "_count", metric, "", 0,
 				float64(metric.Summary.GetSampleCount()),
 			)
 		case dto.MetricType_HISTOGRAM:
@@ -232,7 +243,7 @@ func MetricFamilyToText(out io.Writer, in *dto.MetricFamily) (written int, err e
 			infSeen := false
 			for _, b := range metric.Histogram.Bucket {
 				n, err = writeSample(
-					w, name, "_bucket", metric,
+					w, esc, name, "_bucket", metric,
 					model.BucketLabel, b.GetUpperBound(),
 					float64(b.GetCumulativeCount()),
 				)
@@ -246,7 +257,7 @@ func MetricFamilyToText(out io.Writer, in *dto.MetricFamily) (written int, err e
 			}
 			if !infSeen {
 				n, err = writeSample(
-					w, name, "_bucket", metric,
+					w, esc, name, "_bucket", metric,
 					model.BucketLabel, math.Inf(+1),
 					float64(metric.Histogram.GetSampleCount()),
 				)
@@ -256,7 +267,7 @@ func MetricFamilyToText(out io.Writer, in *dto.MetricFamily) (written int, err e
 				}
 			}
 			n, err = writeSample(
-				w, name, "_sum", metric, "", 0,
+				w, esc, name, "_sum", metric, "", 0,
 				metric.Histogram.GetSampleSum(),
 			)
 			written += n
@@ -264,7 +275,7 @@ func MetricFamilyToText(out io.Writer, in *dto.MetricFamily) (written int, err e
 				return
 			}
 			n, err = writeSample(
-				w, name, "_count", metric, "", 0,
+				w, esc, name, "_count", metric, "", 0,
 				float64(metric.Histogram.GetSampleCount()),
 			)
 		default:
@@ -287,6 +298,7 @@ func MetricFamilyToText(out io.Writer, in *dto.MetricFamily) (written int, err e
 // encountered.
 func writeSample(
 	w enhancedWriter,
+	esc *nameEscaper,
 	name, suffix string,
 	metric *dto.Metric,
 	additionalLabelName string, additionalLabelValue float64,
@@ -294,7 +306,7 @@ func writeSample(
 ) (int, error) {
 	written := 0
 	n, err := writeNameAndLabelPairs(
-		w, name+suffix, metric.Label, additionalLabelName, additionalLabelValue,
+		w, esc, name+suffix, metric.Label, additionalLabelName, additionalLabelValue,
 	)
 	written += n
 	if err != nil {
@@ -341,6 +353,7 @@ func writeSample(
 // label names will also be quoted.
 func writeNameAndLabelPairs(
 	w enhancedWriter,
+	esc *nameEscaper,
 	name string,
 	in []*dto.LabelPair,
 	additionalLabelName string, additionalLabelValue float64,
@@ -387,7 +400,7 @@ func writeNameAndLabelPairs(
 		if err != nil {
 			return written, err
 		}
-		n, err := writeName(w, lp.GetName())
+		n, err := writeName(w, esc.labelName(lp.GetName()))
 		written += n
 		if err != nil {
 			return written, err
@@ -397,7 +410,7 @@ func writeNameAndLabelPairs(
 		if err != nil {
 			return written, err
 		}
-		n, err = writeEscapedString(w, lp.GetValue(), true)
+		n, err = writeEscapedString(w, esc.labelValue(lp), true)
 		written += n
 		if err != nil {
 			return written, err
@@ -451,6 +464,22 @@ var (
 	quotedEscaper = strings.NewReplacer("\\", `\\`, "\n", `\n`, "\"", `\"`)
 )
 
+// EscapeLabelValueForFormat returns the label value escaped as it would be
+// written between the double quotes of a label pair in the given format. For
+// the Prometheus text format and OpenMetrics, '\' is replaced by '\\', the new
+// line character by '\n', and '"' by '\"'. (Both formats agree on the rules for
+// label values. They only differ for HELP text, where the text format does not
+// escape '"'.) Protobuf-based and unknown formats carry label values verbatim,
+// so the value is returned unchanged.
+func EscapeLabelValueForFormat(v model.LabelValue, f Format) string {
+	switch f.FormatType() {
+	case TypeTextPlain, TypeOpenMetrics:
+		return quotedEscaper.Replace(string(v))
+	default:
+		return string(v)
+	}
+}
+
 func writeEscapedString(w enhancedWriter, v string, includeDoubleQuote bool) (int, error) {
 	if includeDoubleQuote {
 		return quotedEscaper.WriteString(w, v)
@@ -518,3 +547,76 @@ func writeName(w enhancedWriter, name string) (int, error) {
 	written++
 	return written, err
 }
+
+// nameEscaper escapes metric and label names while the text-based encoders
+// write them, following the same rules as model.EscapeMetricFamily. This
+// spares NewEncoder an escaped copy of every metric with names that need
+// escaping. As the same label names typically occur in every metric of a
+// family, escaped names are cached. A nil *nameEscaper leaves all names
+// unchanged.
+type nameEscaper struct {
+	scheme      model.EscapingScheme
+	metricNames map[string]string
+	labelNames  map[string]string
+	// shared, if not nil, escapes the names missing from the maps above. It
+	// has to use the same scheme.
+	shared *model.Escaper
+}
+
+// newNameEscaper returns a nameEscaper for the given scheme, or nil for
+// model.NoEscaping.
+func newNameEscaper(scheme model.EscapingScheme) *nameEscaper {
+	if scheme == model.NoEscaping {
+		return nil
+	}
+	return &nameEscaper{scheme: scheme}
+}
+
+func (e *nameEscaper) metricName(name string) string {
+	if e == nil || model.IsValidLegacyMetricName(name) {
+		return name
+	}
+	if escaped, ok := e.metricNames[name]; ok {
+		return escaped
+	}
+	if e.metricNames == nil {
+		e.metricNames = map[string]string{}
+	}
+	var escaped string
+	if e.shared != nil {
+		escaped = e.shared.Escape(name)
+	} else {
+		escaped = model.EscapeName(name, e.scheme)
+	}
+	e.metricNames[name] = escaped
+	return escaped
+}
+
+func (e *nameEscaper) labelName(name string) string {
+	if e == nil || model.IsValidLegacyLabelName(model.LabelName(name)) {
+		return name
+	}
+	if escaped, ok := e.labelNames[name]; ok {
+		return escaped
+	}
+	if e.labelNames == nil {
+		e.labelNames = map[string]string{}
+	}
+	var escaped string
+	if e.shared != nil {
+		escaped = e.shared.EscapeLabelName(name)
+	} else {
+		escaped = model.EscapeLabelName(name, e.scheme)
+	}
+	e.labelNames[name] = escaped
+	return escaped
+}
+
+// labelValue returns the value of lp, which is escaped like a metric name for
+// the model.MetricNameLabel.
+func (e *nameEscaper) labelValue(lp *dto.LabelPair) string {
+	if lp.GetName() == model.MetricNameLabel && lp.Value != nil {
+		return e.metricName(lp.GetValue())
+	}
+	return lp.GetValue()
+}
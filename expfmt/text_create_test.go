@@ -610,3 +610,38 @@ func TestCreateError(t *testing.T) {
 		}
 	}
 }
+
+func TestEscapeLabelValueForFormat(t *testing.T) {
+	value := model.LabelValue("multi\nline \"quoted\" back\\slash")
+	scenarios := []struct {
+		format   Format
+		expected string
+	}{
+		{
+			format:   FmtText,
+			expected: `multi\nline \"quoted\" back\\slash`,
+		},
+		{
+			format:   FmtOpenMetrics_0_0_1,
+			expected: `multi\nline \"quoted\" back\\slash`,
+		},
+		{
+			format:   FmtOpenMetrics_1_0_0,
+			expected: `multi\nline \"quoted\" back\\slash`,
+		},
+		{
+			format:   FmtProtoDelim,
+			expected: "multi\nline \"quoted\" back\\slash",
+		},
+		{
+			format:   FmtProtoText,
+			expected: "multi\nline \"quoted\" back\\slash",
+		},
+	}
+
+	for i, scenario := range scenarios {
+		if got := EscapeLabelValueForFormat(value, scenario.format); got != scenario.expected {
+			t.Errorf("%d. %s: expected %q, got %q", i, scenario.format, scenario.expected, got)
+		}
+	}
+}
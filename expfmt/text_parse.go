@@ -61,6 +61,15 @@ type TextParser struct {
 	currentMetric        *dto.Metric
 	currentLabelPair     *dto.LabelPair
 
+	// The values of metricFamiliesByName in the order of their creation.
+	metricFamilies []*dto.MetricFamily
+
+	// Only used by ParseStream.
+	stream   func(*dto.MetricFamily) error
+	streamMF *dto.MetricFamily         // The family currently being filled.
+	spareMF  *dto.MetricFamily         // A family passed to stream before, for reuse.
+	emitted  map[string]dto.MetricType // Names and types of the families passed to stream.
+
 	// The remaining member variables are only used for summaries/histograms.
 	currentLabels map[string]string // All labels including '__name__' but excluding 'quantile'/'le'
 	// Summary specific.
@@ -100,16 +109,135 @@ type TextParser struct {
 // This method must not be called concurrently. If you want to parse different
 // input concurrently, instantiate a separate Parser for each goroutine.
 func (p *TextParser) TextToMetricFamilies(in io.Reader) (map[string]*dto.MetricFamily, error) {
-	p.reset(in)
-	for nextState := p.startOfLine; nextState != nil; nextState = nextState() {
-		// Magic happens here...
-	}
+	p.parse(in)
 	// Get rid of empty metric families.
 	for k, mf := range p.metricFamiliesByName {
 		if len(mf.GetMetric()) == 0 {
 			delete(p.metricFamiliesByName, k)
 		}
 	}
+	return p.metricFamiliesByName, p.err
+}
+
+// TextToMetricFamiliesOrdered works like TextToMetricFamilies, but returns the
+// MetricFamily proto messages in a slice, in the order in which their names
+// first appeared in the input (in a HELP, TYPE, or sample line). This is useful
+// to render or snapshot parsed input, or to compare the output of two scrapes,
+// where the random iteration order of a map would get in the way. The metrics
+// within each MetricFamily keep the order of the input, as with
+// TextToMetricFamilies.
+func (p *TextParser) TextToMetricFamiliesOrdered(in io.Reader) ([]*dto.MetricFamily, error) {
+	p.parse(in)
+	// Get rid of empty metric families.
+	fams := make([]*dto.MetricFamily, 0, len(p.metricFamilies))
+	for _, mf := range p.metricFamilies {
+		if len(mf.GetMetric()) > 0 {
+			fams = append(fams, mf)
+		}
+	}
+	return fams, p.err
+}
+
+// ParseStream reads 'in' like TextToMetricFamilies, but instead of collecting
+// all metric families, it calls cb for each metric family as soon as it is
+// complete, i.e. once the input moves on to the next metric family (or ends).
+// This keeps only a single metric family in memory at a time, independent of
+// the size of the input. Metric families without samples are skipped. The
+// metric families are passed to cb in the order of the input.
+//
+// To avoid allocations, the MetricFamily passed to cb (including its Metric
+// slice) is reused for later metric families once cb has returned, so cb must
+// not retain it. The Metric messages it contains are not reused and may be
+// retained.
+//
+// The text format requires all lines of a metric family to be grouped
+// together. As ParseStream has passed a metric family to cb once other lines
+// follow, a metric family that appears again after another one (either by name
+// or, for summaries and histograms, with its _sum, _count, or _bucket samples)
+// results in a ParseError, whereas TextToMetricFamilies merges such
+// interleaved metric families. If cb returns an error, parsing stops and
+// ParseStream returns that error.
+//
+// Like TextToMetricFamilies, ParseStream must not be called concurrently.
+func (p *TextParser) ParseStream(in io.Reader, cb func(*dto.MetricFamily) error) error {
+	p.stream = cb
+	p.emitted = map[string]dto.MetricType{}
+	defer func() {
+		p.stream, p.streamMF, p.emitted = nil, nil, nil
+	}()
+	p.parse(in)
+	if p.err == nil {
+		p.err = p.flushStream()
+	}
+	return p.err
+}
+
+// flushStream passes p.streamMF to p.stream unless it has no metrics and
+// forgets about it, so that the next metric family can be started.
+func (p *TextParser) flushStream() error {
+	mf := p.streamMF
+	if mf == nil {
+		return nil
+	}
+	p.streamMF = nil
+	delete(p.metricFamiliesByName, mf.GetName())
+	p.emitted[mf.GetName()] = mf.GetType()
+	// The summaries and histograms of the family are complete, too.
+	if len(p.summaries) > 0 {
+		p.summaries = map[uint64]*dto.Metric{}
+	}
+	if len(p.histograms) > 0 {
+		p.histograms = map[uint64]*dto.Metric{}
+	}
+	var err error
+	if len(mf.GetMetric()) > 0 {
+		err = p.stream(mf)
+	}
+	p.spareMF = mf
+	return err
+}
+
+// newStreamMF returns a MetricFamily for ParseStream with the given name,
+// reusing p.spareMF if possible. It sets a ParseError if a metric family of
+// that name has been passed to p.stream already.
+func (p *TextParser) newStreamMF(name string) *dto.MetricFamily {
+	if _, ok := p.emitted[name]; ok {
+		p.parseError(fmt.Sprintf("metric family %q appears again after other metric families", name))
+		return nil
+	}
+	if t, ok := p.emitted[summaryMetricName(name)]; ok && t == dto.MetricType_SUMMARY {
+		p.parseError(fmt.Sprintf("sample %q of summary %q appears after other metric families", name, summaryMetricName(name)))
+		return nil
+	}
+	if t, ok := p.emitted[histogramMetricName(name)]; ok && t == dto.MetricType_HISTOGRAM {
+		p.parseError(fmt.Sprintf("sample %q of histogram %q appears after other metric families", name, histogramMetricName(name)))
+		return nil
+	}
+	if err := p.flushStream(); err != nil {
+		p.err = err
+		return nil
+	}
+	mf := p.spareMF
+	if mf == nil {
+		mf = &dto.MetricFamily{}
+	}
+	p.spareMF = nil
+	for i := range mf.Metric {
+		mf.Metric[i] = nil
+	}
+	mf.Name, mf.Help, mf.Type, mf.Unit, mf.Metric = proto.String(name), nil, nil, nil, mf.Metric[:0]
+	p.streamMF = mf
+	return mf
+}
+
+// parse reads in into p.metricFamiliesByName and p.metricFamilies, with any
+// error stored in p.err.
+func (p *TextParser) parse(in io.Reader) {
+	p.reset(in)
+	p.skipBOM()
+	for nextState := p.startOfLine; nextState != nil; nextState = nextState() {
+		// Magic happens here...
+	}
 	// If p.err is io.EOF now, we have run into a premature end of the input
 	// stream. Turn this error into something nicer and more
 	// meaningful. (io.EOF is often used as a signal for the legitimate end
@@ -117,11 +245,23 @@ func (p *TextParser) TextToMetricFamilies(in io.Reader) (map[string]*dto.MetricF
 	if p.err != nil && errors.Is(p.err, io.EOF) {
 		p.parseError("unexpected end of input stream")
 	}
-	return p.metricFamiliesByName, p.err
+}
+
+// utf8BOM is the UTF-8 encoded byte order mark.
+var utf8BOM = []byte{0xEF, 0xBB, 0xBF}
+
+// skipBOM discards a UTF-8 byte order mark at the start of the input, which
+// some tools prepend to text files and which would otherwise break parsing of
+// the first metric name.
+func (p *TextParser) skipBOM() {
+	if b, err := p.buf.Peek(len(utf8BOM)); err == nil && bytes.Equal(b, utf8BOM) {
+		_, _ = p.buf.Discard(len(utf8BOM))
+	}
 }
 
 func (p *TextParser) reset(in io.Reader) {
 	p.metricFamiliesByName = map[string]*dto.MetricFamily{}
+	p.metricFamilies = nil
 	if p.buf == nil {
 		p.buf = bufio.NewReader(in)
 	} else {
@@ -158,6 +298,8 @@ func (p *TextParser) startOfLine() stateFn {
 		return p.startComment
 	case '\n':
 		return p.startOfLine // Empty line, start the next one.
+	case '{':
+		return p.readingQuotedMetricName
 	}
 	return p.readingMetricName
 }
@@ -193,7 +335,14 @@ func (p *TextParser) startComment() stateFn {
 	if p.skipBlankTab(); p.err != nil {
 		return nil // Unexpected end of input.
 	}
-	if p.readTokenAsMetricName(); p.err != nil {
+	if p.currentByte == '"' {
+		if p.readTokenAsQuotedName(); p.err != nil {
+			return nil // Unexpected end of input.
+		}
+		if !p.checkQuotedMetricName() {
+			return nil
+		}
+	} else if p.readTokenAsMetricName(); p.err != nil {
 		return nil // Unexpected end of input.
 	}
 	if p.currentByte == '\n' {
@@ -205,7 +354,9 @@ func (p *TextParser) startComment() stateFn {
 		p.parseError("invalid metric name in comment")
 		return nil
 	}
-	p.setOrCreateCurrentMF()
+	if p.setOrCreateCurrentMF(); p.err != nil {
+		return nil
+	}
 	if p.skipBlankTab(); p.err != nil {
 		return nil // Unexpected end of input.
 	}
@@ -233,7 +384,60 @@ func (p *TextParser) readingMetricName() stateFn {
 		p.parseError("invalid metric name")
 		return nil
 	}
-	p.setOrCreateCurrentMF()
+	if p.startMetric(); p.err != nil {
+		return nil
+	}
+	if p.skipBlankTabIfCurrentBlankTab(); p.err != nil {
+		return nil // Unexpected end of input.
+	}
+	return p.readingLabels
+}
+
+// readingQuotedMetricName represents the state where the last byte read (now
+// in p.currentByte) is the '{' of a sample line that starts with the label set,
+// which then has to begin with the quoted metric name, as in
+// `{"my.metric",label="value"} 1`.
+func (p *TextParser) readingQuotedMetricName() stateFn {
+	if p.skipBlankTab(); p.err != nil {
+		return nil // Unexpected end of input.
+	}
+	if p.currentByte != '"' {
+		p.parseError("invalid metric name")
+		return nil
+	}
+	if p.readTokenAsQuotedName(); p.err != nil {
+		return nil // Unexpected end of input.
+	}
+	if !p.checkQuotedMetricName() {
+		return nil
+	}
+	if p.startMetric(); p.err != nil {
+		return nil
+	}
+	p.resetCurrentLabels()
+	if p.skipBlankTabIfCurrentBlankTab(); p.err != nil {
+		return nil // Unexpected end of input.
+	}
+	switch p.currentByte {
+	case ',':
+		return p.startLabelName
+	case '}':
+		if p.skipBlankTab(); p.err != nil {
+			return nil // Unexpected end of input.
+		}
+		return p.readingValue
+	default:
+		p.parseError(fmt.Sprintf("unexpected end of metric name %q", p.currentMF.GetName()))
+		return nil
+	}
+}
+
+// startMetric sets p.currentMF to the metric family of the metric name in
+// p.currentToken and creates a new p.currentMetric.
+func (p *TextParser) startMetric() {
+	if p.setOrCreateCurrentMF(); p.err != nil {
+		return
+	}
 	// Now is the time to fix the type if it hasn't happened yet.
 	if p.currentMF.Type == nil {
 		p.currentMF.Type = dto.MetricType_UNTYPED.Enum()
@@ -243,16 +447,33 @@ func (p *TextParser) readingMetricName() stateFn {
 	// currentMF.Metric right now. First wait if this is a summary,
 	// and the metric exists already, which we can only know after
 	// having read all the labels.
-	if p.skipBlankTabIfCurrentBlankTab(); p.err != nil {
-		return nil // Unexpected end of input.
+}
+
+// checkQuotedMetricName checks the quoted metric name in p.currentToken
+// against the current name validation scheme (see
+// model.GetNameValidationScheme) and sets a parse error if it is not valid.
+func (p *TextParser) checkQuotedMetricName() bool {
+	name := p.currentToken.String()
+	if !model.IsValidMetricName(model.LabelValue(name)) {
+		p.parseError(fmt.Sprintf("invalid metric name %q under the current name validation scheme", name))
+		return false
 	}
-	return p.readingLabels
+	return true
 }
 
 // readingLabels represents the state where the last byte read (now in
 // p.currentByte) is either the first byte of the label set (i.e. a '{'), or the
 // first byte of the value (otherwise).
 func (p *TextParser) readingLabels() stateFn {
+	p.resetCurrentLabels()
+	if p.currentByte != '{' {
+		return p.readingValue
+	}
+	return p.startLabelName
+}
+
+// resetCurrentLabels prepares reading the labels of a new sample line.
+func (p *TextParser) resetCurrentLabels() {
 	// Summaries/histograms are special. We have to reset the
 	// currentLabels map, currentQuantile and currentBucket before starting to
 	// read labels.
@@ -262,10 +483,6 @@ func (p *TextParser) readingLabels() stateFn {
 		p.currentQuantile = math.NaN()
 		p.currentBucket = math.NaN()
 	}
-	if p.currentByte != '{' {
-		return p.readingValue
-	}
-	return p.startLabelName
 }
 
 // startLabelName represents the state where the next byte read from p.buf is
@@ -280,7 +497,15 @@ func (p *TextParser) startLabelName() stateFn {
 		}
 		return p.readingValue
 	}
-	if p.readTokenAsLabelName(); p.err != nil {
+	if p.currentByte == '"' {
+		if p.readTokenAsQuotedName(); p.err != nil {
+			return nil // Unexpected end of input.
+		}
+		if !model.LabelName(p.currentToken.String()).IsValid() {
+			p.parseError(fmt.Sprintf("invalid label name %q for metric %q under the current name validation scheme", p.currentToken.String(), p.currentMF.GetName()))
+			return nil
+		}
+	} else if p.readTokenAsLabelName(); p.err != nil {
 		return nil // Unexpected end of input.
 	}
 	if p.currentToken.Len() == 0 {
@@ -679,6 +904,18 @@ func (p *TextParser) readTokenAsLabelValue() {
 	}
 }
 
+// readTokenAsQuotedName copies a quoted metric or label name from p.buf into
+// p.currentToken, recognizing the same escape sequences as
+// readTokenAsLabelValue. The last byte read (now in p.currentByte) has to be
+// the opening '"'. The byte following the closing '"' is copied into
+// p.currentByte.
+func (p *TextParser) readTokenAsQuotedName() {
+	if p.readTokenAsLabelValue(); p.err != nil {
+		return
+	}
+	p.currentByte, p.err = p.buf.ReadByte()
+}
+
 func (p *TextParser) setOrCreateCurrentMF() {
 	p.currentIsSummaryCount = false
 	p.currentIsSummarySum = false
@@ -713,8 +950,16 @@ func (p *TextParser) setOrCreateCurrentMF() {
 			return
 		}
 	}
+	if p.stream != nil {
+		if p.currentMF = p.newStreamMF(name); p.currentMF == nil {
+			return
+		}
+		p.metricFamiliesByName[name] = p.currentMF
+		return
+	}
 	p.currentMF = &dto.MetricFamily{Name: proto.String(name)}
 	p.metricFamiliesByName[name] = p.currentMF
+	p.metricFamilies = append(p.metricFamilies, p.currentMF)
 }
 
 func isValidLabelNameStart(b byte) bool {
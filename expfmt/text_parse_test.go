@@ -16,11 +16,14 @@ package expfmt
 import (
 	"errors"
 	"math"
+	"os"
 	"strings"
 	"testing"
 
 	dto "github.com/prometheus/client_model/go"
 	"google.golang.org/protobuf/proto"
+
+	"github.com/prometheus/common/model"
 )
 
 func testTextParse(t testing.TB) {
@@ -668,6 +671,203 @@ func BenchmarkParseError(b *testing.B) {
 	}
 }
 
+func TestTextToMetricFamiliesOrdered(t *testing.T) {
+	in := `# TYPE zeta counter
+zeta 1
+# HELP alpha Help for alpha.
+# TYPE alpha summary
+alpha{quantile="0.5"} 1
+alpha_sum 2
+alpha_count 3
+mu{a="1"} 4
+# TYPE beta gauge
+mu{a="2"} 5
+beta 6
+# HELP empty A family without samples.
+zeta_other 7
+`
+	var p TextParser
+	fams, err := p.TextToMetricFamiliesOrdered(strings.NewReader(in))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	var names []string
+	for _, mf := range fams {
+		names = append(names, mf.GetName())
+	}
+	if got, want := strings.Join(names, ","), "zeta,alpha,mu,beta,zeta_other"; got != want {
+		t.Errorf("expected families %s, got %s", want, got)
+	}
+	if got := len(fams[2].GetMetric()); got != 2 {
+		t.Errorf("expected 2 metrics in family mu, got %d", got)
+	}
+
+	// The same parser can be reused, and the result matches
+	// TextToMetricFamilies.
+	byName, err := p.TextToMetricFamilies(strings.NewReader(in))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if len(byName) != len(fams) {
+		t.Fatalf("expected %d families, got %d", len(fams), len(byName))
+	}
+	for _, mf := range fams {
+		if !proto.Equal(mf, byName[mf.GetName()]) {
+			t.Errorf("family %s differs: %v vs. %v", mf.GetName(), mf, byName[mf.GetName()])
+		}
+	}
+
+	if _, err := p.TextToMetricFamiliesOrdered(strings.NewReader("a 1\nb{")); err == nil {
+		t.Errorf("expected an error for invalid input")
+	}
+}
+
+func TestTextParseStream(t *testing.T) {
+	inputs := map[string]string{
+		"mixed types": `# HELP zeta A counter.
+# TYPE zeta counter
+zeta{a="1"} 1
+zeta{a="2"} 2
+# HELP empty A family without samples.
+# TYPE alpha summary
+alpha{quantile="0.5"} 1
+alpha{quantile="0.9"} 2
+alpha_sum 3
+alpha_count 4
+# TYPE hist histogram
+hist_bucket{le="1"} 1
+hist_bucket{le="+Inf"} 2
+hist_sum 3
+hist_count 2
+untyped_metric 5
+`,
+	}
+	data, err := os.ReadFile("testdata/text")
+	if err != nil {
+		t.Fatal(err)
+	}
+	inputs["testdata"] = string(data)
+
+	for name, in := range inputs {
+		t.Run(name, func(t *testing.T) {
+			var p TextParser
+			want, err := p.TextToMetricFamiliesOrdered(strings.NewReader(in))
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			var (
+				got    []*dto.MetricFamily
+				lastMF *dto.MetricFamily
+				reused bool
+			)
+			if err := p.ParseStream(strings.NewReader(in), func(mf *dto.MetricFamily) error {
+				if mf == lastMF {
+					reused = true
+				}
+				lastMF = mf
+				got = append(got, proto.Clone(mf).(*dto.MetricFamily))
+				return nil
+			}); err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if len(got) != len(want) {
+				t.Fatalf("expected %d metric families, got %d", len(want), len(got))
+			}
+			for i := range want {
+				if !proto.Equal(got[i], want[i]) {
+					t.Errorf("metric family %d: expected %v, got %v", i, want[i], got[i])
+				}
+			}
+			if len(got) > 2 && !reused {
+				t.Errorf("expected the MetricFamily to be reused between calls")
+			}
+		})
+	}
+}
+
+func TestTextParseStreamInterleaved(t *testing.T) {
+	scenarios := []struct {
+		name string
+		in   string
+		line int
+		// Whether TextToMetricFamilies accepts the input by merging the
+		// samples into one family.
+		merged bool
+	}{
+		{
+			name:   "same name twice",
+			in:     "a 1\nb 2\na 3\n",
+			line:   3,
+			merged: true,
+		},
+		{
+			name: "TYPE line for an earlier family",
+			in:   "a 1\nb 2\n# TYPE a gauge\n",
+			line: 3,
+		},
+		{
+			name:   "summary count after other family",
+			in:     "# TYPE s summary\ns{quantile=\"0.5\"} 1\ng 2\ns_count 3\n",
+			line:   4,
+			merged: true,
+		},
+		{
+			name:   "histogram bucket after other family",
+			in:     "# TYPE h histogram\nh_bucket{le=\"+Inf\"} 1\ng 2\nh_bucket{le=\"1\"} 1\n",
+			line:   4,
+			merged: true,
+		},
+	}
+	for _, s := range scenarios {
+		t.Run(s.name, func(t *testing.T) {
+			var (
+				p     TextParser
+				calls int
+			)
+			err := p.ParseStream(strings.NewReader(s.in), func(*dto.MetricFamily) error {
+				calls++
+				return nil
+			})
+			var parseErr ParseError
+			if !errors.As(err, &parseErr) {
+				t.Fatalf("expected ParseError, got %v", err)
+			}
+			if parseErr.Line != s.line {
+				t.Errorf("expected error in line %d, got %d", s.line, parseErr.Line)
+			}
+			// Only the first family is complete when the error is detected.
+			if calls != 1 {
+				t.Errorf("expected 1 call before the error, got %d", calls)
+			}
+
+			if _, err := p.TextToMetricFamilies(strings.NewReader(s.in)); s.merged && err != nil {
+				t.Errorf("expected TextToMetricFamilies to accept the input, got %s", err)
+			}
+		})
+	}
+}
+
+func TestTextParseStreamCallbackError(t *testing.T) {
+	errStop := errors.New("stop")
+	var (
+		p     TextParser
+		names []string
+	)
+	err := p.ParseStream(strings.NewReader("a 1\nb 2\nc 3\n"), func(mf *dto.MetricFamily) error {
+		names = append(names, mf.GetName())
+		if mf.GetName() == "b" {
+			return errStop
+		}
+		return nil
+	})
+	if !errors.Is(err, errStop) {
+		t.Errorf("expected the callback error, got %v", err)
+	}
+	if got := strings.Join(names, ","); got != "a,b" {
+		t.Errorf("expected calls for a and b, got %s", got)
+	}
+}
+
 func TestTextParserStartOfLine(t *testing.T) {
 	t.Run("EOF", func(t *testing.T) {
 		p := TextParser{}
@@ -703,3 +903,159 @@ type errReader struct {
 func (r *errReader) Read(p []byte) (int, error) {
 	return 0, r.err
 }
+
+func TestTextParseQuotedNames(t *testing.T) {
+	model.SetNameValidationScheme(model.UTF8Validation)
+	defer model.SetNameValidationScheme(model.LegacyValidation)
+
+	in := `# HELP "http.requests.total" The "total" number of requests.
+# TYPE "http.requests.total" counter
+{"http.requests.total", method="GET"} 5
+{"http.requests.total",method="POST","client.name"="x"} 6 1234
+# TYPE "request.duration" histogram
+{"request.duration_bucket",le="1"} 2
+{"request.duration_bucket",le="+Inf"} 3
+{"request.duration_sum"} 4.5
+{"request.duration_count"} 3
+{"quote\"back\\slash\nnewline"} 1
+`
+	expected := []*dto.MetricFamily{
+		{
+			Name: proto.String("http.requests.total"),
+			Help: proto.String(`The "total" number of requests.`),
+			Type: dto.MetricType_COUNTER.Enum(),
+			Metric: []*dto.Metric{
+				{
+					Label: []*dto.LabelPair{
+						{Name: proto.String("method"), Value: proto.String("GET")},
+					},
+					Counter: &dto.Counter{Value: proto.Float64(5)},
+				},
+				{
+					Label: []*dto.LabelPair{
+						{Name: proto.String("method"), Value: proto.String("POST")},
+						{Name: proto.String("client.name"), Value: proto.String("x")},
+					},
+					Counter:     &dto.Counter{Value: proto.Float64(6)},
+					TimestampMs: proto.Int64(1234),
+				},
+			},
+		},
+		{
+			Name: proto.String("request.duration"),
+			Type: dto.MetricType_HISTOGRAM.Enum(),
+			Metric: []*dto.Metric{
+				{
+					Histogram: &dto.Histogram{
+						SampleCount: proto.Uint64(3),
+						SampleSum:   proto.Float64(4.5),
+						Bucket: []*dto.Bucket{
+							{UpperBound: proto.Float64(1), CumulativeCount: proto.Uint64(2)},
+							{UpperBound: proto.Float64(math.Inf(+1)), CumulativeCount: proto.Uint64(3)},
+						},
+					},
+				},
+			},
+		},
+		{
+			Name: proto.String("quote\"back\\slash\nnewline"),
+			Type: dto.MetricType_UNTYPED.Enum(),
+			Metric: []*dto.Metric{
+				{
+					Untyped: &dto.Untyped{Value: proto.Float64(1)},
+				},
+			},
+		},
+	}
+
+	var parser TextParser
+	out, err := parser.TextToMetricFamilies(strings.NewReader(in))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if len(out) != len(expected) {
+		t.Errorf("expected %d MetricFamilies, got %d", len(expected), len(out))
+	}
+	for _, exp := range expected {
+		got, ok := out[exp.GetName()]
+		if !ok {
+			t.Errorf("expected MetricFamily %q, found none", exp.GetName())
+			continue
+		}
+		if !proto.Equal(exp, got) {
+			t.Errorf("expected MetricFamily %s, got %s", exp, got)
+		}
+	}
+
+	// A quoted name followed by labels, without HELP or TYPE line.
+	out, err = parser.TextToMetricFamilies(strings.NewReader(`{"http.requests",method="get"} 5` + "\n"))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if exp, got := (&dto.MetricFamily{
+		Name: proto.String("http.requests"),
+		Type: dto.MetricType_UNTYPED.Enum(),
+		Metric: []*dto.Metric{
+			{
+				Label:   []*dto.LabelPair{{Name: proto.String("method"), Value: proto.String("get")}},
+				Untyped: &dto.Untyped{Value: proto.Float64(5)},
+			},
+		},
+	}), out["http.requests"]; !proto.Equal(exp, got) {
+		t.Errorf("expected MetricFamily %s, got %s", exp, got)
+	}
+
+	errScenarios := []struct {
+		in  string
+		err string
+	}{
+		{
+			in:  `{"metric","other"} 1`,
+			err: "text format parsing error in line 1: expected '=' after label name",
+		},
+		{
+			in:  `{"metric" label="x"} 1`,
+			err: `text format parsing error in line 1: unexpected end of metric name "metric"`,
+		},
+		{
+			in:  `{""} 1`,
+			err: `text format parsing error in line 1: invalid metric name ""`,
+		},
+		{
+			in:  `metric{""="x"} 1`,
+			err: `text format parsing error in line 1: invalid label name "" for metric "metric"`,
+		},
+	}
+	for i, scenario := range errScenarios {
+		_, err := parser.TextToMetricFamilies(strings.NewReader(scenario.in))
+		if err == nil {
+			t.Errorf("%d. expected error, got nil", i)
+			continue
+		}
+		if !strings.HasPrefix(err.Error(), scenario.err) {
+			t.Errorf("%d. expected error starting with %q, got %q", i, scenario.err, err.Error())
+		}
+	}
+
+	// Names outside of the legacy character set are rejected under legacy
+	// validation, even when quoted.
+	model.SetNameValidationScheme(model.LegacyValidation)
+	for _, in := range []string{
+		"{\"http.requests.total\"} 5\n",
+		"{\"http.requests\",method=\"get\"} 5\n",
+		"# TYPE \"http.requests.total\" counter\n",
+		"metric{\"client.name\"=\"x\"} 1\n",
+	} {
+		_, err := parser.TextToMetricFamilies(strings.NewReader(in))
+		if err == nil || !strings.Contains(err.Error(), "under the current name validation scheme") {
+			t.Errorf("expected validation error for %q, got %v", in, err)
+		}
+	}
+	out, err = parser.TextToMetricFamilies(strings.NewReader("{\"legacy_metric\",\"label\"=\"x\"} 5\n"))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if _, ok := out["legacy_metric"]; !ok {
+		t.Errorf("expected MetricFamily %q, found none", "legacy_metric")
+	}
+}
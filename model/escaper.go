@@ -0,0 +1,112 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package model
+
+import (
+	"sync"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+// Escaper escapes metric and label names like EscapeName and EscapeLabelName,
+// but remembers the escaped names. This pays off for exporters that expose the
+// same names on every scrape. The cache is bounded: Once it holds the
+// configured number of names, further names are escaped without being cached,
+// so that the names seen first (typically those of the first scrape) stay
+// cached. Names that the scheme leaves unchanged are never cached.
+//
+// An Escaper is safe for concurrent use.
+type Escaper struct {
+	scheme    EscapingScheme
+	cacheSize int
+
+	mtx         sync.RWMutex
+	metricNames map[string]string
+	labelNames  map[string]string
+}
+
+// NewEscaper returns an Escaper for the given scheme that caches up to
+// cacheSize escaped names (metric and label names combined). A cacheSize of
+// zero or less disables caching.
+func NewEscaper(scheme EscapingScheme, cacheSize int) *Escaper {
+	return &Escaper{
+		scheme:      scheme,
+		cacheSize:   cacheSize,
+		metricNames: map[string]string{},
+		labelNames:  map[string]string{},
+	}
+}
+
+// Scheme returns the escaping scheme of the Escaper.
+func (e *Escaper) Scheme() EscapingScheme {
+	return e.scheme
+}
+
+// Escape returns the same result as EscapeName with the scheme of the Escaper.
+func (e *Escaper) Escape(name string) string {
+	if e.scheme == NoEscaping || (e.scheme != DotsEscaping && IsValidLegacyMetricName(name)) {
+		return name
+	}
+	return e.cached(e.metricNames, name, EscapeName)
+}
+
+// EscapeLabelName returns the same result as the EscapeLabelName function with
+// the scheme of the Escaper.
+func (e *Escaper) EscapeLabelName(name string) string {
+	if e.scheme == NoEscaping || (e.scheme != DotsEscaping && IsValidLegacyLabelName(LabelName(name))) {
+		return name
+	}
+	return e.cached(e.labelNames, name, EscapeLabelName)
+}
+
+// EscapeMetricFamily returns the same result as the EscapeMetricFamily
+// function with the scheme of the Escaper. Like that function, it leaves valid
+// legacy names unchanged, even for DotsEscaping.
+func (e *Escaper) EscapeMetricFamily(v *dto.MetricFamily) *dto.MetricFamily {
+	if v == nil || e.scheme == NoEscaping {
+		return v
+	}
+	return nameRewriter{
+		metricName: func(name string) string {
+			if IsValidLegacyMetricName(name) {
+				return name
+			}
+			return e.Escape(name)
+		},
+		labelName: func(name string) string {
+			if IsValidLegacyLabelName(LabelName(name)) {
+				return name
+			}
+			return e.EscapeLabelName(name)
+		},
+	}.metricFamily(v)
+}
+
+// cached looks up name in cache, which is one of the maps of e, and otherwise
+// escapes it with escape and caches the result if there is room left.
+func (e *Escaper) cached(cache map[string]string, name string, escape func(string, EscapingScheme) string) string {
+	e.mtx.RLock()
+	escaped, ok := cache[name]
+	e.mtx.RUnlock()
+	if ok {
+		return escaped
+	}
+	escaped = escape(name, e.scheme)
+	e.mtx.Lock()
+	if len(e.metricNames)+len(e.labelNames) < e.cacheSize {
+		cache[name] = escaped
+	}
+	e.mtx.Unlock()
+	return escaped
+}
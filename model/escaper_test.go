@@ -0,0 +1,128 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package model
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+
+	dto "github.com/prometheus/client_model/go"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestEscaper(t *testing.T) {
+	names := []string{"", "http_requests_total", "foo:bar", "my.metric", "9lives", "花火", "a_b.c"}
+	for _, scheme := range []EscapingScheme{NoEscaping, UnderscoreEscaping, DotsEscaping, ValueEncodingEscaping, PercentEscaping} {
+		e := NewEscaper(scheme, 100)
+		if e.Scheme() != scheme {
+			t.Errorf("expected scheme %s, got %s", scheme, e.Scheme())
+		}
+		// Run twice to check the cached results, too.
+		for i := 0; i < 2; i++ {
+			for _, name := range names {
+				if got, want := e.Escape(name), EscapeName(name, scheme); got != want {
+					t.Errorf("%s: Escape(%q) = %q, expected %q", scheme, name, got, want)
+				}
+				if got, want := e.EscapeLabelName(name), EscapeLabelName(name, scheme); got != want {
+					t.Errorf("%s: EscapeLabelName(%q) = %q, expected %q", scheme, name, got, want)
+				}
+			}
+		}
+
+		mf := &dto.MetricFamily{
+			Name: proto.String("my.metric"),
+			Type: dto.MetricType_GAUGE.Enum(),
+			Metric: []*dto.Metric{
+				{
+					Label: []*dto.LabelPair{
+						{Name: proto.String("some.label"), Value: proto.String("v")},
+						{Name: proto.String("plain_label"), Value: proto.String("v")},
+					},
+					Gauge: &dto.Gauge{Value: proto.Float64(1)},
+				},
+			},
+		}
+		if got, want := e.EscapeMetricFamily(mf), EscapeMetricFamily(mf, scheme); !proto.Equal(got, want) {
+			t.Errorf("%s: EscapeMetricFamily returned %v, expected %v", scheme, got, want)
+		}
+	}
+}
+
+func TestEscaperCacheSize(t *testing.T) {
+	e := NewEscaper(ValueEncodingEscaping, 2)
+	for i := 0; i < 5; i++ {
+		e.Escape(fmt.Sprintf("metric.%d", i))
+		e.EscapeLabelName(fmt.Sprintf("label.%d", i))
+	}
+	e.Escape("legacy_name")
+	if n := len(e.metricNames) + len(e.labelNames); n != 2 {
+		t.Errorf("expected 2 cached names, got %d", n)
+	}
+	if _, ok := e.metricNames["metric.0"]; !ok {
+		t.Errorf("expected the first name to be cached")
+	}
+
+	e = NewEscaper(ValueEncodingEscaping, 0)
+	if got := e.Escape("my.metric"); got != "U__my_2e_metric" {
+		t.Errorf("unexpected escaped name %q", got)
+	}
+	if len(e.metricNames) != 0 {
+		t.Errorf("expected no cached names with a cache size of 0")
+	}
+}
+
+func TestEscaperConcurrent(t *testing.T) {
+	e := NewEscaper(ValueEncodingEscaping, 50)
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 100; i++ {
+				name := fmt.Sprintf("metric.%d", i)
+				if got, want := e.Escape(name), EscapeName(name, ValueEncodingEscaping); got != want {
+					t.Errorf("Escape(%q) = %q, expected %q", name, got, want)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func BenchmarkEscaper(b *testing.B) {
+	// 10k series with 500 unique names, as on a typical scrape.
+	names := make([]string, 10000)
+	for i := range names {
+		names[i] = fmt.Sprintf("app.subsystem_%d.requests.total", i%500)
+	}
+	b.Run("EscapeName", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			for _, name := range names {
+				EscapeName(name, ValueEncodingEscaping)
+			}
+		}
+	})
+	b.Run("Escaper", func(b *testing.B) {
+		e := NewEscaper(ValueEncodingEscaping, 1000)
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			for _, name := range names {
+				e.Escape(name)
+			}
+		}
+	})
+}
@@ -19,6 +19,7 @@ import (
 	"regexp"
 	"strings"
 	"unicode/utf8"
+	"unsafe"
 )
 
 const (
@@ -98,14 +99,22 @@ var LabelNameRE = regexp.MustCompile("^[a-zA-Z_][a-zA-Z0-9_]*$")
 type LabelName string
 
 // IsValid returns true iff name matches the pattern of LabelNameRE for legacy
-// names, and iff it's valid UTF-8 if NameValidationScheme is set to
-// UTF8Validation. For the legacy matching, it does not use LabelNameRE for the
-// check but a much faster hardcoded implementation.
+// names, and iff it's valid UTF-8 if the name validation scheme (see
+// GetNameValidationScheme) is set to UTF8Validation. For the legacy matching,
+// it does not use LabelNameRE for the check but a much faster hardcoded
+// implementation. It is equivalent to calling IsValidWithScheme with the
+// current global scheme.
 func (ln LabelName) IsValid() bool {
+	return ln.IsValidWithScheme(GetNameValidationScheme())
+}
+
+// IsValidWithScheme is like IsValid but uses the provided validation scheme
+// instead of the global one.
+func (ln LabelName) IsValidWithScheme(scheme ValidationScheme) bool {
 	if len(ln) == 0 {
 		return false
 	}
-	switch NameValidationScheme {
+	switch scheme {
 	case LegacyValidation:
 		for i, b := range ln {
 			if !((b >= 'a' && b <= 'z') || (b >= 'A' && b <= 'Z') || b == '_' || (b >= '0' && b <= '9' && i > 0)) {
@@ -113,13 +122,35 @@ func (ln LabelName) IsValid() bool {
 			}
 		}
 	case UTF8Validation:
-		return utf8.ValidString(string(ln))
+		return isValidUTF8Name(string(ln))
+	case UTF8NoControlValidation:
+		return isValidUTF8NoControl(string(ln))
 	default:
-		panic(fmt.Sprintf("Invalid name validation scheme requested: %d", NameValidationScheme))
+		panic(fmt.Sprintf("Invalid name validation scheme requested: %d", scheme))
 	}
 	return true
 }
 
+// IsValidLegacy returns true iff ln is a valid label name under
+// LegacyValidation, independent of the global name validation scheme.
+func (ln LabelName) IsValidLegacy() bool {
+	return ln.IsValidWithScheme(LegacyValidation)
+}
+
+// IsValidUTF8 returns true iff ln is a valid label name under UTF8Validation,
+// i.e. non-empty valid UTF-8, independent of the global name validation
+// scheme.
+func (ln LabelName) IsValidUTF8() bool {
+	return ln.IsValidWithScheme(UTF8Validation)
+}
+
+// Bytes returns the bytes of the label name without copying them. The
+// returned slice shares its memory with ln and must not be modified. It is
+// nil if ln is empty.
+func (ln LabelName) Bytes() []byte {
+	return stringBytes(string(ln))
+}
+
 // UnmarshalYAML implements the yaml.Unmarshaler interface.
 func (ln *LabelName) UnmarshalYAML(unmarshal func(interface{}) error) error {
 	var s string
@@ -177,6 +208,21 @@ func (lv LabelValue) IsValid() bool {
 	return utf8.ValidString(string(lv))
 }
 
+// Bytes returns the bytes of the label value without copying them. The
+// returned slice shares its memory with lv and must not be modified. It is
+// nil if lv is empty.
+func (lv LabelValue) Bytes() []byte {
+	return stringBytes(string(lv))
+}
+
+// stringBytes returns the bytes of s without copying them.
+func stringBytes(s string) []byte {
+	if len(s) == 0 {
+		return nil
+	}
+	return unsafe.Slice(unsafe.StringData(s), len(s))
+}
+
 // LabelValues is a sortable LabelValue slice. It implements sort.Interface.
 type LabelValues []LabelValue
 
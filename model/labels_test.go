@@ -14,6 +14,8 @@
 package model
 
 import (
+	"bytes"
+	"hash/fnv"
 	"sort"
 	"testing"
 )
@@ -141,8 +143,14 @@ func TestLabelNameIsValid(t *testing.T) {
 			legacyValid: false,
 			utf8Valid:   false,
 		},
+		{
+			ln:          "label.with.dots_花火",
+			legacyValid: false,
+			utf8Valid:   true,
+		},
 	}
 
+	defer SetNameValidationScheme(GetNameValidationScheme())
 	for _, s := range scenarios {
 		NameValidationScheme = LegacyValidation
 		if s.ln.IsValid() != s.legacyValid {
@@ -155,6 +163,17 @@ func TestLabelNameIsValid(t *testing.T) {
 		if s.ln.IsValid() != s.utf8Valid {
 			t.Errorf("Expected %v for %q using UTF-8 IsValid method", s.legacyValid, s.ln)
 		}
+
+		// IsValidLegacy and IsValidUTF8 ignore the global scheme.
+		for _, scheme := range []ValidationScheme{LegacyValidation, UTF8Validation} {
+			SetNameValidationScheme(scheme)
+			if s.ln.IsValidLegacy() != s.legacyValid {
+				t.Errorf("Expected %v for %q using IsValidLegacy with global scheme %s", s.legacyValid, s.ln, scheme)
+			}
+			if s.ln.IsValidUTF8() != s.utf8Valid {
+				t.Errorf("Expected %v for %q using IsValidUTF8 with global scheme %s", s.utf8Valid, s.ln, scheme)
+			}
+		}
 	}
 }
 
@@ -217,3 +236,67 @@ func TestSortLabelPairs(t *testing.T) {
 		}
 	}
 }
+
+func TestLabelNameAndValueBytes(t *testing.T) {
+	for _, s := range []string{"", "job", "instance", "läbel.välue", "\xff"} {
+		if got := LabelName(s).Bytes(); !bytes.Equal(got, []byte(s)) {
+			t.Errorf("expected label name bytes %q, got %q", s, got)
+		}
+		if got := LabelValue(s).Bytes(); !bytes.Equal(got, []byte(s)) {
+			t.Errorf("expected label value bytes %q, got %q", s, got)
+		}
+	}
+
+	ln, lv := LabelName("job"), LabelValue("api-server")
+	if allocs := testing.AllocsPerRun(100, func() {
+		_ = ln.Bytes()
+		_ = lv.Bytes()
+	}); allocs != 0 {
+		t.Errorf("expected no allocations, got %v", allocs)
+	}
+}
+
+// TestFingerprintMatchesFNVOfBytes verifies that the fingerprint of a label
+// set is the FNV-1a hash of its label names and values as returned by Bytes,
+// so that callers hashing Bytes themselves get stable results.
+func TestFingerprintMatchesFNVOfBytes(t *testing.T) {
+	ls := LabelSet{
+		"job":      "api-server",
+		"instance": "localhost:9090",
+		"läbel":    "välue",
+	}
+	names := make(LabelNames, 0, len(ls))
+	for ln := range ls {
+		names = append(names, ln)
+	}
+	sort.Sort(names)
+
+	h := fnv.New64a()
+	for _, ln := range names {
+		h.Write(ln.Bytes())
+		h.Write([]byte{SeparatorByte})
+		h.Write(ls[ln].Bytes())
+		h.Write([]byte{SeparatorByte})
+	}
+	if got, want := ls.Fingerprint(), Fingerprint(h.Sum64()); got != want {
+		t.Errorf("expected fingerprint %v, got %v", want, got)
+	}
+}
+
+func BenchmarkLabelValueBytes(b *testing.B) {
+	lv := LabelValue("localhost:9090")
+	b.Run("Bytes", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			sinkBytes = lv.Bytes()
+		}
+	})
+	b.Run("conversion", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			sinkBytes = []byte(lv)
+		}
+	})
+}
+
+var sinkBytes []byte
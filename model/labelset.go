@@ -17,6 +17,9 @@ import (
 	"encoding/json"
 	"fmt"
 	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf8"
 )
 
 // A LabelSet is a collection of LabelName and LabelValue pairs.  The LabelSet
@@ -26,21 +29,183 @@ import (
 // match.
 type LabelSet map[LabelName]LabelValue
 
-// Validate checks whether all names and values in the label set
-// are valid.
+// Validate checks whether all names and values in the label set are valid,
+// with names being checked according to the current name validation scheme.
+// If any are invalid, the returned error is a LabelSetValidationError listing
+// every offending label, sorted by label name. It is equivalent to calling
+// ValidateWithScheme with the current global scheme.
 func (ls LabelSet) Validate() error {
+	return ls.ValidateWithScheme(GetNameValidationScheme())
+}
+
+// ValidateWithScheme is like Validate but checks the names according to the
+// provided validation scheme instead of the global one. Label values only need
+// to be valid UTF-8, independent of the scheme.
+func (ls LabelSet) ValidateWithScheme(scheme ValidationScheme) error {
+	var errs LabelSetValidationError
 	for ln, lv := range ls {
-		if !ln.IsValid() {
-			return fmt.Errorf("invalid name %q", ln)
+		if !ln.IsValidWithScheme(scheme) {
+			errs = append(errs, &LabelValidationError{
+				Name:   ln,
+				Reason: labelNameInvalidReason(ln, scheme),
+			})
 		}
 		if !lv.IsValid() {
-			return fmt.Errorf("invalid value %q", lv)
+			errs = append(errs, &LabelValidationError{
+				Name:    ln,
+				Value:   lv,
+				IsValue: true,
+				Reason:  invalidUTF8Reason(string(lv)),
+			})
 		}
 	}
-	return nil
+	if len(errs) == 0 {
+		return nil
+	}
+	sort.Slice(errs, func(i, j int) bool {
+		if errs[i].Name != errs[j].Name {
+			return errs[i].Name < errs[j].Name
+		}
+		return !errs[i].IsValue && errs[j].IsValue
+	})
+	return errs
+}
+
+// Valid reports whether all names and values in the label set are valid, with
+// names being checked according to the current name validation scheme. It is
+// equivalent to checking Validate() == nil, but stops at the first invalid
+// label and does not allocate, which makes it the cheaper choice if the
+// reason for a failed validation is not needed.
+func (ls LabelSet) Valid() bool {
+	scheme := GetNameValidationScheme()
+	for ln, lv := range ls {
+		if !ln.IsValidWithScheme(scheme) || !lv.IsValid() {
+			return false
+		}
+	}
+	return true
+}
+
+// SortedPairs returns the label pairs of the label set sorted by label name, so
+// that encoders can iterate over them in a deterministic order. The metric name
+// label, if present, is included like any other label. The returned slice is
+// newly allocated and may be modified by the caller.
+func (ls LabelSet) SortedPairs() []LabelPair {
+	pairs := make([]LabelPair, 0, len(ls))
+	for ln, lv := range ls {
+		pairs = append(pairs, LabelPair{Name: ln, Value: lv})
+	}
+	sort.Slice(pairs, func(i, j int) bool {
+		return pairs[i].Name < pairs[j].Name
+	})
+	return pairs
+}
+
+// LabelValidationError describes a single invalid label name or value found
+// by LabelSet.Validate.
+type LabelValidationError struct {
+	// Name is the name of the offending label.
+	Name LabelName
+	// Value is the value of the offending label if IsValue is true.
+	Value LabelValue
+	// IsValue is true if the label value is invalid, and false if the label
+	// name is invalid.
+	IsValue bool
+	// Reason describes why the name or value is invalid.
+	Reason string
+}
+
+// Error implements the error interface.
+func (e *LabelValidationError) Error() string {
+	if e.IsValue {
+		return fmt.Sprintf("invalid value %q for label %q: %s", e.Value, e.Name, e.Reason)
+	}
+	return fmt.Sprintf("invalid name %q: %s", e.Name, e.Reason)
+}
+
+// LabelSetValidationError is returned by LabelSet.Validate. It holds one
+// LabelValidationError per invalid label name or value and can be ranged over
+// or inspected with errors.As.
+type LabelSetValidationError []*LabelValidationError
+
+// Error implements the error interface.
+func (e LabelSetValidationError) Error() string {
+	msgs := make([]string, 0, len(e))
+	for _, err := range e {
+		msgs = append(msgs, err.Error())
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// Unwrap returns the individual errors, so that errors.Is and errors.As can
+// match each of them.
+func (e LabelSetValidationError) Unwrap() []error {
+	errs := make([]error, 0, len(e))
+	for _, err := range e {
+		errs = append(errs, err)
+	}
+	return errs
+}
+
+// labelNameInvalidReason returns why ln is not a valid label name under the
+// given validation scheme.
+func labelNameInvalidReason(ln LabelName, scheme ValidationScheme) string {
+	return nameInvalidReason(string(ln), scheme, isValidLegacyLabelRune)
+}
+
+// nameInvalidReason returns why n is not a valid name under the given
+// validation scheme, with isValidRune implementing the legacy rules.
+func nameInvalidReason(n string, scheme ValidationScheme, isValidRune func(rune, int) bool) string {
+	if len(n) == 0 {
+		return "empty"
+	}
+	switch scheme {
+	case LegacyValidation:
+		for i, b := range n {
+			if !isValidRune(b, i) {
+				if b == utf8.RuneError {
+					return invalidUTF8Reason(n)
+				}
+				return fmt.Sprintf("invalid character %q at offset %d (legacy validation)", b, i)
+			}
+		}
+	case UTF8Validation:
+		if i := strings.IndexByte(n, 0); i >= 0 && utf8.ValidString(n) {
+			return fmt.Sprintf("NUL byte at offset %d", i)
+		}
+		return invalidUTF8Reason(n)
+	case UTF8NoControlValidation:
+		for i := 0; i < len(n); {
+			r, size := utf8.DecodeRuneInString(n[i:])
+			switch {
+			case r == utf8.RuneError && size == 1:
+				return invalidUTF8Reason(n)
+			case r == utf8.RuneError:
+				return fmt.Sprintf("replacement character at offset %d", i)
+			case unicode.IsControl(r):
+				return fmt.Sprintf("control character %q at offset %d", r, i)
+			}
+			i += size
+		}
+	}
+	return "invalid"
+}
+
+// invalidUTF8Reason returns a description of the first invalid UTF-8 sequence
+// in s.
+func invalidUTF8Reason(s string) string {
+	for i := 0; i < len(s); {
+		r, size := utf8.DecodeRuneInString(s[i:])
+		if r == utf8.RuneError && size == 1 {
+			return fmt.Sprintf("invalid UTF-8 at offset %d", i)
+		}
+		i += size
+	}
+	return "invalid UTF-8"
 }
 
 // Equal returns true iff both label sets have exactly the same key/value pairs.
+// A nil LabelSet is equal to an empty one.
 func (ls LabelSet) Equal(o LabelSet) bool {
 	if len(ls) != len(o) {
 		return false
@@ -67,7 +232,8 @@ func (ls LabelSet) Equal(o LabelSet) bool {
 // before o, and vice versa. Otherwise the label value is compared
 // alphanumerically.
 //
-// If m and o are equal, the method returns false.
+// If m and o are equal, the method returns false. A nil LabelSet is treated
+// like an empty one, so neither is before the other.
 func (ls LabelSet) Before(o LabelSet) bool {
 	if len(ls) < len(o) {
 		return true
@@ -128,13 +294,19 @@ func (l LabelSet) Merge(other LabelSet) LabelSet {
 	return result
 }
 
-// Fingerprint returns the LabelSet's fingerprint.
+// Fingerprint returns the LabelSet's fingerprint. A nil LabelSet has the same
+// fingerprint as an empty one. The fingerprint only depends on the label names
+// and values, which are hashed sorted by name, and not on the order in which
+// they were inserted or on the map iteration order of the Go version in use.
 func (ls LabelSet) Fingerprint() Fingerprint {
 	return labelSetToFingerprint(ls)
 }
 
 // FastFingerprint returns the LabelSet's Fingerprint calculated by a faster hashing
-// algorithm, which is, however, more susceptible to hash collisions.
+// algorithm, which is, however, more susceptible to hash collisions. A nil
+// LabelSet has the same fingerprint as an empty one. Like Fingerprint, it does
+// not depend on the insertion or iteration order of the labels, as the hashes
+// of the individual labels are combined with XOR.
 func (ls LabelSet) FastFingerprint() Fingerprint {
 	return labelSetToFastFingerprint(ls)
 }
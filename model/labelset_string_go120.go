@@ -17,7 +17,6 @@ package model
 
 import (
 	"fmt"
-	"sort"
 	"strings"
 )
 
@@ -26,14 +25,9 @@ import (
 // Once client golang drops support for go 1.20 (scheduled for August 2024), this
 // file can be removed.
 func (l LabelSet) String() string {
-	labelNames := make([]string, 0, len(l))
-	for name := range l {
-		labelNames = append(labelNames, string(name))
-	}
-	sort.Strings(labelNames)
 	lstrs := make([]string, 0, len(l))
-	for _, name := range labelNames {
-		lstrs = append(lstrs, fmt.Sprintf("%s=%q", name, l[LabelName(name)]))
+	for _, p := range l.SortedPairs() {
+		lstrs = append(lstrs, fmt.Sprintf("%s=%q", p.Name, p.Value))
 	}
 	return fmt.Sprintf("{%s}", strings.Join(lstrs, ", "))
 }
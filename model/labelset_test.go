@@ -17,6 +17,8 @@ package model
 
 import (
 	"encoding/json"
+	"errors"
+	"reflect"
 	"testing"
 )
 
@@ -123,6 +125,36 @@ func TestLabelSetMerge(t *testing.T) {
 	}
 }
 
+func TestLabelSetNilAndEmpty(t *testing.T) {
+	var nilSet LabelSet
+	emptySet := LabelSet{}
+	nonEmpty := LabelSet{"foo": "bar"}
+
+	if !nilSet.Equal(emptySet) || !emptySet.Equal(nilSet) || !nilSet.Equal(nil) {
+		t.Errorf("expected nil and empty label sets to be equal")
+	}
+	if nilSet.Equal(nonEmpty) || nonEmpty.Equal(nilSet) {
+		t.Errorf("expected nil and non-empty label sets not to be equal")
+	}
+
+	if nilSet.Before(emptySet) || emptySet.Before(nilSet) {
+		t.Errorf("expected neither of nil and empty label sets to be before the other")
+	}
+	if !nilSet.Before(nonEmpty) || nonEmpty.Before(nilSet) {
+		t.Errorf("expected nil label set to be before non-empty label set")
+	}
+
+	if nilSet.Fingerprint() != emptySet.Fingerprint() {
+		t.Errorf("expected identical fingerprints, got %v and %v", nilSet.Fingerprint(), emptySet.Fingerprint())
+	}
+	if nilSet.FastFingerprint() != emptySet.FastFingerprint() {
+		t.Errorf("expected identical fast fingerprints, got %v and %v", nilSet.FastFingerprint(), emptySet.FastFingerprint())
+	}
+	if nilSet.Fingerprint() == nonEmpty.Fingerprint() {
+		t.Errorf("expected different fingerprints for nil and non-empty label sets")
+	}
+}
+
 func TestLabelSet_String(t *testing.T) {
 	tests := []struct {
 		input LabelSet
@@ -155,6 +187,216 @@ func TestLabelSet_String(t *testing.T) {
 	}
 }
 
+func TestLabelSetSortedPairs(t *testing.T) {
+	ls := LabelSet{
+		"job":           "api",
+		MetricNameLabel: "up",
+		"instance":      "localhost:9090",
+		"Zone":          "eu",
+		"label.name":    "value",
+	}
+	expected := []LabelPair{
+		{Name: "Zone", Value: "eu"},
+		{Name: MetricNameLabel, Value: "up"},
+		{Name: "instance", Value: "localhost:9090"},
+		{Name: "job", Value: "api"},
+		{Name: "label.name", Value: "value"},
+	}
+	// Run several times, as map iteration order varies.
+	for i := 0; i < 10; i++ {
+		if got := ls.SortedPairs(); !reflect.DeepEqual(got, expected) {
+			t.Fatalf("expected %v, got %v", expected, got)
+		}
+	}
+
+	if got := (LabelSet{}).SortedPairs(); len(got) != 0 {
+		t.Errorf("expected no pairs for an empty label set, got %v", got)
+	}
+	if got := LabelSet(nil).SortedPairs(); len(got) != 0 {
+		t.Errorf("expected no pairs for a nil label set, got %v", got)
+	}
+}
+
+func TestLabelSetValidate(t *testing.T) {
+	SetNameValidationScheme(LegacyValidation)
+	defer SetNameValidationScheme(UTF8Validation)
+
+	ls := LabelSet{
+		"good":     "value",
+		"bad-name": "value",
+		"other":    "\xff",
+	}
+	err := ls.Validate()
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+
+	var verr LabelSetValidationError
+	if !errors.As(err, &verr) {
+		t.Fatalf("expected LabelSetValidationError, got %T", err)
+	}
+	expected := LabelSetValidationError{
+		{Name: "bad-name", Reason: `invalid character '-' at offset 3 (legacy validation)`},
+		{Name: "other", Value: "\xff", IsValue: true, Reason: "invalid UTF-8 at offset 0"},
+	}
+	if !reflect.DeepEqual(verr, expected) {
+		t.Errorf("expected %v, got %v", expected, verr)
+	}
+
+	var lerr *LabelValidationError
+	if !errors.As(err, &lerr) || lerr.Name != "bad-name" {
+		t.Errorf("expected errors.As to find the error for %q, got %v", "bad-name", lerr)
+	}
+
+	expectedMsg := `invalid name "bad-name": invalid character '-' at offset 3 (legacy validation); invalid value "\xff" for label "other": invalid UTF-8 at offset 0`
+	if err.Error() != expectedMsg {
+		t.Errorf("expected message %q, got %q", expectedMsg, err.Error())
+	}
+
+	if err := (LabelSet{"good": "value"}).Validate(); err != nil {
+		t.Errorf("expected no error, got %v", err)
+	}
+
+	SetNameValidationScheme(UTF8Validation)
+	err = LabelSet{"": "value", "bad-name": "value"}.Validate()
+	expectedMsg = `invalid name "": empty`
+	if err == nil || err.Error() != expectedMsg {
+		t.Errorf("expected message %q, got %v", expectedMsg, err)
+	}
+}
+
+func TestLabelSetValidateWithScheme(t *testing.T) {
+	defer SetNameValidationScheme(GetNameValidationScheme())
+	// The global scheme must not affect ValidateWithScheme.
+	SetNameValidationScheme(LegacyValidation)
+
+	scenarios := []struct {
+		name      string
+		ls        LabelSet
+		legacyErr string
+		utf8Err   string
+	}{
+		{
+			name: "reserved names",
+			ls:   LabelSet{MetricNameLabel: "up", "__meta_kubernetes_pod": "p", "__address__": "localhost:9090"},
+		},
+		{
+			name:      "dotted reserved name",
+			ls:        LabelSet{"__meta.pod": "p"},
+			legacyErr: `invalid name "__meta.pod": invalid character '.' at offset 6 (legacy validation)`,
+		},
+		{
+			name:      "dotted name",
+			ls:        LabelSet{"label.name": "value"},
+			legacyErr: `invalid name "label.name": invalid character '.' at offset 5 (legacy validation)`,
+		},
+		{
+			name:      "invalid value",
+			ls:        LabelSet{"__name__": "\xff"},
+			legacyErr: `invalid value "\xff" for label "__name__": invalid UTF-8 at offset 0`,
+			utf8Err:   `invalid value "\xff" for label "__name__": invalid UTF-8 at offset 0`,
+		},
+		{
+			name: "value with dots",
+			ls:   LabelSet{"__name__": "my.metric"},
+		},
+	}
+
+	for _, s := range scenarios {
+		t.Run(s.name, func(t *testing.T) {
+			for scheme, expected := range map[ValidationScheme]string{LegacyValidation: s.legacyErr, UTF8Validation: s.utf8Err} {
+				err := s.ls.ValidateWithScheme(scheme)
+				switch {
+				case expected == "" && err != nil:
+					t.Errorf("scheme %d: expected no error, got %v", scheme, err)
+				case expected != "" && (err == nil || err.Error() != expected):
+					t.Errorf("scheme %d: expected error %q, got %v", scheme, expected, err)
+				}
+			}
+		})
+	}
+
+	SetNameValidationScheme(UTF8Validation)
+	ls := LabelSet{"label.name": "value"}
+	if err := ls.Validate(); err != nil {
+		t.Errorf("expected no error with global UTF-8 validation, got %v", err)
+	}
+	if err := ls.ValidateWithScheme(LegacyValidation); err == nil {
+		t.Error("expected an error with legacy validation")
+	}
+}
+
+func TestLabelSetValid(t *testing.T) {
+	defer SetNameValidationScheme(GetNameValidationScheme())
+
+	scenarios := []struct {
+		name   string
+		ls     LabelSet
+		legacy bool
+		utf8   bool
+	}{
+		{name: "nil", ls: nil, legacy: true, utf8: true},
+		{name: "valid", ls: LabelSet{"job": "api", "instance": "localhost:9090"}, legacy: true, utf8: true},
+		{name: "utf-8 name", ls: LabelSet{"job": "api", "label.name": "value"}, legacy: false, utf8: true},
+		{name: "empty name", ls: LabelSet{"": "value"}, legacy: false, utf8: false},
+		{name: "invalid value", ls: LabelSet{"job": "\xff"}, legacy: false, utf8: false},
+		{name: "invalid utf-8 name", ls: LabelSet{"\xff": "value"}, legacy: false, utf8: false},
+	}
+
+	for _, scenario := range scenarios {
+		t.Run(scenario.name, func(t *testing.T) {
+			for scheme, expected := range map[ValidationScheme]bool{
+				LegacyValidation: scenario.legacy,
+				UTF8Validation:   scenario.utf8,
+			} {
+				SetNameValidationScheme(scheme)
+				if got := scenario.ls.Valid(); got != expected {
+					t.Errorf("%s: expected Valid() to return %t, got %t", scheme, expected, got)
+				}
+				if got := scenario.ls.Validate() == nil; got != expected {
+					t.Errorf("%s: Valid() and Validate() disagree", scheme)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkLabelSetValidity(b *testing.B) {
+	defer SetNameValidationScheme(GetNameValidationScheme())
+	SetNameValidationScheme(LegacyValidation)
+
+	for _, bm := range []struct {
+		name string
+		ls   LabelSet
+	}{
+		{
+			name: "valid",
+			ls: LabelSet{
+				"job": "api", "instance": "localhost:9090", "method": "GET", "code": "200", "path": "/api/v1/query",
+			},
+		},
+		{
+			name: "invalid",
+			ls: LabelSet{
+				"job": "api", "instance": "localhost:9090", "method": "GET", "code": "200", "path.name": "\xff",
+			},
+		},
+	} {
+		b.Run(bm.name+"/Valid", func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				_ = bm.ls.Valid()
+			}
+		})
+		b.Run(bm.name+"/Validate", func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				_ = bm.ls.Validate() == nil
+			}
+		})
+	}
+}
+
 // Benchmark Results for LabelSet's String() method
 // ---------------------------------------------------------------------------------------------------------
 // goos: linux
@@ -14,10 +14,14 @@
 package model
 
 import (
+	"encoding/json"
 	"fmt"
 	"regexp"
 	"sort"
+	"strconv"
 	"strings"
+	"sync/atomic"
+	"unicode"
 	"unicode/utf8"
 
 	dto "github.com/prometheus/client_model/go"
@@ -32,14 +36,99 @@ var (
 	// UTF-8-aware binaries as part of their startup. To avoid need for locking,
 	// this value should be set once, ideally in an init(), before multiple
 	// goroutines are started.
+	//
+	// Deprecated: Use SetNameValidationScheme and NameValidationSchemeValue
+	// (or GetNameValidationScheme) instead, which are safe for concurrent use.
+	// Assigning this variable still takes effect after SetNameValidationScheme
+	// has been called, provided the assignment changes its value: Once the
+	// accessors see a value different from the one the variable had at the
+	// time of that call, they return the value of the variable until
+	// SetNameValidationScheme is called again. In contrast to the accessors,
+	// assigning it while other goroutines validate names is a data race.
 	NameValidationScheme = LegacyValidation
 
 	// NameEscapingScheme defines the default way that names will be
 	// escaped when presented to systems that do not support UTF-8 names. If the
 	// Content-Type "escaping" term is specified, that will override this value.
+	//
+	// Deprecated: Use SetNameEscapingScheme and GetNameEscapingScheme instead,
+	// which are safe for concurrent use. Like for NameValidationScheme,
+	// assigning this variable still takes effect if the assignment changes its
+	// value, but it is not safe for concurrent use.
 	NameEscapingScheme = ValueEncodingEscaping
+
+	// nameValidation holds the configuration set by SetNameValidation,
+	// SetNameValidationScheme, and SetNameEscapingScheme. It is nil if none of
+	// them has been called.
+	nameValidation atomic.Pointer[nameValidationState]
 )
 
+// NameValidation holds the configuration of name validation and escaping of
+// this package. Use GetNameValidation and SetNameValidation to read and change
+// it atomically, or the accessors for the individual fields.
+type NameValidation struct {
+	// Scheme is the method of name validation, see SetNameValidationScheme.
+	Scheme ValidationScheme
+	// EscapingScheme is the default escaping scheme, see
+	// SetNameEscapingScheme.
+	EscapingScheme EscapingScheme
+}
+
+// nameValidationState is the value of nameValidation. Alongside the
+// configuration, it records which fields are in effect and the values of the
+// deprecated variables at the time they were set, so that later assignments to
+// the variables can be detected. Once an assignment has been detected, the
+// field is no longer in effect until it is set again.
+type nameValidationState struct {
+	NameValidation
+	schemeSet, escapingSet bool
+	schemeVar              ValidationScheme
+	escapingVar            EscapingScheme
+}
+
+// forgetNameValidation stores a copy of s with fn applied to it, unless
+// nameValidation has been changed concurrently.
+func forgetNameValidation(s *nameValidationState, fn func(*nameValidationState)) {
+	forgotten := *s
+	fn(&forgotten)
+	nameValidation.CompareAndSwap(s, &forgotten)
+}
+
+// updateNameValidation atomically applies fn to a copy of the current
+// nameValidationState and stores the result.
+func updateNameValidation(fn func(*nameValidationState)) {
+	for {
+		old := nameValidation.Load()
+		s := &nameValidationState{}
+		if old != nil {
+			*s = *old
+		}
+		fn(s)
+		if nameValidation.CompareAndSwap(old, s) {
+			return
+		}
+	}
+}
+
+// SetNameValidation sets both fields of the configuration at once, as if
+// calling SetNameValidationScheme and SetNameEscapingScheme, but atomically.
+func SetNameValidation(c NameValidation) {
+	updateNameValidation(func(s *nameValidationState) {
+		s.NameValidation = c
+		s.schemeSet, s.schemeVar = true, NameValidationScheme
+		s.escapingSet, s.escapingVar = true, NameEscapingScheme
+	})
+}
+
+// GetNameValidation returns the current configuration, i.e. the values
+// returned by NameValidationSchemeValue and GetNameEscapingScheme.
+func GetNameValidation() NameValidation {
+	return NameValidation{
+		Scheme:         NameValidationSchemeValue(),
+		EscapingScheme: GetNameEscapingScheme(),
+	}
+}
+
 // ValidationScheme is a Go enum for determining how metric and label names will
 // be validated by this library.
 type ValidationScheme int
@@ -51,10 +140,52 @@ const (
 	LegacyValidation ValidationScheme = iota
 
 	// UTF8Validation only requires that metric and label names be valid UTF-8
-	// strings.
+	// strings without NUL bytes.
 	UTF8Validation
+
+	// UTF8NoControlValidation requires that metric and label names be valid
+	// UTF-8 strings that contain neither control characters (the C0 and C1
+	// ranges as well as DEL) nor the Unicode replacement character. Such
+	// characters are allowed by UTF8Validation, but break the text-based
+	// exposition formats.
+	UTF8NoControlValidation
 )
 
+// SetNameValidationScheme sets the method of name validation to be used by all
+// calls to IsValidMetricName() and LabelName IsValid(). In contrast to assigning
+// the deprecated NameValidationScheme variable, it is safe to call this
+// function while other goroutines are validating names, for example to enable
+// UTF-8 validation after startup.
+func SetNameValidationScheme(s ValidationScheme) {
+	updateNameValidation(func(state *nameValidationState) {
+		state.Scheme = s
+		state.schemeSet, state.schemeVar = true, NameValidationScheme
+	})
+}
+
+// NameValidationSchemeValue returns the method of name validation currently in
+// use. It returns the value last passed to SetNameValidationScheme or, if that
+// function has never been called or the deprecated NameValidationScheme
+// variable has been assigned a different value since, the value of that
+// variable.
+func NameValidationSchemeValue() ValidationScheme {
+	v := NameValidationScheme
+	s := nameValidation.Load()
+	if s == nil || !s.schemeSet {
+		return v
+	}
+	if v != s.schemeVar {
+		forgetNameValidation(s, func(s *nameValidationState) { s.schemeSet = false })
+		return v
+	}
+	return s.Scheme
+}
+
+// GetNameValidationScheme is equivalent to NameValidationSchemeValue.
+func GetNameValidationScheme() ValidationScheme {
+	return NameValidationSchemeValue()
+}
+
 type EscapingScheme int
 
 const (
@@ -74,6 +205,17 @@ const (
 	// characters with the unicode value, surrounded by underscores. Single
 	// underscores are replaced with double underscores.
 	ValueEncodingEscaping
+
+	// PercentEscaping replaces every byte of a legacy-invalid character with
+	// `%` followed by the two-digit uppercase hexadecimal value of the byte, as
+	// in URL percent-encoding (`%2E` for a dot). Note that the result is not a
+	// valid legacy name, as `%` itself is not. PercentEscaping is therefore
+	// only meant for EscapeName, EscapeLabelName, and UnescapeName, e.g. to
+	// embed names in URLs. It is not an escaping scheme of the exposition
+	// formats: It cannot be selected with the escaping parameter (see
+	// ToEscapingScheme), and it must not be used as the default escaping scheme
+	// (see SetNameEscapingScheme) or with the encoders of the expfmt package.
+	PercentEscaping
 )
 
 const (
@@ -81,7 +223,8 @@ const (
 	// metric and label names that do not conform to the legacy character
 	// requirements should be escaped when being scraped by a legacy prometheus
 	// system. If a system does not explicitly pass an escaping parameter in the
-	// Accept header, the default NameEscapingScheme will be used.
+	// Accept header, the default escaping scheme (see GetNameEscapingScheme)
+	// will be used.
 	EscapingKey = "escaping"
 
 	// Possible values for Escaping Key:
@@ -89,8 +232,54 @@ const (
 	EscapeUnderscores = "underscores"
 	EscapeDots        = "dots"
 	EscapeValues      = "values"
+
+	// AllowUTF8Alt is an alternative spelling of AllowUTF8 used by parts of the
+	// ecosystem. It is accepted on input, but AllowUTF8 is the canonical spelling
+	// and the only one this library emits.
+	AllowUTF8Alt = "allow-utf8"
+
+	// ValidCharsKey is the key of an older Accept or Content-Type parameter that
+	// some systems send instead of EscapingKey. The term validchars=utf8 (see
+	// ValidCharsUTF8) is equivalent to escaping=allow-utf-8. If both keys are
+	// present, EscapingKey takes precedence.
+	ValidCharsKey  = "validchars"
+	ValidCharsUTF8 = "utf8"
+
+	// ValidationSchemeKey is another key some systems send instead of
+	// EscapingKey. It is treated like ValidCharsKey, i.e.
+	// validation-scheme=utf8 is equivalent to escaping=allow-utf-8.
+	ValidationSchemeKey = "validation-scheme"
 )
 
+// SetNameEscapingScheme sets the default way that names will be escaped when
+// presented to systems that do not support UTF-8 names. In contrast to
+// assigning the deprecated NameEscapingScheme variable, it is safe to call this
+// function while other goroutines are encoding metrics.
+func SetNameEscapingScheme(s EscapingScheme) {
+	updateNameValidation(func(state *nameValidationState) {
+		state.EscapingScheme = s
+		state.escapingSet, state.escapingVar = true, NameEscapingScheme
+	})
+}
+
+// GetNameEscapingScheme returns the default escaping scheme currently in use.
+// It returns the value last passed to SetNameEscapingScheme or, if that
+// function has never been called or the deprecated NameEscapingScheme
+// variable has been assigned a different value since, the value of that
+// variable.
+func GetNameEscapingScheme() EscapingScheme {
+	v := NameEscapingScheme
+	s := nameValidation.Load()
+	if s == nil || !s.escapingSet {
+		return v
+	}
+	if v != s.escapingVar {
+		forgetNameValidation(s, func(s *nameValidationState) { s.escapingSet = false })
+		return v
+	}
+	return s.EscapingScheme
+}
+
 // MetricNameRE is a regular expression matching valid metric
 // names. Note that the IsValidMetricName function performs the same
 // check but faster than a match with this regular expression.
@@ -119,6 +308,28 @@ func (m Metric) Clone() Metric {
 	return clone
 }
 
+// Rename returns a copy of the Metric with the MetricNameLabel set to newName.
+// The new name is validated with IsValidMetricName, i.e. according to the
+// current name validation scheme, and an error is returned if it is invalid.
+// The receiver is never modified.
+func (m Metric) Rename(newName LabelValue) (Metric, error) {
+	if !IsValidMetricName(newName) {
+		return nil, fmt.Errorf("invalid metric name %q", newName)
+	}
+	return m.RenameUnchecked(newName), nil
+}
+
+// RenameUnchecked works like Rename, but does not validate the new name.
+func (m Metric) RenameUnchecked(newName LabelValue) Metric {
+	clone := m.Clone()
+	clone[MetricNameLabel] = newName
+	return clone
+}
+
+// String returns the Metric in the syntax of the text format, e.g.
+// `name{label="value"}`. Names that are not valid legacy names are quoted as in
+// version 1.0.0 of the text format, with a metric name moving inside the
+// braces, e.g. `{"my.metric", "my.label"="value"}`.
 func (m Metric) String() string {
 	metricName, hasName := m[MetricNameLabel]
 	numLabels := len(m) - 1
@@ -127,11 +338,20 @@ func (m Metric) String() string {
 	}
 	labelStrings := make([]string, 0, numLabels)
 	for label, value := range m {
-		if label != MetricNameLabel {
+		if label == MetricNameLabel {
+			continue
+		}
+		if IsValidLegacyLabelName(label) {
 			labelStrings = append(labelStrings, fmt.Sprintf("%s=%q", label, value))
+		} else {
+			labelStrings = append(labelStrings, fmt.Sprintf("%q=%q", label, value))
 		}
 	}
+	sort.Strings(labelStrings)
 
+	if hasName && metricName != "" && !IsValidLegacyMetricName(string(metricName)) {
+		return fmt.Sprintf("{%s}", strings.Join(append([]string{fmt.Sprintf("%q", metricName)}, labelStrings...), ", "))
+	}
 	switch numLabels {
 	case 0:
 		if hasName {
@@ -139,7 +359,6 @@ func (m Metric) String() string {
 		}
 		return "{}"
 	default:
-		sort.Strings(labelStrings)
 		return fmt.Sprintf("%s{%s}", metricName, strings.Join(labelStrings, ", "))
 	}
 }
@@ -157,18 +376,54 @@ func (m Metric) FastFingerprint() Fingerprint {
 
 // IsValidMetricName returns true iff name matches the pattern of MetricNameRE
 // for legacy names, and iff it's valid UTF-8 if the UTF8Validation scheme is
-// selected.
+// selected (see GetNameValidationScheme). It is equivalent to calling
+// IsValidMetricNameWithScheme with the current global scheme.
 func IsValidMetricName(n LabelValue) bool {
-	switch NameValidationScheme {
+	return IsValidMetricNameWithScheme(n, GetNameValidationScheme())
+}
+
+// ValidateMetricName is like IsValidMetricName but returns an error describing
+// why the name is invalid, or nil if it is valid. The returned error is a
+// *MetricNameValidationError.
+func ValidateMetricName(n LabelValue) error {
+	scheme := GetNameValidationScheme()
+	if IsValidMetricNameWithScheme(n, scheme) {
+		return nil
+	}
+	return &MetricNameValidationError{
+		Name:   n,
+		Reason: nameInvalidReason(string(n), scheme, isValidLegacyRune),
+	}
+}
+
+// MetricNameValidationError describes an invalid metric name found by
+// ValidateMetricName.
+type MetricNameValidationError struct {
+	// Name is the offending metric name.
+	Name LabelValue
+	// Reason describes why the name is invalid.
+	Reason string
+}
+
+// Error implements the error interface.
+func (e *MetricNameValidationError) Error() string {
+	return fmt.Sprintf("invalid metric name %q: %s", e.Name, e.Reason)
+}
+
+// IsValidMetricNameWithScheme is like IsValidMetricName but uses the provided
+// validation scheme instead of the global one. This allows validating names
+// with different rules within the same binary without changing the global
+// scheme.
+func IsValidMetricNameWithScheme(n LabelValue, scheme ValidationScheme) bool {
+	switch scheme {
 	case LegacyValidation:
 		return IsValidLegacyMetricName(string(n))
 	case UTF8Validation:
-		if len(n) == 0 {
-			return false
-		}
-		return utf8.ValidString(string(n))
+		return isValidUTF8Name(string(n))
+	case UTF8NoControlValidation:
+		return isValidUTF8NoControl(string(n))
 	default:
-		panic(fmt.Sprintf("Invalid name validation scheme requested: %d", NameValidationScheme))
+		panic(fmt.Sprintf("Invalid name validation scheme requested: %d", scheme))
 	}
 }
 
@@ -177,11 +432,31 @@ func IsValidMetricName(n LabelValue) bool {
 // This function, however, does not use MetricNameRE for the check but a much
 // faster hardcoded implementation.
 func IsValidLegacyMetricName(n string) bool {
+	return isValidLegacyName(n, isValidLegacyRune)
+}
+
+// IsValidLegacyLabelName returns true iff n matches the pattern of LabelNameRE,
+// regardless of the current name validation scheme. In contrast to legacy
+// metric names, legacy label names must not contain ':'.
+func IsValidLegacyLabelName(n LabelName) bool {
+	return isValidLegacyName(string(n), isValidLegacyLabelRune)
+}
+
+// isValidUTF8Name returns true iff n is a non-empty, valid UTF-8 string without
+// NUL bytes. Surrogate halves are not valid UTF-8 and are rejected as well.
+func isValidUTF8Name(n string) bool {
+	return len(n) > 0 && utf8.ValidString(n) && strings.IndexByte(n, 0) < 0
+}
+
+// isValidUTF8NoControl returns true iff n is a non-empty, valid UTF-8 string
+// without control characters and without the Unicode replacement character.
+func isValidUTF8NoControl(n string) bool {
 	if len(n) == 0 {
 		return false
 	}
-	for i, b := range n {
-		if !isValidLegacyRune(b, i) {
+	for _, r := range n {
+		// Invalid UTF-8 is decoded as utf8.RuneError, the replacement character.
+		if r == utf8.RuneError || unicode.IsControl(r) {
 			return false
 		}
 	}
@@ -189,9 +464,10 @@ func IsValidLegacyMetricName(n string) bool {
 }
 
 // EscapeMetricFamily escapes the given metric names and labels with the given
-// escaping scheme. Returns a new object that uses the same pointers to fields
-// when possible and creates new escaped versions so as not to mutate the
-// input.
+// escaping scheme. This includes the label names of exemplars attached to
+// counters and histograms. Returns a new object that uses the same pointers to
+// fields when possible and creates new escaped versions so as not to mutate
+// the input.
 func EscapeMetricFamily(v *dto.MetricFamily, scheme EscapingScheme) *dto.MetricFamily {
 	if v == nil {
 		return nil
@@ -201,65 +477,433 @@ func EscapeMetricFamily(v *dto.MetricFamily, scheme EscapingScheme) *dto.MetricF
 		return v
 	}
 
+	return escapingRewriter(scheme).metricFamily(v)
+}
+
+// EscapeMetricFamilies works like calling EscapeMetricFamily for each element
+// of v, but shares the work between the families: Each distinct name is only
+// escaped once, and label pairs with the same escaped name share the same
+// string pointer. This pays off for scrapes in which the same label names
+// appear in many families. The returned slice is always newly allocated (unless
+// v is nil) and has the same length as v, with nil elements of v left nil.
+func EscapeMetricFamilies(v []*dto.MetricFamily, scheme EscapingScheme) []*dto.MetricFamily {
+	if v == nil {
+		return nil
+	}
+	out := make([]*dto.MetricFamily, len(v))
+	if scheme == NoEscaping {
+		copy(out, v)
+		return out
+	}
+	r := cachingEscapingRewriter(scheme)
+	for i, mf := range v {
+		if mf != nil {
+			out[i] = r.metricFamily(mf)
+		}
+	}
+	return out
+}
+
+// RewriteNames returns a copy of v with fn applied to the metric family name,
+// to all label names, including those of exemplars, and to the values of
+// MetricNameLabel labels. The name of a MetricNameLabel label itself is left
+// alone. Like EscapeMetricFamily, RewriteNames does not mutate v, and the
+// returned MetricFamily shares all messages with v that fn leaves unchanged. In
+// particular, if fn returns every name unchanged, all metrics of v are reused.
+// fn may be called several times with the same name.
+func RewriteNames(v *dto.MetricFamily, fn func(name string) string) *dto.MetricFamily {
+	if v == nil {
+		return nil
+	}
+	return nameRewriter{metricName: fn, labelName: fn}.metricFamily(v)
+}
+
+// EscapeMetricFamilyInPlace works like EscapeMetricFamily but modifies v
+// instead of creating escaped copies, which avoids allocating new metrics and
+// label pairs on hot paths. It is only safe to use if the caller owns v, i.e.
+// no other goroutine or data structure holds a reference to v or to any of
+// the messages it contains. Escaped names are stored as new strings, so name
+// pointers shared by several label pairs are never written through.
+func EscapeMetricFamilyInPlace(v *dto.MetricFamily, scheme EscapingScheme) {
+	if v == nil || scheme == NoEscaping {
+		return
+	}
+	if v.Name != nil && !IsValidLegacyMetricName(v.GetName()) {
+		v.Name = proto.String(EscapeName(v.GetName(), scheme))
+	}
+	for _, m := range v.Metric {
+		escapeLabelPairsInPlace(m.GetLabel(), scheme)
+		escapeLabelPairsInPlace(m.GetCounter().GetExemplar().GetLabel(), scheme)
+		for _, b := range m.GetHistogram().GetBucket() {
+			escapeLabelPairsInPlace(b.GetExemplar().GetLabel(), scheme)
+		}
+		for _, e := range m.GetHistogram().GetExemplars() {
+			escapeLabelPairsInPlace(e.GetLabel(), scheme)
+		}
+	}
+}
+
+// escapeLabelPairsInPlace is the in-place counterpart of escapeLabelPairs.
+func escapeLabelPairsInPlace(labels []*dto.LabelPair, scheme EscapingScheme) {
+	for _, l := range labels {
+		if l == nil || l.Name == nil {
+			continue
+		}
+		if l.GetName() == MetricNameLabel {
+			if l.Value != nil && !IsValidLegacyMetricName(l.GetValue()) {
+				l.Value = proto.String(EscapeName(l.GetValue(), scheme))
+			}
+			continue
+		}
+		if !IsValidLegacyLabelName(LabelName(l.GetName())) {
+			l.Name = proto.String(EscapeLabelName(l.GetName(), scheme))
+		}
+	}
+}
+
+// nameRewriter rewrites the metric and label names in a MetricFamily without
+// mutating it. Messages are only copied if a name in them changes, so that the
+// result shares all unchanged messages with the input.
+type nameRewriter struct {
+	metricName func(string) string
+	labelName  func(string) string
+	// interned, if not nil, holds the rewritten names, so that messages
+	// with the same rewritten name share the string pointer.
+	interned map[string]*string
+}
+
+// escapingRewriter returns a nameRewriter implementing EscapeMetricFamily.
+func escapingRewriter(scheme EscapingScheme) nameRewriter {
+	return nameRewriter{
+		metricName: func(name string) string {
+			if IsValidLegacyMetricName(name) {
+				return name
+			}
+			return EscapeName(name, scheme)
+		},
+		labelName: func(name string) string {
+			if IsValidLegacyLabelName(LabelName(name)) {
+				return name
+			}
+			return EscapeLabelName(name, scheme)
+		},
+	}
+}
+
+// cachingEscapingRewriter is like escapingRewriter, but remembers the escaped
+// names and interns them.
+func cachingEscapingRewriter(scheme EscapingScheme) nameRewriter {
+	r := escapingRewriter(scheme)
+	r.metricName = cacheNames(r.metricName)
+	r.labelName = cacheNames(r.labelName)
+	r.interned = map[string]*string{}
+	return r
+}
+
+// cacheNames returns a function returning the same result as fn, calling fn
+// only once per distinct name.
+func cacheNames(fn func(string) string) func(string) string {
+	cache := map[string]string{}
+	return func(name string) string {
+		if rewritten, ok := cache[name]; ok {
+			return rewritten
+		}
+		rewritten := fn(name)
+		cache[name] = rewritten
+		return rewritten
+	}
+}
+
+// newString returns a pointer to s, which is shared with earlier calls for
+// the same s if r interns strings.
+func (r nameRewriter) newString(s string) *string {
+	if r.interned == nil {
+		return proto.String(s)
+	}
+	if p, ok := r.interned[s]; ok {
+		return p
+	}
+	p := proto.String(s)
+	r.interned[s] = p
+	return p
+}
+
+func (r nameRewriter) metricFamily(v *dto.MetricFamily) *dto.MetricFamily {
 	out := &dto.MetricFamily{
+		Name: v.Name,
 		Help: v.Help,
 		Type: v.Type,
 		Unit: v.Unit,
 	}
+	// If the name is nil, copy as-is, don't try to rewrite.
+	if v.Name != nil {
+		if name := r.metricName(v.GetName()); name != v.GetName() {
+			out.Name = r.newString(name)
+		}
+	}
+	if len(v.Metric) > 0 {
+		out.Metric = make([]*dto.Metric, 0, len(v.Metric))
+		for _, m := range v.Metric {
+			out.Metric = append(out.Metric, r.metric(m))
+		}
+	}
+	return out
+}
 
-	// If the name is nil, copy as-is, don't try to escape.
-	if v.Name == nil || IsValidLegacyMetricName(v.GetName()) {
-		out.Name = v.Name
-	} else {
-		out.Name = proto.String(EscapeName(v.GetName(), scheme))
+// metric returns m, or a copy of it with rewritten names if any of them
+// changes.
+func (r nameRewriter) metric(m *dto.Metric) *dto.Metric {
+	if m == nil {
+		return nil
 	}
-	for _, m := range v.Metric {
-		if !metricNeedsEscaping(m) {
-			out.Metric = append(out.Metric, m)
-			continue
+	labels, changed := r.labelPairs(m.Label)
+	counter := r.counter(m.Counter)
+	histogram := r.histogram(m.Histogram)
+	if !changed && counter == m.Counter && histogram == m.Histogram {
+		return m
+	}
+	return &dto.Metric{
+		Label:       labels,
+		Gauge:       m.Gauge,
+		Counter:     counter,
+		Summary:     m.Summary,
+		Untyped:     m.Untyped,
+		Histogram:   histogram,
+		TimestampMs: m.TimestampMs,
+	}
+}
+
+// labelPairs rewrites the label pairs of a metric or an exemplar. If no name
+// changes, the input slice is returned, and the second return value is false.
+func (r nameRewriter) labelPairs(labels []*dto.LabelPair) ([]*dto.LabelPair, bool) {
+	var out []*dto.LabelPair
+	for i, l := range labels {
+		rewritten := r.labelPair(l)
+		if out == nil && rewritten != l {
+			out = make([]*dto.LabelPair, i, len(labels))
+			copy(out, labels[:i])
+		}
+		if out != nil {
+			out = append(out, rewritten)
 		}
+	}
+	if out == nil {
+		return labels, false
+	}
+	return out, true
+}
 
-		escaped := &dto.Metric{
-			Gauge:       m.Gauge,
-			Counter:     m.Counter,
-			Summary:     m.Summary,
-			Untyped:     m.Untyped,
-			Histogram:   m.Histogram,
-			TimestampMs: m.TimestampMs,
+// labelPair returns l, or a new LabelPair if its name changes. For a
+// MetricNameLabel, the value is rewritten as a metric name instead. Labels
+// without a name are returned as is.
+func (r nameRewriter) labelPair(l *dto.LabelPair) *dto.LabelPair {
+	if l == nil || l.Name == nil {
+		return l
+	}
+	if l.GetName() == MetricNameLabel {
+		if l.Value == nil {
+			return l
+		}
+		if value := r.metricName(l.GetValue()); value != l.GetValue() {
+			return &dto.LabelPair{Name: l.Name, Value: r.newString(value)}
 		}
+		return l
+	}
+	if name := r.labelName(l.GetName()); name != l.GetName() {
+		return &dto.LabelPair{Name: r.newString(name), Value: l.Value}
+	}
+	return l
+}
 
-		for _, l := range m.Label {
-			if l.GetName() == MetricNameLabel {
-				if l.Value == nil || IsValidLegacyMetricName(l.GetValue()) {
-					escaped.Label = append(escaped.Label, l)
-					continue
-				}
-				escaped.Label = append(escaped.Label, &dto.LabelPair{
-					Name:  proto.String(MetricNameLabel),
-					Value: proto.String(EscapeName(l.GetValue(), scheme)),
-				})
-				continue
-			}
-			if l.Name == nil || IsValidLegacyMetricName(l.GetName()) {
-				escaped.Label = append(escaped.Label, l)
-				continue
+// exemplar returns e, or a copy of it with rewritten label names if any of
+// them changes.
+func (r nameRewriter) exemplar(e *dto.Exemplar) *dto.Exemplar {
+	if e == nil {
+		return nil
+	}
+	labels, changed := r.labelPairs(e.Label)
+	if !changed {
+		return e
+	}
+	return &dto.Exemplar{
+		Label:     labels,
+		Value:     e.Value,
+		Timestamp: e.Timestamp,
+	}
+}
+
+// counter returns c, or a copy of it with a rewritten exemplar if the exemplar
+// changes.
+func (r nameRewriter) counter(c *dto.Counter) *dto.Counter {
+	if c == nil {
+		return nil
+	}
+	exemplar := r.exemplar(c.Exemplar)
+	if exemplar == c.Exemplar {
+		return c
+	}
+	return &dto.Counter{
+		Value:            c.Value,
+		Exemplar:         exemplar,
+		CreatedTimestamp: c.CreatedTimestamp,
+	}
+}
+
+// histogram returns h, or a copy of it with rewritten bucket and native
+// histogram exemplars if any of them changes. Only the buckets and exemplars
+// that change are copied.
+func (r nameRewriter) histogram(h *dto.Histogram) *dto.Histogram {
+	if h == nil {
+		return nil
+	}
+	var buckets []*dto.Bucket
+	for i, b := range h.Bucket {
+		rewritten := b
+		if exemplar := r.exemplar(b.GetExemplar()); exemplar != b.GetExemplar() {
+			rewritten = &dto.Bucket{
+				CumulativeCount:      b.CumulativeCount,
+				CumulativeCountFloat: b.CumulativeCountFloat,
+				UpperBound:           b.UpperBound,
+				Exemplar:             exemplar,
 			}
-			escaped.Label = append(escaped.Label, &dto.LabelPair{
-				Name:  proto.String(EscapeName(l.GetName(), scheme)),
-				Value: l.Value,
-			})
 		}
-		out.Metric = append(out.Metric, escaped)
+		if buckets == nil && rewritten != b {
+			buckets = make([]*dto.Bucket, i, len(h.Bucket))
+			copy(buckets, h.Bucket[:i])
+		}
+		if buckets != nil {
+			buckets = append(buckets, rewritten)
+		}
+	}
+	var exemplars []*dto.Exemplar
+	for i, e := range h.Exemplars {
+		rewritten := r.exemplar(e)
+		if exemplars == nil && rewritten != e {
+			exemplars = make([]*dto.Exemplar, i, len(h.Exemplars))
+			copy(exemplars, h.Exemplars[:i])
+		}
+		if exemplars != nil {
+			exemplars = append(exemplars, rewritten)
+		}
+	}
+	if buckets == nil && exemplars == nil {
+		return h
+	}
+	out := &dto.Histogram{
+		SampleCount:      h.SampleCount,
+		SampleCountFloat: h.SampleCountFloat,
+		SampleSum:        h.SampleSum,
+		Bucket:           h.Bucket,
+		CreatedTimestamp: h.CreatedTimestamp,
+		Schema:           h.Schema,
+		ZeroThreshold:    h.ZeroThreshold,
+		ZeroCount:        h.ZeroCount,
+		ZeroCountFloat:   h.ZeroCountFloat,
+		NegativeSpan:     h.NegativeSpan,
+		NegativeDelta:    h.NegativeDelta,
+		NegativeCount:    h.NegativeCount,
+		PositiveSpan:     h.PositiveSpan,
+		PositiveDelta:    h.PositiveDelta,
+		PositiveCount:    h.PositiveCount,
+		Exemplars:        h.Exemplars,
+	}
+	if buckets != nil {
+		out.Bucket = buckets
+	}
+	if exemplars != nil {
+		out.Exemplars = exemplars
+	}
+	return out
+}
+
+// EscapeLabelSet escapes the label names in the given LabelSet with the given
+// escaping scheme, following the same rules as EscapeMetricFamily: the value of
+// the MetricNameLabel is escaped like a metric name, while for all other labels
+// only the label name is escaped and the value is kept as is. If no label needs
+// escaping, the input LabelSet is returned unchanged to avoid allocations.
+// Otherwise, a new LabelSet is returned and the input is not mutated.
+//
+// Different label names may escape to the same name, e.g. "a.b" and "a_b" with
+// UnderscoreEscaping. Only one of the colliding labels is kept then: A label
+// whose name is left unchanged (as "a_b" in the example) takes precedence over
+// escaped ones, and among escaped labels, the one whose original name sorts
+// first wins. The result is thus independent of the map iteration order.
+func EscapeLabelSet(ls LabelSet, scheme EscapingScheme) LabelSet {
+	if scheme == NoEscaping || !labelSetNeedsEscaping(ls) {
+		return ls
+	}
+	out := make(LabelSet, len(ls))
+	for ln, lv := range ls {
+		escaped, lv := escapeLabel(ln, lv, scheme)
+		if _, ok := out[escaped]; ok {
+			return escapeLabelSetWithCollisions(ls, scheme)
+		}
+		out[escaped] = lv
 	}
 	return out
 }
 
-func metricNeedsEscaping(m *dto.Metric) bool {
-	for _, l := range m.Label {
-		if l.GetName() == MetricNameLabel && !IsValidLegacyMetricName(l.GetValue()) {
+// escapeLabelSetWithCollisions implements EscapeLabelSet for a LabelSet in
+// which several label names escape to the same name. It resolves the
+// collisions in the order documented there.
+func escapeLabelSetWithCollisions(ls LabelSet, scheme EscapingScheme) LabelSet {
+	names := make(LabelNames, 0, len(ls))
+	for ln := range ls {
+		names = append(names, ln)
+	}
+	sort.Sort(names)
+	out := make(LabelSet, len(ls))
+	// Unchanged names first, so that escaped names cannot replace them.
+	for _, ln := range names {
+		if escaped, lv := escapeLabel(ln, ls[ln], scheme); escaped == ln {
+			out[ln] = lv
+		}
+	}
+	for _, ln := range names {
+		escaped, lv := escapeLabel(ln, ls[ln], scheme)
+		if _, ok := out[escaped]; !ok {
+			out[escaped] = lv
+		}
+	}
+	return out
+}
+
+// escapeLabel returns the escaped name and value of a single label of a
+// LabelSet as escaped by EscapeLabelSet.
+func escapeLabel(ln LabelName, lv LabelValue, scheme EscapingScheme) (LabelName, LabelValue) {
+	if ln == MetricNameLabel {
+		if !IsValidLegacyMetricName(string(lv)) {
+			lv = LabelValue(EscapeName(string(lv), scheme))
+		}
+		return ln, lv
+	}
+	if !IsValidLegacyLabelName(ln) {
+		ln = LabelName(EscapeLabelName(string(ln), scheme))
+	}
+	return ln, lv
+}
+
+// Escape is the method form of EscapeLabelSet: it returns ls with its names
+// escaped according to scheme, or ls itself (the same map) if nothing needs
+// escaping.
+func (ls LabelSet) Escape(scheme EscapingScheme) LabelSet {
+	return EscapeLabelSet(ls, scheme)
+}
+
+// Escape returns m with the value of the MetricNameLabel and all label names
+// escaped according to scheme, following the same rules as EscapeLabelSet. If
+// nothing needs escaping, m itself (the same map) is returned. Otherwise, m
+// is not modified.
+func (m Metric) Escape(scheme EscapingScheme) Metric {
+	return Metric(EscapeLabelSet(LabelSet(m), scheme))
+}
+
+func labelSetNeedsEscaping(ls LabelSet) bool {
+	for ln, lv := range ls {
+		if ln == MetricNameLabel && !IsValidLegacyMetricName(string(lv)) {
 			return true
 		}
-		if !IsValidLegacyMetricName(l.GetName()) {
+		if !IsValidLegacyLabelName(ln) {
 			return true
 		}
 	}
@@ -268,40 +912,83 @@ func metricNeedsEscaping(m *dto.Metric) bool {
 
 const (
 	lowerhex = "0123456789abcdef"
+	upperhex = "0123456789ABCDEF"
 )
 
 // EscapeName escapes the incoming name according to the provided escaping
 // scheme. Depending on the rules of escaping, this may cause no change in the
 // string that is returned. (Especially NoEscaping, which by definition is a
-// noop). This function does not do any validation of the name.
+// noop). This function does not do any validation of the name. For all schemes
+// except NoEscaping and PercentEscaping, the result of escaping a non-empty
+// name is always a valid legacy metric name, e.g. a leading digit is never
+// carried over verbatim.
+//
+// Legacy metric names may contain ':', which is therefore preserved. Use
+// EscapeLabelName to escape label names, where ':' is not allowed.
 func EscapeName(name string, scheme EscapingScheme) string {
+	return escapeName(name, scheme, isValidLegacyRune)
+}
+
+// EscapeLabelName is like EscapeName but applies the legacy rules for label
+// names instead of metric names, i.e. ':' is escaped like any other character
+// that is not allowed in a legacy label name.
+func EscapeLabelName(name string, scheme EscapingScheme) string {
+	return escapeName(name, scheme, isValidLegacyLabelRune)
+}
+
+// IsQuotedName returns true if s is a name in the quoted syntax of the text
+// formats, i.e. enclosed in double quotes, with any double quote or backslash
+// within the name escaped by a backslash, as in `"foo.bar"`. Such a string is
+// the rendering of a name outside of the legacy character set rather than the
+// name itself.
+func IsQuotedName(s string) bool {
+	if len(s) < 2 || s[0] != '"' || s[len(s)-1] != '"' {
+		return false
+	}
+	_, err := strconv.Unquote(s)
+	return err == nil
+}
+
+// EscapeNameStrict works like EscapeName, but returns an error instead of
+// escaping a name for which IsQuotedName returns true. Escaping the quoted
+// rendering of a name would mangle it, e.g. `"foo.bar"` would become
+// `U___22_foo_2e_bar_22_` with ValueEncodingEscaping. Use strconv.Unquote or
+// ParseMetric to obtain the name from its quoted rendering first.
+func EscapeNameStrict(name string, scheme EscapingScheme) (string, error) {
+	if IsQuotedName(name) {
+		return "", fmt.Errorf("cannot escape quoted name %s, unquote it first", name)
+	}
+	return EscapeName(name, scheme), nil
+}
+
+// escapeName implements EscapeName and EscapeLabelName. isValidRune reports
+// whether a rune at the given byte offset may be kept verbatim.
+func escapeName(name string, scheme EscapingScheme, isValidRune func(rune, int) bool) string {
 	if len(name) == 0 {
 		return name
 	}
-	var escaped strings.Builder
+	// The Builder is only declared once we know the name has to change, so
+	// that the no-op paths do not allocate. It is grown to the exact size of
+	// the result up front, so that escaping allocates only once, however long
+	// the name is.
 	switch scheme {
 	case NoEscaping:
 		return name
 	case UnderscoreEscaping:
-		if IsValidLegacyMetricName(name) {
+		return escapeUnderscores(name, isValidRune)
+	case DotsEscaping:
+		// Legacy valid names still need escaping if they contain underscores.
+		if isDotsEscapingNoop(name, isValidRune) {
 			return name
 		}
-		for i, b := range name {
-			if isValidLegacyRune(b, i) {
-				escaped.WriteRune(b)
-			} else {
-				escaped.WriteRune('_')
-			}
-		}
-		return escaped.String()
-	case DotsEscaping:
-		// Do not early return for legacy valid names, we still escape underscores.
+		var escaped strings.Builder
+		escaped.Grow(escapedNameLen(name, scheme, isValidRune))
 		for i, b := range name {
 			if b == '_' {
 				escaped.WriteString("__")
 			} else if b == '.' {
 				escaped.WriteString("_dot_")
-			} else if isValidLegacyRune(b, i) {
+			} else if isValidRune(b, i) {
 				escaped.WriteRune(b)
 			} else {
 				escaped.WriteRune('_')
@@ -309,12 +996,16 @@ func EscapeName(name string, scheme EscapingScheme) string {
 		}
 		return escaped.String()
 	case ValueEncodingEscaping:
-		if IsValidLegacyMetricName(name) {
+		if isValidLegacyName(name, isValidRune) {
 			return name
 		}
+		var escaped strings.Builder
+		escaped.Grow(escapedNameLen(name, scheme, isValidRune))
 		escaped.WriteString("U__")
 		for i, b := range name {
-			if isValidLegacyRune(b, i) {
+			if b == '_' {
+				escaped.WriteString("__")
+			} else if isValidRune(b, i) {
 				escaped.WriteRune(b)
 			} else if !utf8.ValidRune(b) {
 				escaped.WriteString("_FFFD_")
@@ -330,6 +1021,33 @@ func EscapeName(name string, scheme EscapingScheme) string {
 					escaped.WriteByte(lowerhex[b>>uint(s)&0xF])
 				}
 				escaped.WriteRune('_')
+			} else {
+				escaped.WriteRune('_')
+				for s := 20; s >= 0; s -= 4 {
+					escaped.WriteByte(lowerhex[b>>uint(s)&0xF])
+				}
+				escaped.WriteRune('_')
+			}
+		}
+		return escaped.String()
+	case PercentEscaping:
+		if isValidLegacyName(name, isValidRune) {
+			return name
+		}
+		var escaped strings.Builder
+		escaped.Grow(escapedNameLen(name, scheme, isValidRune))
+		for i := 0; i < len(name); {
+			r, size := utf8.DecodeRuneInString(name[i:])
+			if size == 1 && isValidRune(r, i) {
+				escaped.WriteByte(name[i])
+				i++
+				continue
+			}
+			for ; size > 0; size-- {
+				escaped.WriteByte('%')
+				escaped.WriteByte(upperhex[name[i]>>4])
+				escaped.WriteByte(upperhex[name[i]&0xF])
+				i++
 			}
 		}
 		return escaped.String()
@@ -338,6 +1056,97 @@ func EscapeName(name string, scheme EscapingScheme) string {
 	}
 }
 
+// isDotsEscapingNoop returns true if DotsEscaping leaves name unchanged, i.e.
+// if it is a legacy valid name without underscores.
+func isDotsEscapingNoop(name string, isValidRune func(rune, int) bool) bool {
+	for i, b := range name {
+		if b == '_' || !isValidRune(b, i) {
+			return false
+		}
+	}
+	return true
+}
+
+// escapedNameLen returns the length in bytes of the result of escapeName for
+// the DotsEscaping, ValueEncodingEscaping, and PercentEscaping schemes, which
+// may lengthen a name. It has to be kept in sync with escapeName.
+func escapedNameLen(name string, scheme EscapingScheme, isValidRune func(rune, int) bool) int {
+	var n int
+	switch scheme {
+	case DotsEscaping:
+		for _, b := range name {
+			switch b {
+			case '_':
+				n += 2
+			case '.':
+				n += 5
+			default:
+				// Valid runes are ASCII, everything else becomes '_'.
+				n++
+			}
+		}
+	case ValueEncodingEscaping:
+		n = 3
+		for i, b := range name {
+			switch {
+			case b == '_':
+				n += 2
+			case isValidRune(b, i):
+				n++
+			case !utf8.ValidRune(b) || (b >= 0x100 && b < 0x10000):
+				n += 6
+			case b < 0x100:
+				n += 4
+			default:
+				n += 8
+			}
+		}
+	case PercentEscaping:
+		for i := 0; i < len(name); {
+			r, size := utf8.DecodeRuneInString(name[i:])
+			if size == 1 && isValidRune(r, i) {
+				n++
+			} else {
+				n += 3 * size
+			}
+			i += size
+		}
+	default:
+		n = len(name)
+	}
+	return n
+}
+
+// escapeUnderscores replaces every rune rejected by isValidRune with '_'. The
+// name is scanned only once: nothing is allocated until the first invalid rune
+// is found, at which point the valid prefix is copied into a builder sized to
+// fit the whole result. Legacy-valid names are returned unchanged.
+func escapeUnderscores(name string, isValidRune func(rune, int) bool) string {
+	var (
+		escaped strings.Builder
+		changed bool
+	)
+	for i, b := range name {
+		if isValidRune(b, i) {
+			if changed {
+				escaped.WriteRune(b)
+			}
+			continue
+		}
+		if !changed {
+			// Every rune is replaced by at most as many bytes as it takes up.
+			escaped.Grow(len(name))
+			escaped.WriteString(name[:i])
+			changed = true
+		}
+		escaped.WriteByte('_')
+	}
+	if !changed {
+		return name
+	}
+	return escaped.String()
+}
+
 // lower function taken from strconv.atoi
 func lower(c byte) byte {
 	return c | ('x' - 'X')
@@ -386,10 +1195,6 @@ func UnescapeName(name string, scheme EscapingScheme) string {
 			// We think we are in a UTF-8 code, process it.
 			var utf8Val uint
 			for j := 0; i < len(escapedName); j++ {
-				// This is too many characters for a utf8 value.
-				if j > 4 {
-					return name
-				}
 				// Found a closing underscore, convert to a rune, check validity, and append.
 				if escapedName[i] == '_' {
 					utf8Rune := rune(utf8Val)
@@ -399,6 +1204,11 @@ func UnescapeName(name string, scheme EscapingScheme) string {
 					unescaped.WriteRune(utf8Rune)
 					continue TOP
 				}
+				// This is too many characters for a utf8 value based on
+				// the MaxRune value of '\U0010FFFF'.
+				if j >= 6 {
+					return name
+				}
 				r := lower(escapedName[i])
 				utf8Val *= 16
 				if r >= '0' && r <= '9' {
@@ -414,15 +1224,169 @@ func UnescapeName(name string, scheme EscapingScheme) string {
 			return name
 		}
 		return unescaped.String()
+	case PercentEscaping:
+		if !strings.Contains(name, "%") {
+			return name
+		}
+		var unescaped strings.Builder
+		for i := 0; i < len(name); i++ {
+			if name[i] != '%' {
+				unescaped.WriteByte(name[i])
+				continue
+			}
+			if i+2 >= len(name) {
+				return name
+			}
+			hi, ok1 := unhex(name[i+1])
+			lo, ok2 := unhex(name[i+2])
+			if !ok1 || !ok2 {
+				return name
+			}
+			unescaped.WriteByte(hi<<4 | lo)
+			i += 2
+		}
+		return unescaped.String()
 	default:
 		panic(fmt.Sprintf("invalid escaping scheme %d", scheme))
 	}
 }
 
+// DetectEscaping guesses the escaping scheme that has been applied to name,
+// based on the markers the schemes leave behind. It is a best-effort
+// heuristic for names of unknown origin, as a name may look escaped without
+// being escaped, and if the scheme is known, it should be used instead. The
+// rules are checked in the following order:
+//
+//   - A name with the prefix `U__` is assumed to be escaped with
+//     ValueEncodingEscaping.
+//   - A name containing `%` followed by two hexadecimal digits is assumed to
+//     be escaped with PercentEscaping.
+//   - A name containing `_dot_` is assumed to be escaped with DotsEscaping.
+//   - A name that is not a valid legacy metric name cannot be the result of
+//     any other scheme, so NoEscaping is returned.
+//   - In all other cases, including the empty name, the name is ambiguous
+//     and UnderscoreEscaping is returned. As UnescapeName leaves names escaped
+//     with UnderscoreEscaping unchanged, this default is safe to unescape
+//     with.
+func DetectEscaping(name string) EscapingScheme {
+	switch {
+	case strings.HasPrefix(name, "U__"):
+		return ValueEncodingEscaping
+	case containsPercentEncoding(name):
+		return PercentEscaping
+	case strings.Contains(name, "_dot_"):
+		return DotsEscaping
+	case name != "" && !IsValidLegacyMetricName(name):
+		return NoEscaping
+	default:
+		return UnderscoreEscaping
+	}
+}
+
+// containsPercentEncoding reports whether name contains `%` followed by two
+// hexadecimal digits.
+func containsPercentEncoding(name string) bool {
+	for i := strings.IndexByte(name, '%'); i >= 0 && i+2 < len(name); i++ {
+		if name[i] != '%' {
+			continue
+		}
+		_, ok1 := unhex(name[i+1])
+		_, ok2 := unhex(name[i+2])
+		if ok1 && ok2 {
+			return true
+		}
+	}
+	return false
+}
+
+// unhex returns the value of the hexadecimal digit c.
+func unhex(c byte) (byte, bool) {
+	switch c = lower(c); {
+	case c >= '0' && c <= '9':
+		return c - '0', true
+	case c >= 'a' && c <= 'f':
+		return c - 'a' + 10, true
+	}
+	return 0, false
+}
+
+// CheckRoundTripSafe returns the names that do not survive escaping with the
+// given scheme, i.e. those for which UnescapeName(EscapeName(name, scheme),
+// scheme) differs from the name, in the order in which they appear in names.
+// This is useful to verify a choice of escaping scheme for a set of names
+// before migrating, as some schemes (especially UnderscoreEscaping) are lossy.
+func CheckRoundTripSafe(names []string, scheme EscapingScheme) (unsafe []string) {
+	for _, name := range names {
+		if UnescapeName(EscapeName(name, scheme), scheme) != name {
+			unsafe = append(unsafe, name)
+		}
+	}
+	return unsafe
+}
+
+// GraphiteEscape escapes the incoming name into a form that can safely be used
+// as a single node of a Graphite metric path. Graphite uses dots as path
+// separators and treats a number of other characters specially, so all bytes
+// except ASCII letters, digits, '_', '-' and ':' are replaced by '%' followed
+// by their two-digit uppercase hexadecimal value. Multi-byte UTF-8 runes are
+// escaped byte by byte. The mapping is deterministic and independent of the
+// EscapingScheme used for Prometheus names.
+func GraphiteEscape(name string) string {
+	needsEscaping := false
+	for i := 0; i < len(name); i++ {
+		if !isGraphiteSafeByte(name[i]) {
+			needsEscaping = true
+			break
+		}
+	}
+	if !needsEscaping {
+		return name
+	}
+	var escaped strings.Builder
+	escaped.Grow(len(name))
+	for i := 0; i < len(name); i++ {
+		b := name[i]
+		if isGraphiteSafeByte(b) {
+			escaped.WriteByte(b)
+			continue
+		}
+		escaped.WriteByte('%')
+		escaped.WriteByte(upperhex[b>>4])
+		escaped.WriteByte(upperhex[b&0xF])
+	}
+	return escaped.String()
+}
+
+func isGraphiteSafeByte(b byte) bool {
+	return (b >= 'a' && b <= 'z') || (b >= 'A' && b <= 'Z') || (b >= '0' && b <= '9') || b == '_' || b == '-' || b == ':'
+}
+
+// isValidLegacyRune returns true iff b may appear in a legacy metric name at
+// byte offset i. The offset only matters to reject a leading digit, and as
+// byte offset 0 is always the first rune, callers may pass the byte offsets
+// yielded by ranging over a string rather than counting runes.
 func isValidLegacyRune(b rune, i int) bool {
 	return (b >= 'a' && b <= 'z') || (b >= 'A' && b <= 'Z') || b == '_' || b == ':' || (b >= '0' && b <= '9' && i > 0)
 }
 
+func isValidLegacyLabelRune(b rune, i int) bool {
+	return b != ':' && isValidLegacyRune(b, i)
+}
+
+// isValidLegacyName returns true iff n is non-empty and every rune of n is
+// accepted by isValidRune.
+func isValidLegacyName(n string, isValidRune func(rune, int) bool) bool {
+	if len(n) == 0 {
+		return false
+	}
+	for i, b := range n {
+		if !isValidRune(b, i) {
+			return false
+		}
+	}
+	return true
+}
+
 func (e EscapingScheme) String() string {
 	switch e {
 	case NoEscaping:
@@ -433,6 +1397,8 @@ func (e EscapingScheme) String() string {
 		return EscapeDots
 	case ValueEncodingEscaping:
 		return EscapeValues
+	case PercentEscaping:
+		return "percent"
 	default:
 		panic(fmt.Sprintf("unknown format scheme %d", e))
 	}
@@ -443,7 +1409,7 @@ func ToEscapingScheme(s string) (EscapingScheme, error) {
 		return NoEscaping, fmt.Errorf("got empty string instead of escaping scheme")
 	}
 	switch s {
-	case AllowUTF8:
+	case AllowUTF8, AllowUTF8Alt:
 		return NoEscaping, nil
 	case EscapeUnderscores:
 		return UnderscoreEscaping, nil
@@ -455,3 +1421,172 @@ func ToEscapingScheme(s string) (EscapingScheme, error) {
 		return NoEscaping, fmt.Errorf("unknown format scheme " + s)
 	}
 }
+
+// validationSchemeNames lists the names accepted by ValidationScheme.Set, in
+// the order of the corresponding constants.
+var validationSchemeNames = []string{"legacy", "utf8", "utf8-no-control"}
+
+// String returns the name of the validation scheme as accepted by Set, e.g.
+// "legacy" or "utf8".
+func (s ValidationScheme) String() string {
+	if s >= 0 && int(s) < len(validationSchemeNames) {
+		return validationSchemeNames[s]
+	}
+	return fmt.Sprintf("ValidationScheme(%d)", int(s))
+}
+
+// Set implements flag.Value. Names are matched case-insensitively.
+func (s *ValidationScheme) Set(text string) error {
+	for i, name := range validationSchemeNames {
+		if strings.EqualFold(text, name) {
+			*s = ValidationScheme(i)
+			return nil
+		}
+	}
+	return fmt.Errorf("invalid validation scheme %q, valid options are %s", text, strings.Join(validationSchemeNames, ", "))
+}
+
+// Type implements pflag.Value.
+func (s *ValidationScheme) Type() string {
+	return "validationScheme"
+}
+
+// MarshalText implements the encoding.TextMarshaler interface.
+func (s ValidationScheme) MarshalText() ([]byte, error) {
+	if s < 0 || int(s) >= len(validationSchemeNames) {
+		return nil, fmt.Errorf("unknown validation scheme %d", s)
+	}
+	return []byte(s.String()), nil
+}
+
+// UnmarshalText implements the encoding.TextUnmarshaler interface.
+func (s *ValidationScheme) UnmarshalText(text []byte) error {
+	return s.Set(string(text))
+}
+
+// MarshalJSON implements the json.Marshaler interface.
+func (s ValidationScheme) MarshalJSON() ([]byte, error) {
+	text, err := s.MarshalText()
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(string(text))
+}
+
+// UnmarshalJSON implements the json.Unmarshaler interface.
+func (s *ValidationScheme) UnmarshalJSON(b []byte) error {
+	var text string
+	if err := json.Unmarshal(b, &text); err != nil {
+		return err
+	}
+	return s.Set(text)
+}
+
+// MarshalYAML implements the yaml.Marshaler interface.
+func (s ValidationScheme) MarshalYAML() (interface{}, error) {
+	text, err := s.MarshalText()
+	if err != nil {
+		return nil, err
+	}
+	return string(text), nil
+}
+
+// UnmarshalYAML implements the yaml.Unmarshaler interface.
+func (s *ValidationScheme) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var text string
+	if err := unmarshal(&text); err != nil {
+		return err
+	}
+	return s.Set(text)
+}
+
+// escapingSchemeNames lists the names accepted by ParseEscapingScheme. "none"
+// is accepted as a more readable alias of AllowUTF8 for flags and
+// configuration files.
+var escapingSchemeNames = []string{"none", AllowUTF8, EscapeUnderscores, EscapeDots, EscapeValues}
+
+// ParseEscapingScheme parses the name of an escaping scheme as used in flags
+// and configuration files. It accepts the values of the escaping parameter
+// (see EscapingKey) as well as "none" for NoEscaping, matched
+// case-insensitively. In contrast to ToEscapingScheme, which parses the
+// escaping parameter of a media type, it is meant for human input.
+func ParseEscapingScheme(text string) (EscapingScheme, error) {
+	lower := strings.ToLower(text)
+	if lower == "none" {
+		return NoEscaping, nil
+	}
+	s, err := ToEscapingScheme(lower)
+	if err != nil {
+		return NoEscaping, fmt.Errorf("invalid escaping scheme %q, valid options are %s", text, strings.Join(escapingSchemeNames, ", "))
+	}
+	return s, nil
+}
+
+// Set implements flag.Value. It accepts the same names as ParseEscapingScheme.
+func (e *EscapingScheme) Set(text string) error {
+	s, err := ParseEscapingScheme(text)
+	if err != nil {
+		return err
+	}
+	*e = s
+	return nil
+}
+
+// Type implements pflag.Value.
+func (e *EscapingScheme) Type() string {
+	return "escapingScheme"
+}
+
+// MarshalText implements the encoding.TextMarshaler interface. Schemes are
+// always marshaled under their canonical name as returned by String, i.e. like
+// the escaping parameter. Aliases accepted by UnmarshalText are not preserved:
+// NoEscaping parsed from "none" is marshaled as AllowUTF8, which unmarshals to
+// NoEscaping again. PercentEscaping is not an escaping scheme of the
+// exposition formats and cannot be marshaled.
+func (e EscapingScheme) MarshalText() ([]byte, error) {
+	if e < NoEscaping || e > ValueEncodingEscaping {
+		return nil, fmt.Errorf("unknown escaping scheme %d", e)
+	}
+	return []byte(e.String()), nil
+}
+
+// UnmarshalText implements the encoding.TextUnmarshaler interface.
+func (e *EscapingScheme) UnmarshalText(text []byte) error {
+	return e.Set(string(text))
+}
+
+// MarshalJSON implements the json.Marshaler interface.
+func (e EscapingScheme) MarshalJSON() ([]byte, error) {
+	text, err := e.MarshalText()
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(string(text))
+}
+
+// UnmarshalJSON implements the json.Unmarshaler interface.
+func (e *EscapingScheme) UnmarshalJSON(b []byte) error {
+	var text string
+	if err := json.Unmarshal(b, &text); err != nil {
+		return err
+	}
+	return e.Set(text)
+}
+
+// MarshalYAML implements the yaml.Marshaler interface.
+func (e EscapingScheme) MarshalYAML() (interface{}, error) {
+	text, err := e.MarshalText()
+	if err != nil {
+		return nil, err
+	}
+	return string(text), nil
+}
+
+// UnmarshalYAML implements the yaml.Unmarshaler interface.
+func (e *EscapingScheme) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var text string
+	if err := unmarshal(&text); err != nil {
+		return err
+	}
+	return e.Set(text)
+}
@@ -0,0 +1,184 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package model
+
+import (
+	"fmt"
+	"strconv"
+)
+
+// ParseMetric parses a Metric from the syntax written by Metric.String, i.e.
+// the series notation of PromQL and the text format. It accepts the legacy form
+// `name{a="b"}` as well as the quoted form `{"my.metric", "my.label"="b"}`, in
+// which names outside of the legacy character set are quoted and the metric
+// name moves inside the braces. A bare metric name and `{}` are valid, too.
+// Quoted names and label values use Go string literal syntax, as written by
+// Metric.String, so escaped quotes and backslashes are resolved. Whitespace
+// between tokens and a trailing comma after the last label are allowed.
+//
+// Names are not validated beyond the syntax, but empty and duplicate names are
+// rejected. Errors report the byte offset in s at which parsing failed.
+func ParseMetric(s string) (Metric, error) {
+	p := metricParser{s: s}
+	return p.parse()
+}
+
+// metricParser holds the state of ParseMetric.
+type metricParser struct {
+	s   string
+	pos int
+}
+
+func (p *metricParser) errorf(format string, args ...interface{}) error {
+	return fmt.Errorf("cannot parse metric %q: %s at offset %d", p.s, fmt.Sprintf(format, args...), p.pos)
+}
+
+func (p *metricParser) parse() (Metric, error) {
+	m := Metric{}
+	p.skipSpace()
+	if p.pos == len(p.s) {
+		return nil, p.errorf("empty input")
+	}
+	if p.s[p.pos] != '{' {
+		name := p.readBareName(true)
+		if name == "" {
+			return nil, p.errorf("invalid character %q", p.s[p.pos])
+		}
+		m[MetricNameLabel] = LabelValue(name)
+		p.skipSpace()
+	}
+	if p.pos < len(p.s) && p.s[p.pos] == '{' {
+		if err := p.parseLabels(m); err != nil {
+			return nil, err
+		}
+		p.skipSpace()
+	}
+	if p.pos < len(p.s) {
+		return nil, p.errorf("unexpected character %q", p.s[p.pos])
+	}
+	return m, nil
+}
+
+// parseLabels parses the label pairs enclosed in braces at the current position
+// into m. If m has no metric name yet, the first entry may be a quoted metric
+// name.
+func (p *metricParser) parseLabels(m Metric) error {
+	p.pos++ // Skip '{'.
+	_, hasName := m[MetricNameLabel]
+	for first := true; ; first = false {
+		p.skipSpace()
+		if p.pos == len(p.s) {
+			return p.errorf("unterminated label set")
+		}
+		if p.s[p.pos] == '}' {
+			p.pos++
+			return nil
+		}
+
+		start := p.pos
+		var (
+			name   string
+			quoted bool
+			err    error
+		)
+		if p.s[p.pos] == '"' {
+			quoted = true
+			if name, err = p.readQuoted(); err != nil {
+				return err
+			}
+		} else if name = p.readBareName(false); name == "" {
+			return p.errorf("invalid character %q in label name", p.s[p.pos])
+		}
+		if name == "" {
+			p.pos = start
+			return p.errorf("empty name")
+		}
+		p.skipSpace()
+
+		if quoted && first && !hasName && (p.pos == len(p.s) || p.s[p.pos] != '=') {
+			// A quoted metric name inside the braces.
+			m[MetricNameLabel] = LabelValue(name)
+		} else {
+			if p.pos == len(p.s) || p.s[p.pos] != '=' {
+				return p.errorf("expected '=' after label name %q", name)
+			}
+			p.pos++
+			p.skipSpace()
+			if p.pos == len(p.s) || p.s[p.pos] != '"' {
+				return p.errorf("expected quoted value for label %q", name)
+			}
+			value, err := p.readQuoted()
+			if err != nil {
+				return err
+			}
+			if _, ok := m[LabelName(name)]; ok {
+				p.pos = start
+				return p.errorf("duplicate label name %q", name)
+			}
+			m[LabelName(name)] = LabelValue(value)
+		}
+
+		p.skipSpace()
+		if p.pos == len(p.s) {
+			return p.errorf("unterminated label set")
+		}
+		switch p.s[p.pos] {
+		case ',':
+			p.pos++
+		case '}':
+		default:
+			return p.errorf("expected ',' or '}', got %q", p.s[p.pos])
+		}
+	}
+}
+
+// readBareName reads a legacy metric name (if metric is true) or label name
+// at the current position. It returns an empty string if there is none.
+func (p *metricParser) readBareName(metric bool) string {
+	start := p.pos
+	for p.pos < len(p.s) {
+		b := p.s[p.pos]
+		if !((b >= 'a' && b <= 'z') || (b >= 'A' && b <= 'Z') || b == '_' || (metric && b == ':') || (b >= '0' && b <= '9' && p.pos > start)) {
+			break
+		}
+		p.pos++
+	}
+	return p.s[start:p.pos]
+}
+
+// readQuoted reads a quoted string in Go syntax at the current position, which
+// has to be '"', and returns it unquoted.
+func (p *metricParser) readQuoted() (string, error) {
+	start := p.pos
+	for i := p.pos + 1; i < len(p.s); i++ {
+		switch p.s[i] {
+		case '\\':
+			i++
+		case '"':
+			unquoted, err := strconv.Unquote(p.s[start : i+1])
+			if err != nil {
+				return "", p.errorf("invalid quoted string %s", p.s[start:i+1])
+			}
+			p.pos = i + 1
+			return unquoted, nil
+		}
+	}
+	return "", p.errorf("unterminated quoted string")
+}
+
+func (p *metricParser) skipSpace() {
+	for p.pos < len(p.s) && (p.s[p.pos] == ' ' || p.s[p.pos] == '\t' || p.s[p.pos] == '\n' || p.s[p.pos] == '\r') {
+		p.pos++
+	}
+}
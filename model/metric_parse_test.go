@@ -0,0 +1,155 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package model
+
+import (
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+func TestParseMetric(t *testing.T) {
+	scenarios := []struct {
+		input    string
+		expected Metric
+	}{
+		{
+			input:    "foo",
+			expected: Metric{MetricNameLabel: "foo"},
+		},
+		{
+			input:    "{}",
+			expected: Metric{},
+		},
+		{
+			input:    `foo:bar_total{code="200",method="GET"}`,
+			expected: Metric{MetricNameLabel: "foo:bar_total", "code": "200", "method": "GET"},
+		},
+		{
+			input:    ` foo { code = "200" , method="GET", } `,
+			expected: Metric{MetricNameLabel: "foo", "code": "200", "method": "GET"},
+		},
+		{
+			input:    `{"my metric", foo="bar"}`,
+			expected: Metric{MetricNameLabel: "my metric", "foo": "bar"},
+		},
+		{
+			input:    `{"my.metric"}`,
+			expected: Metric{MetricNameLabel: "my.metric"},
+		},
+		{
+			input:    `{"label.one"="a", "label two"="b"}`,
+			expected: Metric{"label.one": "a", "label two": "b"},
+		},
+		{
+			input:    `foo{"label.one"="a"}`,
+			expected: Metric{MetricNameLabel: "foo", "label.one": "a"},
+		},
+		{
+			input:    `{__name__="foo", a="b"}`,
+			expected: Metric{MetricNameLabel: "foo", "a": "b"},
+		},
+		{
+			input:    `foo{path="C:\\dir", quote="say \"hi\"", nl="a\nb", emoji="\U0001F525"}`,
+			expected: Metric{MetricNameLabel: "foo", "path": `C:\dir`, "quote": `say "hi"`, "nl": "a\nb", "emoji": "🔥"},
+		},
+	}
+
+	for _, scenario := range scenarios {
+		t.Run(scenario.input, func(t *testing.T) {
+			got, err := ParseMetric(scenario.input)
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if !got.Equal(scenario.expected) {
+				t.Errorf("expected %v, got %v", scenario.expected, got)
+			}
+		})
+	}
+}
+
+func TestParseMetricErrors(t *testing.T) {
+	scenarios := []struct {
+		input string
+		err   string
+	}{
+		{input: "", err: "empty input at offset 0"},
+		{input: "   ", err: "empty input at offset 3"},
+		{input: "1foo", err: "invalid character '1' at offset 0"},
+		{input: "foo bar", err: "unexpected character 'b' at offset 4"},
+		{input: `foo{a="b"`, err: "unterminated label set at offset 9"},
+		{input: `foo{a="b}`, err: "unterminated quoted string at offset 6"},
+		{input: `foo{a}`, err: `expected '=' after label name "a" at offset 5`},
+		{input: `foo{a=b}`, err: `expected quoted value for label "a" at offset 6`},
+		{input: `foo{a="b" c="d"}`, err: `expected ',' or '}', got 'c' at offset 10`},
+		{input: `foo{a="b",a="c"}`, err: `duplicate label name "a" at offset 10`},
+		{input: `foo{__name__="bar"}`, err: `duplicate label name "__name__" at offset 4`},
+		{input: `foo{"bar"}`, err: `expected '=' after label name "bar" at offset 9`},
+		{input: `{""}`, err: "empty name at offset 1"},
+		{input: `foo{-a="b"}`, err: "invalid character '-' in label name at offset 4"},
+		{input: `foo{a="\q"}`, err: `invalid quoted string "\q" at offset 6`},
+		{input: `foo{a="b"}}`, err: "unexpected character '}' at offset 10"},
+	}
+
+	for _, scenario := range scenarios {
+		t.Run(scenario.input, func(t *testing.T) {
+			_, err := ParseMetric(scenario.input)
+			if err == nil {
+				t.Fatalf("expected error %q, got none", scenario.err)
+			}
+			if !strings.HasSuffix(err.Error(), scenario.err) {
+				t.Errorf("expected error ending in %q, got %q", scenario.err, err)
+			}
+		})
+	}
+}
+
+// TestParseMetricRoundTrip checks that ParseMetric is the inverse of
+// Metric.String for randomly generated metrics.
+func TestParseMetricRoundTrip(t *testing.T) {
+	// Runes that are special in the syntax or in Go string literals.
+	alphabet := []rune("abz_:09 .-{}=,\"\\\n\t\x00é花🔥")
+	randomString := func(r *rand.Rand, minLen int) string {
+		var b strings.Builder
+		for i := r.Intn(6) + minLen; i > 0; i-- {
+			b.WriteRune(alphabet[r.Intn(len(alphabet))])
+		}
+		return b.String()
+	}
+
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 2000; i++ {
+		m := Metric{}
+		if r.Intn(4) > 0 {
+			// Empty metric names are written like missing ones.
+			m[MetricNameLabel] = LabelValue(randomString(r, 1))
+		}
+		for j := r.Intn(4); j > 0; j-- {
+			m[LabelName(randomString(r, 1))] = LabelValue(randomString(r, 0))
+		}
+		if r.Intn(8) == 0 {
+			// An invalid UTF-8 value.
+			m["invalid"] = "\xff"
+		}
+
+		s := m.String()
+		got, err := ParseMetric(s)
+		if err != nil {
+			t.Fatalf("%d: unexpected error parsing %s: %s", i, s, err)
+		}
+		if !got.Equal(m) {
+			t.Fatalf("%d: round trip of %#v via %s resulted in %#v", i, m, s, got)
+		}
+	}
+}
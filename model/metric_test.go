@@ -14,12 +14,21 @@
 package model
 
 import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
 
 	"github.com/google/go-cmp/cmp"
 	"github.com/google/go-cmp/cmp/cmpopts"
 	dto "github.com/prometheus/client_model/go"
 	"google.golang.org/protobuf/proto"
+	"gopkg.in/yaml.v2"
 )
 
 func testMetric(t testing.TB) {
@@ -162,6 +171,278 @@ func TestMetricNameIsLegacyValid(t *testing.T) {
 	}
 }
 
+func TestUTF8NoControlValidation(t *testing.T) {
+	defer SetNameValidationScheme(LegacyValidation)
+
+	scenarios := []struct {
+		name           string
+		utf8Valid      bool
+		noControlValid bool
+	}{
+		{
+			name:           "valid_name",
+			utf8Valid:      true,
+			noControlValid: true,
+		},
+		{
+			name:           "utf8.name.花火",
+			utf8Valid:      true,
+			noControlValid: true,
+		},
+		{
+			name:           "new\nline",
+			utf8Valid:      true,
+			noControlValid: false,
+		},
+		{
+			name:           "nul\x00byte",
+			utf8Valid:      false,
+			noControlValid: false,
+		},
+		{
+			name:           "del\x7f",
+			utf8Valid:      true,
+			noControlValid: false,
+		},
+		{
+			name:           "c1\u0085control",
+			utf8Valid:      true,
+			noControlValid: false,
+		},
+		{
+			name:           "replacement\ufffdchar",
+			utf8Valid:      true,
+			noControlValid: false,
+		},
+		{
+			name:           "a\xc5z",
+			utf8Valid:      false,
+			noControlValid: false,
+		},
+		{
+			name:           "",
+			utf8Valid:      false,
+			noControlValid: false,
+		},
+	}
+
+	for _, s := range scenarios {
+		SetNameValidationScheme(UTF8Validation)
+		if IsValidMetricName(LabelValue(s.name)) != s.utf8Valid {
+			t.Errorf("expected %v for %q using UTF-8 IsValidMetricName", s.utf8Valid, s.name)
+		}
+		if LabelName(s.name).IsValid() != s.utf8Valid {
+			t.Errorf("expected %v for %q using UTF-8 LabelName.IsValid", s.utf8Valid, s.name)
+		}
+		SetNameValidationScheme(UTF8NoControlValidation)
+		if IsValidMetricName(LabelValue(s.name)) != s.noControlValid {
+			t.Errorf("expected %v for %q using UTF-8 without control characters IsValidMetricName", s.noControlValid, s.name)
+		}
+		if LabelName(s.name).IsValid() != s.noControlValid {
+			t.Errorf("expected %v for %q using UTF-8 without control characters LabelName.IsValid", s.noControlValid, s.name)
+		}
+	}
+}
+
+func TestIsValidLegacyLabelName(t *testing.T) {
+	for name, want := range map[LabelName]bool{
+		"foo_bar": true,
+		"_foo":    true,
+		"foo:bar": false,
+		":foo":    false,
+		"0foo":    false,
+		"foo.bar": false,
+		"":        false,
+	} {
+		if got := IsValidLegacyLabelName(name); got != want {
+			t.Errorf("expected %v for %q, got %v", want, name, got)
+		}
+	}
+}
+
+func TestValidateMetricName(t *testing.T) {
+	scenarios := []struct {
+		name   string
+		scheme ValidationScheme
+		input  LabelValue
+		err    string
+	}{
+		{name: "legacy valid", scheme: LegacyValidation, input: "http_requests:sum"},
+		{name: "legacy empty", scheme: LegacyValidation, input: "", err: `invalid metric name "": empty`},
+		{name: "legacy invalid character", scheme: LegacyValidation, input: "foo%bar", err: `invalid metric name "foo%bar": invalid character '%' at offset 3 (legacy validation)`},
+		{name: "legacy leading digit", scheme: LegacyValidation, input: "0foo", err: `invalid metric name "0foo": invalid character '0' at offset 0 (legacy validation)`},
+		{name: "legacy invalid UTF-8", scheme: LegacyValidation, input: "foo\xffbar", err: `invalid metric name "foo\xffbar": invalid UTF-8 at offset 3`},
+		{name: "utf8 valid", scheme: UTF8Validation, input: "foo%bar.花火"},
+		{name: "utf8 empty", scheme: UTF8Validation, input: "", err: `invalid metric name "": empty`},
+		{name: "utf8 invalid UTF-8", scheme: UTF8Validation, input: "hello\xff", err: `invalid metric name "hello\xff": invalid UTF-8 at offset 5`},
+		{name: "utf8 NUL byte", scheme: UTF8Validation, input: "nul\x00byte", err: `invalid metric name "nul\x00byte": NUL byte at offset 3`},
+		{name: "utf8 no control", scheme: UTF8NoControlValidation, input: "new\nline", err: `invalid metric name "new\nline": control character '\n' at offset 3`},
+	}
+
+	defer SetNameValidationScheme(GetNameValidationScheme())
+	for _, s := range scenarios {
+		t.Run(s.name, func(t *testing.T) {
+			SetNameValidationScheme(s.scheme)
+			err := ValidateMetricName(s.input)
+			if (err == nil) != IsValidMetricName(s.input) {
+				t.Errorf("ValidateMetricName returned %v, but IsValidMetricName returned %v", err, IsValidMetricName(s.input))
+			}
+			if s.err == "" {
+				if err != nil {
+					t.Errorf("expected no error, got %v", err)
+				}
+				return
+			}
+			if err == nil || err.Error() != s.err {
+				t.Errorf("expected error %s, got %v", s.err, err)
+			}
+			var nameErr *MetricNameValidationError
+			if !errors.As(err, &nameErr) || nameErr.Name != s.input {
+				t.Errorf("expected a MetricNameValidationError for %q, got %#v", s.input, err)
+			}
+		})
+	}
+}
+
+func TestIsValidWithScheme(t *testing.T) {
+	scenarios := []struct {
+		name              string
+		legacyMetricValid bool
+		legacyLabelValid  bool
+		utf8Valid         bool
+	}{
+		{name: "valid_name", legacyMetricValid: true, legacyLabelValid: true, utf8Valid: true},
+		{name: "colon:name", legacyMetricValid: true, legacyLabelValid: false, utf8Valid: true},
+		{name: "utf8.name.花火", legacyMetricValid: false, legacyLabelValid: false, utf8Valid: true},
+		{name: "0leading_digit", legacyMetricValid: false, legacyLabelValid: false, utf8Valid: true},
+		{name: "nul\x00byte", legacyMetricValid: false, legacyLabelValid: false, utf8Valid: false},
+		{name: "surrogate\xed\xa0\x80", legacyMetricValid: false, legacyLabelValid: false, utf8Valid: false},
+		{name: "a\xc5z", legacyMetricValid: false, legacyLabelValid: false, utf8Valid: false},
+		{name: "", legacyMetricValid: false, legacyLabelValid: false, utf8Valid: false},
+	}
+
+	// The global scheme must not influence the per-call variants.
+	defer SetNameValidationScheme(GetNameValidationScheme())
+	for _, global := range []ValidationScheme{LegacyValidation, UTF8Validation} {
+		SetNameValidationScheme(global)
+		for _, s := range scenarios {
+			if got := IsValidMetricNameWithScheme(LabelValue(s.name), LegacyValidation); got != s.legacyMetricValid {
+				t.Errorf("expected %v for %q using legacy IsValidMetricNameWithScheme, got %v", s.legacyMetricValid, s.name, got)
+			}
+			if got := IsValidMetricNameWithScheme(LabelValue(s.name), UTF8Validation); got != s.utf8Valid {
+				t.Errorf("expected %v for %q using UTF-8 IsValidMetricNameWithScheme, got %v", s.utf8Valid, s.name, got)
+			}
+			if got := LabelName(s.name).IsValidWithScheme(LegacyValidation); got != s.legacyLabelValid {
+				t.Errorf("expected %v for %q using legacy LabelName.IsValidWithScheme, got %v", s.legacyLabelValid, s.name, got)
+			}
+			if got := LabelName(s.name).IsValidWithScheme(UTF8Validation); got != s.utf8Valid {
+				t.Errorf("expected %v for %q using UTF-8 LabelName.IsValidWithScheme, got %v", s.utf8Valid, s.name, got)
+			}
+		}
+	}
+}
+
+func TestSetNameValidationSchemeConcurrently(t *testing.T) {
+	defer SetNameValidationScheme(LegacyValidation)
+
+	var wg sync.WaitGroup
+	done := make(chan struct{})
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		schemes := []ValidationScheme{LegacyValidation, UTF8Validation}
+		for i := 0; ; i++ {
+			select {
+			case <-done:
+				return
+			default:
+				SetNameValidationScheme(schemes[i%len(schemes)])
+			}
+		}
+	}()
+
+	for i := 0; i < 1000; i++ {
+		// Legacy-valid names are valid under all schemes, invalid UTF-8 under none.
+		if !IsValidMetricName("valid_name") || !LabelName("valid_name").IsValid() {
+			t.Errorf("expected legacy-valid name to be valid")
+		}
+		if IsValidMetricName("a\xc5z") || LabelName("a\xc5z").IsValid() {
+			t.Errorf("expected invalid UTF-8 name to be invalid")
+		}
+		if s := GetNameValidationScheme(); s != LegacyValidation && s != UTF8Validation {
+			t.Errorf("unexpected validation scheme %d", s)
+		}
+	}
+	close(done)
+	wg.Wait()
+
+	SetNameValidationScheme(UTF8Validation)
+	if !IsValidMetricName("utf8.name") {
+		t.Errorf("expected UTF-8 name to be valid after enabling UTF-8 validation")
+	}
+	SetNameValidationScheme(LegacyValidation)
+	if IsValidMetricName("utf8.name") {
+		t.Errorf("expected UTF-8 name to be invalid after enabling legacy validation")
+	}
+}
+
+func TestSetNameEscapingScheme(t *testing.T) {
+	old := GetNameEscapingScheme()
+	defer SetNameEscapingScheme(old)
+
+	SetNameEscapingScheme(DotsEscaping)
+	if s := GetNameEscapingScheme(); s != DotsEscaping {
+		t.Errorf("expected %v, got %v", DotsEscaping, s)
+	}
+	SetNameEscapingScheme(NoEscaping)
+	if s := GetNameEscapingScheme(); s != NoEscaping {
+		t.Errorf("expected %v, got %v", NoEscaping, s)
+	}
+}
+
+func TestNameValidation(t *testing.T) {
+	oldVars := NameValidation{Scheme: NameValidationScheme, EscapingScheme: NameEscapingScheme}
+	old := GetNameValidation()
+	defer func() {
+		NameValidationScheme, NameEscapingScheme = oldVars.Scheme, oldVars.EscapingScheme
+		SetNameValidation(old)
+	}()
+	NameValidationScheme, NameEscapingScheme = LegacyValidation, ValueEncodingEscaping
+
+	c := NameValidation{Scheme: UTF8Validation, EscapingScheme: DotsEscaping}
+	SetNameValidation(c)
+	if got := GetNameValidation(); got != c {
+		t.Errorf("expected %+v, got %+v", c, got)
+	}
+	if got := NameValidationSchemeValue(); got != UTF8Validation {
+		t.Errorf("expected %s, got %s", UTF8Validation, got)
+	}
+
+	// Assigning the deprecated variables after the setters still works.
+	NameValidationScheme = UTF8NoControlValidation
+	NameEscapingScheme = UnderscoreEscaping
+	if got := GetNameValidationScheme(); got != UTF8NoControlValidation {
+		t.Errorf("expected %s after assigning NameValidationScheme, got %s", UTF8NoControlValidation, got)
+	}
+	if got := GetNameEscapingScheme(); got != UnderscoreEscaping {
+		t.Errorf("expected %s after assigning NameEscapingScheme, got %s", UnderscoreEscaping, got)
+	}
+	// Even if a variable is assigned its value at the time of the last call
+	// of the setter again.
+	NameValidationScheme = LegacyValidation
+	NameEscapingScheme = ValueEncodingEscaping
+	if got := GetNameValidation(); got != (NameValidation{Scheme: LegacyValidation, EscapingScheme: ValueEncodingEscaping}) {
+		t.Errorf("expected the values of the variables, got %+v", got)
+	}
+
+	// The setters take over again.
+	SetNameValidationScheme(UTF8Validation)
+	SetNameEscapingScheme(NoEscaping)
+	if got := GetNameValidation(); got != (NameValidation{Scheme: UTF8Validation, EscapingScheme: NoEscaping}) {
+		t.Errorf("expected the values of the setters, got %+v", got)
+	}
+}
+
 func TestMetricClone(t *testing.T) {
 	m := Metric{
 		"first_name":   "electro",
@@ -183,6 +464,52 @@ func TestMetricClone(t *testing.T) {
 	}
 }
 
+func TestMetricRename(t *testing.T) {
+	defer SetNameValidationScheme(LegacyValidation)
+
+	m := Metric{
+		MetricNameLabel: "old_name",
+		"job":           "robot",
+	}
+
+	SetNameValidationScheme(LegacyValidation)
+	renamed, err := m.Rename("new_name")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if expected := (Metric{MetricNameLabel: "new_name", "job": "robot"}); !renamed.Equal(expected) {
+		t.Errorf("expected %v, got %v", expected, renamed)
+	}
+	if m[MetricNameLabel] != "old_name" {
+		t.Errorf("expected original metric to be unchanged, got %v", m)
+	}
+
+	if _, err := m.Rename("dotted.name"); err == nil {
+		t.Errorf("expected error renaming to dotted name under legacy validation")
+	}
+	if renamed := m.RenameUnchecked("dotted.name"); renamed[MetricNameLabel] != "dotted.name" {
+		t.Errorf("expected unchecked rename to dotted name, got %v", renamed)
+	}
+
+	SetNameValidationScheme(UTF8Validation)
+	renamed, err = m.Rename("dotted.name")
+	if err != nil {
+		t.Fatalf("unexpected error under UTF-8 validation: %s", err)
+	}
+	if renamed[MetricNameLabel] != "dotted.name" {
+		t.Errorf("expected rename to dotted name, got %v", renamed)
+	}
+
+	// Renaming a metric without name adds the name.
+	renamed, err = Metric{"job": "robot"}.Rename("new_name")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if expected := (Metric{MetricNameLabel: "new_name", "job": "robot"}); !renamed.Equal(expected) {
+		t.Errorf("expected %v, got %v", expected, renamed)
+	}
+}
+
 func TestMetricToString(t *testing.T) {
 	scenarios := []struct {
 		name     string
@@ -219,6 +546,46 @@ func TestMetricToString(t *testing.T) {
 			input:    Metric{},
 			expected: "{}",
 		},
+		{
+			name: "dotted metric name",
+			input: Metric{
+				"__name__": "my.metric",
+				"foo":      "bar",
+			},
+			expected: `{"my.metric", foo="bar"}`,
+		},
+		{
+			name: "metric name with space and no labels",
+			input: Metric{
+				"__name__": "my metric",
+			},
+			expected: `{"my metric"}`,
+		},
+		{
+			name: "metric name with braces",
+			input: Metric{
+				"__name__": "my metric{}",
+				"foo":      "bar",
+			},
+			expected: `{"my metric{}", foo="bar"}`,
+		},
+		{
+			name: "utf-8 label names",
+			input: Metric{
+				"__name__":  "legacy_name",
+				"label.one": "a",
+				"label two": "b",
+				"three":     "c",
+			},
+			expected: `legacy_name{"label two"="b", "label.one"="a", three="c"}`,
+		},
+		{
+			name: "utf-8 label name without metric name",
+			input: Metric{
+				"label.one": "a",
+			},
+			expected: `{"label.one"="a"}`,
+		},
 	}
 
 	for _, scenario := range scenarios {
@@ -279,6 +646,22 @@ func TestEscapeName(t *testing.T) {
 			expectedUnescapedDots: "_",
 			expectedValue:         "U___82b1__706b_",
 		},
+		{
+			name:                  "name with unicode characters >= 0x10000",
+			input:                 "requests.🔥_total",
+			expectedUnderscores:   "requests___total",
+			expectedDots:          "requests_dot____total",
+			expectedUnescapedDots: "requests.__total",
+			expectedValue:         "U__requests_2e__01f525___total",
+		},
+		{
+			name:                  "name with the maximum unicode character",
+			input:                 "max\U0010FFFF",
+			expectedUnderscores:   "max_",
+			expectedDots:          "max_",
+			expectedUnescapedDots: "max_",
+			expectedValue:         "U__max_10ffff_",
+		},
 	}
 
 	for _, scenario := range scenarios {
@@ -315,144 +698,675 @@ func TestEscapeName(t *testing.T) {
 	}
 }
 
-func TestValueUnescapeErrors(t *testing.T) {
+func TestIsQuotedName(t *testing.T) {
 	scenarios := []struct {
 		name     string
-		input    string
-		expected string
+		expected bool
+	}{
+		{name: `"foo.bar"`, expected: true},
+		{name: `"花火"`, expected: true},
+		{name: `"with \"quotes\""`, expected: true},
+		{name: `""`, expected: true},
+		{name: `foo.bar`},
+		{name: `foo_bar`},
+		{name: `"`},
+		{name: `"foo`},
+		{name: `foo"`},
+		{name: `"foo"bar"`},
+		{name: `"foo\"`},
+		{name: ``},
+	}
+	for _, s := range scenarios {
+		if got := IsQuotedName(s.name); got != s.expected {
+			t.Errorf("IsQuotedName(%s) = %t, expected %t", s.name, got, s.expected)
+		}
+	}
+}
+
+func TestEscapeNameStrict(t *testing.T) {
+	if _, err := EscapeNameStrict(`"foo.bar"`, ValueEncodingEscaping); err == nil {
+		t.Errorf("expected an error for a quoted name")
+	}
+	for _, scheme := range []EscapingScheme{NoEscaping, UnderscoreEscaping, DotsEscaping, ValueEncodingEscaping, PercentEscaping} {
+		for _, name := range []string{"foo.bar", "foo_bar", `foo"bar`, ""} {
+			got, err := EscapeNameStrict(name, scheme)
+			if err != nil {
+				t.Errorf("%s: unexpected error for %q: %s", scheme, name, err)
+			}
+			if want := EscapeName(name, scheme); got != want {
+				t.Errorf("%s: EscapeNameStrict(%q) = %q, expected %q", scheme, name, got, want)
+			}
+		}
+	}
+}
+
+func TestEscapeNameProducesLegacyValidNames(t *testing.T) {
+	scenarios := []struct {
+		name                string
+		input               string
+		expectedUnderscores string
+		expectedDots        string
+		expectedValue       string
 	}{
 		{
-			name: "empty string",
-		},
-		{
-			name:     "basic case, no error",
-			input:    "U__no:unescapingrequired",
-			expected: "no:unescapingrequired",
-		},
-		{
-			name:     "capitals ok, no error",
-			input:    "U__capitals_2E_ok",
-			expected: "capitals.ok",
-		},
-		{
-			name:     "underscores, no error",
-			input:    "U__underscores__doubled__",
-			expected: "underscores_doubled_",
-		},
-		{
-			name:     "invalid single underscore",
-			input:    "U__underscores_doubled_",
-			expected: "U__underscores_doubled_",
+			name:                "leading digit",
+			input:               "0abc",
+			expectedUnderscores: "_abc",
+			expectedDots:        "_abc",
+			expectedValue:       "U___30_abc",
 		},
 		{
-			name:     "invalid single underscore, 2",
-			input:    "U__underscores__doubled_",
-			expected: "U__underscores__doubled_",
+			name:                "leading digit followed by dot",
+			input:               "0.5quantile",
+			expectedUnderscores: "__5quantile",
+			expectedDots:        "__dot_5quantile",
+			expectedValue:       "U___30__2e_5quantile",
 		},
 		{
-			name:     "giant fake utf-8 code",
-			input:    "U__my__hack_2e_attempt_872348732fabdabbab_",
-			expected: "U__my__hack_2e_attempt_872348732fabdabbab_",
+			name:                "leading dot",
+			input:               ".5quantile",
+			expectedUnderscores: "_5quantile",
+			expectedDots:        "_dot_5quantile",
+			expectedValue:       "U___2e_5quantile",
 		},
 		{
-			name:     "trailing utf-8",
-			input:    "U__my__hack_2e",
-			expected: "U__my__hack_2e",
+			name:                "multi-byte leading rune followed by digit",
+			input:               "é9metric",
+			expectedUnderscores: "_9metric",
+			expectedDots:        "_9metric",
+			expectedValue:       "U___e9_9metric",
 		},
 		{
-			name:     "invalid utf-8 value",
-			input:    "U__bad__utf_2eg_",
-			expected: "U__bad__utf_2eg_",
+			name:                "multi-byte rune followed by digit",
+			input:               "a花9",
+			expectedUnderscores: "a_9",
+			expectedDots:        "a_9",
+			expectedValue:       "U__a_82b1_9",
 		},
 		{
-			name:     "surrogate utf-8 value",
-			input:    "U__bad__utf_D900_",
-			expected: "U__bad__utf_D900_",
+			name:                "leading underscore",
+			input:               "_5quantile",
+			expectedUnderscores: "_5quantile",
+			expectedDots:        "__5quantile",
+			expectedValue:       "_5quantile",
 		},
 	}
 
 	for _, scenario := range scenarios {
 		t.Run(scenario.name, func(t *testing.T) {
-			got := UnescapeName(scenario.input, ValueEncodingEscaping)
-			if got != scenario.expected {
-				t.Errorf("expected unescaped string output %s but got %s", scenario.expected, got)
+			for scheme, expected := range map[EscapingScheme]string{
+				UnderscoreEscaping:    scenario.expectedUnderscores,
+				DotsEscaping:          scenario.expectedDots,
+				ValueEncodingEscaping: scenario.expectedValue,
+			} {
+				got := EscapeName(scenario.input, scheme)
+				if got != expected {
+					t.Errorf("%s: expected string output %s but got %s", scheme, expected, got)
+				}
+				if !IsValidLegacyMetricName(got) {
+					t.Errorf("%s: escaped output %s is not a valid legacy metric name", scheme, got)
+				}
 			}
 		})
 	}
 }
 
-func TestEscapeMetricFamily(t *testing.T) {
+func TestEscapeLabelName(t *testing.T) {
 	scenarios := []struct {
-		name     string
-		input    *dto.MetricFamily
-		scheme   EscapingScheme
-		expected *dto.MetricFamily
+		name                string
+		input               string
+		expectedUnderscores string
+		expectedDots        string
+		expectedValue       string
+		expectedPercent     string
 	}{
 		{
-			name:     "empty",
-			input:    &dto.MetricFamily{},
-			scheme:   ValueEncodingEscaping,
-			expected: &dto.MetricFamily{},
+			name:                "colon",
+			input:               "foo:bar",
+			expectedUnderscores: "foo_bar",
+			expectedDots:        "foo_bar",
+			expectedValue:       "U__foo_3a_bar",
+			expectedPercent:     "foo%3Abar",
 		},
 		{
-			name:   "simple, no escaping needed",
-			scheme: ValueEncodingEscaping,
-			input: &dto.MetricFamily{
-				Name: proto.String("my_metric"),
-				Help: proto.String("some help text"),
-				Type: dto.MetricType_COUNTER.Enum(),
-				Metric: []*dto.Metric{
-					{
-						Counter: &dto.Counter{
-							Value: proto.Float64(34.2),
-						},
-						Label: []*dto.LabelPair{
-							{
-								Name:  proto.String("__name__"),
-								Value: proto.String("my_metric"),
-							},
-							{
-								Name:  proto.String("some_label"),
-								Value: proto.String("labelvalue"),
-							},
-						},
-					},
-				},
-			},
-			expected: &dto.MetricFamily{
-				Name: proto.String("my_metric"),
-				Help: proto.String("some help text"),
-				Type: dto.MetricType_COUNTER.Enum(),
-				Metric: []*dto.Metric{
-					{
-						Counter: &dto.Counter{
-							Value: proto.Float64(34.2),
-						},
-						Label: []*dto.LabelPair{
-							{
-								Name:  proto.String("__name__"),
-								Value: proto.String("my_metric"),
-							},
-							{
-								Name:  proto.String("some_label"),
-								Value: proto.String("labelvalue"),
-							},
-						},
-					},
-				},
-			},
+			name:                "colon and dot",
+			input:               "foo:bar.baz",
+			expectedUnderscores: "foo_bar_baz",
+			expectedDots:        "foo_bar_dot_baz",
+			expectedValue:       "U__foo_3a_bar_2e_baz",
+			expectedPercent:     "foo%3Abar%2Ebaz",
 		},
 		{
-			name:   "label name escaping needed",
-			scheme: ValueEncodingEscaping,
-			input: &dto.MetricFamily{
-				Name: proto.String("my_metric"),
-				Help: proto.String("some help text"),
-				Type: dto.MetricType_COUNTER.Enum(),
-				Metric: []*dto.Metric{
-					{
-						Counter: &dto.Counter{
-							Value: proto.Float64(34.2),
+			name:                "legacy valid",
+			input:               "foo_bar",
+			expectedUnderscores: "foo_bar",
+			expectedDots:        "foo__bar",
+			expectedValue:       "foo_bar",
+			expectedPercent:     "foo_bar",
+		},
+	}
+
+	for _, scenario := range scenarios {
+		t.Run(scenario.name, func(t *testing.T) {
+			for scheme, expected := range map[EscapingScheme]string{
+				NoEscaping:            scenario.input,
+				UnderscoreEscaping:    scenario.expectedUnderscores,
+				DotsEscaping:          scenario.expectedDots,
+				ValueEncodingEscaping: scenario.expectedValue,
+				PercentEscaping:       scenario.expectedPercent,
+			} {
+				got := EscapeLabelName(scenario.input, scheme)
+				if got != expected {
+					t.Errorf("%s: expected string output %s but got %s", scheme, expected, got)
+				}
+				if scheme != NoEscaping && scheme != PercentEscaping && !LabelNameRE.MatchString(got) {
+					t.Errorf("%s: escaped output %s is not a valid legacy label name", scheme, got)
+				}
+			}
+		})
+	}
+
+	// Under metric name rules, ':' is valid and therefore preserved.
+	for _, scheme := range []EscapingScheme{UnderscoreEscaping, ValueEncodingEscaping, PercentEscaping} {
+		if got := EscapeName("foo:bar", scheme); got != "foo:bar" {
+			t.Errorf("%s: expected metric name foo:bar to be preserved but got %s", scheme, got)
+		}
+	}
+}
+
+func TestEscapeNameLegacyNoAllocs(t *testing.T) {
+	for _, scheme := range []EscapingScheme{UnderscoreEscaping, ValueEncodingEscaping} {
+		allocs := testing.AllocsPerRun(100, func() {
+			if EscapeName("http_requests_total:sum", scheme) != "http_requests_total:sum" {
+				t.Fatalf("%s: legacy-valid name was modified", scheme)
+			}
+		})
+		if allocs != 0 {
+			t.Errorf("%s: expected no allocations for legacy-valid name, got %v", scheme, allocs)
+		}
+	}
+
+	// DotsEscaping leaves legacy-valid names without underscores unchanged.
+	allocs := testing.AllocsPerRun(100, func() {
+		if EscapeName("httpRequestsTotal:sum", DotsEscaping) != "httpRequestsTotal:sum" {
+			t.Fatalf("legacy-valid name without underscores was modified")
+		}
+		if EscapeLabelName("statusCode", DotsEscaping) != "statusCode" {
+			t.Fatalf("legacy-valid label name without underscores was modified")
+		}
+	})
+	if allocs != 0 {
+		t.Errorf("%s: expected no allocations for legacy-valid name without underscores, got %v", DotsEscaping, allocs)
+	}
+}
+
+func BenchmarkEscapeNameLegacy(b *testing.B) {
+	for _, scheme := range []EscapingScheme{UnderscoreEscaping, ValueEncodingEscaping} {
+		b.Run(scheme.String(), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				EscapeName("http_requests_total:sum", scheme)
+			}
+		})
+	}
+	// DotsEscaping changes underscores, so only names without them are
+	// left alone.
+	b.Run(DotsEscaping.String(), func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			EscapeName("httpRequestsTotal:sum", DotsEscaping)
+		}
+	})
+}
+
+// escapeUnderscoresTwoPass is the previous implementation of UnderscoreEscaping
+// in EscapeName, kept as a baseline for BenchmarkEscapeNameUnderscores.
+func escapeUnderscoresTwoPass(name string) string {
+	if IsValidLegacyMetricName(name) {
+		return name
+	}
+	var escaped strings.Builder
+	for i, b := range name {
+		if isValidLegacyRune(b, i) {
+			escaped.WriteRune(b)
+		} else {
+			escaped.WriteRune('_')
+		}
+	}
+	return escaped.String()
+}
+
+// BenchmarkEscapeNameUnderscores compares the single-pass UnderscoreEscaping
+// against the previous two-pass implementation on a long mixed name. The
+// single-pass variant allocates exactly once, while the two-pass variant
+// reallocates its builder several times as it grows.
+func BenchmarkEscapeNameUnderscores(b *testing.B) {
+	name := strings.Repeat("http.server_requests-花火:", 256/len("http.server_requests-花火:")+1)[:256]
+	if got, want := EscapeName(name, UnderscoreEscaping), escapeUnderscoresTwoPass(name); got != want {
+		b.Fatalf("single-pass result %q differs from two-pass result %q", got, want)
+	}
+	b.Run("two-pass", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			escapeUnderscoresTwoPass(name)
+		}
+	})
+	b.Run("single-pass", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			EscapeName(name, UnderscoreEscaping)
+		}
+	})
+}
+
+func TestEscapeNameLongNames(t *testing.T) {
+	// One rune of each kind that the schemes treat differently, including
+	// invalid UTF-8 and runes of all encoded lengths.
+	unit := "a_.-:9é花\xff😀"
+	for _, scheme := range []EscapingScheme{UnderscoreEscaping, DotsEscaping, ValueEncodingEscaping, PercentEscaping} {
+		short := EscapeName(unit, scheme)
+		name := strings.Repeat(unit, 10000)
+		var got string
+		allocs := testing.AllocsPerRun(10, func() {
+			got = EscapeName(name, scheme)
+		})
+		if allocs != 1 {
+			t.Errorf("%s: expected a single allocation, got %v", scheme, allocs)
+		}
+		// Escaping is independent of the context of a rune, except for the
+		// prefix of ValueEncodingEscaping.
+		prefix := ""
+		if scheme == ValueEncodingEscaping {
+			prefix = "U__"
+		}
+		if want := prefix + strings.Repeat(strings.TrimPrefix(short, prefix), 10000); got != want {
+			t.Errorf("%s: unexpected result for long name", scheme)
+		}
+	}
+
+	for _, scheme := range []EscapingScheme{DotsEscaping, ValueEncodingEscaping, PercentEscaping} {
+		// These names are all escaped, so escapedNameLen has to be exact.
+		for _, n := range []string{".", "9", "-", "é", "\xff", "😀", unit} {
+			if got, want := escapedNameLen(n, scheme, isValidLegacyRune), len(EscapeName(n, scheme)); got != want {
+				t.Errorf("%s: escapedNameLen(%q) = %d, but escaped name has length %d", scheme, n, got, want)
+			}
+		}
+	}
+}
+
+// BenchmarkEscapeNameLong shows that escaping scales linearly with the length
+// of the name.
+func BenchmarkEscapeNameLong(b *testing.B) {
+	for _, size := range []int{1 << 10, 1 << 20} {
+		name := strings.Repeat("http.server_requests-花火:", size/len("http.server_requests-花火:")+1)[:size]
+		for _, scheme := range []EscapingScheme{DotsEscaping, ValueEncodingEscaping, PercentEscaping} {
+			b.Run(fmt.Sprintf("%s/%d", scheme, size), func(b *testing.B) {
+				b.ReportAllocs()
+				b.SetBytes(int64(size))
+				for i := 0; i < b.N; i++ {
+					EscapeName(name, scheme)
+				}
+			})
+		}
+	}
+}
+
+func TestEscapeNameMultiByteLeadingRune(t *testing.T) {
+	// The digit following a multi-byte leading rune is at a byte offset > 1
+	// but is not the first rune, so it is kept by all schemes.
+	for scheme, expected := range map[EscapingScheme]string{
+		NoEscaping:            "é9metric",
+		UnderscoreEscaping:    "_9metric",
+		DotsEscaping:          "_9metric",
+		ValueEncodingEscaping: "U___e9_9metric",
+		PercentEscaping:       "%C3%A99metric",
+	} {
+		if got := EscapeName("é9metric", scheme); got != expected {
+			t.Errorf("%s: expected %s, got %s", scheme, expected, got)
+		}
+		if got := EscapeLabelName("é9metric", scheme); got != expected {
+			t.Errorf("%s: expected label name %s, got %s", scheme, expected, got)
+		}
+	}
+	if IsValidLegacyMetricName("é9metric") {
+		t.Errorf("expected é9metric not to be a valid legacy metric name")
+	}
+}
+
+func TestCheckRoundTripSafe(t *testing.T) {
+	names := []string{
+		"legacy_name",
+		"http.requests",
+		"http-requests",
+		"花火",
+		"no:escaping_required",
+	}
+
+	if unsafe := CheckRoundTripSafe(names, ValueEncodingEscaping); len(unsafe) != 0 {
+		t.Errorf("expected all names to round-trip with value encoding, got unsafe names %v", unsafe)
+	}
+	if unsafe := CheckRoundTripSafe(names, NoEscaping); len(unsafe) != 0 {
+		t.Errorf("expected all names to round-trip without escaping, got unsafe names %v", unsafe)
+	}
+
+	// "http.requests" and "http-requests" both become "http_requests".
+	expected := []string{"http.requests", "http-requests", "花火"}
+	if unsafe := CheckRoundTripSafe(names, UnderscoreEscaping); !cmp.Equal(unsafe, expected) {
+		t.Errorf("expected unsafe names %v with underscore escaping, got %v", expected, unsafe)
+	}
+
+	// Legacy-valid names that look value-encoded are not left intact.
+	expected = []string{"U__http_2e_requests"}
+	if unsafe := CheckRoundTripSafe([]string{"U__http_2e_requests", "legacy_name"}, ValueEncodingEscaping); !cmp.Equal(unsafe, expected) {
+		t.Errorf("expected unsafe names %v with value encoding, got %v", expected, unsafe)
+	}
+}
+
+func TestDetectEscaping(t *testing.T) {
+	scenarios := []struct {
+		name     string
+		expected EscapingScheme
+	}{
+		{name: "U__my_2e_metric", expected: ValueEncodingEscaping},
+		{name: "U__", expected: ValueEncodingEscaping},
+		{name: "my%2Emetric", expected: PercentEscaping},
+		{name: "my%2emetric", expected: PercentEscaping},
+		{name: "my_dot_metric", expected: DotsEscaping},
+		{name: "my.metric", expected: NoEscaping},
+		{name: "花火", expected: NoEscaping},
+		{name: "100%", expected: NoEscaping},
+		{name: "my%zzmetric", expected: NoEscaping},
+		// Ambiguous names result in the documented default.
+		{name: "my_metric", expected: UnderscoreEscaping},
+		{name: "my:metric", expected: UnderscoreEscaping},
+		{name: "", expected: UnderscoreEscaping},
+	}
+
+	for _, scenario := range scenarios {
+		if got := DetectEscaping(scenario.name); got != scenario.expected {
+			t.Errorf("%q: expected %s, got %s", scenario.name, scenario.expected, got)
+		}
+	}
+
+	// Detected schemes reverse the escaping of clearly marked names.
+	for _, scheme := range []EscapingScheme{DotsEscaping, ValueEncodingEscaping, PercentEscaping} {
+		escaped := EscapeName("my.metric", scheme)
+		if got := UnescapeName(escaped, DetectEscaping(escaped)); got != "my.metric" {
+			t.Errorf("%s: expected %q to unescape to my.metric with the detected scheme, got %q", scheme, escaped, got)
+		}
+	}
+}
+
+func TestGraphiteEscape(t *testing.T) {
+	scenarios := []struct {
+		name     string
+		input    string
+		expected string
+	}{
+		{
+			name: "empty string",
+		},
+		{
+			name:     "no escaping required",
+			input:    "http_requests:rate-5m",
+			expected: "http_requests:rate-5m",
+		},
+		{
+			name:     "dots",
+			input:    "mysystem.prod.cpu",
+			expected: "mysystem%2Eprod%2Ecpu",
+		},
+		{
+			name:     "spaces",
+			input:    "my metric name",
+			expected: "my%20metric%20name",
+		},
+		{
+			name:     "slashes",
+			input:    "/var/log",
+			expected: "%2Fvar%2Flog",
+		},
+		{
+			name:     "graphite symbols",
+			input:    `a(b){c},d=e'f"g\h`,
+			expected: "a%28b%29%7Bc%7D%2Cd%3De%27f%22g%5Ch",
+		},
+		{
+			name:     "multi-byte runes",
+			input:    "花火",
+			expected: "%E8%8A%B1%E7%81%AB",
+		},
+	}
+
+	for _, scenario := range scenarios {
+		t.Run(scenario.name, func(t *testing.T) {
+			got := GraphiteEscape(scenario.input)
+			if got != scenario.expected {
+				t.Errorf("expected string output %s but got %s", scenario.expected, got)
+			}
+			// The escaped output must not contain any Graphite-unsafe characters.
+			if strings.ContainsAny(got, " ./(){},='\"\\") {
+				t.Errorf("escaped output %s still contains graphite-unsafe characters", got)
+			}
+		})
+	}
+}
+
+func TestPercentEscaping(t *testing.T) {
+	scenarios := []struct {
+		name     string
+		input    string
+		expected string
+	}{
+		{
+			name: "empty string",
+		},
+		{
+			name:     "legacy valid name",
+			input:    "no:escaping_required",
+			expected: "no:escaping_required",
+		},
+		{
+			name:     "name with dots",
+			input:    "http.requests.total",
+			expected: "http%2Erequests%2Etotal",
+		},
+		{
+			name:     "leading digit",
+			input:    "0abc",
+			expected: "%30abc",
+		},
+		{
+			name:     "literal percent sign",
+			input:    "100%.used",
+			expected: "%3100%25%2Eused",
+		},
+		{
+			name:     "multibyte runes",
+			input:    "花火_total",
+			expected: "%E8%8A%B1%E7%81%AB_total",
+		},
+		{
+			name:     "invalid utf-8",
+			input:    "bad\xffname",
+			expected: "bad%FFname",
+		},
+	}
+
+	for _, scenario := range scenarios {
+		t.Run(scenario.name, func(t *testing.T) {
+			got := EscapeName(scenario.input, PercentEscaping)
+			if got != scenario.expected {
+				t.Errorf("expected string output %s but got %s", scenario.expected, got)
+			}
+			got = UnescapeName(got, PercentEscaping)
+			if got != scenario.input {
+				t.Errorf("expected unescaped string output %s but got %s", scenario.input, got)
+			}
+		})
+	}
+
+	// Malformed escape sequences leave the input untouched.
+	for _, input := range []string{"foo%", "foo%2", "foo%zz"} {
+		if got := UnescapeName(input, PercentEscaping); got != input {
+			t.Errorf("expected %s to be returned unchanged, got %s", input, got)
+		}
+	}
+
+	// PercentEscaping is not an escaping scheme of the exposition formats.
+	if _, err := ToEscapingScheme(PercentEscaping.String()); err == nil {
+		t.Errorf("expected escaping term %s to be rejected", PercentEscaping)
+	}
+}
+
+func TestValueUnescapeErrors(t *testing.T) {
+	scenarios := []struct {
+		name     string
+		input    string
+		expected string
+	}{
+		{
+			name: "empty string",
+		},
+		{
+			name:     "basic case, no error",
+			input:    "U__no:unescapingrequired",
+			expected: "no:unescapingrequired",
+		},
+		{
+			name:     "capitals ok, no error",
+			input:    "U__capitals_2E_ok",
+			expected: "capitals.ok",
+		},
+		{
+			name:     "underscores, no error",
+			input:    "U__underscores__doubled__",
+			expected: "underscores_doubled_",
+		},
+		{
+			name:     "invalid single underscore",
+			input:    "U__underscores_doubled_",
+			expected: "U__underscores_doubled_",
+		},
+		{
+			name:     "invalid single underscore, 2",
+			input:    "U__underscores__doubled_",
+			expected: "U__underscores__doubled_",
+		},
+		{
+			name:     "giant fake utf-8 code",
+			input:    "U__my__hack_2e_attempt_872348732fabdabbab_",
+			expected: "U__my__hack_2e_attempt_872348732fabdabbab_",
+		},
+		{
+			name:     "supplementary plane utf-8 code",
+			input:    "U__fire_01f525_",
+			expected: "fire🔥",
+		},
+		{
+			name:     "too long utf-8 code",
+			input:    "U__fire_001f525_",
+			expected: "U__fire_001f525_",
+		},
+		{
+			name:     "trailing utf-8",
+			input:    "U__my__hack_2e",
+			expected: "U__my__hack_2e",
+		},
+		{
+			name:     "invalid utf-8 value",
+			input:    "U__bad__utf_2eg_",
+			expected: "U__bad__utf_2eg_",
+		},
+		{
+			name:     "surrogate utf-8 value",
+			input:    "U__bad__utf_D900_",
+			expected: "U__bad__utf_D900_",
+		},
+	}
+
+	for _, scenario := range scenarios {
+		t.Run(scenario.name, func(t *testing.T) {
+			got := UnescapeName(scenario.input, ValueEncodingEscaping)
+			if got != scenario.expected {
+				t.Errorf("expected unescaped string output %s but got %s", scenario.expected, got)
+			}
+		})
+	}
+}
+
+func TestEscapeMetricFamily(t *testing.T) {
+	scenarios := []struct {
+		name     string
+		input    *dto.MetricFamily
+		scheme   EscapingScheme
+		expected *dto.MetricFamily
+	}{
+		{
+			name:     "empty",
+			input:    &dto.MetricFamily{},
+			scheme:   ValueEncodingEscaping,
+			expected: &dto.MetricFamily{},
+		},
+		{
+			name:   "simple, no escaping needed",
+			scheme: ValueEncodingEscaping,
+			input: &dto.MetricFamily{
+				Name: proto.String("my_metric"),
+				Help: proto.String("some help text"),
+				Type: dto.MetricType_COUNTER.Enum(),
+				Metric: []*dto.Metric{
+					{
+						Counter: &dto.Counter{
+							Value: proto.Float64(34.2),
+						},
+						Label: []*dto.LabelPair{
+							{
+								Name:  proto.String("__name__"),
+								Value: proto.String("my_metric"),
+							},
+							{
+								Name:  proto.String("some_label"),
+								Value: proto.String("labelvalue"),
+							},
+						},
+					},
+				},
+			},
+			expected: &dto.MetricFamily{
+				Name: proto.String("my_metric"),
+				Help: proto.String("some help text"),
+				Type: dto.MetricType_COUNTER.Enum(),
+				Metric: []*dto.Metric{
+					{
+						Counter: &dto.Counter{
+							Value: proto.Float64(34.2),
+						},
+						Label: []*dto.LabelPair{
+							{
+								Name:  proto.String("__name__"),
+								Value: proto.String("my_metric"),
+							},
+							{
+								Name:  proto.String("some_label"),
+								Value: proto.String("labelvalue"),
+							},
+						},
+					},
+				},
+			},
+		},
+		{
+			name:   "label name escaping needed",
+			scheme: ValueEncodingEscaping,
+			input: &dto.MetricFamily{
+				Name: proto.String("my_metric"),
+				Help: proto.String("some help text"),
+				Type: dto.MetricType_COUNTER.Enum(),
+				Metric: []*dto.Metric{
+					{
+						Counter: &dto.Counter{
+							Value: proto.Float64(34.2),
 						},
 						Label: []*dto.LabelPair{
 							{
@@ -521,89 +1435,797 @@ func TestEscapeMetricFamily(t *testing.T) {
 				Type: dto.MetricType_COUNTER.Enum(),
 				Metric: []*dto.Metric{
 					{
-						Counter: &dto.Counter{
-							Value: proto.Float64(34.2),
-						},
-						Label: []*dto.LabelPair{
-							{
-								Name:  proto.String("__name__"),
-								Value: proto.String("U__my_2e_metric"),
-							},
-							{
-								Name:  proto.String("U__some_3f_label"),
-								Value: proto.String("label??value"),
-							},
-						},
+						Counter: &dto.Counter{
+							Value: proto.Float64(34.2),
+						},
+						Label: []*dto.LabelPair{
+							{
+								Name:  proto.String("__name__"),
+								Value: proto.String("U__my_2e_metric"),
+							},
+							{
+								Name:  proto.String("U__some_3f_label"),
+								Value: proto.String("label??value"),
+							},
+						},
+					},
+				},
+			},
+		},
+		{
+			name:   "gauge, escaping needed",
+			scheme: DotsEscaping,
+			input: &dto.MetricFamily{
+				Name: proto.String("unicode.and.dots.花火"),
+				Help: proto.String("some help text"),
+				Type: dto.MetricType_GAUGE.Enum(),
+				Metric: []*dto.Metric{
+					{
+						Gauge: &dto.Gauge{
+							Value: proto.Float64(34.2),
+						},
+						Label: []*dto.LabelPair{
+							{
+								Name:  proto.String("__name__"),
+								Value: proto.String("unicode.and.dots.花火"),
+							},
+							{
+								Name:  proto.String("some_label"),
+								Value: proto.String("label??value"),
+							},
+						},
+					},
+				},
+			},
+			expected: &dto.MetricFamily{
+				Name: proto.String("unicode_dot_and_dot_dots_dot___"),
+				Help: proto.String("some help text"),
+				Type: dto.MetricType_GAUGE.Enum(),
+				Metric: []*dto.Metric{
+					{
+						Gauge: &dto.Gauge{
+							Value: proto.Float64(34.2),
+						},
+						Label: []*dto.LabelPair{
+							{
+								Name:  proto.String("__name__"),
+								Value: proto.String("unicode_dot_and_dot_dots_dot___"),
+							},
+							{
+								Name:  proto.String("some_label"),
+								Value: proto.String("label??value"),
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+
+	unexportList := []interface{}{dto.MetricFamily{}, dto.Metric{}, dto.LabelPair{}, dto.Counter{}, dto.Gauge{}}
+
+	for _, scenario := range scenarios {
+		t.Run(scenario.name, func(t *testing.T) {
+			original := proto.Clone(scenario.input)
+			got := EscapeMetricFamily(scenario.input, scenario.scheme)
+			if !cmp.Equal(scenario.expected, got, cmpopts.IgnoreUnexported(unexportList...)) {
+				t.Errorf("unexpected difference in escaped output:" + cmp.Diff(scenario.expected, got, cmpopts.IgnoreUnexported(unexportList...)))
+			}
+			if !cmp.Equal(scenario.input, original, cmpopts.IgnoreUnexported(unexportList...)) {
+				t.Errorf("input was mutated during escaping" + cmp.Diff(scenario.expected, got, cmpopts.IgnoreUnexported(unexportList...)))
+			}
+			inPlace := proto.Clone(scenario.input).(*dto.MetricFamily)
+			EscapeMetricFamilyInPlace(inPlace, scenario.scheme)
+			if !cmp.Equal(scenario.expected, inPlace, cmpopts.IgnoreUnexported(unexportList...)) {
+				t.Errorf("unexpected difference in output escaped in place:" + cmp.Diff(scenario.expected, inPlace, cmpopts.IgnoreUnexported(unexportList...)))
+			}
+		})
+	}
+}
+
+func TestEscapeMetricFamilyInPlace(t *testing.T) {
+	shared := proto.String("trace.id")
+	input := &dto.MetricFamily{
+		Name: proto.String("my.metric"),
+		Type: dto.MetricType_COUNTER.Enum(),
+		Metric: []*dto.Metric{
+			{
+				Label: []*dto.LabelPair{
+					{Name: proto.String(MetricNameLabel), Value: proto.String(":rule.name")},
+					{Name: proto.String("some.label"), Value: proto.String("x")},
+				},
+				Counter: &dto.Counter{
+					Value: proto.Float64(1),
+					Exemplar: &dto.Exemplar{
+						Label: []*dto.LabelPair{{Name: shared, Value: proto.String("abc")}},
+						Value: proto.Float64(1),
+					},
+				},
+			},
+			{
+				Histogram: &dto.Histogram{
+					Bucket: []*dto.Bucket{
+						{
+							UpperBound: proto.Float64(1),
+							Exemplar: &dto.Exemplar{
+								Label: []*dto.LabelPair{{Name: shared, Value: proto.String("def")}},
+							},
+						},
+					},
+					Exemplars: []*dto.Exemplar{
+						{Label: []*dto.LabelPair{{Name: proto.String("span.id"), Value: proto.String("ghi")}}},
+					},
+				},
+			},
+		},
+	}
+	expected := EscapeMetricFamily(input, UnderscoreEscaping)
+	pair := input.Metric[0].Label[1]
+	EscapeMetricFamilyInPlace(input, UnderscoreEscaping)
+	if !proto.Equal(input, expected) {
+		t.Errorf("expected in-place escaping to match EscapeMetricFamily, got %v", input)
+	}
+	if pair.GetName() != "some_label" {
+		t.Errorf("expected label pair to be modified in place, got %s", pair.GetName())
+	}
+	if *shared != "trace.id" {
+		t.Errorf("shared name was written through, got %s", *shared)
+	}
+}
+
+func TestRewriteNames(t *testing.T) {
+	newInput := func() *dto.MetricFamily {
+		return &dto.MetricFamily{
+			Name: proto.String("http_requests_total"),
+			Help: proto.String("Some help."),
+			Type: dto.MetricType_COUNTER.Enum(),
+			Metric: []*dto.Metric{
+				{
+					Label: []*dto.LabelPair{
+						{Name: proto.String("method"), Value: proto.String("GET")},
+						{Name: proto.String(MetricNameLabel), Value: proto.String("http_requests_total")},
+					},
+					Counter: &dto.Counter{
+						Value: proto.Float64(1),
+						Exemplar: &dto.Exemplar{
+							Label: []*dto.LabelPair{{Name: proto.String("trace_id"), Value: proto.String("abc")}},
+							Value: proto.Float64(1),
+						},
+					},
+				},
+				{
+					Counter: &dto.Counter{Value: proto.Float64(2)},
+				},
+			},
+		}
+	}
+
+	t.Run("identity", func(t *testing.T) {
+		input := newInput()
+		got := RewriteNames(input, func(name string) string { return name })
+		if got.Name != input.Name {
+			t.Errorf("expected the name pointer to be reused")
+		}
+		for i, m := range got.Metric {
+			if m != input.Metric[i] {
+				t.Errorf("expected metric %d to be reused", i)
+			}
+		}
+		if !proto.Equal(got, input) {
+			t.Errorf("expected %v, got %v", input, got)
+		}
+	})
+
+	t.Run("prefix", func(t *testing.T) {
+		input := newInput()
+		original := proto.Clone(input)
+		got := RewriteNames(input, func(name string) string { return "app_" + name })
+		expected := &dto.MetricFamily{
+			Name: proto.String("app_http_requests_total"),
+			Help: proto.String("Some help."),
+			Type: dto.MetricType_COUNTER.Enum(),
+			Metric: []*dto.Metric{
+				{
+					Label: []*dto.LabelPair{
+						{Name: proto.String("app_method"), Value: proto.String("GET")},
+						{Name: proto.String(MetricNameLabel), Value: proto.String("app_http_requests_total")},
+					},
+					Counter: &dto.Counter{
+						Value: proto.Float64(1),
+						Exemplar: &dto.Exemplar{
+							Label: []*dto.LabelPair{{Name: proto.String("app_trace_id"), Value: proto.String("abc")}},
+							Value: proto.Float64(1),
+						},
+					},
+				},
+				{
+					Counter: &dto.Counter{Value: proto.Float64(2)},
+				},
+			},
+		}
+		if !proto.Equal(got, expected) {
+			t.Errorf("expected %v, got %v", expected, got)
+		}
+		if !proto.Equal(input, original) {
+			t.Errorf("input was mutated, got %v", input)
+		}
+		// The second metric has no names to rewrite.
+		if got.Metric[1] != input.Metric[1] {
+			t.Errorf("expected unchanged metric to be reused")
+		}
+	})
+
+	t.Run("only some labels", func(t *testing.T) {
+		input := newInput()
+		got := RewriteNames(input, strings.ToUpper)
+		m := got.Metric[0]
+		if m == input.Metric[0] {
+			t.Fatalf("expected changed metric to be copied")
+		}
+		if m.GetLabel()[0].GetName() != "METHOD" || m.GetLabel()[1].GetValue() != "HTTP_REQUESTS_TOTAL" {
+			t.Errorf("unexpected labels %v", m.GetLabel())
+		}
+		if got.GetName() != "HTTP_REQUESTS_TOTAL" {
+			t.Errorf("unexpected name %s", got.GetName())
+		}
+	})
+
+	if RewriteNames(nil, strings.ToUpper) != nil {
+		t.Errorf("expected nil for nil input")
+	}
+}
+
+func BenchmarkEscapeMetricFamily(b *testing.B) {
+	family := &dto.MetricFamily{
+		Name: proto.String("http.requests.total"),
+		Type: dto.MetricType_COUNTER.Enum(),
+	}
+	for i := 0; i < 10000; i++ {
+		family.Metric = append(family.Metric, &dto.Metric{
+			Label: []*dto.LabelPair{
+				{Name: proto.String("http.method"), Value: proto.String("GET")},
+				{Name: proto.String("instance"), Value: proto.String("localhost:9090")},
+				{Name: proto.String("http.status_code"), Value: proto.String("200")},
+			},
+			Counter: &dto.Counter{Value: proto.Float64(float64(i))},
+		})
+	}
+	b.Run("copy", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			EscapeMetricFamily(family, UnderscoreEscaping)
+		}
+	})
+	b.Run("in-place", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			b.StopTimer()
+			v := proto.Clone(family).(*dto.MetricFamily)
+			b.StartTimer()
+			EscapeMetricFamilyInPlace(v, UnderscoreEscaping)
+		}
+	})
+}
+
+func TestEscapeMetricFamilies(t *testing.T) {
+	newFamily := func(name string) *dto.MetricFamily {
+		return &dto.MetricFamily{
+			Name: proto.String(name),
+			Type: dto.MetricType_COUNTER.Enum(),
+			Metric: []*dto.Metric{
+				{
+					Label: []*dto.LabelPair{
+						{Name: proto.String("http.method"), Value: proto.String("GET")},
+						{Name: proto.String("job"), Value: proto.String("api")},
+					},
+					Counter: &dto.Counter{
+						Value: proto.Float64(1),
+						Exemplar: &dto.Exemplar{
+							Label: []*dto.LabelPair{{Name: proto.String("trace.id"), Value: proto.String("abc")}},
+						},
+					},
+				},
+			},
+		}
+	}
+	input := []*dto.MetricFamily{newFamily("my.counter"), nil, newFamily("other_counter")}
+	original := []*dto.MetricFamily{proto.Clone(input[0]).(*dto.MetricFamily), nil, proto.Clone(input[2]).(*dto.MetricFamily)}
+
+	for _, scheme := range []EscapingScheme{UnderscoreEscaping, DotsEscaping, ValueEncodingEscaping, NoEscaping} {
+		got := EscapeMetricFamilies(input, scheme)
+		if len(got) != len(input) {
+			t.Fatalf("scheme %s: expected %d families, got %d", scheme, len(input), len(got))
+		}
+		for i, mf := range input {
+			if want := EscapeMetricFamily(mf, scheme); !proto.Equal(got[i], want) {
+				t.Errorf("scheme %s, family %d: expected %v, got %v", scheme, i, want, got[i])
+			}
+		}
+		for i := range input {
+			if !proto.Equal(input[i], original[i]) {
+				t.Errorf("scheme %s: input family %d was mutated", scheme, i)
+			}
+		}
+	}
+
+	// The escaped label name is shared between the families.
+	got := EscapeMetricFamilies(input, UnderscoreEscaping)
+	if got[0].Metric[0].Label[0].Name != got[2].Metric[0].Label[0].Name {
+		t.Errorf("expected escaped label names to share their pointer")
+	}
+	if got[2].Metric[0].Label[1] != input[2].Metric[0].Label[1] {
+		t.Errorf("expected unchanged label pair to be reused")
+	}
+
+	if EscapeMetricFamilies(nil, UnderscoreEscaping) != nil {
+		t.Errorf("expected nil for nil input")
+	}
+}
+
+func BenchmarkEscapeMetricFamilies(b *testing.B) {
+	// A scrape with many families sharing the same few label names, as is
+	// typical for instrumentation libraries.
+	var families []*dto.MetricFamily
+	for i := 0; i < 200; i++ {
+		family := &dto.MetricFamily{
+			Name: proto.String(fmt.Sprintf("app.subsystem_%d.requests.total", i)),
+			Type: dto.MetricType_COUNTER.Enum(),
+		}
+		for j := 0; j < 20; j++ {
+			family.Metric = append(family.Metric, &dto.Metric{
+				Label: []*dto.LabelPair{
+					{Name: proto.String("http.method"), Value: proto.String("GET")},
+					{Name: proto.String("http.status_code"), Value: proto.String(strconv.Itoa(200 + j))},
+					{Name: proto.String("service.name"), Value: proto.String("api")},
+					{Name: proto.String("instance"), Value: proto.String("localhost:9090")},
+				},
+				Counter: &dto.Counter{Value: proto.Float64(float64(j))},
+			})
+		}
+		families = append(families, family)
+	}
+	b.Run("loop", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			out := make([]*dto.MetricFamily, 0, len(families))
+			for _, mf := range families {
+				out = append(out, EscapeMetricFamily(mf, ValueEncodingEscaping))
+			}
+		}
+	})
+	b.Run("batch", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			EscapeMetricFamilies(families, ValueEncodingEscaping)
+		}
+	})
+}
+
+func TestEscapeMetricFamilyNilLabels(t *testing.T) {
+	input := &dto.MetricFamily{
+		Name: proto.String("my.metric"),
+		Type: dto.MetricType_GAUGE.Enum(),
+		Metric: []*dto.Metric{
+			nil,
+			{
+				Gauge: &dto.Gauge{
+					Value: proto.Float64(1),
+				},
+				Label: []*dto.LabelPair{
+					nil,
+					{
+						Name: proto.String("nil.value"),
+					},
+					{
+						Value: proto.String("nil name"),
+					},
+					{
+						Name:  proto.String("__name__"),
+						Value: nil,
 					},
 				},
 			},
 		},
-		{
-			name:   "gauge, escaping needed",
-			scheme: DotsEscaping,
-			input: &dto.MetricFamily{
-				Name: proto.String("unicode.and.dots.花火"),
-				Help: proto.String("some help text"),
-				Type: dto.MetricType_GAUGE.Enum(),
-				Metric: []*dto.Metric{
-					{
-						Gauge: &dto.Gauge{
-							Value: proto.Float64(34.2),
-						},
-						Label: []*dto.LabelPair{
-							{
-								Name:  proto.String("__name__"),
-								Value: proto.String("unicode.and.dots.花火"),
-							},
-							{
-								Name:  proto.String("some_label"),
-								Value: proto.String("label??value"),
-							},
+	}
+
+	got := EscapeMetricFamily(input, UnderscoreEscaping)
+	if got.GetName() != "my_metric" {
+		t.Errorf("expected escaped name my_metric, got %s", got.GetName())
+	}
+	if len(got.GetMetric()) != 2 {
+		t.Fatalf("expected 2 metrics, got %d", len(got.GetMetric()))
+	}
+	if got.GetMetric()[0] != nil {
+		t.Errorf("expected nil metric to be copied as is")
+	}
+	labels := got.GetMetric()[1].GetLabel()
+	if len(labels) != 4 {
+		t.Fatalf("expected 4 labels, got %d", len(labels))
+	}
+	if labels[0] != nil {
+		t.Errorf("expected nil label pair to be copied as is")
+	}
+	if labels[1].GetName() != "nil_value" || labels[1].Value != nil {
+		t.Errorf("expected escaped label name with nil value, got %v", labels[1])
+	}
+	if labels[2] != input.Metric[1].Label[2] {
+		t.Errorf("expected label pair without name to be copied as is")
+	}
+	if labels[3] != input.Metric[1].Label[3] {
+		t.Errorf("expected __name__ label pair without value to be copied as is")
+	}
+}
+
+func TestEscapeMetricFamilyExemplars(t *testing.T) {
+	exemplar := func(name string) *dto.Exemplar {
+		return &dto.Exemplar{
+			Label: []*dto.LabelPair{
+				{
+					Name:  proto.String(name),
+					Value: proto.String("abc123"),
+				},
+			},
+			Value: proto.Float64(1),
+		}
+	}
+	legacyBucket := &dto.Bucket{
+		UpperBound:      proto.Float64(1),
+		CumulativeCount: proto.Uint64(1),
+		Exemplar:        exemplar("trace_id"),
+	}
+	input := &dto.MetricFamily{
+		Name: proto.String("my_metric"),
+		Type: dto.MetricType_HISTOGRAM.Enum(),
+		Metric: []*dto.Metric{
+			{
+				Counter: &dto.Counter{
+					Value:    proto.Float64(1),
+					Exemplar: exemplar("trace.id"),
+				},
+			},
+			{
+				Histogram: &dto.Histogram{
+					SampleCount: proto.Uint64(2),
+					SampleSum:   proto.Float64(3),
+					Bucket: []*dto.Bucket{
+						legacyBucket,
+						{
+							UpperBound:      proto.Float64(2),
+							CumulativeCount: proto.Uint64(2),
+							Exemplar:        exemplar("trace.id"),
 						},
 					},
+					Exemplars: []*dto.Exemplar{exemplar("span.id")},
 				},
 			},
-			expected: &dto.MetricFamily{
-				Name: proto.String("unicode_dot_and_dot_dots_dot___"),
-				Help: proto.String("some help text"),
-				Type: dto.MetricType_GAUGE.Enum(),
-				Metric: []*dto.Metric{
+			{
+				Counter: &dto.Counter{
+					Value:    proto.Float64(1),
+					Exemplar: exemplar("trace_id"),
+				},
+			},
+		},
+	}
+	inputCopy := proto.Clone(input)
+
+	for scheme, expected := range map[EscapingScheme][]string{
+		NoEscaping:            {"trace.id", "trace.id", "span.id"},
+		UnderscoreEscaping:    {"trace_id", "trace_id", "span_id"},
+		DotsEscaping:          {"trace_dot_id", "trace_dot_id", "span_dot_id"},
+		ValueEncodingEscaping: {"U__trace_2e_id", "U__trace_2e_id", "U__span_2e_id"},
+	} {
+		t.Run(scheme.String(), func(t *testing.T) {
+			got := EscapeMetricFamily(input, scheme)
+			names := []string{
+				got.Metric[0].GetCounter().GetExemplar().GetLabel()[0].GetName(),
+				got.Metric[1].GetHistogram().GetBucket()[1].GetExemplar().GetLabel()[0].GetName(),
+				got.Metric[1].GetHistogram().GetExemplars()[0].GetLabel()[0].GetName(),
+			}
+			if !cmp.Equal(names, expected) {
+				t.Errorf("expected exemplar label names %v, got %v", expected, names)
+			}
+			if got.Metric[1].GetHistogram().GetBucket()[0] != legacyBucket {
+				t.Errorf("expected bucket without exemplar needing escaping to be reused")
+			}
+			if got.Metric[2] != input.Metric[2] {
+				t.Errorf("expected metric without labels needing escaping to be reused")
+			}
+			if got.Metric[1].GetHistogram().GetSampleSum() != 3 {
+				t.Errorf("expected histogram fields to be copied")
+			}
+			if !proto.Equal(input, inputCopy) {
+				t.Errorf("input was mutated")
+			}
+		})
+	}
+}
+
+func TestEscapeMetricFamilyKeepsUnit(t *testing.T) {
+	input := &dto.MetricFamily{
+		Name: proto.String("request.duration.seconds"),
+		Help: proto.String("Request duration."),
+		Type: dto.MetricType_GAUGE.Enum(),
+		Unit: proto.String("seconds"),
+		Metric: []*dto.Metric{
+			{Gauge: &dto.Gauge{Value: proto.Float64(1)}},
+		},
+	}
+	for _, scheme := range []EscapingScheme{UnderscoreEscaping, DotsEscaping, ValueEncodingEscaping} {
+		got := EscapeMetricFamily(input, scheme)
+		if got.GetName() == input.GetName() {
+			t.Errorf("%s: expected name to be escaped", scheme)
+		}
+		if got.GetUnit() != "seconds" {
+			t.Errorf("%s: expected unit seconds to survive escaping, got %q", scheme, got.GetUnit())
+		}
+		if got.GetHelp() != input.GetHelp() || got.GetType() != input.GetType() {
+			t.Errorf("%s: expected help and type to survive escaping", scheme)
+		}
+	}
+}
+
+func TestEscapeMetricNameLabelValue(t *testing.T) {
+	input := &dto.MetricFamily{
+		Name: proto.String("my_metric"),
+		Type: dto.MetricType_GAUGE.Enum(),
+		Metric: []*dto.Metric{
+			{
+				Label: []*dto.LabelPair{
 					{
-						Gauge: &dto.Gauge{
-							Value: proto.Float64(34.2),
-						},
-						Label: []*dto.LabelPair{
-							{
-								Name:  proto.String("__name__"),
-								Value: proto.String("unicode_dot_and_dot_dots_dot___"),
-							},
-							{
-								Name:  proto.String("some_label"),
-								Value: proto.String("label??value"),
-							},
-						},
+						Name:  proto.String(MetricNameLabel),
+						Value: proto.String(":recording:rule.name"),
 					},
 				},
+				Gauge: &dto.Gauge{Value: proto.Float64(1)},
 			},
 		},
 	}
+	// The value of the MetricNameLabel is a metric name, so colons survive.
+	got := EscapeMetricFamily(input, UnderscoreEscaping)
+	if v := got.Metric[0].Label[0].GetValue(); v != ":recording:rule_name" {
+		t.Errorf("expected EscapeMetricFamily to escape %s label value to :recording:rule_name, got %s", MetricNameLabel, v)
+	}
+	ls := EscapeLabelSet(LabelSet{MetricNameLabel: ":recording:rule.name"}, UnderscoreEscaping)
+	if v := ls[MetricNameLabel]; v != ":recording:rule_name" {
+		t.Errorf("expected EscapeLabelSet to escape %s label value to :recording:rule_name, got %s", MetricNameLabel, v)
+	}
+}
 
-	unexportList := []interface{}{dto.MetricFamily{}, dto.Metric{}, dto.LabelPair{}, dto.Counter{}, dto.Gauge{}}
+func TestEscapeMetricFamilyChecksLabelNames(t *testing.T) {
+	legacyNames := &dto.Metric{
+		Label: []*dto.LabelPair{
+			{
+				Name:  proto.String("path"),
+				Value: proto.String("/some.path with spaces"),
+			},
+		},
+		Gauge: &dto.Gauge{Value: proto.Float64(1)},
+	}
+	dottedName := &dto.Metric{
+		Label: []*dto.LabelPair{
+			{
+				Name:  proto.String("some.label"),
+				Value: proto.String("x"),
+			},
+		},
+		Gauge: &dto.Gauge{Value: proto.Float64(2)},
+	}
+	input := &dto.MetricFamily{
+		Name:   proto.String("my_metric"),
+		Type:   dto.MetricType_GAUGE.Enum(),
+		Metric: []*dto.Metric{legacyNames, dottedName},
+	}
+
+	got := EscapeMetricFamily(input, UnderscoreEscaping)
+	if got.Metric[0] != legacyNames {
+		t.Errorf("expected metric with legacy-valid label names to be reused, regardless of label values")
+	}
+	if got.Metric[1] == dottedName {
+		t.Fatalf("expected metric with legacy-invalid label name to be copied")
+	}
+	want := []*dto.LabelPair{
+		{
+			Name:  proto.String("some_label"),
+			Value: proto.String("x"),
+		},
+	}
+	if !cmp.Equal(got.Metric[1].Label, want, cmpopts.IgnoreUnexported(dto.LabelPair{})) {
+		t.Errorf("unexpected labels: %v", cmp.Diff(want, got.Metric[1].Label, cmpopts.IgnoreUnexported(dto.LabelPair{})))
+	}
+	if dottedName.Label[0].GetName() != "some.label" {
+		t.Errorf("input was mutated")
+	}
+}
+
+func TestEscapeMetricFamilyColonLabelName(t *testing.T) {
+	m := &dto.Metric{
+		Label: []*dto.LabelPair{
+			{
+				Name:  proto.String("foo:bar"),
+				Value: proto.String("x"),
+			},
+		},
+		Gauge: &dto.Gauge{Value: proto.Float64(1)},
+	}
+	input := &dto.MetricFamily{
+		Name:   proto.String("my:metric"),
+		Type:   dto.MetricType_GAUGE.Enum(),
+		Metric: []*dto.Metric{m},
+	}
+
+	got := EscapeMetricFamily(input, UnderscoreEscaping)
+	if got.GetName() != "my:metric" {
+		t.Errorf("expected metric name my:metric to be preserved, got %s", got.GetName())
+	}
+	if got.Metric[0] == m {
+		t.Fatalf("expected metric with colon in label name to be copied")
+	}
+	want := []*dto.LabelPair{
+		{
+			Name:  proto.String("foo_bar"),
+			Value: proto.String("x"),
+		},
+	}
+	if !cmp.Equal(got.Metric[0].Label, want, cmpopts.IgnoreUnexported(dto.LabelPair{})) {
+		t.Errorf("unexpected labels: %v", cmp.Diff(want, got.Metric[0].Label, cmpopts.IgnoreUnexported(dto.LabelPair{})))
+	}
+}
+
+func TestEscapeLabelSet(t *testing.T) {
+	scenarios := []struct {
+		name     string
+		input    LabelSet
+		scheme   EscapingScheme
+		expected LabelSet
+	}{
+		{
+			name:     "empty",
+			input:    LabelSet{},
+			scheme:   ValueEncodingEscaping,
+			expected: LabelSet{},
+		},
+		{
+			name: "no escaping needed",
+			input: LabelSet{
+				MetricNameLabel: "my_metric",
+				"some_label":    "label.value",
+			},
+			scheme: ValueEncodingEscaping,
+			expected: LabelSet{
+				MetricNameLabel: "my_metric",
+				"some_label":    "label.value",
+			},
+		},
+		{
+			name: "mixed legacy and utf-8 names",
+			input: LabelSet{
+				MetricNameLabel: "my.metric",
+				"some_label":    "label.value",
+				"some.label":    "other.value",
+			},
+			scheme: ValueEncodingEscaping,
+			expected: LabelSet{
+				MetricNameLabel:    "U__my_2e_metric",
+				"some_label":       "label.value",
+				"U__some_2e_label": "other.value",
+			},
+		},
+		{
+			name: "underscores",
+			input: LabelSet{
+				MetricNameLabel: "my.metric",
+				"some.label":    "other.value",
+			},
+			scheme: UnderscoreEscaping,
+			expected: LabelSet{
+				MetricNameLabel: "my_metric",
+				"some_label":    "other.value",
+			},
+		},
+		{
+			name: "colon in label name",
+			input: LabelSet{
+				MetricNameLabel: "my:metric",
+				"some:label":    "other.value",
+			},
+			scheme: UnderscoreEscaping,
+			expected: LabelSet{
+				MetricNameLabel: "my:metric",
+				"some_label":    "other.value",
+			},
+		},
+		{
+			name: "no escaping scheme",
+			input: LabelSet{
+				MetricNameLabel: "my.metric",
+				"some.label":    "other.value",
+			},
+			scheme: NoEscaping,
+			expected: LabelSet{
+				MetricNameLabel: "my.metric",
+				"some.label":    "other.value",
+			},
+		},
+	}
 
 	for _, scenario := range scenarios {
 		t.Run(scenario.name, func(t *testing.T) {
-			original := proto.Clone(scenario.input)
-			got := EscapeMetricFamily(scenario.input, scenario.scheme)
-			if !cmp.Equal(scenario.expected, got, cmpopts.IgnoreUnexported(unexportList...)) {
-				t.Errorf("unexpected difference in escaped output:" + cmp.Diff(scenario.expected, got, cmpopts.IgnoreUnexported(unexportList...)))
+			original := scenario.input.Clone()
+			got := EscapeLabelSet(scenario.input, scenario.scheme)
+			if !got.Equal(scenario.expected) {
+				t.Errorf("expected %v, got %v", scenario.expected, got)
 			}
-			if !cmp.Equal(scenario.input, original, cmpopts.IgnoreUnexported(unexportList...)) {
-				t.Errorf("input was mutated during escaping" + cmp.Diff(scenario.expected, got, cmpopts.IgnoreUnexported(unexportList...)))
+			if got := scenario.input.Escape(scenario.scheme); !got.Equal(scenario.expected) {
+				t.Errorf("expected LabelSet.Escape to return %v, got %v", scenario.expected, got)
+			}
+			if got := Metric(scenario.input).Escape(scenario.scheme); !got.Equal(Metric(scenario.expected)) {
+				t.Errorf("expected Metric.Escape to return %v, got %v", scenario.expected, got)
+			}
+			if !scenario.input.Equal(original) {
+				t.Errorf("input was mutated during escaping, got %v", scenario.input)
+			}
+		})
+	}
+}
+
+func TestEscapeLabelSetCollisions(t *testing.T) {
+	scenarios := []struct {
+		name     string
+		input    LabelSet
+		expected LabelSet
+	}{
+		{
+			name:     "unchanged name wins",
+			input:    LabelSet{"a.b": "1", "a_b": "2", "a-b": "3"},
+			expected: LabelSet{"a_b": "2"},
+		},
+		{
+			name:     "first escaped name wins",
+			input:    LabelSet{"a.b": "1", "a-b": "2", "a/b": "3"},
+			expected: LabelSet{"a_b": "2"},
+		},
+		{
+			name:     "metric name label cannot be replaced",
+			input:    LabelSet{MetricNameLabel: "my.metric", "__name..": "x", "other.label": "y"},
+			expected: LabelSet{MetricNameLabel: "my_metric", "other_label": "y"},
+		},
+	}
+	for _, scenario := range scenarios {
+		t.Run(scenario.name, func(t *testing.T) {
+			// Map iteration order is random, so try several times.
+			for i := 0; i < 20; i++ {
+				if got := EscapeLabelSet(scenario.input, UnderscoreEscaping); !got.Equal(scenario.expected) {
+					t.Fatalf("expected %v, got %v", scenario.expected, got)
+				}
 			}
 		})
 	}
 }
 
+func TestEscapeWithoutCopy(t *testing.T) {
+	clean := LabelSet{MetricNameLabel: "my:metric", "some_label": "label.value"}
+	for _, scheme := range []EscapingScheme{NoEscaping, UnderscoreEscaping, DotsEscaping, ValueEncodingEscaping} {
+		if got := clean.Escape(scheme); reflect.ValueOf(got).Pointer() != reflect.ValueOf(clean).Pointer() {
+			t.Errorf("%s: expected LabelSet.Escape to return the receiver for a clean label set", scheme)
+		}
+		m := Metric(clean)
+		if got := m.Escape(scheme); reflect.ValueOf(got).Pointer() != reflect.ValueOf(m).Pointer() {
+			t.Errorf("%s: expected Metric.Escape to return the receiver for a clean metric", scheme)
+		}
+	}
+	allocs := testing.AllocsPerRun(100, func() {
+		_ = clean.Escape(ValueEncodingEscaping)
+	})
+	if allocs != 0 {
+		t.Errorf("expected escaping a clean label set not to allocate, got %v allocations", allocs)
+	}
+
+	dirty := Metric{MetricNameLabel: "my.metric"}
+	if got := dirty.Escape(UnderscoreEscaping); reflect.ValueOf(got).Pointer() == reflect.ValueOf(dirty).Pointer() {
+		t.Errorf("expected Metric.Escape to return a copy if escaping is needed")
+	}
+}
+
 // TestProtoFormatUnchanged checks to see if the proto format changed, in which
 // case EscapeMetricFamily will need to be updated.
 func TestProtoFormatUnchanged(t *testing.T) {
@@ -646,3 +2268,156 @@ func TestProtoFormatUnchanged(t *testing.T) {
 		})
 	}
 }
+
+func TestValidationSchemeMarshalling(t *testing.T) {
+	type config struct {
+		Scheme ValidationScheme `json:"scheme" yaml:"scheme"`
+	}
+	for _, scheme := range []ValidationScheme{LegacyValidation, UTF8Validation, UTF8NoControlValidation} {
+		out, err := yaml.Marshal(config{Scheme: scheme})
+		if err != nil {
+			t.Fatalf("%s: unexpected YAML marshalling error: %v", scheme, err)
+		}
+		var gotYAML config
+		if err := yaml.Unmarshal(out, &gotYAML); err != nil {
+			t.Fatalf("%s: unexpected YAML unmarshalling error: %v", scheme, err)
+		}
+		if gotYAML.Scheme != scheme {
+			t.Errorf("expected %s after YAML round trip of %q, got %s", scheme, out, gotYAML.Scheme)
+		}
+
+		out, err = json.Marshal(config{Scheme: scheme})
+		if err != nil {
+			t.Fatalf("%s: unexpected JSON marshalling error: %v", scheme, err)
+		}
+		var gotJSON config
+		if err := json.Unmarshal(out, &gotJSON); err != nil {
+			t.Fatalf("%s: unexpected JSON unmarshalling error: %v", scheme, err)
+		}
+		if gotJSON.Scheme != scheme {
+			t.Errorf("expected %s after JSON round trip of %s, got %s", scheme, out, gotJSON.Scheme)
+		}
+	}
+
+	var c config
+	if err := yaml.Unmarshal([]byte("scheme: UTF8"), &c); err != nil || c.Scheme != UTF8Validation {
+		t.Errorf("expected case-insensitive match of UTF8, got %s with error %v", c.Scheme, err)
+	}
+	err := yaml.Unmarshal([]byte("scheme: bogus"), &c)
+	if err == nil || !strings.Contains(err.Error(), "legacy, utf8, utf8-no-control") {
+		t.Errorf("expected error listing the valid options, got %v", err)
+	}
+	if _, err := json.Marshal(config{Scheme: ValidationScheme(42)}); err == nil {
+		t.Errorf("expected error marshalling an unknown validation scheme")
+	}
+}
+
+func TestEscapingSchemeMarshalling(t *testing.T) {
+	type config struct {
+		Scheme EscapingScheme `json:"scheme" yaml:"scheme"`
+	}
+	for _, scheme := range []EscapingScheme{NoEscaping, UnderscoreEscaping, DotsEscaping, ValueEncodingEscaping} {
+		out, err := yaml.Marshal(config{Scheme: scheme})
+		if err != nil {
+			t.Fatalf("%s: unexpected YAML marshalling error: %v", scheme, err)
+		}
+		var gotYAML config
+		if err := yaml.Unmarshal(out, &gotYAML); err != nil {
+			t.Fatalf("%s: unexpected YAML unmarshalling error: %v", scheme, err)
+		}
+		if gotYAML.Scheme != scheme {
+			t.Errorf("expected %s after YAML round trip of %q, got %s", scheme, out, gotYAML.Scheme)
+		}
+
+		out, err = json.Marshal(config{Scheme: scheme})
+		if err != nil {
+			t.Fatalf("%s: unexpected JSON marshalling error: %v", scheme, err)
+		}
+		var gotJSON config
+		if err := json.Unmarshal(out, &gotJSON); err != nil {
+			t.Fatalf("%s: unexpected JSON unmarshalling error: %v", scheme, err)
+		}
+		if gotJSON.Scheme != scheme {
+			t.Errorf("expected %s after JSON round trip of %s, got %s", scheme, out, gotJSON.Scheme)
+		}
+	}
+
+	c := config{Scheme: DotsEscaping}
+	if err := yaml.Unmarshal([]byte("scheme: None"), &c); err != nil || c.Scheme != NoEscaping {
+		t.Errorf("expected None to select NoEscaping, got %s with error %v", c.Scheme, err)
+	}
+	// The alias is not preserved, NoEscaping is marshaled under its canonical name.
+	if out, err := yaml.Marshal(c); err != nil || string(out) != "scheme: "+AllowUTF8+"\n" {
+		t.Errorf("expected NoEscaping to marshal as %s, got %q with error %v", AllowUTF8, out, err)
+	}
+	if out, err := json.Marshal(c); err != nil || string(out) != `{"scheme":"`+AllowUTF8+`"}` {
+		t.Errorf("expected NoEscaping to marshal as %s, got %s with error %v", AllowUTF8, out, err)
+	}
+	err := yaml.Unmarshal([]byte("scheme: bogus"), &c)
+	if err == nil || !strings.Contains(err.Error(), "none, allow-utf-8, underscores, dots, values") {
+		t.Errorf("expected error listing the valid options, got %v", err)
+	}
+	if _, err := json.Marshal(config{Scheme: EscapingScheme(42)}); err == nil {
+		t.Errorf("expected error marshalling an unknown escaping scheme")
+	}
+	if _, err := json.Marshal(config{Scheme: PercentEscaping}); err == nil {
+		t.Errorf("expected error marshalling %s", PercentEscaping)
+	}
+}
+
+func TestParseEscapingScheme(t *testing.T) {
+	scenarios := []struct {
+		input    string
+		expected EscapingScheme
+	}{
+		{input: "none", expected: NoEscaping},
+		{input: "NONE", expected: NoEscaping},
+		{input: AllowUTF8, expected: NoEscaping},
+		{input: AllowUTF8Alt, expected: NoEscaping},
+		{input: "underscores", expected: UnderscoreEscaping},
+		{input: "Dots", expected: DotsEscaping},
+		{input: "values", expected: ValueEncodingEscaping},
+	}
+	for _, scenario := range scenarios {
+		got, err := ParseEscapingScheme(scenario.input)
+		if err != nil {
+			t.Errorf("%q: unexpected error: %v", scenario.input, err)
+			continue
+		}
+		if got != scenario.expected {
+			t.Errorf("%q: expected %s, got %s", scenario.input, scenario.expected, got)
+		}
+	}
+
+	for _, input := range []string{"", "bogus", "underscore", " dots", "percent"} {
+		if _, err := ParseEscapingScheme(input); err == nil {
+			t.Errorf("%q: expected an error", input)
+		}
+	}
+
+	// The names returned by String are accepted.
+	for _, scheme := range []EscapingScheme{NoEscaping, UnderscoreEscaping, DotsEscaping, ValueEncodingEscaping} {
+		if got, err := ParseEscapingScheme(scheme.String()); err != nil || got != scheme {
+			t.Errorf("expected %q to parse as %s, got %s with error %v", scheme.String(), scheme, got, err)
+		}
+	}
+}
+
+func TestSchemeFlags(t *testing.T) {
+	var (
+		validation = LegacyValidation
+		escaping   = UnderscoreEscaping
+	)
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.Var(&validation, "metric-name-validation-scheme", "")
+	fs.Var(&escaping, "metric-name-escaping-scheme", "")
+	if err := fs.Parse([]string{"--metric-name-validation-scheme=utf8", "--metric-name-escaping-scheme=Dots"}); err != nil {
+		t.Fatalf("unexpected error parsing flags: %v", err)
+	}
+	if validation != UTF8Validation {
+		t.Errorf("expected %s, got %s", UTF8Validation, validation)
+	}
+	if escaping != DotsEscaping {
+		t.Errorf("expected %s, got %s", DotsEscaping, escaping)
+	}
+}
@@ -0,0 +1,79 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package model
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ValidatedMetric wraps a Metric and caches the result of validating it, so
+// that pipelines validating the same Metric repeatedly do not pay for
+// revalidating all of its labels every time. The cached result is discarded
+// whenever the Metric is changed through Set or Delete, or when the global
+// name validation scheme (see GetNameValidationScheme) has changed since the
+// last validation.
+//
+// A ValidatedMetric is not safe for concurrent use.
+type ValidatedMetric struct {
+	m Metric
+
+	validated bool
+	scheme    ValidationScheme
+	err       error
+}
+
+// NewValidatedMetric returns a ValidatedMetric wrapping a copy of m, so that
+// later changes to m do not bypass the cache.
+func NewValidatedMetric(m Metric) *ValidatedMetric {
+	return &ValidatedMetric{m: m.Clone()}
+}
+
+// Metric returns the wrapped Metric. It must not be modified, use Set and
+// Delete instead.
+func (v *ValidatedMetric) Metric() Metric {
+	return v.m
+}
+
+// Set sets the label with the given name to the given value and discards the
+// cached validation result.
+func (v *ValidatedMetric) Set(ln LabelName, lv LabelValue) {
+	v.m[ln] = lv
+	v.validated = false
+}
+
+// Delete removes the label with the given name and discards the cached
+// validation result.
+func (v *ValidatedMetric) Delete(ln LabelName) {
+	delete(v.m, ln)
+	v.validated = false
+}
+
+// Validate checks whether the metric name (if any) is valid according to
+// IsValidMetricName and all labels are valid according to LabelSet.Validate.
+// The result is cached until the Metric or the global name validation scheme
+// changes.
+func (v *ValidatedMetric) Validate() error {
+	scheme := GetNameValidationScheme()
+	if v.validated && v.scheme == scheme {
+		return v.err
+	}
+	var nameErr error
+	if name, ok := v.m[MetricNameLabel]; ok && !IsValidMetricNameWithScheme(name, scheme) {
+		nameErr = fmt.Errorf("invalid metric name %q", name)
+	}
+	v.err = errors.Join(nameErr, LabelSet(v.m).Validate())
+	v.validated, v.scheme = true, scheme
+	return v.err
+}
@@ -0,0 +1,78 @@
+// Copyright 2024 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package model
+
+import (
+	"testing"
+)
+
+func TestValidatedMetric(t *testing.T) {
+	defer SetNameValidationScheme(GetNameValidationScheme())
+	SetNameValidationScheme(LegacyValidation)
+
+	m := Metric{MetricNameLabel: "my_metric", "job": "api"}
+	v := NewValidatedMetric(m)
+	if err := v.Validate(); err != nil {
+		t.Fatalf("expected valid metric, got %v", err)
+	}
+
+	// Changes to the original Metric must not bypass the cache.
+	m["job"] = "\xff"
+	if err := v.Validate(); err != nil {
+		t.Errorf("expected wrapped metric to be unaffected by changes to the original, got %v", err)
+	}
+
+	v.Set("job", "\xff")
+	err := v.Validate()
+	if err == nil {
+		t.Fatalf("expected invalid label value to be detected after Set")
+	}
+	if again := v.Validate(); again != err {
+		t.Errorf("expected cached error %v, got %v", err, again)
+	}
+
+	v.Delete("job")
+	if err := v.Validate(); err != nil {
+		t.Errorf("expected valid metric after Delete, got %v", err)
+	}
+
+	v.Set(MetricNameLabel, "my.metric")
+	if err := v.Validate(); err == nil {
+		t.Errorf("expected invalid metric name under legacy validation")
+	}
+	// Changing the global validation scheme invalidates the cached result.
+	SetNameValidationScheme(UTF8Validation)
+	if err := v.Validate(); err != nil {
+		t.Errorf("expected valid metric name under UTF-8 validation, got %v", err)
+	}
+	if got := v.Metric()[MetricNameLabel]; got != "my.metric" {
+		t.Errorf("expected metric name my.metric, got %s", got)
+	}
+}
+
+func BenchmarkValidatedMetric(b *testing.B) {
+	v := NewValidatedMetric(Metric{
+		MetricNameLabel: "http_requests_total",
+		"job":           "api",
+		"instance":      "localhost:9090",
+		"method":        "GET",
+		"code":          "200",
+	})
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if err := v.Validate(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -15,6 +15,7 @@ package model
 
 import (
 	"fmt"
+	"math/rand"
 	"runtime"
 	"sync"
 	"testing"
@@ -92,6 +93,47 @@ func TestMetricToFastFingerprint(t *testing.T) {
 	}
 }
 
+func TestFingerprintIndependentOfInsertionOrder(t *testing.T) {
+	pairs := []struct {
+		name  LabelName
+		value LabelValue
+	}{
+		{MetricNameLabel, "http_requests_total"},
+		{"job", "api"},
+		{"instance", "localhost:9090"},
+		{"method", "GET"},
+		{"code", "200"},
+		{"path", "/api/v1/query"},
+		{"le", "+Inf"},
+		{"a", ""},
+		{"zone", "eu-west-1a"},
+	}
+	reference := make(LabelSet, len(pairs))
+	for _, p := range pairs {
+		reference[p.name] = p.value
+	}
+	fp, fastFP := reference.Fingerprint(), reference.FastFingerprint()
+
+	r := rand.New(rand.NewSource(42))
+	for i := 0; i < 100; i++ {
+		r.Shuffle(len(pairs), func(i, j int) { pairs[i], pairs[j] = pairs[j], pairs[i] })
+		// Varying the initial capacity changes the layout of the map.
+		ls := make(LabelSet, i%len(pairs))
+		for _, p := range pairs {
+			ls[p.name] = p.value
+		}
+		if got := ls.Fingerprint(); got != fp {
+			t.Fatalf("%d: expected Fingerprint %d, got %d", i, fp, got)
+		}
+		if got := ls.FastFingerprint(); got != fastFP {
+			t.Fatalf("%d: expected FastFingerprint %d, got %d", i, fastFP, got)
+		}
+		if got := Metric(ls).Fingerprint(); got != fp {
+			t.Fatalf("%d: expected Metric.Fingerprint %d, got %d", i, fp, got)
+		}
+	}
+}
+
 func TestSignatureForLabels(t *testing.T) {
 	scenarios := []struct {
 		in     Metric
@@ -27,6 +27,16 @@ import (
 // suitable to signal a non-existing SamplePair.
 var ZeroSamplePair = SamplePair{Timestamp: Earliest}
 
+// StaleNaN is the bit pattern of the NaN value that Prometheus uses to mark a
+// series as stale. Use math.Float64frombits(StaleNaN) to get the float value,
+// and IsStaleNaN to check for it, as NaN values never compare equal.
+const StaleNaN uint64 = 0x7ff0000000000002
+
+// IsStaleNaN returns true if v is the staleness marker (see StaleNaN).
+func IsStaleNaN(v float64) bool {
+	return math.Float64bits(v) == StaleNaN
+}
+
 // A SampleValue is a representation of a value for a given sample at a given
 // time.
 type SampleValue float64
@@ -111,6 +111,17 @@ func TestEqualValues(t *testing.T) {
 	}
 }
 
+func TestIsStaleNaN(t *testing.T) {
+	if !IsStaleNaN(math.Float64frombits(StaleNaN)) {
+		t.Error("expected stale marker to be detected")
+	}
+	for _, v := range []float64{math.NaN(), math.Inf(1), 0, 1} {
+		if IsStaleNaN(v) {
+			t.Errorf("expected %v not to be detected as stale marker", v)
+		}
+	}
+}
+
 func TestSamplePairJSON(t *testing.T) {
 	input := []struct {
 		plain string